@@ -5,3 +5,5 @@ go 1.20
 require golang.org/x/crypto v0.29.0
 
 require golang.org/x/sys v0.27.0
+
+require github.com/andybalholm/brotli v1.1.1
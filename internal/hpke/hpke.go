@@ -0,0 +1,356 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hpke implements the base mode of Hybrid Public Key Encryption
+// (HPKE) as specified in RFC 9180, restricted to what Encrypted Client
+// Hello needs: DHKEM(X25519, HKDF-SHA256), the HKDF-SHA256, HKDF-SHA384
+// and HKDF-SHA512 KDFs, and the AES-128-GCM, AES-256-GCM and
+// ChaCha20Poly1305 AEADs.
+package hpke
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KEM, KDF, and AEAD identifiers. See RFC 9180, Section 7.
+const (
+	DHKEM_X25519_HKDF_SHA256 uint16 = 0x0020
+
+	KDF_HKDF_SHA256 uint16 = 0x0001
+	KDF_HKDF_SHA384 uint16 = 0x0002
+	KDF_HKDF_SHA512 uint16 = 0x0003
+
+	AEAD_AES_128_GCM      uint16 = 0x0001
+	AEAD_AES_256_GCM      uint16 = 0x0002
+	AEAD_ChaCha20Poly1305 uint16 = 0x0003
+)
+
+// testingOnlyGenerateKey is used during testing to derandomize the
+// ephemeral key generation.
+var testingOnlyGenerateKey func() (*ecdh.PrivateKey, error)
+
+type hkdfKDF struct {
+	hash crypto.Hash
+}
+
+func (kdf *hkdfKDF) LabeledExtract(suiteID []byte, salt []byte, label string, inputKey []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(suiteID)+len(label)+len(inputKey))
+	labeledIKM = append(labeledIKM, []byte("HPKE-v1")...)
+	labeledIKM = append(labeledIKM, suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, inputKey...)
+	return hkdf.Extract(kdf.hash.New, labeledIKM, salt)
+}
+
+func (kdf *hkdfKDF) LabeledExpand(suiteID []byte, randomKey []byte, label string, info []byte, length uint16) []byte {
+	labeledInfo := make([]byte, 0, 2+7+len(suiteID)+len(label)+len(info))
+	labeledInfo = binary.BigEndian.AppendUint16(labeledInfo, length)
+	labeledInfo = append(labeledInfo, []byte("HPKE-v1")...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	n, err := hkdf.Expand(kdf.hash.New, randomKey, labeledInfo).Read(out)
+	if err != nil || n != int(length) {
+		panic("hpke: LabeledExpand failed unexpectedly")
+	}
+	return out
+}
+
+// dhKEM implements the KEM specified in RFC 9180, Section 4.1.
+type dhKEM struct {
+	dh  ecdh.Curve
+	kdf hkdfKDF
+
+	suiteID []byte
+	nSecret uint16
+}
+
+// SupportedKEMs contains the KEMs implemented by this package.
+var SupportedKEMs = map[uint16]struct {
+	curve   ecdh.Curve
+	hash    crypto.Hash
+	nSecret uint16
+}{
+	DHKEM_X25519_HKDF_SHA256: {ecdh.X25519(), crypto.SHA256, 32},
+}
+
+func newDHKem(kemID uint16) (*dhKEM, error) {
+	suite, ok := SupportedKEMs[kemID]
+	if !ok {
+		return nil, errors.New("hpke: unsupported KEM id")
+	}
+	return &dhKEM{
+		dh:      suite.curve,
+		kdf:     hkdfKDF{suite.hash},
+		suiteID: binary.BigEndian.AppendUint16([]byte("KEM"), kemID),
+		nSecret: suite.nSecret,
+	}, nil
+}
+
+func (dh *dhKEM) ExtractAndExpand(dhKey, kemContext []byte) []byte {
+	eaePRK := dh.kdf.LabeledExtract(dh.suiteID, nil, "eae_prk", dhKey)
+	return dh.kdf.LabeledExpand(dh.suiteID, eaePRK, "shared_secret", kemContext, dh.nSecret)
+}
+
+func (dh *dhKEM) Encap(pubRecipient *ecdh.PublicKey) (sharedSecret []byte, encapPub []byte, err error) {
+	var privEph *ecdh.PrivateKey
+	if testingOnlyGenerateKey != nil {
+		privEph, err = testingOnlyGenerateKey()
+	} else {
+		privEph, err = dh.dh.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	dhVal, err := privEph.ECDH(pubRecipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	encPubEph := privEph.PublicKey().Bytes()
+
+	encPubRecip := pubRecipient.Bytes()
+	kemContext := append(encPubEph, encPubRecip...)
+
+	return dh.ExtractAndExpand(dhVal, kemContext), encPubEph, nil
+}
+
+func (dh *dhKEM) Decap(encPubEph []byte, secRecipient *ecdh.PrivateKey) ([]byte, error) {
+	pubEph, err := dh.dh.NewPublicKey(encPubEph)
+	if err != nil {
+		return nil, err
+	}
+	dhVal, err := secRecipient.ECDH(pubEph)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(encPubEph[:len(encPubEph):len(encPubEph)], secRecipient.PublicKey().Bytes()...)
+
+	return dh.ExtractAndExpand(dhVal, kemContext), nil
+}
+
+// DeriveKeyPair deterministically derives a key pair for the given KEM
+// from the input keying material. See RFC 9180, Section 7.1.3.
+func DeriveKeyPair(kemID uint16, ikm []byte) (*ecdh.PrivateKey, error) {
+	dh, err := newDHKem(kemID)
+	if err != nil {
+		return nil, err
+	}
+	dkpPRK := dh.kdf.LabeledExtract(dh.suiteID, nil, "dkp_prk", ikm)
+	sk := dh.kdf.LabeledExpand(dh.suiteID, dkpPRK, "sk", nil, dh.nSecret)
+	return dh.dh.NewPrivateKey(sk)
+}
+
+type context struct {
+	aead cipher.AEAD
+
+	sharedSecret []byte
+
+	suiteID []byte
+
+	key            []byte
+	baseNonce      []byte
+	exporterSecret []byte
+
+	kdf *hkdfKDF
+
+	seqNum uint64
+}
+
+// Sender is the sender context of a HPKE base mode exchange.
+type Sender struct {
+	*context
+}
+
+// Recipient is the recipient context of a HPKE base mode exchange.
+type Recipient struct {
+	*context
+}
+
+func aesGCMNew(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SupportedAEADs contains the AEADs implemented by this package.
+var SupportedAEADs = map[uint16]struct {
+	keySize   int
+	nonceSize int
+	aead      func([]byte) (cipher.AEAD, error)
+}{
+	AEAD_AES_128_GCM:      {keySize: 16, nonceSize: 12, aead: aesGCMNew},
+	AEAD_AES_256_GCM:      {keySize: 32, nonceSize: 12, aead: aesGCMNew},
+	AEAD_ChaCha20Poly1305: {keySize: chacha20poly1305.KeySize, nonceSize: chacha20poly1305.NonceSize, aead: chacha20poly1305.New},
+}
+
+// SupportedKDFs contains the KDFs implemented by this package.
+var SupportedKDFs = map[uint16]crypto.Hash{
+	KDF_HKDF_SHA256: crypto.SHA256,
+	KDF_HKDF_SHA384: crypto.SHA384,
+	KDF_HKDF_SHA512: crypto.SHA512,
+}
+
+func newContext(sharedSecret []byte, kemID, kdfID, aeadID uint16, info []byte) (*context, error) {
+	sid := suiteID(kemID, kdfID, aeadID)
+
+	hash, ok := SupportedKDFs[kdfID]
+	if !ok {
+		return nil, errors.New("hpke: unsupported KDF id")
+	}
+	kdf := &hkdfKDF{hash}
+
+	aeadInfo, ok := SupportedAEADs[aeadID]
+	if !ok {
+		return nil, errors.New("hpke: unsupported AEAD id")
+	}
+
+	pskIDHash := kdf.LabeledExtract(sid, nil, "psk_id_hash", nil)
+	infoHash := kdf.LabeledExtract(sid, nil, "info_hash", info)
+	ksContext := append([]byte{0}, pskIDHash...)
+	ksContext = append(ksContext, infoHash...)
+
+	secret := kdf.LabeledExtract(sid, sharedSecret, "secret", nil)
+
+	key := kdf.LabeledExpand(sid, secret, "key", ksContext, uint16(aeadInfo.keySize))
+	baseNonce := kdf.LabeledExpand(sid, secret, "base_nonce", ksContext, uint16(aeadInfo.nonceSize))
+	exporterSecret := kdf.LabeledExpand(sid, secret, "exp", ksContext, uint16(hash.Size()))
+
+	aead, err := aeadInfo.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &context{
+		aead:           aead,
+		sharedSecret:   sharedSecret,
+		suiteID:        sid,
+		key:            key,
+		baseNonce:      baseNonce,
+		exporterSecret: exporterSecret,
+		kdf:            kdf,
+	}, nil
+}
+
+// SetupSender sets up a sender context for the given recipient public key
+// and returns it along with the encapsulated key to send to the recipient.
+func SetupSender(kemID, kdfID, aeadID uint16, pub *ecdh.PublicKey, info []byte) ([]byte, *Sender, error) {
+	kem, err := newDHKem(kemID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, encapsulatedKey, err := kem.Encap(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	context, err := newContext(sharedSecret, kemID, kdfID, aeadID, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encapsulatedKey, &Sender{context}, nil
+}
+
+// SetupRecipient sets up a recipient context using the given private key
+// and the encapsulated key received from the sender.
+func SetupRecipient(kemID, kdfID, aeadID uint16, priv *ecdh.PrivateKey, info, encPubEph []byte) (*Recipient, error) {
+	kem, err := newDHKem(kemID)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := kem.Decap(encPubEph, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	context, err := newContext(sharedSecret, kemID, kdfID, aeadID, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recipient{context}, nil
+}
+
+func (ctx *context) nextNonce() []byte {
+	nonce := make([]byte, ctx.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ctx.seqNum)
+	for i := range ctx.baseNonce {
+		nonce[i] ^= ctx.baseNonce[i]
+	}
+	return nonce
+}
+
+func (ctx *context) incrementNonce() {
+	// The message limit is 2^96-1 for 12-byte nonces, which a 64-bit
+	// counter cannot reach. Still, refuse to wrap around.
+	if ctx.seqNum == ^uint64(0) {
+		panic("hpke: message limit reached")
+	}
+	ctx.seqNum++
+}
+
+// Seal encrypts and authenticates plaintext using the given additional data.
+func (s *Sender) Seal(aad, plaintext []byte) ([]byte, error) {
+	ciphertext := s.aead.Seal(nil, s.nextNonce(), plaintext, aad)
+	s.incrementNonce()
+	return ciphertext, nil
+}
+
+// Open decrypts and authenticates ciphertext using the given additional data.
+func (r *Recipient) Open(aad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := r.aead.Open(nil, r.nextNonce(), ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	r.incrementNonce()
+	return plaintext, nil
+}
+
+// Export derives a secret of the given length from the context. See
+// RFC 9180, Section 5.3.
+func (ctx *context) Export(exporterContext []byte, length uint16) []byte {
+	return ctx.kdf.LabeledExpand(ctx.suiteID, ctx.exporterSecret, "sec", exporterContext, length)
+}
+
+func suiteID(kemID, kdfID, aeadID uint16) []byte {
+	suiteID := make([]byte, 0, 4+2+2+2)
+	suiteID = append(suiteID, []byte("HPKE")...)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kemID)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kdfID)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, aeadID)
+	return suiteID
+}
+
+// ParseHPKEPublicKey parses a public key for the given KEM.
+func ParseHPKEPublicKey(kemID uint16, bytes []byte) (*ecdh.PublicKey, error) {
+	kemInfo, ok := SupportedKEMs[kemID]
+	if !ok {
+		return nil, errors.New("hpke: unsupported KEM id")
+	}
+	return kemInfo.curve.NewPublicKey(bytes)
+}
+
+// ParseHPKEPrivateKey parses a private key for the given KEM.
+func ParseHPKEPrivateKey(kemID uint16, bytes []byte) (*ecdh.PrivateKey, error) {
+	kemInfo, ok := SupportedKEMs[kemID]
+	if !ok {
+		return nil, errors.New("hpke: unsupported KEM id")
+	}
+	return kemInfo.curve.NewPrivateKey(bytes)
+}
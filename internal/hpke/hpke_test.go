@@ -0,0 +1,175 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hpke
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func mustDecodeHex(t *testing.T, in string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// drawRandomInput reads a length-prefixed random input from r, which is
+// how the accumulated test vectors are computed.
+func drawRandomInput(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	l := make([]byte, 1)
+	if _, err := r.Read(l); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, int(l[0]))
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRFC9180Vectors(t *testing.T) {
+	vectorsJSON, err := os.ReadFile("testdata/rfc9180.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Mode uint16 `json:"mode"`
+		KEM  uint16 `json:"kem_id"`
+		KDF  uint16 `json:"kdf_id"`
+		AEAD uint16 `json:"aead_id"`
+		Info string `json:"info"`
+		IkmE string `json:"ikmE"`
+		IkmR string `json:"ikmR"`
+		SkRm string `json:"skRm"`
+		PkRm string `json:"pkRm"`
+		Enc  string `json:"enc"`
+
+		// Instead of checking in the very large full vectors, these
+		// are accumulated values over many encryptions and exports.
+		AccEncryptions string `json:"encryptions_accumulated"`
+		AccExports     string `json:"exports_accumulated"`
+	}
+	if err := json.Unmarshal(vectorsJSON, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vector := range vectors {
+		name := fmt.Sprintf("mode %04x kem %04x kdf %04x aead %04x",
+			vector.Mode, vector.KEM, vector.KDF, vector.AEAD)
+		t.Run(name, func(t *testing.T) {
+			pub, err := ParseHPKEPublicKey(vector.KEM, mustDecodeHex(t, vector.PkRm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv, err := ParseHPKEPrivateKey(vector.KEM, mustDecodeHex(t, vector.SkRm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			derived, err := DeriveKeyPair(vector.KEM, mustDecodeHex(t, vector.IkmR))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !derived.PublicKey().Equal(pub) || !priv.PublicKey().Equal(pub) {
+				t.Fatal("the recipient keys do not match")
+			}
+
+			ephemeral, err := DeriveKeyPair(vector.KEM, mustDecodeHex(t, vector.IkmE))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testingOnlyGenerateKey = func() (*ecdh.PrivateKey, error) { return ephemeral, nil }
+			t.Cleanup(func() { testingOnlyGenerateKey = nil })
+
+			info := mustDecodeHex(t, vector.Info)
+			encap, sender, err := SetupSender(vector.KEM, vector.KDF, vector.AEAD, pub, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustDecodeHex(t, vector.Enc); !bytes.Equal(encap, want) {
+				t.Fatalf("unexpected encapsulated key, got: %x, want %x", encap, want)
+			}
+			recipient, err := SetupRecipient(vector.KEM, vector.KDF, vector.AEAD, priv, info, encap)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source, sink := sha3.NewShake128(), sha3.NewShake128()
+			for i := 0; i < 1000; i++ {
+				aad, plaintext := drawRandomInput(t, source), drawRandomInput(t, source)
+				ciphertext, err := sender.Seal(aad, plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sink.Write(ciphertext)
+				got, err := recipient.Open(aad, ciphertext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, plaintext) {
+					t.Fatalf("unexpected plaintext: got %x want %x", got, plaintext)
+				}
+			}
+			encryptions := make([]byte, 16)
+			sink.Read(encryptions)
+			if want := mustDecodeHex(t, vector.AccEncryptions); !bytes.Equal(encryptions, want) {
+				t.Errorf("unexpected accumulated encryptions, got: %x, want %x", encryptions, want)
+			}
+
+			source, sink = sha3.NewShake128(), sha3.NewShake128()
+			for l := 0; l < 1000; l++ {
+				context := drawRandomInput(t, source)
+				value := sender.Export(context, uint16(l))
+				sink.Write(value)
+				if got := recipient.Export(context, uint16(l)); !bytes.Equal(got, value) {
+					t.Fatalf("recipient: unexpected exported secret: got %x want %x", got, value)
+				}
+			}
+			exports := make([]byte, 16)
+			sink.Read(exports)
+			if want := mustDecodeHex(t, vector.AccExports); !bytes.Equal(exports, want) {
+				t.Errorf("unexpected accumulated exports, got: %x, want %x", exports, want)
+			}
+		})
+	}
+}
+
+func TestRecipientRejectsTampering(t *testing.T) {
+	priv, err := DeriveKeyPair(DHKEM_X25519_HKDF_SHA256, []byte("recipient"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encap, sender, err := SetupSender(DHKEM_X25519_HKDF_SHA256, KDF_HKDF_SHA256,
+		AEAD_AES_128_GCM, priv.PublicKey(), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := sender.Seal([]byte("aad"), []byte("hello"))
+
+	recipient, err := SetupRecipient(DHKEM_X25519_HKDF_SHA256, KDF_HKDF_SHA256,
+		AEAD_AES_128_GCM, priv, []byte("other info"), encap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recipient.Open([]byte("aad"), ciphertext); err == nil {
+		t.Error("expected an error with a different info")
+	}
+
+	if _, _, err := SetupSender(0x0010, KDF_HKDF_SHA256, AEAD_AES_128_GCM,
+		priv.PublicKey(), nil); err == nil {
+		t.Error("expected an error with an unsupported KEM")
+	}
+}
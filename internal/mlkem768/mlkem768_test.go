@@ -0,0 +1,188 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mlkem768
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	Ke, c, err := ek.Encapsulate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Kd, err := dk.Decapsulate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Ke, Kd) {
+		t.Fail()
+	}
+
+	ek1, err := NewEncapsulationKey(ek.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ek.Bytes(), ek1.Bytes()) {
+		t.Fail()
+	}
+	dk1, err := NewDecapsulationKey(dk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dk.Bytes(), dk1.Bytes()) {
+		t.Fail()
+	}
+	Kd1, err := dk1.Decapsulate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Ke, Kd1) {
+		t.Fail()
+	}
+
+	dk2, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(dk.EncapsulationKey().Bytes(), dk2.EncapsulationKey().Bytes()) {
+		t.Fail()
+	}
+	if bytes.Equal(dk.Bytes(), dk2.Bytes()) {
+		t.Fail()
+	}
+
+	Ke1, c1, err := ek.Encapsulate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(c, c1) {
+		t.Fail()
+	}
+	if bytes.Equal(Ke, Ke1) {
+		t.Fail()
+	}
+}
+
+func TestBadLengths(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	ekBytes := ek.Bytes()
+	_, c, err := ek.Encapsulate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(ekBytes)-1; i++ {
+		if _, err := NewEncapsulationKey(ekBytes[:i]); err == nil {
+			t.Errorf("expected error for ek length %d", i)
+		}
+	}
+	ekLong := append(ekBytes, 0)
+	if _, err := NewEncapsulationKey(ekLong); err == nil {
+		t.Error("expected error for ek length", len(ekLong))
+	}
+
+	for i := 0; i < len(c)-1; i++ {
+		if _, err := dk.Decapsulate(c[:i]); err == nil {
+			t.Errorf("expected error for c length %d", i)
+		}
+	}
+	cLong := append(c, 0)
+	if _, err := dk.Decapsulate(cLong); err == nil {
+		t.Error("expected error for c length", len(cLong))
+	}
+}
+
+func TestInvalidEncapsulationKey(t *testing.T) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekBytes := dk.EncapsulationKey().Bytes()
+	// The first coefficient is encoded in the first 12 bits, set it to q.
+	ekBytes[0] = byte(q & 0xff)
+	ekBytes[1] = ekBytes[1]&0xf0 | byte(q>>8)
+	if _, err := NewEncapsulationKey(ekBytes); err == nil {
+		t.Error("expected error for an unreduced coefficient")
+	}
+}
+
+// TestKnownAnswer uses the vector of the standard library self-test.
+func TestKnownAnswer(t *testing.T) {
+	var d, z, m [32]byte
+	for i := range d {
+		d[i] = byte(0x01 + i)
+		z[i] = byte(0x21 + i)
+		m[i] = byte(0x41 + i)
+	}
+	K := []byte{
+		0x55, 0x01, 0xfc, 0x52, 0x3b, 0x74, 0x5f, 0x41,
+		0x76, 0x2a, 0x18, 0x8d, 0xe4, 0x4a, 0x59, 0xb9,
+		0x20, 0xf4, 0x30, 0x14, 0x62, 0x04, 0xee, 0x4e,
+		0x79, 0x37, 0x32, 0x39, 0x6d, 0xf7, 0xaa, 0x48,
+	}
+	dk, err := NewDecapsulationKey(append(d[:], z[:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Ke, c, err := dk.EncapsulationKey().Encapsulate(bytes.NewReader(m[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Kd, err := dk.Decapsulate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Ke, K) || !bytes.Equal(Kd, K) {
+		t.Errorf("got %x and %x, want %x", Ke, Kd, K)
+	}
+
+	// Implicit rejection produces a different, deterministic, key.
+	c[0] ^= 1
+	Kr, err := dk.Decapsulate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(Kr, K) {
+		t.Error("decapsulating a modified ciphertext returned the same key")
+	}
+}
+
+func BenchmarkKeyGen(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := GenerateKey(rand.Reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	dk, err := GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ek := dk.EncapsulationKey()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, c, err := ek.Encapsulate(rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := dk.Decapsulate(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
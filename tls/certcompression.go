@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Certificate compression algorithms. See RFC 8879, Section 3.
+const (
+	CertCompressionZlib   uint16 = 1
+	CertCompressionBrotli uint16 = 2
+	CertCompressionZstd   uint16 = 3
+)
+
+// compressedCertificateMsg is the CompressedCertificate message. See
+// RFC 8879, Section 4.
+type compressedCertificateMsg struct {
+	raw                          []byte
+	algorithm                    uint16
+	uncompressedLength           uint32
+	compressedCertificateMessage []byte
+}
+
+func (m *compressedCertificateMsg) marshal() ([]byte, error) {
+	if m.raw != nil {
+		return m.raw, nil
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCompressedCertificate)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(m.algorithm)
+		b.AddUint24(m.uncompressedLength)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.compressedCertificateMessage)
+		})
+	})
+
+	var err error
+	m.raw, err = b.Bytes()
+	return m.raw, err
+}
+
+func (m *compressedCertificateMsg) unmarshal(data []byte) bool {
+	*m = compressedCertificateMsg{raw: data}
+	s := cryptobyte.String(data)
+
+	if !s.Skip(4) || // message type and uint24 length field
+		!s.ReadUint16(&m.algorithm) ||
+		!s.ReadUint24(&m.uncompressedLength) ||
+		!readUint24LengthPrefixed(&s, &m.compressedCertificateMessage) ||
+		len(m.compressedCertificateMessage) == 0 || !s.Empty() {
+		return false
+	}
+	return true
+}
+
+// decompressCertificate returns the Certificate message contained inside
+// a CompressedCertificate message, provided that we offered the algorithm
+// used by the peer.
+func decompressCertificate(offered []uint16, m *compressedCertificateMsg) (*certificateMsgTLS13, error) {
+	algorithmOK := false
+	for _, algorithm := range offered {
+		if algorithm == m.algorithm {
+			algorithmOK = true
+			break
+		}
+	}
+	if !algorithmOK {
+		return nil, fmt.Errorf("tls: server used unadvertised certificate compression algorithm %d", m.algorithm)
+	}
+
+	// Apply the same limit we apply to uncompressed handshake messages.
+	if m.uncompressedLength > maxHandshake {
+		return nil, fmt.Errorf("tls: compressed certificate of length %d bytes exceeds maximum of %d bytes",
+			m.uncompressedLength, maxHandshake)
+	}
+
+	var reader io.Reader
+	compressed := bytes.NewReader(m.compressedCertificateMessage)
+	switch m.algorithm {
+	case CertCompressionZlib:
+		zr, err := zlib.NewReader(compressed)
+		if err != nil {
+			return nil, errors.New("tls: invalid compressed certificate: " + err.Error())
+		}
+		defer zr.Close()
+		reader = zr
+	case CertCompressionBrotli:
+		reader = brotli.NewReader(compressed)
+	default:
+		return nil, fmt.Errorf("tls: unsupported certificate compression algorithm %d", m.algorithm)
+	}
+
+	// The uncompressed message starts with its own handshake header, which
+	// is not part of the compressed data. See RFC 8879, Section 4.
+	uncompressed := make([]byte, 4+int(m.uncompressedLength))
+	uncompressed[0] = typeCertificate
+	uncompressed[1] = byte(m.uncompressedLength >> 16)
+	uncompressed[2] = byte(m.uncompressedLength >> 8)
+	uncompressed[3] = byte(m.uncompressedLength)
+	if _, err := io.ReadFull(reader, uncompressed[4:]); err != nil {
+		return nil, errors.New("tls: invalid compressed certificate: " + err.Error())
+	}
+	if n, _ := reader.Read(make([]byte, 1)); n != 0 {
+		return nil, errors.New("tls: compressed certificate longer than advertised")
+	}
+
+	certMsg := new(certificateMsgTLS13)
+	if !certMsg.unmarshal(uncompressed) {
+		return nil, errors.New("tls: invalid compressed certificate")
+	}
+	return certMsg, nil
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"compress/zlib"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressCertificate returns a CompressedCertificate message containing
+// the given Certificate message compressed with the given algorithm.
+func compressCertificate(t *testing.T, algorithm uint16, certMsg *certificateMsgTLS13) *compressedCertificateMsg {
+	t.Helper()
+	raw, err := certMsg.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	switch algorithm {
+	case CertCompressionZlib:
+		w := zlib.NewWriter(&buf)
+		w.Write(raw[4:])
+		w.Close()
+	case CertCompressionBrotli:
+		w := brotli.NewWriter(&buf)
+		w.Write(raw[4:])
+		w.Close()
+	default:
+		t.Fatalf("unexpected algorithm %d", algorithm)
+	}
+	return &compressedCertificateMsg{
+		algorithm:                    algorithm,
+		uncompressedLength:           uint32(len(raw) - 4),
+		compressedCertificateMessage: buf.Bytes(),
+	}
+}
+
+func TestDecompressCertificate(t *testing.T) {
+	certMsg := &certificateMsgTLS13{
+		certificate: Certificate{
+			Certificate:                 [][]byte{testRSACertificate, testRSACertificateIssuer},
+			SignedCertificateTimestamps: [][]byte{[]byte("sct")},
+		},
+		scts: true,
+	}
+
+	for _, algorithm := range []uint16{CertCompressionZlib, CertCompressionBrotli} {
+		compressed := compressCertificate(t, algorithm, certMsg)
+
+		// Make sure the message survives a round trip.
+		raw, err := compressed.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := new(compressedCertificateMsg)
+		if !parsed.unmarshal(raw) {
+			t.Fatal("cannot unmarshal the CompressedCertificate message")
+		}
+
+		got, err := decompressCertificate([]uint16{CertCompressionBrotli, CertCompressionZlib}, parsed)
+		if err != nil {
+			t.Fatalf("algorithm %d: %v", algorithm, err)
+		}
+		if !reflect.DeepEqual(got.certificate, certMsg.certificate) {
+			t.Errorf("algorithm %d: got %+v", algorithm, got.certificate)
+		}
+
+		if _, err := decompressCertificate([]uint16{CertCompressionZstd}, parsed); err == nil ||
+			!strings.Contains(err.Error(), "unadvertised") {
+			t.Errorf("algorithm %d: expected an error for an unadvertised algorithm, got %v", algorithm, err)
+		}
+
+		parsed.uncompressedLength++
+		if _, err := decompressCertificate([]uint16{algorithm}, parsed); err == nil {
+			t.Errorf("algorithm %d: expected an error for a wrong uncompressed length", algorithm)
+		}
+		parsed.uncompressedLength -= 2
+		if _, err := decompressCertificate([]uint16{algorithm}, parsed); err == nil {
+			t.Errorf("algorithm %d: expected an error for a wrong uncompressed length", algorithm)
+		}
+		parsed.uncompressedLength = maxHandshake + 1
+		if _, err := decompressCertificate([]uint16{algorithm}, parsed); err == nil {
+			t.Errorf("algorithm %d: expected an error for a huge certificate", algorithm)
+		}
+	}
+}
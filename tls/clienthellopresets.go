@@ -0,0 +1,265 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Names of the built-in ClientHello presets. Each preset reproduces the
+// ClientHello sent by a specific version of a browser, as captured in
+// testdata. Chrome 102, Edge 106 and Firefox 105 were released in 2022, and
+// iOS 14 in 2020, so the presets do not match current browser versions.
+// The server_name, key_share, and pre_shared_key extensions, as well as the
+// random, the session ID, and the GREASE values, depend on the Config and
+// on the connection.
+const (
+	PresetChrome102  = "chrome-102"
+	PresetEdge106    = "edge-106"
+	PresetFirefox105 = "firefox-105"
+	PresetIOS14      = "ios-14"
+)
+
+// clientHelloPresets maps the name of each preset to the function that
+// returns a fresh copy of its spec.
+var clientHelloPresets = map[string]func() *ClientHelloSpec{
+	PresetChrome102:  chromiumClientHelloSpec,
+	PresetEdge106:    chromiumClientHelloSpec,
+	PresetFirefox105: firefox105ClientHelloSpec,
+	PresetIOS14:      iOS14ClientHelloSpec,
+}
+
+// ClientHelloPreset returns a new copy of the [ClientHelloSpec] of the
+// preset with the given name, which the caller is free to modify.
+//
+// Presets send the ALPN protocols that the browser sends (usually "h2" and
+// "http/1.1"), regardless of the Config's NextProtos, so callers should be
+// prepared to speak the protocol selected by the server.
+func ClientHelloPreset(name string) (*ClientHelloSpec, error) {
+	newSpec, ok := clientHelloPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("tls: unknown ClientHello preset %q", name)
+	}
+	return newSpec(), nil
+}
+
+// ClientHelloPresetNames returns the sorted names of the built-in presets.
+func ClientHelloPresetNames() []string {
+	names := make([]string, 0, len(clientHelloPresets))
+	for name := range clientHelloPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// alpnExtensionData returns the extension_data of an ALPN extension
+// containing the given protocols.
+func alpnExtensionData(protos ...string) []byte {
+	var list []byte
+	for _, proto := range protos {
+		list = append(list, byte(len(proto)))
+		list = append(list, proto...)
+	}
+	return append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+}
+
+// chromiumClientHelloSpec returns the spec of Chrome 102, which is also
+// used by Edge 106, since their captured ClientHellos are the same.
+func chromiumClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			GREASEPlaceholder,
+			TLS_AES_128_GCM_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		SessionIDLength: 32,
+		SupportedCurves: []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256, CurveP384},
+		KeyShareCurves:  []CurveID{CurveID(GREASEPlaceholder), X25519},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			PSSWithSHA256,
+			PKCS1WithSHA256,
+			ECDSAWithP384AndSHA384,
+			PSSWithSHA384,
+			PKCS1WithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA512,
+		},
+		SupportedVersions:            []uint16{GREASEPlaceholder, VersionTLS13, VersionTLS12},
+		CertCompressionAlgorithms:    []uint16{CertCompressionBrotli},
+		ApplicationSettingsProtocols: []string{"h2"},
+		Extensions: []ClientHelloExtension{
+			{Type: GREASEPlaceholder},
+			{Type: ExtensionServerName},
+			{Type: ExtensionExtendedMasterSecret},
+			{Type: ExtensionRenegotiationInfo},
+			{Type: ExtensionSupportedCurves},
+			{Type: ExtensionSupportedPoints},
+			{Type: ExtensionSessionTicket},
+			{Type: ExtensionALPN, Data: alpnExtensionData("h2", "http/1.1")},
+			{Type: ExtensionStatusRequest},
+			{Type: ExtensionSignatureAlgorithms},
+			{Type: ExtensionSCT},
+			{Type: ExtensionKeyShare},
+			{Type: ExtensionPSKModes},
+			{Type: ExtensionSupportedVersions},
+			{Type: ExtensionCompressCertificate},
+			{Type: ExtensionApplicationSettings},
+			{Type: GREASEPlaceholder, Data: []byte{0}},
+			{Type: ExtensionPadding},
+			{Type: ExtensionPreSharedKey},
+		},
+	}
+}
+
+// firefox105ClientHelloSpec returns the spec of Firefox 105.
+func firefox105ClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		SessionIDLength: 32,
+		SupportedCurves: []CurveID{
+			X25519, CurveP256, CurveP384, CurveP521,
+			0x0100, // ffdhe2048
+			0x0101, // ffdhe3072
+		},
+		KeyShareCurves: []CurveID{X25519, CurveP256},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			ECDSAWithP384AndSHA384,
+			ECDSAWithP521AndSHA512,
+			PSSWithSHA256,
+			PSSWithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA256,
+			PKCS1WithSHA384,
+			PKCS1WithSHA512,
+			ECDSAWithSHA1,
+			PKCS1WithSHA1,
+		},
+		SupportedVersions: []uint16{VersionTLS13, VersionTLS12},
+		Extensions: []ClientHelloExtension{
+			{Type: ExtensionServerName},
+			{Type: ExtensionExtendedMasterSecret},
+			{Type: ExtensionRenegotiationInfo},
+			{Type: ExtensionSupportedCurves},
+			{Type: ExtensionSupportedPoints},
+			{Type: ExtensionSessionTicket},
+			{Type: ExtensionALPN, Data: alpnExtensionData("h2", "http/1.1")},
+			{Type: ExtensionStatusRequest},
+			{Type: ExtensionDelegatedCredentials, Data: []byte{
+				0x00, 0x08, 0x04, 0x03, 0x05, 0x03, 0x06, 0x03, 0x02, 0x03,
+			}},
+			{Type: ExtensionKeyShare},
+			{Type: ExtensionSupportedVersions},
+			{Type: ExtensionSignatureAlgorithms},
+			{Type: ExtensionPSKModes},
+			{Type: ExtensionRecordSizeLimit, Data: []byte{0x40, 0x01}},
+			{Type: ExtensionPadding},
+			{Type: ExtensionPreSharedKey},
+		},
+	}
+}
+
+// iOS14ClientHelloSpec returns the spec of Safari on iOS 14.
+func iOS14ClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			GREASEPlaceholder,
+			TLS_AES_128_GCM_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			0xc024, // TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			0xc028, // TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			0x003d, // TLS_RSA_WITH_AES_256_CBC_SHA256
+			TLS_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			0xc008, // TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA
+			TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+			TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		SessionIDLength: 32,
+		SupportedCurves: []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256, CurveP384, CurveP521},
+		KeyShareCurves:  []CurveID{CurveID(GREASEPlaceholder), X25519},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			PSSWithSHA256,
+			PKCS1WithSHA256,
+			ECDSAWithP384AndSHA384,
+			ECDSAWithSHA1,
+			PSSWithSHA384,
+			PSSWithSHA384, // Safari sends it twice.
+			PKCS1WithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA512,
+			PKCS1WithSHA1,
+		},
+		SupportedVersions: []uint16{
+			GREASEPlaceholder, VersionTLS13, VersionTLS12, VersionTLS11, VersionTLS10,
+		},
+		Extensions: []ClientHelloExtension{
+			{Type: GREASEPlaceholder},
+			{Type: ExtensionServerName},
+			{Type: ExtensionExtendedMasterSecret},
+			{Type: ExtensionRenegotiationInfo},
+			{Type: ExtensionSupportedCurves},
+			{Type: ExtensionSupportedPoints},
+			{Type: ExtensionALPN, Data: alpnExtensionData("h2", "http/1.1")},
+			{Type: ExtensionStatusRequest},
+			{Type: ExtensionSignatureAlgorithms},
+			{Type: ExtensionSCT},
+			{Type: ExtensionKeyShare},
+			{Type: ExtensionPSKModes},
+			{Type: ExtensionSupportedVersions},
+			{Type: GREASEPlaceholder, Data: []byte{0}},
+			{Type: ExtensionPadding},
+		},
+	}
+}
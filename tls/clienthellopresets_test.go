@@ -0,0 +1,381 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// presetClientHello returns the ClientHello built from the given preset,
+// with the key shares replaced by zero bytes, such that the result only
+// depends on the preset and on the Config.
+func presetClientHello(t *testing.T, name string) []byte {
+	t.Helper()
+	spec, err := ClientHelloPreset(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig.Clone()
+	config.ServerName = "example.golang"
+	config.ClientHelloSpec = spec
+	c := &Conn{config: config}
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := range hello.keyShares {
+		hello.keyShares[idx].data = make([]byte, len(hello.keyShares[idx].data))
+	}
+	hello.raw = nil
+	raw, err := hello.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// helloShape is the part of a ClientHello that identifies the client, with
+// all the GREASE values replaced by GREASEPlaceholder.
+type helloShape struct {
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedCurves     []CurveID
+	KeyShareCurves      []CurveID
+	SignatureAlgorithms []SignatureScheme
+	SupportedVersions   []uint16
+	ALPNProtocols       []string
+	Padding             bool
+}
+
+func degrease(value uint16) uint16 {
+	if isGREASEValue(value) {
+		return GREASEPlaceholder
+	}
+	return value
+}
+
+// helloShapeFromRaw returns the shape of a marshaled ClientHello, which may
+// be inside a TLS record.
+func helloShapeFromRaw(t *testing.T, raw []byte) *helloShape {
+	t.Helper()
+	if len(raw) > 5 && raw[0] == byte(recordTypeHandshake) {
+		raw = raw[5:]
+	}
+	var hello clientHelloMsg
+	if !hello.unmarshal(raw) {
+		t.Fatal("cannot unmarshal the ClientHello")
+	}
+	shape := &helloShape{ALPNProtocols: hello.alpnProtocols}
+	for _, suite := range hello.cipherSuites {
+		shape.CipherSuites = append(shape.CipherSuites, degrease(suite))
+	}
+	for _, ext := range clientHelloExtensionTypes(t, raw) {
+		shape.Extensions = append(shape.Extensions, degrease(ext))
+		shape.Padding = shape.Padding || ext == ExtensionPadding
+	}
+	for _, curve := range hello.supportedCurves {
+		shape.SupportedCurves = append(shape.SupportedCurves, CurveID(degrease(uint16(curve))))
+	}
+	for _, ks := range hello.keyShares {
+		shape.KeyShareCurves = append(shape.KeyShareCurves, CurveID(degrease(uint16(ks.group))))
+	}
+	shape.SignatureAlgorithms = hello.supportedSignatureAlgorithms
+	for _, vers := range hello.supportedVersions {
+		shape.SupportedVersions = append(shape.SupportedVersions, degrease(vers))
+	}
+	return shape
+}
+
+// capturedHelloJSON is the format of the ClientHelloCaptured-*.json files.
+// See testdata/ClientHelloCaptured-README.
+type capturedHelloJSON struct {
+	CipherSuites []string `json:"cipher_suites"`
+	Extensions   []struct {
+		Name                string   `json:"name"`
+		NamedGroupList      []string `json:"named_group_list"`
+		SignatureAlgorithms []string `json:"supported_signature_algorithms"`
+		ProtocolNameList    []string `json:"protocol_name_list"`
+		Versions            []string `json:"versions"`
+		ClientShares        []struct {
+			Group string `json:"group"`
+		} `json:"client_shares"`
+	} `json:"extensions"`
+}
+
+var capturedExtensionNames = map[string]uint16{
+	"GREASE":                                 GREASEPlaceholder,
+	"server_name":                            ExtensionServerName,
+	"status_request":                         ExtensionStatusRequest,
+	"supported_groups":                       ExtensionSupportedCurves,
+	"ec_point_formats":                       ExtensionSupportedPoints,
+	"signature_algorithms":                   ExtensionSignatureAlgorithms,
+	"application_layer_protocol_negotiation": ExtensionALPN,
+	"signed_certificate_timestamp":           ExtensionSCT,
+	"padding":                                ExtensionPadding,
+	"extended_master_secret":                 ExtensionExtendedMasterSecret,
+	"compress_certificate":                   ExtensionCompressCertificate,
+	"record_size_limit":                      ExtensionRecordSizeLimit,
+	"delegated_credentials":                  ExtensionDelegatedCredentials,
+	"session_ticket":                         ExtensionSessionTicket,
+	"supported_versions":                     ExtensionSupportedVersions,
+	"psk_key_exchange_modes":                 ExtensionPSKModes,
+	"key_share":                              ExtensionKeyShare,
+	"application_settings":                   ExtensionApplicationSettings,
+	"renegotiation_info":                     ExtensionRenegotiationInfo,
+}
+
+// capturedCipherSuiteNames contains the captured cipher suites that this
+// package does not implement.
+var capturedCipherSuiteNames = map[string]uint16{
+	"GREASE":                                  GREASEPlaceholder,
+	"TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA":   0xc008,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384": 0xc024,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384":   0xc028,
+	"TLS_RSA_WITH_AES_256_CBC_SHA256":         0x003d,
+}
+
+var capturedGroupNames = map[string]CurveID{
+	"GREASE":    CurveID(GREASEPlaceholder),
+	"x25519":    X25519,
+	"secp256r1": CurveP256,
+	"secp384r1": CurveP384,
+	"secp521r1": CurveP521,
+	"ffdhe2048": 0x0100,
+	"ffdhe3072": 0x0101,
+}
+
+var capturedSignatureAlgorithmNames = map[string]SignatureScheme{
+	"rsa_pkcs1_sha1":         PKCS1WithSHA1,
+	"rsa_pkcs1_sha256":       PKCS1WithSHA256,
+	"rsa_pkcs1_sha384":       PKCS1WithSHA384,
+	"rsa_pkcs1_sha512":       PKCS1WithSHA512,
+	"rsa_pss_rsae_sha256":    PSSWithSHA256,
+	"rsa_pss_rsae_sha384":    PSSWithSHA384,
+	"rsa_pss_rsae_sha512":    PSSWithSHA512,
+	"ecdsa_sha1":             ECDSAWithSHA1,
+	"ecdsa_secp256r1_sha256": ECDSAWithP256AndSHA256,
+	"ecdsa_secp384r1_sha384": ECDSAWithP384AndSHA384,
+	"ecdsa_secp521r1_sha512": ECDSAWithP521AndSHA512,
+}
+
+var capturedVersionNames = map[string]uint16{
+	"GREASE":  GREASEPlaceholder,
+	"TLS 1.3": VersionTLS13,
+	"TLS 1.2": VersionTLS12,
+	"TLS 1.1": VersionTLS11,
+	"TLS 1.0": VersionTLS10,
+}
+
+// helloShapeFromJSON returns the shape of a ClientHello described in the
+// format of the ClientHelloCaptured-*.json files.
+func helloShapeFromJSON(t *testing.T, data []byte) *helloShape {
+	t.Helper()
+	var captured capturedHelloJSON
+	if err := json.Unmarshal(data, &captured); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(names map[string]uint16, name string) uint16 {
+		value, ok := names[name]
+		if !ok {
+			t.Fatalf("unknown name %q", name)
+		}
+		return value
+	}
+	suiteNames := make(map[string]uint16)
+	for name, id := range capturedCipherSuiteNames {
+		suiteNames[name] = id
+	}
+	for _, suite := range append(CipherSuites(), InsecureCipherSuites()...) {
+		suiteNames[suite.Name] = suite.ID
+	}
+	groupNames := make(map[string]uint16)
+	for name, group := range capturedGroupNames {
+		groupNames[name] = uint16(group)
+	}
+	sigAlgNames := make(map[string]uint16)
+	for name, scheme := range capturedSignatureAlgorithmNames {
+		sigAlgNames[name] = uint16(scheme)
+	}
+
+	shape := &helloShape{}
+	for _, name := range captured.CipherSuites {
+		shape.CipherSuites = append(shape.CipherSuites, lookup(suiteNames, name))
+	}
+	for _, ext := range captured.Extensions {
+		extType := lookup(capturedExtensionNames, ext.Name)
+		shape.Extensions = append(shape.Extensions, extType)
+		switch extType {
+		case ExtensionSupportedCurves:
+			for _, name := range ext.NamedGroupList {
+				shape.SupportedCurves = append(shape.SupportedCurves, CurveID(lookup(groupNames, name)))
+			}
+		case ExtensionKeyShare:
+			for _, share := range ext.ClientShares {
+				shape.KeyShareCurves = append(shape.KeyShareCurves, CurveID(lookup(groupNames, share.Group)))
+			}
+		case ExtensionSignatureAlgorithms:
+			for _, name := range ext.SignatureAlgorithms {
+				shape.SignatureAlgorithms = append(shape.SignatureAlgorithms, SignatureScheme(lookup(sigAlgNames, name)))
+			}
+		case ExtensionSupportedVersions:
+			for _, name := range ext.Versions {
+				shape.SupportedVersions = append(shape.SupportedVersions, lookup(capturedVersionNames, name))
+			}
+		case ExtensionALPN:
+			shape.ALPNProtocols = ext.ProtocolNameList
+		case ExtensionPadding:
+			shape.Padding = true
+		}
+	}
+	return shape
+}
+
+// TestClientHelloPresetsCaptured compares the ClientHello built from each
+// preset with the one captured from the browser. Captures are either a hex
+// dump of the ClientHello or a JSON description of it, as explained in
+// testdata/ClientHelloCaptured-README.
+func TestClientHelloPresetsCaptured(t *testing.T) {
+	for _, name := range ClientHelloPresetNames() {
+		t.Run(name, func(t *testing.T) {
+			var want *helloShape
+			path := filepath.Join("testdata", "ClientHelloCaptured-"+name)
+			if data, err := os.ReadFile(path + ".hex"); err == nil {
+				raw, err := hex.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = helloShapeFromRaw(t, raw)
+			} else if data, err := os.ReadFile(path + ".json"); err == nil {
+				want = helloShapeFromJSON(t, data)
+			}
+			if want == nil {
+				t.Fatalf("no captured ClientHello in %s.{hex,json}", path)
+			}
+			got := helloShapeFromRaw(t, presetClientHello(t, name))
+			gotValue, wantValue := reflect.ValueOf(*got), reflect.ValueOf(*want)
+			for idx := 0; idx < gotValue.NumField(); idx++ {
+				field := gotValue.Type().Field(idx).Name
+				if !reflect.DeepEqual(gotValue.Field(idx).Interface(), wantValue.Field(idx).Interface()) {
+					t.Errorf("%s: got %v, captured %v", field, gotValue.Field(idx), wantValue.Field(idx))
+				}
+			}
+		})
+	}
+}
+
+func TestClientHelloPresetExtensions(t *testing.T) {
+	raw := presetClientHello(t, PresetChrome102)
+	got := clientHelloExtensionTypes(t, raw)
+	grease1, grease2 := got[0], got[len(got)-2]
+	if !isGREASEValue(grease1) || !isGREASEValue(grease2) || grease1 == grease2 {
+		t.Errorf("expected two distinct GREASE extensions, got %x and %x", grease1, grease2)
+	}
+	want := []uint16{
+		grease1,
+		ExtensionServerName,
+		ExtensionExtendedMasterSecret,
+		ExtensionRenegotiationInfo,
+		ExtensionSupportedCurves,
+		ExtensionSupportedPoints,
+		ExtensionSessionTicket,
+		ExtensionALPN,
+		ExtensionStatusRequest,
+		ExtensionSignatureAlgorithms,
+		ExtensionSCT,
+		ExtensionKeyShare,
+		ExtensionPSKModes,
+		ExtensionSupportedVersions,
+		ExtensionCompressCertificate,
+		ExtensionApplicationSettings,
+		grease2,
+		ExtensionPadding,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got extensions %x, want %x", got, want)
+	}
+	if len(raw) != 512 {
+		t.Errorf("expected the ClientHello to be padded to 512 bytes, got %d", len(raw))
+	}
+
+	var hello clientHelloMsg
+	if !hello.unmarshal(raw) {
+		t.Fatal("cannot unmarshal the ClientHello")
+	}
+	if !isGREASEValue(hello.cipherSuites[0]) || !isGREASEValue(uint16(hello.supportedCurves[0])) ||
+		!isGREASEValue(hello.supportedVersions[0]) || !isGREASEValue(uint16(hello.keyShares[0].group)) {
+		t.Error("expected GREASE values in cipher suites, groups, versions, and key shares")
+	}
+	if !reflect.DeepEqual(hello.alpnProtocols, []string{"h2", "http/1.1"}) {
+		t.Errorf("got ALPN protocols %q", hello.alpnProtocols)
+	}
+}
+
+func TestClientHelloPresetUnknown(t *testing.T) {
+	if _, err := ClientHelloPreset("netscape-4"); err == nil {
+		t.Fatal("expected an error for an unknown preset")
+	}
+	spec, _ := ClientHelloPreset(PresetChrome102)
+	spec.CipherSuites[1] = 0
+	if other, _ := ClientHelloPreset(PresetChrome102); other.CipherSuites[1] == 0 {
+		t.Fatal("presets must return a fresh copy of the spec")
+	}
+}
+
+func TestClientHelloPresetsHandshake(t *testing.T) {
+	for _, name := range ClientHelloPresetNames() {
+		for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+			t.Run(name+"-"+VersionName(vers), func(t *testing.T) {
+				serverConfig := testConfig.Clone()
+				serverConfig.MaxVersion = vers
+				serverConfig.NextProtos = []string{"h2"}
+
+				clientConfig := testConfig.Clone()
+				clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+				clientConfig.ClientHelloSpec, _ = ClientHelloPreset(name)
+
+				for _, wantResume := range []bool{false, true} {
+					_, cs, err := testHandshake(t, clientConfig, serverConfig)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if cs.Version != vers {
+						t.Errorf("got version %x, want %x", cs.Version, vers)
+					}
+					if cs.NegotiatedProtocol != "h2" {
+						t.Errorf("got ALPN protocol %q", cs.NegotiatedProtocol)
+					}
+					// Safari does not send session_ticket and pre_shared_key.
+					if name != PresetIOS14 && cs.DidResume != wantResume {
+						t.Errorf("got DidResume %v, want %v", cs.DidResume, wantResume)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestClientHelloPresetsJA4 checks that the JA4 fingerprints of the presets,
+// which do not depend on the extensions order, never drift.
+func TestClientHelloPresetsJA4(t *testing.T) {
+	want := map[string]string{
+		PresetChrome102:  "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		PresetEdge106:    "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		PresetFirefox105: "t13d1715h2_5b57614c22b0_3d5424432f57",
+		PresetIOS14:      "t13d2613h2_2802a3db6c62_845d286b0d67",
+	}
+	for _, name := range ClientHelloPresetNames() {
+		hello, err := ParseClientHello(presetClientHello(t, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hello.Fingerprint().JA4(); got != want[name] {
+			t.Errorf("%s: got JA4 %q, want %q", name, got, want[name])
+		}
+	}
+}
@@ -0,0 +1,910 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS extension numbers that may appear in a [ClientHelloSpec].
+const (
+	ExtensionServerName              uint16 = extensionServerName
+	ExtensionStatusRequest           uint16 = extensionStatusRequest
+	ExtensionSupportedCurves         uint16 = extensionSupportedCurves
+	ExtensionSupportedPoints         uint16 = extensionSupportedPoints
+	ExtensionSignatureAlgorithms     uint16 = extensionSignatureAlgorithms
+	ExtensionALPN                    uint16 = extensionALPN
+	ExtensionSCT                     uint16 = extensionSCT
+	ExtensionPadding                 uint16 = 21
+	ExtensionExtendedMasterSecret    uint16 = extensionExtendedMasterSecret
+	ExtensionCompressCertificate     uint16 = extensionCompressCertificate
+	ExtensionRecordSizeLimit         uint16 = 28
+	ExtensionDelegatedCredentials    uint16 = 34
+	ExtensionSessionTicket           uint16 = extensionSessionTicket
+	ExtensionPreSharedKey            uint16 = extensionPreSharedKey
+	ExtensionEarlyData               uint16 = extensionEarlyData
+	ExtensionSupportedVersions       uint16 = extensionSupportedVersions
+	ExtensionCookie                  uint16 = extensionCookie
+	ExtensionPSKModes                uint16 = extensionPSKModes
+	ExtensionSignatureAlgorithmsCert uint16 = extensionSignatureAlgorithmsCert
+	ExtensionKeyShare                uint16 = extensionKeyShare
+	ExtensionQUICTransportParameters uint16 = extensionQUICTransportParameters
+	ExtensionApplicationSettings     uint16 = extensionApplicationSettings
+	ExtensionEncryptedClientHello    uint16 = extensionEncryptedClientHello
+	ExtensionRenegotiationInfo       uint16 = extensionRenegotiationInfo
+)
+
+// ClientHelloSpec describes the ClientHello that a client sends. When
+// [Config.ClientHelloSpec] is not nil, the client builds the ClientHello
+// from the spec rather than using the default layout of this package, which
+// is the same layout used by crypto/tls.
+//
+// The spec controls which extensions are sent and in which order. The
+// handshake still checks the server's replies against what was actually
+// offered, so, for example, the server cannot select a cipher suite, a
+// version, or an ALPN protocol that the spec did not include.
+type ClientHelloSpec struct {
+	// LegacyVersion is the value of the legacy_version field. If zero, we
+	// use the maximum supported version capped to TLS 1.2.
+	LegacyVersion uint16
+
+	// CipherSuites contains the cipher suites to offer, in order. Values
+	// that this package does not implement are sent as is, but the handshake
+	// fails if the server selects them. This field must not be empty.
+	CipherSuites []uint16
+
+	// CompressionMethods contains the compression methods to offer. If
+	// nil, we only offer the null compression method.
+	CompressionMethods []uint8
+
+	// SessionIDLength is the length of the random legacy_session_id we
+	// send, which must be between zero and 32. The session ID is never sent
+	// for QUIC connections (see RFC 9001, Section 8.4).
+	SessionIDLength int
+
+	// SupportedCurves contains the groups to send in the supported_groups
+	// extension. If nil, we use the Config's CurvePreferences.
+	SupportedCurves []CurveID
+
+	// KeyShareCurves contains the groups for which the client sends a
+	// TLS 1.3 key share, in order. A GREASEPlaceholder sends a GREASE key
+	// share containing a single zero byte. If nil, the client sends a key
+	// share for the first group in SupportedCurves it implements.
+	KeyShareCurves []CurveID
+
+	// SupportedPoints contains the point formats to send in the
+	// ec_point_formats extension. If nil, we send the uncompressed format.
+	SupportedPoints []uint8
+
+	// SignatureAlgorithms contains the signature algorithms to send in the
+	// signature_algorithms extension. If nil, we use the default ones.
+	SignatureAlgorithms []SignatureScheme
+
+	// SignatureAlgorithmsCert contains the signature algorithms to send in
+	// the signature_algorithms_cert extension. If nil, we use the value of
+	// SignatureAlgorithms.
+	SignatureAlgorithmsCert []SignatureScheme
+
+	// SupportedVersions contains the versions to send in the
+	// supported_versions extension. If nil, we use the versions allowed by
+	// the Config's MinVersion and MaxVersion.
+	SupportedVersions []uint16
+
+	// CertCompressionAlgorithms contains the algorithms to send in the
+	// compress_certificate extension (see RFC 8879). The client is able to
+	// decompress certificates using CertCompressionZlib and
+	// CertCompressionBrotli.
+	CertCompressionAlgorithms []uint16
+
+	// ApplicationSettingsProtocols contains the ALPN protocols to send
+	// in the application_settings extension (ALPS). When the server
+	// negotiates ALPS, the client sends empty application settings.
+	ApplicationSettingsProtocols []string
+
+	// Extensions contains the extensions to send, in order. An extension
+	// cannot appear more than once and pre_shared_key, when present, must
+	// be the last extension. The only exception is GREASEPlaceholder, which
+	// can appear twice and is replaced by two distinct GREASE extensions.
+	// The cookie extension is automatically added after a HelloRetryRequest,
+	// and the encrypted_client_hello extension is automatically added when
+	// using ECH, if needed. When the Config does not configure ECH, an
+	// encrypted_client_hello extension in the spec is sent as a GREASE
+	// extension, as with Config.EncryptedClientHelloGREASE.
+	Extensions []ClientHelloExtension
+
+	// ShuffleExtensions, when true, causes the client to send Extensions in
+	// a random order, which changes for each connection, as Chrome does since
+	// version 110. The GREASE, padding and pre_shared_key extensions keep
+	// their position.
+	ShuffleExtensions bool
+}
+
+// ClientHelloExtension is an extension inside a [ClientHelloSpec].
+type ClientHelloExtension struct {
+	// Type is the extension type.
+	Type uint16
+
+	// Data, when not nil, is the extension_data we send verbatim.
+	//
+	// When nil, the client generates the extension_data for the extensions
+	// this package knows about. For example, server_name contains the
+	// Config's ServerName, key_share contains the client key share, and
+	// padding pads the ClientHello to 512 bytes when its size is between
+	// 256 and 511 bytes, as BoringSSL does. The client sends an empty
+	// extension_data for any other extension type.
+	//
+	// The Data of extensions whose value depends on the handshake state
+	// (i.e., key_share, pre_shared_key, early_data, cookie,
+	// quic_transport_parameters, and encrypted_client_hello) must be nil.
+	Data []byte
+}
+
+// errClientHelloSpec is the prefix of errors caused by an invalid ClientHelloSpec.
+var errClientHelloSpec = errors.New("tls: invalid ClientHelloSpec")
+
+// check returns an error if the spec cannot be used to build a ClientHello.
+func (s *ClientHelloSpec) check() error {
+	if len(s.CipherSuites) == 0 {
+		return fmt.Errorf("%w: no cipher suites", errClientHelloSpec)
+	}
+	if s.SessionIDLength < 0 || s.SessionIDLength > 32 {
+		return fmt.Errorf("%w: session ID length %d", errClientHelloSpec, s.SessionIDLength)
+	}
+	seen := make(map[uint16]bool)
+	greaseCount := 0
+	for idx, ext := range s.Extensions {
+		if ext.Type == GREASEPlaceholder {
+			if greaseCount++; greaseCount > 2 {
+				return fmt.Errorf("%w: too many GREASE extensions", errClientHelloSpec)
+			}
+			continue
+		}
+		if seen[ext.Type] {
+			return fmt.Errorf("%w: duplicate extension %d", errClientHelloSpec, ext.Type)
+		}
+		seen[ext.Type] = true
+		switch ext.Type {
+		case extensionPreSharedKey:
+			if idx != len(s.Extensions)-1 {
+				return fmt.Errorf("%w: pre_shared_key must be the last extension", errClientHelloSpec)
+			}
+			fallthrough
+		case extensionKeyShare, extensionEarlyData, extensionCookie, extensionQUICTransportParameters,
+			extensionEncryptedClientHello:
+			if ext.Data != nil {
+				return fmt.Errorf("%w: extension %d cannot have custom data", errClientHelloSpec, ext.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// hasExtension returns whether the spec contains the given extension.
+func (s *ClientHelloSpec) hasExtension(extType uint16) bool {
+	for _, ext := range s.Extensions {
+		if ext.Type == extType {
+			return true
+		}
+	}
+	return false
+}
+
+// makeClientHelloFromSpec is like makeClientHello but builds the
+// ClientHello using the given spec. The caller has already checked the
+// parts of the Config that do not depend on the spec.
+func (c *Conn) makeClientHelloFromSpec(spec *ClientHelloSpec) (*clientHelloMsg, []*keySharePrivateKey, error) {
+	config := c.config
+	if err := spec.check(); err != nil {
+		return nil, nil, err
+	}
+	grease, err := newGREASEValues(config.rand())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	supportedVersions := spec.SupportedVersions
+	if supportedVersions == nil {
+		supportedVersions = config.supportedVersions(roleClient)
+	}
+	legacyVersion := spec.LegacyVersion
+	if legacyVersion == 0 {
+		legacyVersion = config.maxSupportedVersion(roleClient)
+		if legacyVersion > VersionTLS12 {
+			legacyVersion = VersionTLS12
+		}
+	}
+	if !spec.hasExtension(extensionSupportedVersions) {
+		// Without supported_versions, the legacy_version is the maximum
+		// version we offer. See RFC 8446, Section 4.2.1.
+		var implied []uint16
+		for _, vers := range config.supportedVersions(roleClient) {
+			if vers <= legacyVersion {
+				implied = append(implied, vers)
+			}
+		}
+		supportedVersions = implied
+	}
+	if len(supportedVersions) == 0 {
+		return nil, nil, errors.New("tls: no supported versions satisfy MinVersion and MaxVersion")
+	}
+
+	compressionMethods := spec.CompressionMethods
+	if compressionMethods == nil {
+		compressionMethods = []uint8{compressionNone}
+	}
+	supportedCurves := spec.SupportedCurves
+	if supportedCurves == nil {
+		supportedCurves = config.curvePreferences(maxVersion(supportedVersions))
+	}
+	supportedPoints := spec.SupportedPoints
+	if supportedPoints == nil {
+		supportedPoints = []uint8{pointFormatUncompressed}
+	}
+	signatureAlgorithms := spec.SignatureAlgorithms
+	if signatureAlgorithms == nil {
+		signatureAlgorithms = supportedSignatureAlgorithms()
+	}
+	signatureAlgorithmsCert := spec.SignatureAlgorithmsCert
+	if signatureAlgorithmsCert == nil {
+		signatureAlgorithmsCert = signatureAlgorithms
+	}
+
+	hello := &clientHelloMsg{
+		vers:               legacyVersion,
+		random:             make([]byte, 32),
+		cipherSuites:       replaceGREASE(spec.CipherSuites, grease[greaseCipher]),
+		compressionMethods: compressionMethods,
+		supportedVersions:  replaceGREASE(supportedVersions, grease[greaseVersion]),
+		extensions:         make([]ClientHelloExtension, 0, len(spec.Extensions)),
+	}
+	for _, suite := range spec.CipherSuites {
+		if suite == scsvRenegotiation {
+			hello.secureRenegotiationSupported = true
+		}
+	}
+
+	extensions := spec.Extensions
+	if spec.ShuffleExtensions {
+		if extensions, err = shuffleExtensions(config.rand(), extensions); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Only fill the fields of the extensions we are actually sending, such
+	// that the rest of the handshake checks the server's replies against
+	// what we have offered.
+	for _, ext := range extensions {
+		if ext.Type == GREASEPlaceholder {
+			ext.Type = grease[greaseExtension1]
+			if hello.hasExtension(ext.Type) {
+				ext.Type = grease[greaseExtension2]
+			}
+		}
+		hello.extensions = append(hello.extensions, ext)
+		if ext.Data != nil {
+			if err := hello.setExtensionFromData(ext); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		switch ext.Type {
+		case extensionServerName:
+			hello.serverName = hostnameInSNI(config.ServerName)
+		case extensionStatusRequest:
+			hello.ocspStapling = true
+		case extensionSupportedCurves:
+			hello.supportedCurves = replaceGREASE(supportedCurves, grease[greaseGroup])
+		case extensionSupportedPoints:
+			hello.supportedPoints = supportedPoints
+		case extensionSessionTicket:
+			hello.ticketSupported = true
+		case extensionSignatureAlgorithms:
+			hello.supportedSignatureAlgorithms = replaceGREASE(
+				signatureAlgorithms, grease[greaseSignatureAlgorithm])
+		case extensionSignatureAlgorithmsCert:
+			hello.supportedSignatureAlgorithmsCert = replaceGREASE(
+				signatureAlgorithmsCert, grease[greaseSignatureAlgorithm])
+		case extensionRenegotiationInfo:
+			hello.secureRenegotiationSupported = true
+			if c.handshakes > 0 {
+				hello.secureRenegotiation = c.clientFinished[:]
+			}
+		case extensionExtendedMasterSecret:
+			hello.extendedMasterSecret = true
+		case extensionALPN:
+			hello.alpnProtocols = config.NextProtos
+		case extensionSCT:
+			hello.scts = true
+		case extensionPSKModes:
+			hello.pskModes = []uint8{pskModeDHE}
+		case extensionCompressCertificate:
+			hello.certCompressionAlgorithms = spec.CertCompressionAlgorithms
+		case extensionApplicationSettings:
+			hello.applicationSettingsProtocols = spec.ApplicationSettingsProtocols
+		}
+	}
+	if testingOnlyForceClientHelloSignatureAlgorithms != nil {
+		hello.supportedSignatureAlgorithms = testingOnlyForceClientHelloSignatureAlgorithms
+	}
+
+	if _, err := io.ReadFull(config.rand(), hello.random); err != nil {
+		return nil, nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	if c.quic == nil {
+		hello.sessionId = make([]byte, spec.SessionIDLength)
+		if _, err := io.ReadFull(config.rand(), hello.sessionId); err != nil {
+			return nil, nil, errors.New("tls: short read from Rand: " + err.Error())
+		}
+	}
+
+	var keys []*keySharePrivateKey
+	if hello.offersVersion(VersionTLS13) && spec.hasExtension(extensionKeyShare) {
+		keyShareCurves := spec.KeyShareCurves
+		if keyShareCurves == nil {
+			// Use the first group we support.
+			for _, curveID := range hello.supportedCurves {
+				if isSupportedKeyShareGroup(curveID) {
+					keyShareCurves = []CurveID{curveID}
+					break
+				}
+			}
+		}
+		if len(keyShareCurves) == 0 {
+			return nil, nil, fmt.Errorf("%w: no supported group for the key share", errClientHelloSpec)
+		}
+		for _, curveID := range keyShareCurves {
+			if uint16(curveID) == GREASEPlaceholder {
+				// A GREASE key share contains a single zero byte, like in BoringSSL.
+				hello.keyShares = append(hello.keyShares, keyShare{
+					group: CurveID(grease[greaseGroup]),
+					data:  []byte{0},
+				})
+				continue
+			}
+			if !isSupportedKeyShareGroup(curveID) {
+				return nil, nil, fmt.Errorf("%w: unsupported key share group %d", errClientHelloSpec, curveID)
+			}
+			key, share, err := generateKeyShare(config.rand(), curveID)
+			if err != nil {
+				return nil, nil, err
+			}
+			hello.keyShares = append(hello.keyShares, share)
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return nil, nil, fmt.Errorf("%w: no supported group for the key share", errClientHelloSpec)
+		}
+	}
+
+	if c.quic != nil {
+		if !spec.hasExtension(extensionQUICTransportParameters) {
+			return nil, nil, fmt.Errorf("%w: QUIC requires quic_transport_parameters", errClientHelloSpec)
+		}
+		p, err := c.quicGetTransportParameters()
+		if err != nil {
+			return nil, nil, err
+		}
+		if p == nil {
+			p = []byte{}
+		}
+		hello.quicTransportParameters = p
+	}
+
+	return hello, keys, nil
+}
+
+// shuffleExtensions returns a copy of extensions in a random order, where
+// the GREASE, padding and pre_shared_key extensions keep their position.
+func shuffleExtensions(rand io.Reader, extensions []ClientHelloExtension) ([]ClientHelloExtension, error) {
+	var movable []int
+	for idx, ext := range extensions {
+		switch ext.Type {
+		case GREASEPlaceholder, ExtensionPadding, extensionPreSharedKey:
+		default:
+			movable = append(movable, idx)
+		}
+	}
+	shuffled := append([]ClientHelloExtension(nil), extensions...)
+	var buf [4]byte
+	for i := len(movable) - 1; i > 0; i-- {
+		if _, err := io.ReadFull(rand, buf[:]); err != nil {
+			return nil, errors.New("tls: short read from Rand: " + err.Error())
+		}
+		j := int(binary.BigEndian.Uint32(buf[:]) % uint32(i+1))
+		shuffled[movable[i]], shuffled[movable[j]] = shuffled[movable[j]], shuffled[movable[i]]
+	}
+	return shuffled, nil
+}
+
+// maxVersion returns the highest version in versions, ignoring GREASE values,
+// or zero if there is none.
+func maxVersion(versions []uint16) uint16 {
+	var vers uint16
+	for _, v := range versions {
+		if !isGREASEValue(v) && v > vers {
+			vers = v
+		}
+	}
+	return vers
+}
+
+// setExtensionFromData sets the fields of the ClientHello corresponding
+// to an extension with custom data, such that the handshake checks the
+// server's replies against what we have actually offered.
+func (m *clientHelloMsg) setExtensionFromData(ext ClientHelloExtension) error {
+	// The ClientHello parser ignores the extensions that only
+	// clients using a ClientHelloSpec know about.
+	data := cryptobyte.String(ext.Data)
+	switch ext.Type {
+	case extensionCompressCertificate:
+		// RFC 8879, Section 3
+		var algorithms cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&algorithms) || !data.Empty() {
+			return fmt.Errorf("%w: invalid data for extension %d", errClientHelloSpec, ext.Type)
+		}
+		m.certCompressionAlgorithms = nil
+		for !algorithms.Empty() {
+			var algorithm uint16
+			if !algorithms.ReadUint16(&algorithm) {
+				return fmt.Errorf("%w: invalid data for extension %d", errClientHelloSpec, ext.Type)
+			}
+			m.certCompressionAlgorithms = append(m.certCompressionAlgorithms, algorithm)
+		}
+		return nil
+	case extensionApplicationSettings:
+		// draft-vvv-tls-alps, Section 3
+		var protoList cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&protoList) || !data.Empty() {
+			return fmt.Errorf("%w: invalid data for extension %d", errClientHelloSpec, ext.Type)
+		}
+		m.applicationSettingsProtocols = nil
+		for !protoList.Empty() {
+			var proto cryptobyte.String
+			if !protoList.ReadUint8LengthPrefixed(&proto) {
+				return fmt.Errorf("%w: invalid data for extension %d", errClientHelloSpec, ext.Type)
+			}
+			m.applicationSettingsProtocols = append(m.applicationSettingsProtocols, string(proto))
+		}
+		return nil
+	}
+
+	// Reuse the ClientHello parser by wrapping the extension into an
+	// otherwise empty ClientHello.
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(VersionTLS12)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0) // empty legacy_session_id
+		b.AddUint16(2)
+		b.AddUint16(TLS_AES_128_GCM_SHA256)
+		b.AddUint8(1)
+		b.AddUint8(compressionNone)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(ext.Type)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(ext.Data)
+			})
+		})
+	})
+	var parsed clientHelloMsg
+	if raw, err := b.Bytes(); err != nil || !parsed.unmarshal(raw) {
+		return fmt.Errorf("%w: invalid data for extension %d", errClientHelloSpec, ext.Type)
+	}
+	switch ext.Type {
+	case extensionServerName:
+		m.serverName = parsed.serverName
+	case extensionStatusRequest:
+		m.ocspStapling = parsed.ocspStapling
+	case extensionSupportedCurves:
+		m.supportedCurves = parsed.supportedCurves
+	case extensionSupportedPoints:
+		m.supportedPoints = parsed.supportedPoints
+	case extensionSessionTicket:
+		m.ticketSupported = true
+	case extensionSignatureAlgorithms:
+		m.supportedSignatureAlgorithms = parsed.supportedSignatureAlgorithms
+	case extensionSignatureAlgorithmsCert:
+		m.supportedSignatureAlgorithmsCert = parsed.supportedSignatureAlgorithmsCert
+	case extensionRenegotiationInfo:
+		m.secureRenegotiationSupported = true
+	case extensionExtendedMasterSecret:
+		m.extendedMasterSecret = true
+	case extensionALPN:
+		m.alpnProtocols = parsed.alpnProtocols
+	case extensionSCT:
+		m.scts = true
+	case extensionSupportedVersions:
+		m.supportedVersions = parsed.supportedVersions
+	case extensionPSKModes:
+		m.pskModes = parsed.pskModes
+	}
+	return nil
+}
+
+// offersVersion returns whether the ClientHello offers the given version.
+func (m *clientHelloMsg) offersVersion(vers uint16) bool {
+	for _, v := range m.supportedVersions {
+		if v == vers {
+			return true
+		}
+	}
+	return false
+}
+
+// hasExtension returns whether the ClientHello was built from a spec
+// that contains the given extension.
+func (m *clientHelloMsg) hasExtension(extType uint16) bool {
+	for _, ext := range m.extensions {
+		if ext.Type == extType {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalWithExtensions is like marshal but emits the extensions in the
+// order specified by m.extensions.
+func (m *clientHelloMsg) marshalWithExtensions() ([]byte, error) {
+	extensions := m.extensions
+	if len(m.cookie) > 0 && !m.hasExtension(extensionCookie) {
+		// The cookie is only sent after a HelloRetryRequest, so specs
+		// normally do not include it.
+		extensions = insertExtension(extensions, extensionCookie)
+	}
+	if len(m.encryptedClientHello) > 0 && !m.hasExtension(extensionEncryptedClientHello) {
+		extensions = insertExtension(extensions, extensionEncryptedClientHello)
+	}
+
+	// The padding depends on the size of the rest of the message, so
+	// we first marshal without padding and then, if needed, again.
+	out, err := m.marshalExtensionsWithPadding(extensions, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range extensions {
+		if ext.Type != ExtensionPadding || ext.Data != nil {
+			continue
+		}
+		if paddingLen, ok := boringPaddingLength(len(out)); ok {
+			out, err = m.marshalExtensionsWithPadding(extensions, paddingLen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+
+	m.raw = out
+	return m.raw, nil
+}
+
+// insertExtension returns a copy of extensions with an extension of the
+// given type placed before the padding and pre_shared_key extensions, which
+// need to be at the end, or otherwise as the last extension.
+func insertExtension(extensions []ClientHelloExtension, extType uint16) []ClientHelloExtension {
+	out := make([]ClientHelloExtension, 0, len(extensions)+1)
+	inserted := false
+	for _, ext := range extensions {
+		if !inserted && (ext.Type == ExtensionPadding || ext.Type == extensionPreSharedKey) {
+			out = append(out, ClientHelloExtension{Type: extType})
+			inserted = true
+		}
+		out = append(out, ext)
+	}
+	if !inserted {
+		out = append(out, ClientHelloExtension{Type: extType})
+	}
+	return out
+}
+
+// boringPaddingLength returns the length of the padding extension_data to
+// add to a ClientHello whose length without padding is unpaddedLen, using
+// the same algorithm used by BoringSSL. It returns false if we should not
+// send the padding extension.
+func boringPaddingLength(unpaddedLen int) (int, bool) {
+	if unpaddedLen > 0xff && unpaddedLen < 0x200 {
+		paddingLen := 0x200 - unpaddedLen
+		if paddingLen >= 4+1 {
+			paddingLen -= 4 // extension type and length
+		} else {
+			paddingLen = 1
+		}
+		return paddingLen, true
+	}
+	return 0, false
+}
+
+// marshalExtensionsWithPadding marshals the ClientHello using the given
+// extensions. A padding extension with nil Data is omitted when paddingLen
+// is zero and otherwise contains paddingLen zero bytes.
+func (m *clientHelloMsg) marshalExtensionsWithPadding(extensions []ClientHelloExtension, paddingLen int) ([]byte, error) {
+	var exts cryptobyte.Builder
+	for _, ext := range extensions {
+		if ext.Type == ExtensionPadding && ext.Data == nil {
+			if paddingLen > 0 {
+				exts.AddUint16(ExtensionPadding)
+				exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+					exts.AddBytes(make([]byte, paddingLen))
+				})
+			}
+			continue
+		}
+		m.marshalExtension(&exts, ext)
+	}
+	extBytes, err := exts.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(m.vers)
+		addBytesWithLength(b, m.random, 32)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.sessionId)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range m.cipherSuites {
+				b.AddUint16(suite)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.compressionMethods)
+		})
+
+		if len(extBytes) > 0 {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(extBytes)
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+// marshalExtension appends a single extension to the builder, skipping the
+// extensions that have no value in the current handshake state (e.g., the
+// pre_shared_key extension when we are not resuming a session).
+func (m *clientHelloMsg) marshalExtension(exts *cryptobyte.Builder, ext ClientHelloExtension) {
+	if ext.Data != nil {
+		exts.AddUint16(ext.Type)
+		exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+			exts.AddBytes(ext.Data)
+		})
+		return
+	}
+	switch ext.Type {
+	case extensionServerName:
+		if len(m.serverName) == 0 {
+			return
+		}
+	case extensionSupportedCurves:
+		if len(m.supportedCurves) == 0 {
+			return
+		}
+	case extensionSignatureAlgorithms:
+		if len(m.supportedSignatureAlgorithms) == 0 {
+			return
+		}
+	case extensionSignatureAlgorithmsCert:
+		if len(m.supportedSignatureAlgorithmsCert) == 0 {
+			return
+		}
+	case extensionALPN:
+		if len(m.alpnProtocols) == 0 {
+			return
+		}
+	case extensionCookie:
+		if len(m.cookie) == 0 {
+			return
+		}
+	case extensionKeyShare:
+		if len(m.keyShares) == 0 {
+			return
+		}
+	case extensionEarlyData:
+		if !m.earlyData {
+			return
+		}
+	case extensionQUICTransportParameters:
+		if m.quicTransportParameters == nil {
+			return
+		}
+	case extensionPreSharedKey:
+		if len(m.pskIdentities) == 0 {
+			return
+		}
+	case extensionCompressCertificate:
+		if len(m.certCompressionAlgorithms) == 0 {
+			return
+		}
+	case extensionApplicationSettings:
+		if len(m.applicationSettingsProtocols) == 0 {
+			return
+		}
+	case extensionEncryptedClientHello:
+		if len(m.encryptedClientHello) == 0 {
+			return
+		}
+	}
+	exts.AddUint16(ext.Type)
+	exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+		switch ext.Type {
+		case extensionServerName:
+			// RFC 6066, Section 3
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				exts.AddUint8(0) // name_type = host_name
+				exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+					exts.AddBytes([]byte(m.serverName))
+				})
+			})
+		case extensionStatusRequest:
+			// RFC 4366, Section 3.6
+			exts.AddUint8(1)  // status_type = ocsp
+			exts.AddUint16(0) // empty responder_id_list
+			exts.AddUint16(0) // empty request_extensions
+		case extensionSupportedCurves:
+			// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, curve := range m.supportedCurves {
+					exts.AddUint16(uint16(curve))
+				}
+			})
+		case extensionSupportedPoints:
+			// RFC 4492, Section 5.1.2
+			exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+				exts.AddBytes(m.supportedPoints)
+			})
+		case extensionSessionTicket:
+			// RFC 5077, Section 3.2
+			exts.AddBytes(m.sessionTicket)
+		case extensionSignatureAlgorithms:
+			// RFC 5246, Section 7.4.1.4.1
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, sigAlgo := range m.supportedSignatureAlgorithms {
+					exts.AddUint16(uint16(sigAlgo))
+				}
+			})
+		case extensionSignatureAlgorithmsCert:
+			// RFC 8446, Section 4.2.3
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, sigAlgo := range m.supportedSignatureAlgorithmsCert {
+					exts.AddUint16(uint16(sigAlgo))
+				}
+			})
+		case extensionRenegotiationInfo:
+			// RFC 5746, Section 3.2
+			exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+				exts.AddBytes(m.secureRenegotiation)
+			})
+		case extensionALPN:
+			// RFC 7301, Section 3.1
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, proto := range m.alpnProtocols {
+					exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+						exts.AddBytes([]byte(proto))
+					})
+				}
+			})
+		case extensionSupportedVersions:
+			// RFC 8446, Section 4.2.1
+			exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, vers := range m.supportedVersions {
+					exts.AddUint16(vers)
+				}
+			})
+		case extensionCookie:
+			// RFC 8446, Section 4.2.2
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				exts.AddBytes(m.cookie)
+			})
+		case extensionKeyShare:
+			// RFC 8446, Section 4.2.8
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, ks := range m.keyShares {
+					exts.AddUint16(uint16(ks.group))
+					exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+						exts.AddBytes(ks.data)
+					})
+				}
+			})
+		case extensionPSKModes:
+			// RFC 8446, Section 4.2.9
+			exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+				exts.AddBytes(m.pskModes)
+			})
+		case extensionQUICTransportParameters:
+			// RFC 9001, Section 8.2
+			exts.AddBytes(m.quicTransportParameters)
+		case extensionCompressCertificate:
+			// RFC 8879, Section 3
+			exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, algorithm := range m.certCompressionAlgorithms {
+					exts.AddUint16(algorithm)
+				}
+			})
+		case extensionApplicationSettings:
+			// draft-vvv-tls-alps, Section 3
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, proto := range m.applicationSettingsProtocols {
+					exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+						exts.AddBytes([]byte(proto))
+					})
+				}
+			})
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni, Section 5
+			exts.AddBytes(m.encryptedClientHello)
+		case extensionPreSharedKey:
+			// RFC 8446, Section 4.2.11
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, psk := range m.pskIdentities {
+					exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+						exts.AddBytes(psk.label)
+					})
+					exts.AddUint32(psk.obfuscatedTicketAge)
+				}
+			})
+			exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+				for _, binder := range m.pskBinders {
+					exts.AddUint8LengthPrefixed(func(exts *cryptobyte.Builder) {
+						exts.AddBytes(binder)
+					})
+				}
+			})
+		}
+		// The other extensions, including extended_master_secret, SCT,
+		// early_data, and unknown extensions, have empty extension_data.
+	})
+}
+
+// checkServerHelloExtensions ensures that a TLS 1.2 or earlier server did
+// not reply with extensions that we did not offer. See RFC 5246, Section
+// 7.4.1.4.
+func checkServerHelloExtensions(hello *clientHelloMsg, serverHello *serverHelloMsg) error {
+	switch {
+	case serverHello.extendedMasterSecret && !hello.extendedMasterSecret,
+		serverHello.ocspStapling && !hello.ocspStapling,
+		serverHello.ticketSupported && !hello.ticketSupported,
+		len(serverHello.scts) > 0 && !hello.scts,
+		serverHello.secureRenegotiationSupported && !hello.secureRenegotiationSupported:
+		return errors.New("tls: server sent an unsolicited ServerHello extension")
+	}
+	return nil
+}
+
+// checkApplicationSettings checks that the server only sent the ALPS
+// extension for an ALPN protocol for which we offered it.
+func (hs *clientHandshakeStateTLS13) checkApplicationSettings() error {
+	if hs.c.clientProtocol != "" {
+		for _, proto := range hs.hello.applicationSettingsProtocols {
+			if proto == hs.c.clientProtocol {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: server sent an unexpected application_settings extension")
+}
+
+// sendClientEncryptedExtensions sends the client's EncryptedExtensions
+// message, which is required when the server negotiated ALPS. The client
+// always sends empty application settings.
+func (hs *clientHandshakeStateTLS13) sendClientEncryptedExtensions() error {
+	if !hs.sendApplicationSettings {
+		return nil
+	}
+	encryptedExtensions := &encryptedExtensionsMsg{
+		hasApplicationSettings: true,
+		applicationSettings:    []byte{},
+	}
+	if _, err := hs.c.writeHandshakeRecord(encryptedExtensions, hs.transcript); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHelloExtensionTypes returns the extension types inside a marshaled
+// ClientHello in the order in which they appear.
+func clientHelloExtensionTypes(t *testing.T, raw []byte) []uint16 {
+	t.Helper()
+	var (
+		s                   = cryptobyte.String(raw)
+		vers                uint16
+		random, sessionID   []byte
+		suites, compression cryptobyte.String
+		exts                cryptobyte.String
+	)
+	if !s.Skip(4) || !s.ReadUint16(&vers) || !s.ReadBytes(&random, 32) ||
+		!readUint8LengthPrefixed(&s, &sessionID) || !s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&exts) {
+		t.Fatal("cannot parse ClientHello")
+	}
+	var types []uint16
+	for !exts.Empty() {
+		var extType uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&data) {
+			t.Fatal("cannot parse ClientHello extension")
+		}
+		types = append(types, extType)
+	}
+	return types
+}
+
+// testClientHelloSpec returns a ClientHelloSpec similar to the default
+// ClientHello but using a different extension order.
+func testClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		SessionIDLength: 32,
+		SupportedCurves: []CurveID{X25519, CurveP256},
+		Extensions: []ClientHelloExtension{
+			{Type: ExtensionSupportedVersions},
+			{Type: ExtensionKeyShare},
+			{Type: ExtensionServerName},
+			{Type: ExtensionALPN},
+			{Type: ExtensionExtendedMasterSecret},
+			{Type: ExtensionRenegotiationInfo},
+			{Type: ExtensionSupportedCurves},
+			{Type: ExtensionSupportedPoints},
+			{Type: ExtensionSessionTicket},
+			{Type: ExtensionSignatureAlgorithms},
+			{Type: ExtensionPSKModes},
+			{Type: 0x4469, Data: []byte{0x00, 0x03, 0x02, 0x68, 0x32}},
+			{Type: ExtensionPadding},
+			{Type: ExtensionPreSharedKey},
+		},
+	}
+}
+
+func TestClientHelloSpecMarshal(t *testing.T) {
+	config := testConfig.Clone()
+	config.ServerName = "example.golang"
+	config.NextProtos = []string{"h2", "http/1.1"}
+	config.ClientHelloSpec = testClientHelloSpec()
+	c := &Conn{config: config}
+
+	hello, keys, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || len(hello.keyShares) != 1 || hello.keyShares[0].group != X25519 {
+		t.Fatal("expected a single X25519 key share")
+	}
+	raw, err := hello.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 512 {
+		t.Fatalf("expected the padded ClientHello to be 512 bytes, got %d", len(raw))
+	}
+
+	got := clientHelloExtensionTypes(t, raw)
+	want := []uint16{
+		ExtensionSupportedVersions,
+		ExtensionKeyShare,
+		ExtensionServerName,
+		ExtensionALPN,
+		ExtensionExtendedMasterSecret,
+		ExtensionRenegotiationInfo,
+		ExtensionSupportedCurves,
+		ExtensionSupportedPoints,
+		ExtensionSessionTicket,
+		ExtensionSignatureAlgorithms,
+		ExtensionPSKModes,
+		0x4469,
+		ExtensionPadding,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got extensions %v, want %v", got, want)
+	}
+	if !bytes.Contains(raw, []byte{0x44, 0x69, 0x00, 0x05, 0x00, 0x03, 0x02, 0x68, 0x32}) {
+		t.Error("the custom extension data was not sent verbatim")
+	}
+
+	var parsed clientHelloMsg
+	if !parsed.unmarshal(raw) {
+		t.Fatal("cannot unmarshal the ClientHello")
+	}
+	if !reflect.DeepEqual(parsed.cipherSuites, config.ClientHelloSpec.CipherSuites) {
+		t.Errorf("got cipher suites %v", parsed.cipherSuites)
+	}
+	if parsed.serverName != "example.golang" || len(parsed.sessionId) != 32 ||
+		!reflect.DeepEqual(parsed.alpnProtocols, config.NextProtos) {
+		t.Errorf("unexpected ClientHello: %+v", parsed)
+	}
+	if parsed.ocspStapling || parsed.scts {
+		t.Error("the ClientHello contains extensions not in the spec")
+	}
+}
+
+func TestClientHelloSpecCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(spec *ClientHelloSpec)
+		errStr string
+	}{{
+		name:   "without cipher suites",
+		modify: func(spec *ClientHelloSpec) { spec.CipherSuites = nil },
+		errStr: "no cipher suites",
+	}, {
+		name:   "with a session ID that is too long",
+		modify: func(spec *ClientHelloSpec) { spec.SessionIDLength = 33 },
+		errStr: "session ID length",
+	}, {
+		name: "with duplicate extensions",
+		modify: func(spec *ClientHelloSpec) {
+			spec.Extensions = append([]ClientHelloExtension{{Type: ExtensionALPN}}, spec.Extensions...)
+		},
+		errStr: "duplicate extension",
+	}, {
+		name: "with pre_shared_key not being the last extension",
+		modify: func(spec *ClientHelloSpec) {
+			spec.Extensions = append(spec.Extensions, ClientHelloExtension{Type: 0x1234})
+		},
+		errStr: "must be the last extension",
+	}, {
+		name: "with custom key_share data",
+		modify: func(spec *ClientHelloSpec) {
+			spec.Extensions[1] = ClientHelloExtension{Type: ExtensionKeyShare, Data: []byte{}}
+		},
+		errStr: "cannot have custom data",
+	}, {
+		name: "without any supported group for the key share",
+		modify: func(spec *ClientHelloSpec) {
+			spec.SupportedCurves = []CurveID{0x1234}
+		},
+		errStr: "no supported group",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig.Clone()
+			config.ClientHelloSpec = testClientHelloSpec()
+			tt.modify(config.ClientHelloSpec)
+			c := &Conn{config: config}
+			_, _, err := c.makeClientHello()
+			if !errors.Is(err, errClientHelloSpec) || !strings.Contains(err.Error(), tt.errStr) {
+				t.Fatalf("expected error containing %q, got %v", tt.errStr, err)
+			}
+		})
+	}
+}
+
+func TestClientHelloSpecHandshake(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		t.Run(VersionName(vers), func(t *testing.T) {
+			serverConfig := testConfig.Clone()
+			serverConfig.MaxVersion = vers
+			serverConfig.NextProtos = []string{"h2"}
+
+			clientConfig := testConfig.Clone()
+			clientConfig.NextProtos = []string{"h2", "http/1.1"}
+			clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+			clientConfig.ClientHelloSpec = testClientHelloSpec()
+
+			for _, wantResume := range []bool{false, true} {
+				_, cs, err := testHandshake(t, clientConfig, serverConfig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cs.Version != vers {
+					t.Errorf("got version %x, want %x", cs.Version, vers)
+				}
+				if cs.NegotiatedProtocol != "h2" {
+					t.Errorf("got ALPN protocol %q", cs.NegotiatedProtocol)
+				}
+				if cs.DidResume != wantResume {
+					t.Errorf("got DidResume %v, want %v", cs.DidResume, wantResume)
+				}
+			}
+		})
+	}
+}
+
+func TestClientHelloSpecHelloRetryRequest(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	clientConfig := testConfig.Clone()
+	clientConfig.ClientHelloSpec = testClientHelloSpec()
+
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != VersionTLS13 {
+		t.Errorf("got version %x", cs.Version)
+	}
+}
+
+func TestClientHelloSpecUnofferedExtensions(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.NextProtos = []string{"h2"}
+	clientConfig.ClientHelloSpec = testClientHelloSpec()
+	clientConfig.ClientHelloSpec.Extensions = []ClientHelloExtension{
+		{Type: ExtensionSupportedVersions},
+		{Type: ExtensionKeyShare},
+		{Type: ExtensionSupportedCurves},
+		{Type: ExtensionSignatureAlgorithms},
+	}
+	c := &Conn{config: clientConfig}
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.alpnProtocols != nil {
+		t.Fatal("expected no ALPN protocols when the spec does not include ALPN")
+	}
+
+	// Because the ALPN extension has not been sent, a server cannot select
+	// any protocol even though the Config contains NextProtos.
+	if err := checkALPN(hello.alpnProtocols, "h2", false); err == nil {
+		t.Error("expected an error for an unrequested ALPN protocol")
+	}
+
+	serverHello := &serverHelloMsg{extendedMasterSecret: true}
+	if err := checkServerHelloExtensions(hello, serverHello); err == nil {
+		t.Error("expected an error for an unsolicited extended_master_secret")
+	}
+	serverHello = &serverHelloMsg{ocspStapling: true}
+	if err := checkServerHelloExtensions(hello, serverHello); err == nil {
+		t.Error("expected an error for an unsolicited status_request")
+	}
+
+	// Loading a session must not offer the extensions the spec omits.
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+	if _, _, _, err := c.loadSession(hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.ticketSupported || hello.pskModes != nil {
+		t.Error("loadSession offered session_ticket or psk_key_exchange_modes")
+	}
+	serverHello = &serverHelloMsg{ticketSupported: true}
+	if err := checkServerHelloExtensions(hello, serverHello); err == nil {
+		t.Error("expected an error for an unsolicited session_ticket")
+	}
+}
+
+func TestClientHelloSpecGREASEVersionCurves(t *testing.T) {
+	config := testConfig.Clone()
+	config.CurvePreferences = []CurveID{X25519MLKEM768, X25519}
+	config.ClientHelloSpec = testClientHelloSpec()
+	config.ClientHelloSpec.SupportedCurves = nil
+	config.ClientHelloSpec.SupportedVersions = []uint16{GREASEPlaceholder, VersionTLS12}
+	c := &Conn{config: config}
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The groups are those for TLS 1.2, rather than for the GREASE version,
+	// so they do not include the hybrid group.
+	if want := []CurveID{X25519}; !reflect.DeepEqual(hello.supportedCurves, want) {
+		t.Errorf("got groups %v, want %v", hello.supportedCurves, want)
+	}
+}
+
+func TestClientHelloSpecShuffleExtensions(t *testing.T) {
+	config := testConfig.Clone()
+	config.Rand = nil
+	config.ServerName = "example.golang"
+	orders := make(map[string]bool)
+	var want []uint16
+	for i := 0; i < 10; i++ {
+		// Like Chrome 131, send an X25519MLKEM768 key share and a GREASE
+		// encrypted_client_hello extension.
+		spec, _ := ClientHelloPreset(PresetChrome102)
+		spec.SupportedCurves = []CurveID{CurveID(GREASEPlaceholder), X25519MLKEM768, X25519, CurveP256, CurveP384}
+		spec.KeyShareCurves = []CurveID{CurveID(GREASEPlaceholder), X25519MLKEM768, X25519}
+		spec.Extensions = append([]ClientHelloExtension{spec.Extensions[0], {Type: ExtensionEncryptedClientHello}}, spec.Extensions[1:]...)
+		spec.ShuffleExtensions = true
+		config.ClientHelloSpec = spec
+		c := &Conn{config: config}
+		hello, _, err := c.makeClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := hello.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := clientHelloExtensionTypes(t, raw)
+		// The padding extension is omitted, since the X25519MLKEM768 key
+		// share makes the ClientHello larger than 512 bytes.
+		n := len(got)
+		if !isGREASEValue(got[0]) || !isGREASEValue(got[n-1]) {
+			t.Fatalf("GREASE extensions moved: %x", got)
+		}
+		orders[fmt.Sprint(got[1:n-1])] = true
+
+		sorted := append([]uint16(nil), got[1:n-1]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if want == nil {
+			want = sorted
+		} else if !reflect.DeepEqual(sorted, want) {
+			t.Fatalf("got extensions %x, want %x", sorted, want)
+		}
+		if !hello.hasExtension(ExtensionEncryptedClientHello) || len(hello.encryptedClientHello) == 0 {
+			t.Fatal("expected a GREASE encrypted_client_hello extension")
+		}
+	}
+	if len(orders) < 2 {
+		t.Error("the order of the extensions is not randomized")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/ooni/oocrypto/internal/godebug"
+	"github.com/ooni/oocrypto/tls/fingerprint"
 )
 
 const (
@@ -79,23 +80,24 @@ const (
 
 // TLS handshake message types.
 const (
-	typeHelloRequest        uint8 = 0
-	typeClientHello         uint8 = 1
-	typeServerHello         uint8 = 2
-	typeNewSessionTicket    uint8 = 4
-	typeEndOfEarlyData      uint8 = 5
-	typeEncryptedExtensions uint8 = 8
-	typeCertificate         uint8 = 11
-	typeServerKeyExchange   uint8 = 12
-	typeCertificateRequest  uint8 = 13
-	typeServerHelloDone     uint8 = 14
-	typeCertificateVerify   uint8 = 15
-	typeClientKeyExchange   uint8 = 16
-	typeFinished            uint8 = 20
-	typeCertificateStatus   uint8 = 22
-	typeKeyUpdate           uint8 = 24
-	typeNextProtocol        uint8 = 67  // Not IANA assigned
-	typeMessageHash         uint8 = 254 // synthetic message
+	typeHelloRequest          uint8 = 0
+	typeClientHello           uint8 = 1
+	typeServerHello           uint8 = 2
+	typeNewSessionTicket      uint8 = 4
+	typeEndOfEarlyData        uint8 = 5
+	typeEncryptedExtensions   uint8 = 8
+	typeCertificate           uint8 = 11
+	typeServerKeyExchange     uint8 = 12
+	typeCertificateRequest    uint8 = 13
+	typeServerHelloDone       uint8 = 14
+	typeCertificateVerify     uint8 = 15
+	typeClientKeyExchange     uint8 = 16
+	typeFinished              uint8 = 20
+	typeCertificateStatus     uint8 = 22
+	typeKeyUpdate             uint8 = 24
+	typeCompressedCertificate uint8 = 25  // RFC 8879
+	typeNextProtocol          uint8 = 67  // Not IANA assigned
+	typeMessageHash           uint8 = 254 // synthetic message
 )
 
 // TLS compression types.
@@ -113,6 +115,7 @@ const (
 	extensionALPN                    uint16 = 16
 	extensionSCT                     uint16 = 18
 	extensionExtendedMasterSecret    uint16 = 23
+	extensionCompressCertificate     uint16 = 27 // RFC 8879
 	extensionSessionTicket           uint16 = 35
 	extensionPreSharedKey            uint16 = 41
 	extensionEarlyData               uint16 = 42
@@ -123,6 +126,9 @@ const (
 	extensionSignatureAlgorithmsCert uint16 = 50
 	extensionKeyShare                uint16 = 51
 	extensionQUICTransportParameters uint16 = 57
+	extensionApplicationSettings     uint16 = 17513  // draft-vvv-tls-alps
+	extensionECHOuterExtensions      uint16 = 0xfd00 // draft-ietf-tls-esni
+	extensionEncryptedClientHello    uint16 = 0xfe0d // draft-ietf-tls-esni
 	extensionRenegotiationInfo       uint16 = 0xff01
 )
 
@@ -134,15 +140,19 @@ const (
 // CurveID is the type of a TLS identifier for an elliptic curve. See
 // https://www.iana.org/assignments/tls-parameters/tls-parameters.xml#tls-parameters-8.
 //
-// In TLS 1.3, this type is called NamedGroup, but at this time this library
-// only supports Elliptic Curve based groups. See RFC 8446, Section 4.2.7.
+// In TLS 1.3, this type is called NamedGroup, and it also identifies the
+// hybrid post-quantum groups, which combine X25519 with ML-KEM-768 (or its
+// draft version, Kyber768) and are only used in TLS 1.3. See RFC 8446,
+// Section 4.2.7.
 type CurveID uint16
 
 const (
-	CurveP256 CurveID = 23
-	CurveP384 CurveID = 24
-	CurveP521 CurveID = 25
-	X25519    CurveID = 29
+	CurveP256             CurveID = 23
+	CurveP384             CurveID = 24
+	CurveP521             CurveID = 25
+	X25519                CurveID = 29
+	X25519MLKEM768        CurveID = 4588   // draft-kwiatkowski-tls-ecdhe-mlkem
+	X25519Kyber768Draft00 CurveID = 0x6399 // draft-tls-westerbaan-xyber768d00
 )
 
 // TLS 1.3 Key Share. See RFC 8446, Section 4.2.8.
@@ -251,6 +261,11 @@ type ConnectionState struct {
 	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_AES_128_GCM_SHA256).
 	CipherSuite uint16
 
+	// CurveID is the key exchange mechanism used for the connection. It is
+	// zero if the handshake did not use a key exchange group, as in TLS 1.2
+	// resumptions and RSA key exchange.
+	CurveID CurveID
+
 	// NegotiatedProtocol is the application protocol negotiated with ALPN.
 	NegotiatedProtocol string
 
@@ -298,6 +313,46 @@ type ConnectionState struct {
 	// resumed connections that don't support Extended Master Secret (RFC 7627).
 	TLSUnique []byte
 
+	// ECHAccepted indicates if Encrypted Client Hello was offered by the client
+	// and accepted by the server.
+	ECHAccepted bool
+
+	// HandshakeTranscript contains the handshake messages sent and received,
+	// in order, until the handshake completes, if the Config enables
+	// RecordHandshakeTranscript. It is also available when the handshake
+	// fails partway. The Raw bytes are the messages as exchanged, so with
+	// Encrypted Client Hello the client sends the outer ClientHello.
+	// Post-handshake messages are not included.
+	//
+	// HandshakeTranscript and its contents should not be modified.
+	HandshakeTranscript []HandshakeMessageInfo
+
+	// ServerRandom is the random value of the ServerHello, if one was
+	// exchanged, excluding any HelloRetryRequest.
+	ServerRandom []byte
+
+	// DidHelloRetryRequest is true if the server sent a HelloRetryRequest.
+	DidHelloRetryRequest bool
+
+	// ServerExtensions contains the types of the extensions sent by the
+	// server in the ServerHello and, in TLS 1.3, in the EncryptedExtensions,
+	// in the order in which they were sent.
+	ServerExtensions []uint16
+
+	// JA3 and JA4 are the fingerprints of the first ClientHello exchanged,
+	// as sent on the wire. JA3S and JA4S are the fingerprints of the
+	// ServerHello, excluding any HelloRetryRequest. They are set once the
+	// handshake completes or fails, and are empty if the message was not
+	// exchanged. See the fingerprint package for details.
+	JA3, JA4   string
+	JA3S, JA4S string
+
+	// WriteKeyGeneration and ReadKeyGeneration are the number of times the
+	// TLS 1.3 keys used to send and receive records were updated after the
+	// handshake. See Conn.UpdateKeys.
+	WriteKeyGeneration uint64
+	ReadKeyGeneration  uint64
+
 	// ekm is a closure exposed via ExportKeyingMaterial.
 	ekm func(label string, context []byte, length int) ([]byte, error)
 }
@@ -444,6 +499,10 @@ type ClientHelloInfo struct {
 	// might be rejected if used.
 	SupportedVersions []uint16
 
+	// Extensions lists the IDs of the extensions presented by the client
+	// in the ClientHello.
+	Extensions []uint16
+
 	// Conn is the underlying net.Conn for the connection. Do not read
 	// from, or write to, this connection; that will cause the TLS
 	// connection to fail.
@@ -455,6 +514,11 @@ type ClientHelloInfo struct {
 
 	// ctx is the context of the handshake that is in progress.
 	ctx context.Context
+
+	// hello is the ClientHello, and quic is whether it was received over
+	// QUIC, for use with JA3 and JA4.
+	hello *clientHelloMsg
+	quic  bool
 }
 
 // Context returns the context of the handshake that is in progress.
@@ -464,6 +528,37 @@ func (c *ClientHelloInfo) Context() context.Context {
 	return c.ctx
 }
 
+// JA3 returns the JA3 fingerprint of the ClientHello, or an empty string if
+// it is not available. See the fingerprint package for details.
+func (c *ClientHelloInfo) JA3() string {
+	ch, ok := c.fingerprint()
+	if !ok {
+		return ""
+	}
+	return ch.JA3()
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, or an empty string if
+// it is not available. See the fingerprint package for details.
+func (c *ClientHelloInfo) JA4() string {
+	ch, ok := c.fingerprint()
+	if !ok {
+		return ""
+	}
+	return clientHelloJA4(ch, c.quic)
+}
+
+func (c *ClientHelloInfo) fingerprint() (*fingerprint.ClientHello, bool) {
+	if c.hello == nil {
+		return nil, false
+	}
+	hello, ok := newClientHelloMessage(c.hello)
+	if !ok {
+		return nil, false
+	}
+	return hello.Fingerprint(), true
+}
+
 // CertificateRequestInfo contains information from a server's
 // CertificateRequest message, which is used to demand a certificate and proof
 // of control from a client.
@@ -647,11 +742,19 @@ type Config struct {
 	NextProtos []string
 
 	// ServerName is used to verify the hostname on the returned
-	// certificates unless InsecureSkipVerify is given. It is also included
-	// in the client's handshake to support virtual hosting unless it is
-	// an IP address.
+	// certificates unless InsecureSkipVerify or CertificateServerName is
+	// given. It is also included in the client's handshake to support
+	// virtual hosting unless it is an IP address.
 	ServerName string
 
+	// CertificateServerName, if not empty, is used by clients instead of
+	// ServerName to verify the hostname on the returned certificates,
+	// unless InsecureSkipVerify is given. ServerName still controls the
+	// Server Name Indication extension, which is omitted if ServerName is
+	// empty, so a client can send a different name, or none at all, while
+	// still verifying the certificates. Servers ignore this field.
+	CertificateServerName string
+
 	// ClientAuth determines the server's policy for
 	// TLS Client Authentication. The default is NoClientCert.
 	ClientAuth ClientAuthType
@@ -753,16 +856,65 @@ type Config struct {
 
 	// CurvePreferences contains the elliptic curves that will be used in
 	// an ECDHE handshake, in preference order. If empty, the default will
-	// be used. The client will use the first preference as the type for
-	// its key share in TLS 1.3. This may change in the future.
+	// be used. Unless KeyShareCurves is set, the client will use the first
+	// preference as the type for its key share in TLS 1.3.
+	//
+	// The hybrid post-quantum groups X25519MLKEM768 and
+	// X25519Kyber768Draft00 are not in the default, and are only used in
+	// TLS 1.3: TLS 1.2 handshakes skip them.
 	CurvePreferences []CurveID
 
+	// KeyShareCurves, if not empty, contains the groups for which the
+	// client sends a key share in its initial TLS 1.3 ClientHello, in
+	// order, for example X25519MLKEM768 and X25519. Each group must also be
+	// in CurvePreferences, or in the default if CurvePreferences is empty.
+	// The client keeps all the private keys until the server picks one of
+	// the groups, so the server can avoid a HelloRetryRequest. If empty,
+	// only the first group in CurvePreferences is used.
+	//
+	// KeyShareCurves is ignored when ClientHelloSpec is set, in which case
+	// ClientHelloSpec.KeyShareCurves applies.
+	KeyShareCurves []CurveID
+
 	// DynamicRecordSizingDisabled disables adaptive sizing of TLS records.
 	// When true, the largest possible TLS record size is always used. When
 	// false, the size of TLS records may be adjusted in an attempt to
 	// improve latency.
 	DynamicRecordSizingDisabled bool
 
+	// RecordPadding, when not nil, controls the padding added to TLS 1.3
+	// records to hide the length of their content. See the RecordPadding
+	// documentation for more details.
+	RecordPadding *RecordPadding
+
+	// KernelTLS, when true, causes a Conn to offload its record layer to
+	// the kernel after the handshake, if supported. Then, Read and Write
+	// use the underlying connection directly, and ReadFrom can use
+	// sendfile(2), avoiding copies between user space and the kernel.
+	//
+	// Kernel TLS is supported on Linux, with the tls kernel module, when
+	// the underlying connection is a *net.TCPConn and the negotiated cipher
+	// suite uses AES-GCM or ChaCha20-Poly1305. It is not used with
+	// RecordPadding or, in TLS 1.2, when renegotiation is enabled. If only
+	// one direction can be offloaded, for example because records following
+	// the handshake were already read, the other one keeps using the record
+	// layer of the Conn, and if neither can, the Conn works as if KernelTLS
+	// were false. Use Conn.KernelTLS to check which directions are
+	// offloaded.
+	//
+	// The Tracer is not called for records handled by the kernel. TLS 1.3
+	// connections are only offloaded on Linux 6.14 or later, which can
+	// update the keys after a KeyUpdate message. The kernel support for
+	// the version and cipher suite is checked from the kernel release before
+	// attaching the tls upper layer protocol to the socket, which cannot be
+	// undone: if installing the keys then fails, the handshake fails.
+	KernelTLS bool
+
+	// KeyUpdatePolicy, when not nil, causes a TLS 1.3 Conn to update its
+	// sending keys automatically. See the KeyUpdatePolicy documentation for
+	// more details.
+	KeyUpdatePolicy *KeyUpdatePolicy
+
 	// Renegotiation controls what types of renegotiation are supported.
 	// The default, none, is correct for the vast majority of applications.
 	Renegotiation RenegotiationSupport
@@ -775,6 +927,116 @@ type Config struct {
 	// used for debugging.
 	KeyLogWriter io.Writer
 
+	// Tracer, when not nil, contains hooks called as the connection runs
+	// the handshake and exchanges records. See the Tracer documentation for
+	// more details.
+	Tracer *Tracer
+
+	// RecordHandshakeTranscript, when true, causes the connection to keep
+	// the handshake messages exchanged until the handshake completes, which
+	// are returned in ConnectionState.HandshakeTranscript.
+	RecordHandshakeTranscript bool
+
+	// ClientHelloFragmentation, when not nil, causes a client to split its
+	// ClientHello across several TLS records. See the
+	// ClientHelloFragmentation documentation for more details. Servers
+	// ignore this field.
+	ClientHelloFragmentation *ClientHelloFragmentation
+
+	// ClientHelloSegmentation, when not nil, causes a client to write the
+	// records carrying its ClientHello with several Write calls on the
+	// underlying connection. See the ClientHelloSegmentation documentation
+	// for more details. Servers ignore this field.
+	ClientHelloSegmentation *ClientHelloSegmentation
+
+	// ClientHelloSpec, when not nil, controls the ClientHello sent by a
+	// client, including which extensions it contains and their order. See
+	// the ClientHelloSpec documentation for more details. Servers ignore
+	// this field.
+	ClientHelloSpec *ClientHelloSpec
+
+	// GREASE, when true, causes a client to send GREASE values (see
+	// RFC 8701) in its default ClientHello, as Chromium does, using random
+	// values chosen for each connection. The ClientHelloSpec, when set, takes
+	// precedence and controls GREASE using GREASEPlaceholder. Servers always
+	// ignore GREASE values sent by clients, regardless of this field.
+	GREASE bool
+
+	// EncryptedClientHelloConfigList is a serialized ECHConfigList. If
+	// provided, clients will attempt to connect to servers using Encrypted
+	// Client Hello (ECH) using one of the provided ECHConfigs, sending the
+	// ECHConfig's public_name in the outer ClientHello and ServerName only
+	// in the encrypted inner ClientHello.
+	//
+	// Servers do not use this field. In order to configure ECH for servers,
+	// see the EncryptedClientHelloKeys field.
+	//
+	// If the list contains no valid ECH configs, the handshake will fail
+	// and return an error.
+	//
+	// If EncryptedClientHelloConfigList is set, MinVersion, if set, must
+	// be VersionTLS13.
+	//
+	// When EncryptedClientHelloConfigList is set, the handshake will only
+	// succeed if ECH is successfully negotiated. If the server rejects ECH,
+	// an ECHRejectionError error will be returned, which may contain a new
+	// ECHConfigList that the server suggests using.
+	EncryptedClientHelloConfigList []byte
+
+	// EncryptedClientHelloRejectionVerify, if not nil, is called when ECH is
+	// rejected by the remote server, in order to verify the ECH provider
+	// certificate in the outer ClientHello. If it returns a non-nil error, the
+	// handshake is aborted and that error results.
+	//
+	// On the server side this field is not used.
+	//
+	// Unlike VerifyPeerCertificate and VerifyConnection, normal certificate
+	// verification will not be performed before calling
+	// EncryptedClientHelloRejectionVerify.
+	//
+	// If EncryptedClientHelloRejectionVerify is nil and ECH is rejected, the
+	// roots in RootCAs will be used to verify the ECH providers public
+	// certificate. VerifyPeerCertificate and VerifyConnection are not called
+	// when ECH is rejected, even if set, and InsecureSkipVerify is ignored.
+	EncryptedClientHelloRejectionVerify func(ConnectionState) error
+
+	// EncryptedClientHelloGREASE, when true and EncryptedClientHelloConfigList
+	// is nil, causes a client offering TLS 1.3 to send a GREASE
+	// encrypted_client_hello extension, which is syntactically valid but
+	// contains random values, as Chrome does when it has no ECHConfig for the
+	// server (see draft-ietf-tls-esni, Section 6.2). Servers, including ours,
+	// ignore it and complete the handshake as if ECH was not offered.
+	//
+	// Servers do not use this field.
+	EncryptedClientHelloGREASE bool
+
+	// GetEncryptedClientHelloKeys, if not nil, is called by a server when a
+	// client attempts ECH, with the ClientHelloInfo of the outer ClientHello.
+	//
+	// If GetEncryptedClientHelloKeys is not nil, EncryptedClientHelloKeys is
+	// ignored. If it returns an error, the handshake is aborted and that
+	// error results.
+	GetEncryptedClientHelloKeys func(*ClientHelloInfo) ([]EncryptedClientHelloKey, error)
+
+	// EncryptedClientHelloKeys are the ECH keys a server uses to decrypt the
+	// inner ClientHello when a client attempts ECH. If one of them is able to
+	// decrypt it, the handshake continues using the inner ClientHello,
+	// including for selecting the certificate and calling
+	// GetConfigForClient. Use GenerateEncryptedClientHelloKey to generate
+	// new keys.
+	//
+	// If EncryptedClientHelloKeys is set, MinVersion, if set, must be
+	// VersionTLS13.
+	//
+	// If a client attempts ECH, but it is rejected by the server, the server
+	// completes the handshake using the outer ClientHello and sends a list
+	// of configs to retry based on the set of EncryptedClientHelloKeys which
+	// have the SendAsRetry field set.
+	//
+	// Clients do not use this field. In order to configure ECH for clients,
+	// see the EncryptedClientHelloConfigList field.
+	EncryptedClientHelloKeys []EncryptedClientHelloKey
+
 	// mutex protects sessionTicketKeys and autoSessionTicketKeys.
 	mutex sync.RWMutex
 	// sessionTicketKeys contains zero or more ticket keys. If set, it means
@@ -788,6 +1050,23 @@ type Config struct {
 	autoSessionTicketKeys []ticketKey
 }
 
+// EncryptedClientHelloKey holds a private key that is associated with a
+// specific ECHConfig known to clients.
+type EncryptedClientHelloKey struct {
+	// Config is the marshaled ECHConfig associated with PrivateKey. It must
+	// match the config provided to clients byte-for-byte, and must use
+	// DHKEM(X25519, HKDF-SHA256) as KEM.
+	Config []byte
+	// PrivateKey is the marshaled private key, in the format expected by
+	// HPKE's DeserializePrivateKey (see RFC 9180), for the KEM used in
+	// Config.
+	PrivateKey []byte
+	// SendAsRetry indicates whether Config should be sent as part of the
+	// list of retry configs when ECH is requested by the client but rejected
+	// by the server.
+	SendAsRetry bool
+}
+
 const (
 	// ticketKeyLifetime is how long a ticket key remains valid and can be used to
 	// resume a client connection.
@@ -834,36 +1113,52 @@ func (c *Config) Clone() *Config {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 	return &Config{
-		Rand:                        c.Rand,
-		Time:                        c.Time,
-		Certificates:                c.Certificates,
-		NameToCertificate:           c.NameToCertificate,
-		GetCertificate:              c.GetCertificate,
-		GetClientCertificate:        c.GetClientCertificate,
-		GetConfigForClient:          c.GetConfigForClient,
-		VerifyPeerCertificate:       c.VerifyPeerCertificate,
-		VerifyConnection:            c.VerifyConnection,
-		RootCAs:                     c.RootCAs,
-		NextProtos:                  c.NextProtos,
-		ServerName:                  c.ServerName,
-		ClientAuth:                  c.ClientAuth,
-		ClientCAs:                   c.ClientCAs,
-		InsecureSkipVerify:          c.InsecureSkipVerify,
-		CipherSuites:                c.CipherSuites,
-		PreferServerCipherSuites:    c.PreferServerCipherSuites,
-		SessionTicketsDisabled:      c.SessionTicketsDisabled,
-		SessionTicketKey:            c.SessionTicketKey,
-		ClientSessionCache:          c.ClientSessionCache,
-		UnwrapSession:               c.UnwrapSession,
-		WrapSession:                 c.WrapSession,
-		MinVersion:                  c.MinVersion,
-		MaxVersion:                  c.MaxVersion,
-		CurvePreferences:            c.CurvePreferences,
-		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
-		Renegotiation:               c.Renegotiation,
-		KeyLogWriter:                c.KeyLogWriter,
-		sessionTicketKeys:           c.sessionTicketKeys,
-		autoSessionTicketKeys:       c.autoSessionTicketKeys,
+		Rand:                                c.Rand,
+		Time:                                c.Time,
+		Certificates:                        c.Certificates,
+		NameToCertificate:                   c.NameToCertificate,
+		GetCertificate:                      c.GetCertificate,
+		GetClientCertificate:                c.GetClientCertificate,
+		GetConfigForClient:                  c.GetConfigForClient,
+		VerifyPeerCertificate:               c.VerifyPeerCertificate,
+		VerifyConnection:                    c.VerifyConnection,
+		RootCAs:                             c.RootCAs,
+		NextProtos:                          c.NextProtos,
+		ServerName:                          c.ServerName,
+		CertificateServerName:               c.CertificateServerName,
+		ClientAuth:                          c.ClientAuth,
+		ClientCAs:                           c.ClientCAs,
+		InsecureSkipVerify:                  c.InsecureSkipVerify,
+		CipherSuites:                        c.CipherSuites,
+		PreferServerCipherSuites:            c.PreferServerCipherSuites,
+		SessionTicketsDisabled:              c.SessionTicketsDisabled,
+		SessionTicketKey:                    c.SessionTicketKey,
+		ClientSessionCache:                  c.ClientSessionCache,
+		UnwrapSession:                       c.UnwrapSession,
+		WrapSession:                         c.WrapSession,
+		MinVersion:                          c.MinVersion,
+		MaxVersion:                          c.MaxVersion,
+		CurvePreferences:                    c.CurvePreferences,
+		KeyShareCurves:                      c.KeyShareCurves,
+		DynamicRecordSizingDisabled:         c.DynamicRecordSizingDisabled,
+		RecordPadding:                       c.RecordPadding,
+		KernelTLS:                           c.KernelTLS,
+		KeyUpdatePolicy:                     c.KeyUpdatePolicy,
+		Renegotiation:                       c.Renegotiation,
+		KeyLogWriter:                        c.KeyLogWriter,
+		Tracer:                              c.Tracer,
+		RecordHandshakeTranscript:           c.RecordHandshakeTranscript,
+		ClientHelloFragmentation:            c.ClientHelloFragmentation,
+		ClientHelloSegmentation:             c.ClientHelloSegmentation,
+		ClientHelloSpec:                     c.ClientHelloSpec,
+		GREASE:                              c.GREASE,
+		EncryptedClientHelloConfigList:      c.EncryptedClientHelloConfigList,
+		EncryptedClientHelloRejectionVerify: c.EncryptedClientHelloRejectionVerify,
+		EncryptedClientHelloGREASE:          c.EncryptedClientHelloGREASE,
+		GetEncryptedClientHelloKeys:         c.GetEncryptedClientHelloKeys,
+		EncryptedClientHelloKeys:            c.EncryptedClientHelloKeys,
+		sessionTicketKeys:                   c.sessionTicketKeys,
+		autoSessionTicketKeys:               c.autoSessionTicketKeys,
 	}
 }
 
@@ -1001,6 +1296,15 @@ func (c *Config) rand() io.Reader {
 	return r
 }
 
+// verifyServerName returns the hostname that a client verifies the server
+// certificates against.
+func (c *Config) verifyServerName() string {
+	if c.CertificateServerName != "" {
+		return c.CertificateServerName
+	}
+	return c.ServerName
+}
+
 func (c *Config) time() time.Time {
 	t := c.Time
 	if t == nil {
@@ -1049,6 +1353,9 @@ func (c *Config) supportedVersions(isClient bool) []uint16 {
 				continue
 			}
 		}
+		if isClient && c != nil && c.EncryptedClientHelloConfigList != nil && v < VersionTLS13 {
+			continue
+		}
 		if c != nil && c.MinVersion != 0 && v < c.MinVersion {
 			continue
 		}
@@ -1084,18 +1391,29 @@ func supportedVersionsFromMax(maxVersion uint16) []uint16 {
 
 var defaultCurvePreferences = []CurveID{X25519, CurveP256, CurveP384, CurveP521}
 
-func (c *Config) curvePreferences() []CurveID {
+// curvePreferences returns the configured curve preferences, excluding the
+// hybrid post-quantum groups when version is lower than TLS 1.3.
+func (c *Config) curvePreferences(version uint16) []CurveID {
 	if needFIPS() {
 		return fipsCurvePreferences(c)
 	}
 	if c == nil || len(c.CurvePreferences) == 0 {
 		return defaultCurvePreferences
 	}
-	return c.CurvePreferences
+	if version >= VersionTLS13 {
+		return c.CurvePreferences
+	}
+	var curves []CurveID
+	for _, curve := range c.CurvePreferences {
+		if !isHybridGroup(curve) {
+			curves = append(curves, curve)
+		}
+	}
+	return curves
 }
 
-func (c *Config) supportsCurve(curve CurveID) bool {
-	for _, cc := range c.curvePreferences() {
+func (c *Config) supportsCurve(version uint16, curve CurveID) bool {
+	for _, cc := range c.curvePreferences(version) {
 		if cc == curve {
 			return true
 		}
@@ -1254,7 +1572,7 @@ func (chi *ClientHelloInfo) SupportsCertificate(c *Certificate) error {
 	}
 
 	// The only signed key exchange we support is ECDHE.
-	if !supportsECDHE(config, chi.SupportedCurves, chi.SupportedPoints) {
+	if !supportsECDHE(config, vers, chi.SupportedCurves, chi.SupportedPoints) {
 		return supportsRSAFallback(errors.New("client doesn't support ECDHE, can only use legacy RSA key exchange"))
 	}
 
@@ -1275,7 +1593,7 @@ func (chi *ClientHelloInfo) SupportsCertificate(c *Certificate) error {
 			}
 			var curveOk bool
 			for _, c := range chi.SupportedCurves {
-				if c == curve && config.supportsCurve(c) {
+				if c == curve && config.supportsCurve(vers, c) {
 					curveOk = true
 					break
 				}
@@ -50,6 +50,7 @@ type Conn struct {
 	extMasterSecret  bool
 	didResume        bool // whether this connection was a session resumption
 	cipherSuite      uint16
+	curveID          CurveID  // key exchange group, if any
 	ocspResponse     []byte   // stapled OCSP response
 	scts             [][]byte // signed certificate timestamps from server
 	peerCertificates []*x509.Certificate
@@ -61,6 +62,9 @@ type Conn struct {
 	verifiedChains [][]*x509.Certificate
 	// serverName contains the server name indicated by the client, if any.
 	serverName string
+	// echAccepted is true if the server accepted the Encrypted Client
+	// Hello we sent.
+	echAccepted bool
 	// secureRenegotiation is true if the server echoed the secure
 	// renegotiation extension. (This is meaningless as a server because
 	// renegotiation is not supported in that case.)
@@ -98,6 +102,22 @@ type Conn struct {
 	// clientProtocol is the negotiated ALPN protocol.
 	clientProtocol string
 
+	// handshakeTranscript contains the handshake messages sent and
+	// received until the handshake completes, if
+	// Config.RecordHandshakeTranscript is true.
+	handshakeTranscript []HandshakeMessageInfo
+	// lastMessageSent and lastMessageReceived are the last handshake
+	// messages exchanged until the handshake completes, for HandshakeError.
+	lastMessageSent, lastMessageReceived *HandshakeMessageInfo
+	// hellos contains the fields of ConnectionState derived from the hello
+	// messages exchanged during the first handshake.
+	hellos helloSummary
+	// handshakeCtx is the context of the handshake in progress, if any,
+	// and writeDeadline is the last write deadline set on the connection,
+	// which ClientHelloSegmentation honors while waiting between writes.
+	handshakeCtx  context.Context
+	writeDeadline atomic.Pointer[time.Time]
+
 	// input/output
 	in, out   halfConn
 	rawInput  bytes.Buffer // raw input, starting with a record header
@@ -111,11 +131,25 @@ type Conn struct {
 	bytesSent   int64
 	packetsSent int64
 
+	// bytesReceived counts the bytes read from the underlying connection.
+	// handshakePhase is what the handshake is doing, and expectedMessages
+	// are the types of the handshake messages it is waiting for. They are
+	// all reported by HandshakeError.
+	bytesReceived    int64
+	handshakePhase   HandshakePhase
+	expectedMessages []uint8
+	// externalErr is the last error returned by the underlying connection
+	// or by a Config callback, which is not wrapped in a HandshakeError.
+	externalErr error
+
 	// retryCount counts the number of consecutive non-advancing records
 	// received by Conn.readRecord. That is, records that neither advance the
 	// handshake, nor deliver application data. Protected by in.Mutex.
 	retryCount int
 
+	// kernelTLS is set if the record layer is offloaded to the kernel.
+	kernelTLS atomic.Pointer[kernelTLS]
+
 	// activeCall indicates whether Close has been call in the low bit.
 	// the rest of the bits are the number of goroutines in Conn.Write.
 	activeCall atomic.Int32
@@ -141,6 +175,7 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means [Conn.Read] and [Conn.Write] will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.writeDeadline.Store(&t)
 	return c.conn.SetDeadline(t)
 }
 
@@ -154,6 +189,7 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means [Conn.Write] will not time out.
 // After a [Conn.Write] has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(&t)
 	return c.conn.SetWriteDeadline(t)
 }
 
@@ -180,8 +216,20 @@ type halfConn struct {
 	nextCipher any       // next encryption state
 	nextMac    hash.Hash // next MAC algorithm
 
+	key, iv         []byte // TLS 1.2 AEAD key and IV, for kernel TLS
+	nextKey, nextIV []byte // next TLS 1.2 AEAD key and IV
+
 	level         QUICEncryptionLevel // current QUIC encryption level
 	trafficSecret []byte              // current TLS 1.3 traffic secret
+
+	// trafficBytes and trafficRecords count the content bytes and records
+	// sent with the current keys, for KeyUpdatePolicy. keyGeneration counts
+	// the TLS 1.3 key updates after the handshake.
+	trafficBytes   int64
+	trafficRecords int64
+	keyGeneration  atomic.Uint64
+
+	onKeyChange func(QUICEncryptionLevel) // called when the keys change, for Tracer
 }
 
 type permanentError struct {
@@ -218,11 +266,16 @@ func (hc *halfConn) changeCipherSpec() error {
 	}
 	hc.cipher = hc.nextCipher
 	hc.mac = hc.nextMac
+	hc.key, hc.iv = hc.nextKey, hc.nextIV
 	hc.nextCipher = nil
 	hc.nextMac = nil
+	hc.nextKey, hc.nextIV = nil, nil
 	for i := range hc.seq {
 		hc.seq[i] = 0
 	}
+	if hc.onKeyChange != nil {
+		hc.onKeyChange(QUICEncryptionLevelApplication)
+	}
 	return nil
 }
 
@@ -234,6 +287,10 @@ func (hc *halfConn) setTrafficSecret(suite *cipherSuiteTLS13, level QUICEncrypti
 	for i := range hc.seq {
 		hc.seq[i] = 0
 	}
+	hc.trafficBytes, hc.trafficRecords = 0, 0
+	if hc.onKeyChange != nil {
+		hc.onKeyChange(level)
+	}
 }
 
 // incSeq increments the sequence number.
@@ -476,8 +533,9 @@ func sliceForAppend(in []byte, n int) (head, tail []byte) {
 }
 
 // encrypt encrypts payload, adding the appropriate nonce and/or MAC, and
-// appends it to record, which must already contain the record header.
-func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, error) {
+// appends it to record, which must already contain the record header. For
+// TLS 1.3, padding zero bytes are added after the content type.
+func (hc *halfConn) encrypt(record, payload []byte, padding int, rand io.Reader) ([]byte, error) {
 	if hc.cipher == nil {
 		return append(record, payload...), nil
 	}
@@ -522,8 +580,11 @@ func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, err
 			// Encrypt the actual ContentType and replace the plaintext one.
 			record = append(record, record[0])
 			record[0] = byte(recordTypeApplicationData)
+			for i := 0; i < padding; i++ {
+				record = append(record, 0)
+			}
 
-			n := len(payload) + 1 + c.Overhead()
+			n := len(payload) + 1 + padding + c.Overhead()
 			record[3] = byte(n >> 8)
 			record[4] = byte(n)
 
@@ -623,6 +684,10 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		return c.in.setErrorLocked(errors.New("tls: internal error: attempted to read record with QUIC transport"))
 	}
 
+	if k := c.kernelTLS.Load(); k != nil && k.rx {
+		return c.readKernelRecord(k, expectChangeCipherSpec)
+	}
+
 	// Read header, payload.
 	if err := c.readFromUntil(c.conn, recordHeaderLen); err != nil {
 		// RFC 8446, Section 6.1 suggests that EOF without an alertCloseNotify
@@ -684,10 +749,17 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 
 	// Process message.
 	record := c.rawInput.Next(recordHeaderLen + n)
+	c.traceRecord(false, record[:recordHeaderLen])
 	data, typ, err := c.in.decrypt(record)
 	if err != nil {
 		return c.in.setErrorLocked(c.sendAlert(err.(alert)))
 	}
+	return c.processRecord(typ, data, expectChangeCipherSpec)
+}
+
+// processRecord processes the decrypted content of a record.
+func (c *Conn) processRecord(typ recordType, data []byte, expectChangeCipherSpec bool) error {
+	handshakeComplete := c.isHandshakeComplete.Load()
 	if len(data) > maxPlaintext {
 		return c.in.setErrorLocked(c.sendAlert(alertRecordOverflow))
 	}
@@ -718,6 +790,7 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		if len(data) != 2 {
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
+		c.traceAlert(false, data[0], alert(data[1]))
 		if alert(data[1]) == alertCloseNotify {
 			return c.in.setErrorLocked(io.EOF)
 		}
@@ -766,9 +839,9 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		if len(data) == 0 {
 			return c.retryReadRecord(expectChangeCipherSpec)
 		}
-		// Note that data is owned by c.rawInput, following the Next call above,
-		// to avoid copying the plaintext. This is safe because c.rawInput is
-		// not read from or written to until c.input is drained.
+		// Note that data is owned by c.rawInput, following the Next call in
+		// readRecordOrCCS, to avoid copying the plaintext. This is safe because
+		// c.rawInput is not read from or written to until c.input is drained.
 		c.input.Reset(data)
 
 	case recordTypeHandshake:
@@ -826,13 +899,16 @@ func (c *Conn) readFromUntil(r io.Reader, n int) error {
 	// attempt to fetch it so that it can be used in (*Conn).Read to
 	// "predict" closeNotify alerts.
 	c.rawInput.Grow(needs + bytes.MinRead)
-	_, err := c.rawInput.ReadFrom(&atLeastReader{r, int64(needs)})
+	read, err := c.rawInput.ReadFrom(&atLeastReader{r, int64(needs)})
+	c.bytesReceived += read
+	c.transportError(err)
 	return err
 }
 
 // sendAlertLocked sends a TLS alert message.
 func (c *Conn) sendAlertLocked(err alert) error {
 	if c.quic != nil {
+		c.traceAlert(true, alertLevelError, err)
 		return c.out.setErrorLocked(&net.OpError{Op: "local error", Err: err})
 	}
 
@@ -843,6 +919,7 @@ func (c *Conn) sendAlertLocked(err alert) error {
 		c.tmp[0] = alertLevelError
 	}
 	c.tmp[1] = byte(err)
+	c.traceAlert(true, c.tmp[0], err)
 
 	_, writeErr := c.writeRecordLocked(recordTypeAlert, c.tmp[0:2])
 	if err == alertCloseNotify {
@@ -945,6 +1022,7 @@ func (c *Conn) write(data []byte) (int, error) {
 
 	n, err := c.conn.Write(data)
 	c.bytesSent += int64(n)
+	c.transportError(err)
 	return n, err
 }
 
@@ -955,6 +1033,7 @@ func (c *Conn) flush() (int, error) {
 
 	n, err := c.conn.Write(c.sendBuf)
 	c.bytesSent += int64(n)
+	c.transportError(err)
 	c.sendBuf = nil
 	c.buffering = false
 	return n, err
@@ -983,6 +1062,10 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 		return len(data), nil
 	}
 
+	if k := c.kernelTLS.Load(); k != nil && k.tx {
+		return c.writeKernelRecord(k, typ, data)
+	}
+
 	outBufPtr := outBufPool.Get().(*[]byte)
 	outBuf := *outBufPtr
 	defer func() {
@@ -997,7 +1080,10 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 
 	var n int
 	for len(data) > 0 {
-		m := len(data)
+		m, err := c.autoUpdateKeys(typ, len(data))
+		if err != nil {
+			return n, err
+		}
 		if maxPayload := c.maxPayloadSizeForWrite(typ); m > maxPayload {
 			m = maxPayload
 		}
@@ -1019,14 +1105,16 @@ func (c *Conn) writeRecordLocked(typ recordType, data []byte) (int, error) {
 		outBuf[3] = byte(m >> 8)
 		outBuf[4] = byte(m)
 
-		var err error
-		outBuf, err = c.out.encrypt(outBuf, data[:m], c.config.rand())
+		outBuf, err = c.out.encrypt(outBuf, data[:m], c.recordPaddingLen(typ, m), c.config.rand())
 		if err != nil {
 			return n, err
 		}
+		c.traceRecord(true, outBuf[:recordHeaderLen])
 		if _, err := c.write(outBuf); err != nil {
 			return n, err
 		}
+		c.out.trafficBytes += int64(m)
+		c.out.trafficRecords++
 		n += m
 		data = data[m:]
 	}
@@ -1054,8 +1142,24 @@ func (c *Conn) writeHandshakeRecord(msg handshakeMessage, transcript transcriptH
 	if transcript != nil {
 		transcript.Write(data)
 	}
+	c.addHandshakeMessage(true, data)
 
-	return c.writeRecordLocked(recordTypeHandshake, data)
+	c.handshakePhase = HandshakePhaseSending
+	var n int
+	_, isClientHello := msg.(*clientHelloMsg)
+	isClientHello = isClientHello && c.isClient && c.quic == nil
+	switch {
+	case isClientHello && c.config.ClientHelloSegmentation != nil:
+		n, err = c.writeSegmentedClientHello(data)
+	case isClientHello && c.config.ClientHelloFragmentation != nil:
+		n, err = c.writeFragmentedClientHello(data)
+	default:
+		n, err = c.writeRecordLocked(recordTypeHandshake, data)
+	}
+	if err == nil {
+		c.handshakePhase = HandshakePhaseProcessing
+	}
+	return n, err
 }
 
 // writeChangeCipherRecord writes a ChangeCipherSpec message to the connection and
@@ -1063,7 +1167,11 @@ func (c *Conn) writeHandshakeRecord(msg handshakeMessage, transcript transcriptH
 func (c *Conn) writeChangeCipherRecord() error {
 	c.out.Lock()
 	defer c.out.Unlock()
+	c.handshakePhase = HandshakePhaseSending
 	_, err := c.writeRecordLocked(recordTypeChangeCipherSpec, []byte{1})
+	if err == nil {
+		c.handshakePhase = HandshakePhaseProcessing
+	}
 	return err
 }
 
@@ -1084,6 +1192,7 @@ func (c *Conn) readHandshakeBytes(n int) error {
 // the record layer. If transcript is non-nil, the message
 // is written to the passed transcriptHash.
 func (c *Conn) readHandshake(transcript transcriptHash) (any, error) {
+	c.handshakePhase = HandshakePhaseReceiving
 	if err := c.readHandshakeBytes(4); err != nil {
 		return nil, err
 	}
@@ -1097,10 +1206,22 @@ func (c *Conn) readHandshake(transcript transcriptHash) (any, error) {
 		return nil, err
 	}
 	data = c.hand.Next(4 + n)
-	return c.unmarshalHandshakeMessage(data, transcript)
+	c.handshakePhase = HandshakePhaseProcessing
+	msg, err := c.unmarshalHandshakeMessage(data, transcript)
+	if err == nil {
+		c.receivedHandshake(data[0])
+	}
+	return msg, err
 }
 
 func (c *Conn) unmarshalHandshakeMessage(data []byte, transcript transcriptHash) (handshakeMessage, error) {
+	// The handshake message unmarshalers
+	// expect to be able to keep references to data,
+	// so pass in a fresh copy that won't be overwritten.
+	// The same copy is recorded by addHandshakeMessage.
+	data = append([]byte(nil), data...)
+	c.addHandshakeMessage(false, data)
+
 	var m handshakeMessage
 	switch data[0] {
 	case typeHelloRequest:
@@ -1121,6 +1242,8 @@ func (c *Conn) unmarshalHandshakeMessage(data []byte, transcript transcriptHash)
 		} else {
 			m = new(certificateMsg)
 		}
+	case typeCompressedCertificate:
+		m = new(compressedCertificateMsg)
 	case typeCertificateRequest:
 		if c.vers == VersionTLS13 {
 			m = new(certificateRequestMsgTLS13)
@@ -1153,11 +1276,6 @@ func (c *Conn) unmarshalHandshakeMessage(data []byte, transcript transcriptHash)
 		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 	}
 
-	// The handshake message unmarshalers
-	// expect to be able to keep references to data,
-	// so pass in a fresh copy that won't be overwritten.
-	data = append([]byte(nil), data...)
-
 	if !m.unmarshal(data) {
 		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 	}
@@ -1277,6 +1395,7 @@ func (c *Conn) handleRenegotiation() error {
 	if c.handshakeErr = c.clientHandshake(context.Background()); c.handshakeErr == nil {
 		c.handshakes++
 	}
+	c.handshakeErr = c.newHandshakeError(c.handshakeErr)
 	return c.handshakeErr
 }
 
@@ -1323,26 +1442,20 @@ func (c *Conn) handleKeyUpdate(keyUpdate *keyUpdateMsg) error {
 	}
 
 	newSecret := cipherSuite.nextTrafficSecret(c.in.trafficSecret)
-	c.in.setTrafficSecret(cipherSuite, QUICEncryptionLevelInitial, newSecret)
+	c.in.setTrafficSecret(cipherSuite, QUICEncryptionLevelApplication, newSecret)
+	c.in.keyGeneration.Add(1)
+	if err := c.rekeyKernelTLS(&c.in); err != nil {
+		return c.in.setErrorLocked(err)
+	}
 
 	if keyUpdate.updateRequested {
 		c.out.Lock()
 		defer c.out.Unlock()
 
-		msg := &keyUpdateMsg{}
-		msgBytes, err := msg.marshal()
-		if err != nil {
-			return err
-		}
-		_, err = c.writeRecordLocked(recordTypeHandshake, msgBytes)
-		if err != nil {
+		if err := c.sendKeyUpdateLocked(false); err != nil {
 			// Surface the error at the next write.
 			c.out.setErrorLocked(err)
-			return nil
 		}
-
-		newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
-		c.out.setTrafficSecret(cipherSuite, QUICEncryptionLevelInitial, newSecret)
 	}
 
 	return nil
@@ -1551,9 +1664,17 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 	c.in.Lock()
 	defer c.in.Unlock()
 
+	c.handshakeCtx = handshakeCtx
 	c.handshakeErr = c.handshakeFn(handshakeCtx)
+	c.handshakeCtx = nil
+	c.summarizeHellos()
 	if c.handshakeErr == nil {
 		c.handshakes++
+		if err := c.enableKernelTLS(); err != nil {
+			// The socket can no longer be used without the kernel.
+			c.isHandshakeComplete.Store(false)
+			c.handshakeErr = err
+		}
 	} else {
 		// If an error occurred during the handshake try to flush the
 		// alert that might be left in the buffer.
@@ -1566,6 +1687,7 @@ func (c *Conn) handshakeContext(ctx context.Context) (ret error) {
 	if c.handshakeErr != nil && c.isHandshakeComplete.Load() {
 		panic("tls: internal error: handshake returned an error but is marked successful")
 	}
+	c.handshakeErr = c.newHandshakeError(c.handshakeErr)
 
 	if c.quic != nil {
 		if c.handshakeErr == nil {
@@ -1612,10 +1734,15 @@ func (c *Conn) connectionStateLocked() ConnectionState {
 	state.NegotiatedProtocolIsMutual = true
 	state.ServerName = c.serverName
 	state.CipherSuite = c.cipherSuite
+	state.CurveID = c.curveID
 	state.PeerCertificates = c.peerCertificates
 	state.VerifiedChains = c.verifiedChains
 	state.SignedCertificateTimestamps = c.scts
 	state.OCSPResponse = c.ocspResponse
+	state.ECHAccepted = c.echAccepted
+	state.WriteKeyGeneration = c.out.keyGeneration.Load()
+	state.ReadKeyGeneration = c.in.keyGeneration.Load()
+	c.setTranscriptState(&state)
 	if (!c.didResume || c.extMasterSecret) && c.vers != VersionTLS13 {
 		if c.clientFinishedIsFirst {
 			state.TLSUnique = c.clientFinished[:]
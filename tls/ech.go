@@ -0,0 +1,573 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/ooni/oocrypto/internal/hpke"
+	"github.com/ooni/oocrypto/subtle"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// This file implements the client side of Encrypted Client Hello (ECH) as
+// specified by draft-ietf-tls-esni-22. The client sends an outer ClientHello
+// containing the ECHConfig's public_name and, inside the
+// encrypted_client_hello extension, the real (inner) ClientHello encrypted
+// using HPKE. A server that is able to decrypt the inner ClientHello
+// continues the handshake using it and signals so in the ServerHello random.
+// The server side is in ech_server.go.
+
+type echCipher struct {
+	KDFID  uint16
+	AEADID uint16
+}
+
+type echExtension struct {
+	Type uint16
+	Data []byte
+}
+
+// echConfig is a parsed ECHConfig. See draft-ietf-tls-esni, Section 4.
+type echConfig struct {
+	raw []byte
+
+	Version uint16
+	Length  uint16
+
+	ConfigID             uint8
+	KemID                uint16
+	PublicKey            []byte
+	SymmetricCipherSuite []echCipher
+
+	MaxNameLength uint8
+	PublicName    []byte
+	Extensions    []echExtension
+}
+
+var errMalformedECHConfig = errors.New("tls: malformed ECHConfigList")
+
+// parseECHConfig parses a single ECHConfig. It returns skip set to true,
+// and no error, if the config has an unsupported version.
+func parseECHConfig(enc []byte) (skip bool, ec echConfig, err error) {
+	s := cryptobyte.String(enc)
+	ec.raw = enc
+	var contents cryptobyte.String
+	if !s.ReadUint16(&ec.Version) ||
+		!s.ReadUint16LengthPrefixed(&contents) || !s.Empty() {
+		return false, echConfig{}, errMalformedECHConfig
+	}
+	ec.Length = uint16(len(contents))
+	if ec.Version != extensionEncryptedClientHello {
+		return true, echConfig{}, nil
+	}
+	if !contents.ReadUint8(&ec.ConfigID) ||
+		!contents.ReadUint16(&ec.KemID) ||
+		!readUint16LengthPrefixed(&contents, &ec.PublicKey) {
+		return false, echConfig{}, errMalformedECHConfig
+	}
+	var cipherSuites cryptobyte.String
+	if !contents.ReadUint16LengthPrefixed(&cipherSuites) {
+		return false, echConfig{}, errMalformedECHConfig
+	}
+	for !cipherSuites.Empty() {
+		var c echCipher
+		if !cipherSuites.ReadUint16(&c.KDFID) ||
+			!cipherSuites.ReadUint16(&c.AEADID) {
+			return false, echConfig{}, errMalformedECHConfig
+		}
+		ec.SymmetricCipherSuite = append(ec.SymmetricCipherSuite, c)
+	}
+	if !contents.ReadUint8(&ec.MaxNameLength) ||
+		!readUint8LengthPrefixed(&contents, &ec.PublicName) {
+		return false, echConfig{}, errMalformedECHConfig
+	}
+	var extensions cryptobyte.String
+	if !contents.ReadUint16LengthPrefixed(&extensions) || !contents.Empty() {
+		return false, echConfig{}, errMalformedECHConfig
+	}
+	for !extensions.Empty() {
+		var e echExtension
+		if !extensions.ReadUint16(&e.Type) ||
+			!readUint16LengthPrefixed(&extensions, &e.Data) {
+			return false, echConfig{}, errMalformedECHConfig
+		}
+		ec.Extensions = append(ec.Extensions, e)
+	}
+	return false, ec, nil
+}
+
+// parseECHConfigList parses a draft-ietf-tls-esni-18 ECHConfigList, returning
+// the ECHConfigs with a supported version, in the same order they were
+// parsed, or an error if the list is malformed.
+func parseECHConfigList(data []byte) ([]echConfig, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, errMalformedECHConfig
+	}
+	var configs []echConfig
+	for !list.Empty() {
+		var length uint16
+		raw := list
+		if !list.Skip(2) || !list.ReadUint16(&length) || !list.Skip(int(length)) {
+			return nil, errMalformedECHConfig
+		}
+		skip, ec, err := parseECHConfig(raw[:4+int(length)])
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			continue
+		}
+		configs = append(configs, ec)
+	}
+	return configs, nil
+}
+
+// pickECHConfig returns the first ECHConfig in the list that we are able
+// to use, along with the first cipher suite we support, or nil.
+func pickECHConfig(list []echConfig) (*echConfig, echCipher) {
+	for i := range list {
+		ec := &list[i]
+		if _, ok := hpke.SupportedKEMs[ec.KemID]; !ok {
+			continue
+		}
+		if !validDNSName(string(ec.PublicName)) {
+			continue
+		}
+		var unsupportedExt bool
+		for _, ext := range ec.Extensions {
+			// If high order bit is set to 1 the extension is mandatory.
+			// Since we don't support any extensions, if we see a mandatory
+			// bit, we skip the config.
+			if ext.Type&uint16(1<<15) != 0 {
+				unsupportedExt = true
+			}
+		}
+		if unsupportedExt {
+			continue
+		}
+		for _, cs := range ec.SymmetricCipherSuite {
+			// All of the supported AEADs and KDFs are fine, rather than
+			// imposing some sort of preference here, we just pick the first
+			// valid suite.
+			if _, ok := hpke.SupportedKDFs[cs.KDFID]; !ok {
+				continue
+			}
+			if _, ok := hpke.SupportedAEADs[cs.AEADID]; !ok {
+				continue
+			}
+			return ec, cs
+		}
+	}
+	return nil, echCipher{}
+}
+
+// validDNSName is a rather rudimentary check for the validity of a DNS name.
+// This is used to check if the public_name in a ECHConfig is valid when we are
+// picking a config. This can be somewhat lax because even if we pick a
+// valid-looking name, the DNS layer will later reject it anyway.
+func validDNSName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) <= 1 {
+		return false
+	}
+	for _, l := range labels {
+		labelLen := len(l)
+		if labelLen == 0 {
+			return false
+		}
+		for i, r := range l {
+			if r == '-' && (i == 0 || i == labelLen-1) {
+				return false
+			}
+			if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ECHRejectionError is the error type returned when ECH is rejected by a remote
+// server. If the server offered a ECHConfigList to use for retries, the
+// RetryConfigList field will contain this list.
+//
+// The client may treat an ECHRejectionError with an empty set of RetryConfigs
+// as a secure signal from the server.
+type ECHRejectionError struct {
+	RetryConfigList []byte
+}
+
+func (e *ECHRejectionError) Error() string {
+	return "tls: server rejected ECH"
+}
+
+// echClientContext is the client state of an ECH handshake.
+type echClientContext struct {
+	config          *echConfig
+	kdfID           uint16
+	aeadID          uint16
+	hpkeContext     *hpke.Sender
+	encapsulatedKey []byte
+
+	innerHello      *clientHelloMsg
+	innerTranscript hash.Hash
+
+	// outerHello is the outer ClientHello, which we need to send again
+	// after the server accepted ECH in a HelloRetryRequest.
+	outerHello *clientHelloMsg
+
+	echRejected  bool
+	retryConfigs []byte
+}
+
+// newECHClientContext returns the ECH state for the given ClientHello, or
+// nil if the Config does not enable ECH. The ClientHello becomes the inner
+// ClientHello, which the caller splits using splitClientHello once the
+// ClientHello is otherwise complete.
+func (c *Conn) newECHClientContext(hello *clientHelloMsg) (*echClientContext, error) {
+	config := c.config
+	if config.EncryptedClientHelloConfigList == nil {
+		return nil, nil
+	}
+	if config.MinVersion != 0 && config.MinVersion < VersionTLS13 {
+		return nil, errors.New("tls: MinVersion must be >= VersionTLS13 if EncryptedClientHelloConfigList is populated")
+	}
+	if config.MaxVersion != 0 && config.MaxVersion <= VersionTLS12 {
+		return nil, errors.New("tls: MaxVersion must be >= VersionTLS13 if EncryptedClientHelloConfigList is populated")
+	}
+	if !hello.offersVersion(VersionTLS13) {
+		return nil, errors.New("tls: EncryptedClientHelloConfigList requires offering TLS 1.3")
+	}
+	echConfigs, err := parseECHConfigList(config.EncryptedClientHelloConfigList)
+	if err != nil {
+		return nil, err
+	}
+	echConfig, cs := pickECHConfig(echConfigs)
+	if echConfig == nil {
+		return nil, errors.New("tls: EncryptedClientHelloConfigList contains no valid configs")
+	}
+	pub, err := hpke.ParseHPKEPublicKey(echConfig.KemID, echConfig.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ech := &echClientContext{config: echConfig, kdfID: cs.KDFID, aeadID: cs.AEADID}
+	info := append([]byte("tls ech\x00"), echConfig.raw...)
+	ech.encapsulatedKey, ech.hpkeContext, err = hpke.SetupSender(echConfig.KemID, cs.KDFID, cs.AEADID, pub, info)
+	if err != nil {
+		return nil, err
+	}
+
+	hello.encryptedClientHello = []byte{1} // inner ClientHello
+	// The inner ClientHello must only offer TLS 1.3 and later, while a
+	// ClientHelloSpec may explicitly list earlier versions.
+	var versions []uint16
+	for _, v := range hello.supportedVersions {
+		if v >= VersionTLS13 || isGREASEValue(v) {
+			versions = append(versions, v)
+		}
+	}
+	hello.supportedVersions = versions
+	if hello.extensions == nil {
+		// The inner ClientHello only offers TLS 1.3, so there is no point
+		// in sending the TLS 1.2 extensions. A ClientHelloSpec, instead,
+		// controls the extensions we send.
+		hello.supportedPoints = nil
+		hello.ticketSupported = false
+		hello.secureRenegotiationSupported = false
+		hello.extendedMasterSecret = false
+	}
+	return ech, nil
+}
+
+// splitClientHello turns hello, which must be the complete inner
+// ClientHello, into the outer ClientHello, which contains the public_name,
+// a new random, no pre_shared_key extension, and the encrypted inner
+// ClientHello. See draft-ietf-tls-esni, Section 6.1.
+func (ech *echClientContext) splitClientHello(c *Conn, hello *clientHelloMsg) error {
+	inner := *hello
+	ech.innerHello = &inner
+
+	hello.raw = nil
+	hello.serverName = string(ech.config.PublicName)
+	hello.random = make([]byte, 32)
+	if _, err := io.ReadFull(c.config.rand(), hello.random); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	hello.pskIdentities = nil
+	hello.pskBinders = nil
+	return computeAndUpdateOuterECHExtension(hello, ech.innerHello, ech, true)
+}
+
+// greaseECHExtension returns a GREASE encrypted_client_hello extension,
+// which is syntactically valid but which no server is able to decrypt. As
+// BoringSSL does, it contains a random config_id, a valid X25519 encapsulated
+// key, and a random payload whose length is a random multiple of 32 bytes
+// between 128 and 224, plus the AEAD tag. See draft-ietf-tls-esni, Section 6.2.
+func greaseECHExtension(rand io.Reader) ([]byte, error) {
+	var seed [2]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	key, err := ecdh.X25519().GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	aeadID := uint16(hpke.AEAD_AES_128_GCM)
+	if !hasAESGCMHardwareSupport {
+		aeadID = hpke.AEAD_ChaCha20Poly1305
+	}
+	payload := make([]byte, 32*(4+int(seed[1]%4))+16)
+	if _, err := io.ReadFull(rand, payload); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	return generateOuterECHExt(seed[0], hpke.KDF_HKDF_SHA256, aeadID, key.PublicKey().Bytes(), payload)
+}
+
+// addECHGREASE adds a GREASE encrypted_client_hello extension to hello if
+// the Config enables EncryptedClientHelloGREASE or its ClientHelloSpec
+// contains encrypted_client_hello, does not configure real ECH, and hello
+// offers TLS 1.3.
+func (c *Conn) addECHGREASE(hello *clientHelloMsg) error {
+	config := c.config
+	greaseECH := config.EncryptedClientHelloGREASE ||
+		config.ClientHelloSpec != nil && config.ClientHelloSpec.hasExtension(extensionEncryptedClientHello)
+	if !greaseECH || config.EncryptedClientHelloConfigList != nil ||
+		!hello.offersVersion(VersionTLS13) {
+		return nil
+	}
+	ext, err := greaseECHExtension(config.rand())
+	if err != nil {
+		return err
+	}
+	hello.encryptedClientHello = ext
+	return nil
+}
+
+// encodeInnerClientHello returns the EncodedClientHelloInner for the given
+// inner ClientHello, which we send without compressing extensions using
+// ech_outer_extensions. See draft-ietf-tls-esni, Section 5.1.
+func encodeInnerClientHello(inner *clientHelloMsg, maxNameLength int) ([]byte, error) {
+	h, err := inner.marshal()
+	if err != nil {
+		return nil, err
+	}
+	// Strip the four byte header and the legacy_session_id, which the
+	// server copies from the outer ClientHello. We do this on the marshaled
+	// message, rather than marshaling it again without the session ID, to
+	// make sure the rest of it (e.g., the padding extension) does not change.
+	sessionIDOffset := 4 + 2 + 32
+	encoded := make([]byte, 0, len(h))
+	encoded = append(encoded, h[4:sessionIDOffset]...)
+	encoded = append(encoded, 0)
+	encoded = append(encoded, h[sessionIDOffset+1+len(inner.sessionId):]...)
+
+	var paddingLen int
+	if inner.serverName != "" {
+		if paddingLen = maxNameLength - len(inner.serverName); paddingLen < 0 {
+			paddingLen = 0
+		}
+	} else {
+		paddingLen = maxNameLength + 9
+	}
+	paddingLen += 31 - ((len(encoded) + paddingLen - 1) % 32)
+
+	return append(encoded, make([]byte, paddingLen)...), nil
+}
+
+func generateOuterECHExt(id uint8, kdfID, aeadID uint16, encodedKey []byte, payload []byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint8(0) // outer
+	b.AddUint16(kdfID)
+	b.AddUint16(aeadID)
+	b.AddUint8(id)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(encodedKey) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(payload) })
+	return b.Bytes()
+}
+
+// computeAndUpdateOuterECHExtension encrypts the inner ClientHello into the
+// encrypted_client_hello extension of the outer one. The ClientHello sent
+// after a HelloRetryRequest does not include the encapsulated key.
+func computeAndUpdateOuterECHExtension(outer, inner *clientHelloMsg, ech *echClientContext, useKey bool) error {
+	var encapKey []byte
+	if useKey {
+		encapKey = ech.encapsulatedKey
+	}
+	encodedInner, err := encodeInnerClientHello(inner, int(ech.config.MaxNameLength))
+	if err != nil {
+		return err
+	}
+	// NOTE: the tag lengths for all of the supported AEADs are the same (16
+	// bytes), so we have hardcoded it here. If we add support for another AEAD
+	// with a different tag length, we will need to change this.
+	encryptedLen := len(encodedInner) + 16 // AEAD tag length
+	outer.encryptedClientHello, err = generateOuterECHExt(ech.config.ConfigID, ech.kdfID, ech.aeadID, encapKey, make([]byte, encryptedLen))
+	if err != nil {
+		return err
+	}
+	outer.raw = nil
+	serializedOuter, err := outer.marshal()
+	if err != nil {
+		return err
+	}
+	serializedOuter = serializedOuter[4:] // strip the four byte prefix
+	encryptedInner, err := ech.hpkeContext.Seal(serializedOuter, encodedInner)
+	if err != nil {
+		return err
+	}
+	outer.encryptedClientHello, err = generateOuterECHExt(ech.config.ConfigID, ech.kdfID, ech.aeadID, encapKey, encryptedInner)
+	if err != nil {
+		return err
+	}
+	outer.raw = nil
+	return nil
+}
+
+// echAcceptConfirmation computes the ECH acceptance signal for the given
+// transcript, as specified in draft-ietf-tls-esni, Section 7.2.
+func echAcceptConfirmation(suite *cipherSuiteTLS13, innerRandom []byte, label string, transcript hash.Hash) []byte {
+	prk := hkdf.Extract(suite.hash.New, innerRandom, nil)
+	return suite.expandLabel(prk, label, transcript.Sum(nil), 8)
+}
+
+// processECHHelloRetryRequest checks whether the server accepted ECH in the
+// HelloRetryRequest in hs.serverHello. If so, the handshake continues using
+// the inner ClientHello and transcript. It must be called before the
+// HelloRetryRequest is added to the transcript.
+func (hs *clientHandshakeStateTLS13) processECHHelloRetryRequest() error {
+	c := hs.c
+	ech := hs.echContext
+
+	if hs.serverHello.encryptedClientHello == nil {
+		ech.echRejected = true
+		return nil
+	}
+	if len(hs.serverHello.encryptedClientHello) != 8 {
+		c.sendAlert(alertDecodeError)
+		return errors.New("tls: malformed encrypted client hello extension")
+	}
+
+	chHash := ech.innerTranscript.Sum(nil)
+	transcript := hs.suite.hash.New()
+	transcript.Write([]byte{typeMessageHash, 0, 0, uint8(len(chHash))})
+	transcript.Write(chHash)
+	hrr := bytes.Replace(hs.serverHello.raw, hs.serverHello.encryptedClientHello, make([]byte, 8), 1)
+	transcript.Write(hrr)
+	confirmation := echAcceptConfirmation(hs.suite, ech.innerHello.random, "hrr ech accept confirmation", transcript)
+	if subtle.ConstantTimeCompare(confirmation, hs.serverHello.encryptedClientHello) != 1 {
+		ech.echRejected = true
+		return nil
+	}
+
+	ech.outerHello = hs.hello
+	hs.hello = ech.innerHello
+	hs.transcript = ech.innerTranscript
+	c.serverName = c.config.ServerName
+	c.echAccepted = true
+	return nil
+}
+
+// sendECHClientHello sends the outer ClientHello containing hs.hello, which
+// is the inner ClientHello updated after a HelloRetryRequest, and adds the
+// inner ClientHello to the transcript.
+func (hs *clientHandshakeStateTLS13) sendECHClientHello() error {
+	ech := hs.echContext
+	outer := ech.outerHello
+	// The HelloRetryRequest may only change the key shares and the
+	// cookie. Update them in the outer ClientHello too, to keep it
+	// consistent with a regular second ClientHello.
+	outer.keyShares = hs.hello.keyShares
+	outer.cookie = hs.hello.cookie
+	outer.earlyData = hs.hello.earlyData
+	if err := computeAndUpdateOuterECHExtension(outer, hs.hello, ech, false); err != nil {
+		return err
+	}
+	if _, err := hs.c.writeHandshakeRecord(outer, nil); err != nil {
+		return err
+	}
+	return transcriptMsg(hs.hello, hs.transcript)
+}
+
+// processECHServerHello checks whether the server accepted ECH using the
+// confirmation signal in the ServerHello random. If so, the handshake
+// continues using the inner ClientHello and transcript. It must be called
+// before the ServerHello is added to the transcript.
+func (hs *clientHandshakeStateTLS13) processECHServerHello() error {
+	c := hs.c
+	ech := hs.echContext
+	if ech.echRejected {
+		return nil
+	}
+
+	// The acceptance confirmation replaces the last 8 bytes of the random,
+	// which come after the four byte header and the two byte version.
+	const confirmationOffset = 4 + 2 + 24
+	transcript := cloneHash(ech.innerTranscript, hs.suite.hash)
+	transcript.Write(hs.serverHello.raw[:confirmationOffset])
+	transcript.Write(make([]byte, 8))
+	transcript.Write(hs.serverHello.raw[confirmationOffset+8:])
+	confirmation := echAcceptConfirmation(hs.suite, ech.innerHello.random, "ech accept confirmation", transcript)
+	if subtle.ConstantTimeCompare(confirmation, hs.serverHello.random[24:]) != 1 {
+		if c.echAccepted {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server rejected ECH after accepting it in the HelloRetryRequest")
+		}
+		ech.echRejected = true
+		return nil
+	}
+
+	if hs.serverHello.encryptedClientHello != nil {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: unexpected encrypted client hello extension in server hello despite ECH being accepted")
+	}
+	if !c.echAccepted {
+		hs.hello = ech.innerHello
+		hs.transcript = ech.innerTranscript
+		c.serverName = c.config.ServerName
+		c.echAccepted = true
+	}
+	return nil
+}
+
+// verifyECHRejectionCertificate verifies the certificate of a server that
+// rejected ECH, which must be valid for the public_name we sent in the outer
+// ClientHello. See draft-ietf-tls-esni, Section 6.1.7.
+func (c *Conn) verifyECHRejectionCertificate(certs []*x509.Certificate) error {
+	if c.config.EncryptedClientHelloRejectionVerify != nil {
+		c.peerCertificates = certs
+		if err := c.callbackError(c.config.EncryptedClientHelloRejectionVerify(c.connectionStateLocked())); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+		return nil
+	}
+	opts := x509.VerifyOptions{
+		Roots:         c.config.RootCAs,
+		CurrentTime:   c.config.time(),
+		DNSName:       c.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	var err error
+	c.verifiedChains, err = certs[0].Verify(opts)
+	if err != nil {
+		c.sendAlert(alertBadCertificate)
+		return &CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+	}
+	return nil
+}
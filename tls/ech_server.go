@@ -0,0 +1,508 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ooni/oocrypto/internal/hpke"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// This file implements the server side of Encrypted Client Hello (ECH) as
+// specified by draft-ietf-tls-esni-22. The server trial-decrypts the inner
+// ClientHello using its EncryptedClientHelloKeys and, if it succeeds,
+// continues the handshake using the inner ClientHello. Otherwise, it
+// completes the handshake using the outer ClientHello and sends the retry
+// configs to the client.
+
+// GenerateEncryptedClientHelloKey generates a new DHKEM(X25519, HKDF-SHA256)
+// key pair and the corresponding ECHConfig, using the given config_id and
+// public_name, suitable for Config.EncryptedClientHelloKeys. The ECHConfig
+// offers HKDF-SHA256 with AES-128-GCM, AES-256-GCM and ChaCha20Poly1305, and
+// a maximum_name_length of zero. The returned key has SendAsRetry set.
+//
+// If random is nil, crypto/rand.Reader is used.
+//
+// Use MarshalEncryptedClientHelloConfigList to obtain the ECHConfigList to
+// provide to clients.
+func GenerateEncryptedClientHelloKey(random io.Reader, configID uint8, publicName string) (EncryptedClientHelloKey, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	if !validDNSName(publicName) {
+		return EncryptedClientHelloKey{}, fmt.Errorf("tls: invalid ECH public name %q", publicName)
+	}
+	priv, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+	var b cryptobyte.Builder
+	b.AddUint16(extensionEncryptedClientHello) // version
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(hpke.DHKEM_X25519_HKDF_SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(priv.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aeadID := range []uint16{hpke.AEAD_AES_128_GCM, hpke.AEAD_AES_256_GCM, hpke.AEAD_ChaCha20Poly1305} {
+				b.AddUint16(hpke.KDF_HKDF_SHA256)
+				b.AddUint16(aeadID)
+			}
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return EncryptedClientHelloKey{}, fmt.Errorf("tls: invalid ECHConfig: %w", err)
+	}
+	return EncryptedClientHelloKey{
+		Config:      config,
+		PrivateKey:  priv.Bytes(),
+		SendAsRetry: true,
+	}, nil
+}
+
+// MarshalEncryptedClientHelloConfigList returns the ECHConfigList containing
+// the Config of each of the given keys, in order, suitable for
+// Config.EncryptedClientHelloConfigList. It returns an error if any of the
+// configs is malformed.
+func MarshalEncryptedClientHelloConfigList(keys []EncryptedClientHelloKey) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range keys {
+			if _, _, err := parseECHConfig(key.Config); err != nil {
+				b.SetError(err)
+				return
+			}
+			b.AddBytes(key.Config)
+		}
+	})
+	return b.Bytes()
+}
+
+type echExtType uint8
+
+const (
+	innerECHExt echExtType = 1
+	outerECHExt echExtType = 0
+)
+
+var (
+	errMalformedECHExt = errors.New("tls: malformed encrypted client hello extension")
+	errInvalidECHExt   = errors.New("tls: client sent invalid encrypted client hello extension")
+)
+
+// echServerContext is the server state of an ECH handshake.
+type echServerContext struct {
+	hpkeContext *hpke.Recipient
+	configID    uint8
+	ciphersuite echCipher
+	// inner indicates that the initial ClientHello we received contained an
+	// encrypted_client_hello extension that indicated it was an inner
+	// ClientHello, which happens when we are the backend server of a
+	// client-facing server that decrypted it. We don't do any additional
+	// processing of the ClientHello in this case, we only send the
+	// acceptance confirmation.
+	inner bool
+}
+
+// parseECHExt parses the encrypted_client_hello extension of a ClientHello.
+// See draft-ietf-tls-esni, Section 5.
+func parseECHExt(ext []byte) (echType echExtType, cs echCipher, configID uint8, encap []byte, payload []byte, err error) {
+	s := cryptobyte.String(ext)
+	var echInt uint8
+	if !s.ReadUint8(&echInt) {
+		return 0, echCipher{}, 0, nil, nil, errMalformedECHExt
+	}
+	echType = echExtType(echInt)
+	if echType == innerECHExt {
+		if !s.Empty() {
+			return 0, echCipher{}, 0, nil, nil, errMalformedECHExt
+		}
+		return echType, echCipher{}, 0, nil, nil, nil
+	}
+	if echType != outerECHExt {
+		return 0, echCipher{}, 0, nil, nil, errInvalidECHExt
+	}
+	if !s.ReadUint16(&cs.KDFID) ||
+		!s.ReadUint16(&cs.AEADID) ||
+		!s.ReadUint8(&configID) ||
+		!readUint16LengthPrefixed(&s, &encap) ||
+		!readUint16LengthPrefixed(&s, &payload) ||
+		!s.Empty() {
+		return 0, echCipher{}, 0, nil, nil, errMalformedECHExt
+	}
+	// Clone encap and payload so that they do not alias the raw extension.
+	return echType, cs, configID, bytes.Clone(encap), bytes.Clone(payload), nil
+}
+
+// processECHClientHello returns the ClientHello to use for the rest of the
+// handshake, which is the decrypted inner ClientHello if one of echKeys is
+// able to decrypt it, and the ECH state, which is nil if ECH was rejected.
+func (c *Conn) processECHClientHello(outer *clientHelloMsg, echKeys []EncryptedClientHelloKey) (*clientHelloMsg, *echServerContext, error) {
+	echType, echCiphersuite, configID, encap, payload, err := parseECHExt(outer.encryptedClientHello)
+	if err != nil {
+		if errors.Is(err, errInvalidECHExt) {
+			c.sendAlert(alertIllegalParameter)
+		} else {
+			c.sendAlert(alertDecodeError)
+		}
+		return nil, nil, errInvalidECHExt
+	}
+
+	if echType == innerECHExt {
+		return outer, &echServerContext{inner: true}, nil
+	}
+
+	if _, ok := hpke.SupportedKDFs[echCiphersuite.KDFID]; !ok {
+		return outer, nil, nil
+	}
+	if _, ok := hpke.SupportedAEADs[echCiphersuite.AEADID]; !ok {
+		return outer, nil, nil
+	}
+
+	for _, echKey := range echKeys {
+		skip, config, err := parseECHConfig(echKey.Config)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, nil, fmt.Errorf("tls: invalid EncryptedClientHelloKey Config: %s", err)
+		}
+		if skip {
+			continue
+		}
+		echPriv, err := hpke.ParseHPKEPrivateKey(config.KemID, echKey.PrivateKey)
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, nil, fmt.Errorf("tls: invalid EncryptedClientHelloKey PrivateKey: %s", err)
+		}
+		info := append([]byte("tls ech\x00"), echKey.Config...)
+		hpkeContext, err := hpke.SetupRecipient(config.KemID, echCiphersuite.KDFID, echCiphersuite.AEADID, echPriv, info, encap)
+		if err != nil {
+			// Attempt the next trial decryption.
+			continue
+		}
+		encodedInner, err := decryptECHPayload(hpkeContext, outer.raw, payload)
+		if err != nil {
+			// Attempt the next trial decryption.
+			continue
+		}
+
+		// We do not enforce that the outer server_name matches the config
+		// public_name, since the client already had to know the config in
+		// order to encrypt the payload. This is only a MAY in the spec.
+
+		inner, err := decodeInnerClientHello(outer, encodedInner)
+		if err != nil {
+			c.sendAlert(alertIllegalParameter)
+			return nil, nil, errInvalidECHExt
+		}
+
+		c.echAccepted = true
+		return inner, &echServerContext{
+			hpkeContext: hpkeContext,
+			configID:    configID,
+			ciphersuite: echCiphersuite,
+		}, nil
+	}
+
+	return outer, nil, nil
+}
+
+// decryptECHPayload decrypts the payload of the encrypted_client_hello
+// extension of the marshaled outer ClientHello hello, which is authenticated
+// with the payload replaced by zeros.
+func decryptECHPayload(context *hpke.Recipient, hello, payload []byte) ([]byte, error) {
+	outerAAD := bytes.Replace(hello[4:], payload, make([]byte, len(payload)), 1)
+	return context.Open(outerAAD, payload)
+}
+
+type rawExtension struct {
+	extType uint16
+	data    []byte
+}
+
+// extractRawExtensions returns the extensions of the marshaled hello, in
+// the order they appear.
+func extractRawExtensions(hello *clientHelloMsg) ([]rawExtension, error) {
+	s := cryptobyte.String(hello.raw)
+	var skip cryptobyte.String
+	if !s.Skip(4+2+32) || // header, version, random
+		!s.ReadUint8LengthPrefixed(&skip) || // session ID
+		!s.ReadUint16LengthPrefixed(&skip) || // cipher suites
+		!s.ReadUint8LengthPrefixed(&skip) { // compression methods
+		return nil, errors.New("tls: malformed outer client hello")
+	}
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("tls: malformed outer client hello")
+	}
+	var rawExtensions []rawExtension
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) ||
+			!extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, errors.New("tls: malformed outer client hello")
+		}
+		rawExtensions = append(rawExtensions, rawExtension{extension, extData})
+	}
+	return rawExtensions, nil
+}
+
+// decodeInnerClientHello reconstructs the inner ClientHello from the
+// EncodedClientHelloInner, copying the legacy_session_id and any extension
+// referenced by ech_outer_extensions from the outer ClientHello. See
+// draft-ietf-tls-esni, Section 5.1.
+func decodeInnerClientHello(outer *clientHelloMsg, encoded []byte) (*clientHelloMsg, error) {
+	innerReader := cryptobyte.String(encoded)
+	var versionAndRandom, sessionID, cipherSuites, compressionMethods []byte
+	var extensions cryptobyte.String
+	if !innerReader.ReadBytes(&versionAndRandom, 2+32) ||
+		!readUint8LengthPrefixed(&innerReader, &sessionID) ||
+		len(sessionID) != 0 ||
+		!readUint16LengthPrefixed(&innerReader, &cipherSuites) ||
+		!readUint8LengthPrefixed(&innerReader, &compressionMethods) ||
+		!innerReader.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("tls: invalid inner client hello")
+	}
+
+	// The padding must be all zeros.
+	for _, p := range innerReader {
+		if p != 0 {
+			return nil, errors.New("tls: invalid inner client hello")
+		}
+	}
+
+	rawOuterExts, err := extractRawExtensions(outer)
+	if err != nil {
+		return nil, err
+	}
+
+	recon := cryptobyte.NewBuilder(nil)
+	recon.AddUint8(typeClientHello)
+	recon.AddUint24LengthPrefixed(func(recon *cryptobyte.Builder) {
+		recon.AddBytes(versionAndRandom)
+		recon.AddUint8LengthPrefixed(func(recon *cryptobyte.Builder) {
+			recon.AddBytes(outer.sessionId)
+		})
+		recon.AddUint16LengthPrefixed(func(recon *cryptobyte.Builder) {
+			recon.AddBytes(cipherSuites)
+		})
+		recon.AddUint8LengthPrefixed(func(recon *cryptobyte.Builder) {
+			recon.AddBytes(compressionMethods)
+		})
+		recon.AddUint16LengthPrefixed(func(recon *cryptobyte.Builder) {
+			for !extensions.Empty() {
+				var extension uint16
+				var extData cryptobyte.String
+				if !extensions.ReadUint16(&extension) ||
+					!extensions.ReadUint16LengthPrefixed(&extData) {
+					recon.SetError(errors.New("tls: invalid inner client hello"))
+					return
+				}
+				if extension != extensionECHOuterExtensions {
+					recon.AddUint16(extension)
+					recon.AddUint16LengthPrefixed(func(recon *cryptobyte.Builder) {
+						recon.AddBytes(extData)
+					})
+					continue
+				}
+				// The referenced extensions must appear in the outer
+				// ClientHello in the same order.
+				var outerExts cryptobyte.String
+				if !extData.ReadUint8LengthPrefixed(&outerExts) || !extData.Empty() {
+					recon.SetError(errors.New("tls: invalid inner client hello"))
+					return
+				}
+				var i int
+				for !outerExts.Empty() {
+					var extType uint16
+					if !outerExts.ReadUint16(&extType) {
+						recon.SetError(errors.New("tls: invalid inner client hello"))
+						return
+					}
+					if extType == extensionEncryptedClientHello {
+						recon.SetError(errors.New("tls: invalid outer extensions"))
+						return
+					}
+					for ; i < len(rawOuterExts) && rawOuterExts[i].extType != extType; i++ {
+					}
+					if i == len(rawOuterExts) {
+						recon.SetError(errors.New("tls: invalid outer extensions"))
+						return
+					}
+					recon.AddUint16(rawOuterExts[i].extType)
+					recon.AddUint16LengthPrefixed(func(recon *cryptobyte.Builder) {
+						recon.AddBytes(rawOuterExts[i].data)
+					})
+					i++
+				}
+			}
+		})
+	})
+
+	reconBytes, err := recon.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	inner := &clientHelloMsg{}
+	if !inner.unmarshal(reconBytes) {
+		return nil, errors.New("tls: invalid reconstructed inner client hello")
+	}
+
+	if !bytes.Equal(inner.encryptedClientHello, []byte{uint8(innerECHExt)}) {
+		return nil, errInvalidECHExt
+	}
+
+	hasTLS13 := false
+	for _, v := range inner.supportedVersions {
+		if isGREASEValue(v) {
+			continue
+		}
+		if v < VersionTLS13 {
+			return nil, errors.New("tls: client sent encrypted_client_hello extension with unsupported versions")
+		}
+		if v == VersionTLS13 {
+			hasTLS13 = true
+		}
+	}
+	if !hasTLS13 {
+		return nil, errors.New("tls: client sent encrypted_client_hello extension but did not offer TLS 1.3")
+	}
+
+	return inner, nil
+}
+
+// buildRetryConfigList returns the ECHConfigList containing the configs of
+// the keys with SendAsRetry set, or nil if there are none.
+func buildRetryConfigList(keys []EncryptedClientHelloKey) ([]byte, error) {
+	var retryKeys []EncryptedClientHelloKey
+	for _, key := range keys {
+		if key.SendAsRetry {
+			retryKeys = append(retryKeys, key)
+		}
+	}
+	if len(retryKeys) == 0 {
+		return nil, nil
+	}
+	return MarshalEncryptedClientHelloConfigList(retryKeys)
+}
+
+// processECHHelloRetryRequest adds the ECH acceptance confirmation to the
+// HelloRetryRequest. See draft-ietf-tls-esni, Section 7.2.1.
+func (hs *serverHandshakeStateTLS13) processECHHelloRetryRequest(helloRetryRequest *serverHelloMsg) error {
+	helloRetryRequest.encryptedClientHello = make([]byte, 8)
+	confTranscript := cloneHash(hs.transcript, hs.suite.hash)
+	if confTranscript == nil {
+		hs.c.sendAlert(alertInternalError)
+		return errors.New("tls: internal error: failed to clone hash")
+	}
+	if err := transcriptMsg(helloRetryRequest, confTranscript); err != nil {
+		return err
+	}
+	helloRetryRequest.encryptedClientHello = echAcceptConfirmation(hs.suite,
+		hs.clientHello.random, "hrr ech accept confirmation", confTranscript)
+	helloRetryRequest.raw = nil
+	return nil
+}
+
+// processECHSecondClientHello returns the ClientHello to use after a
+// HelloRetryRequest, decrypting it if ECH was accepted in the first one.
+func (hs *serverHandshakeStateTLS13) processECHSecondClientHello(clientHello *clientHelloMsg) (*clientHelloMsg, error) {
+	c := hs.c
+
+	if len(clientHello.encryptedClientHello) == 0 {
+		c.sendAlert(alertMissingExtension)
+		return nil, errors.New("tls: second client hello missing encrypted client hello extension")
+	}
+
+	echType, echCiphersuite, configID, encap, payload, err := parseECHExt(clientHello.encryptedClientHello)
+	if err != nil {
+		c.sendAlert(alertDecodeError)
+		return nil, errInvalidECHExt
+	}
+
+	if echType == outerECHExt && hs.echContext.inner || echType == innerECHExt && !hs.echContext.inner {
+		c.sendAlert(alertDecodeError)
+		return nil, errors.New("tls: unexpected switch in encrypted client hello extension type")
+	}
+	if echType == innerECHExt {
+		return clientHello, nil
+	}
+
+	if echCiphersuite != hs.echContext.ciphersuite || configID != hs.echContext.configID || len(encap) != 0 {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errors.New("tls: second client hello encrypted client hello extension does not match")
+	}
+
+	encodedInner, err := decryptECHPayload(hs.echContext.hpkeContext, clientHello.raw, payload)
+	if err != nil {
+		c.sendAlert(alertDecryptError)
+		return nil, errors.New("tls: failed to decrypt second client hello encrypted client hello extension payload")
+	}
+
+	inner, err := decodeInnerClientHello(clientHello, encodedInner)
+	if err != nil {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errInvalidECHExt
+	}
+	return inner, nil
+}
+
+// setECHAcceptConfirmation sets the last eight bytes of the ServerHello
+// random to the ECH acceptance confirmation. See draft-ietf-tls-esni,
+// Section 7.2.
+func (hs *serverHandshakeStateTLS13) setECHAcceptConfirmation() error {
+	copy(hs.hello.random[32-8:], make([]byte, 8))
+	hs.hello.raw = nil
+	echTranscript := cloneHash(hs.transcript, hs.suite.hash)
+	if echTranscript == nil {
+		hs.c.sendAlert(alertInternalError)
+		return errors.New("tls: internal error: failed to clone hash")
+	}
+	if err := transcriptMsg(hs.clientHello, echTranscript); err != nil {
+		return err
+	}
+	if err := transcriptMsg(hs.hello, echTranscript); err != nil {
+		return err
+	}
+	copy(hs.hello.random[32-8:], echAcceptConfirmation(hs.suite,
+		hs.clientHello.random, "ech accept confirmation", echTranscript))
+	hs.hello.raw = nil
+	return nil
+}
+
+// echRetryConfigs returns the retry configs to send in EncryptedExtensions,
+// if the client offered ECH and we did not accept it.
+func (hs *serverHandshakeStateTLS13) echRetryConfigs() ([]byte, error) {
+	c := hs.c
+	if hs.echContext != nil || len(hs.clientHello.encryptedClientHello) == 0 {
+		return nil, nil
+	}
+	echKeys := c.config.EncryptedClientHelloKeys
+	if c.config.GetEncryptedClientHelloKeys != nil {
+		var err error
+		echKeys, err = c.config.GetEncryptedClientHelloKeys(clientHelloInfo(hs.ctx, c, hs.clientHello))
+		if err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, c.callbackError(err)
+		}
+	}
+	retryConfigs, err := buildRetryConfigList(echKeys)
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return nil, err
+	}
+	return retryConfigs, nil
+}
@@ -0,0 +1,717 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooni/oocrypto/internal/hpke"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testECHConfig returns an ECHConfig using DHKEM(X25519, HKDF-SHA256),
+// HKDF-SHA256, and AES-128-GCM with the given public key.
+func testECHConfig(t *testing.T, id uint8, publicName string, publicKey []byte) []byte {
+	t.Helper()
+	var b cryptobyte.Builder
+	b.AddUint16(extensionEncryptedClientHello)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(hpke.DHKEM_X25519_HKDF_SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(hpke.KDF_HKDF_SHA256)
+			b.AddUint16(hpke.AEAD_AES_128_GCM)
+		})
+		b.AddUint8(32) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // extensions
+	})
+	return b.BytesOrPanic()
+}
+
+// testECHConfigList returns an ECHConfigList containing the given configs.
+func testECHConfigList(configs ...[]byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, config := range configs {
+			b.AddBytes(config)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+func testECHKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestParseECHConfigList(t *testing.T) {
+	key := testECHKey(t).PublicKey().Bytes()
+	valid := testECHConfig(t, 1, "public.example", key)
+	unknownVersion := []byte{0xfe, 0x0a, 0x00, 0x02, 0xaa, 0xbb}
+
+	configs, err := parseECHConfigList(testECHConfigList(unknownVersion, valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("got %d configs, want 1", len(configs))
+	}
+	ec := configs[0]
+	if !bytes.Equal(ec.raw, valid) || ec.ConfigID != 1 || string(ec.PublicName) != "public.example" ||
+		!bytes.Equal(ec.PublicKey, key) || ec.MaxNameLength != 32 || len(ec.SymmetricCipherSuite) != 1 {
+		t.Errorf("unexpected config: %+v", ec)
+	}
+
+	for _, malformed := range [][]byte{
+		nil,
+		{0x00},
+		{0x00, 0x05, 0xfe, 0x0d},
+		append(testECHConfigList(valid), 0),
+		testECHConfigList(valid[:len(valid)-1]),
+	} {
+		if _, err := parseECHConfigList(malformed); err == nil {
+			t.Errorf("expected an error parsing %x", malformed)
+		}
+	}
+}
+
+func TestPickECHConfig(t *testing.T) {
+	key := testECHKey(t).PublicKey().Bytes()
+	parse := func(config []byte) []echConfig {
+		configs, err := parseECHConfigList(testECHConfigList(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return configs
+	}
+
+	badName := parse(testECHConfig(t, 1, "localhost", key))
+	if ec, _ := pickECHConfig(badName); ec != nil {
+		t.Error("picked a config with an invalid public name")
+	}
+	badKEM := parse(testECHConfig(t, 2, "public.example", key))
+	badKEM[0].KemID = 0x0010 // DHKEM(P-256, HKDF-SHA256)
+	if ec, _ := pickECHConfig(badKEM); ec != nil {
+		t.Error("picked a config with an unsupported KEM")
+	}
+	mandatory := parse(testECHConfig(t, 3, "public.example", key))
+	mandatory[0].Extensions = []echExtension{{Type: 0xfaaa}}
+	if ec, _ := pickECHConfig(mandatory); ec != nil {
+		t.Error("picked a config with a mandatory extension")
+	}
+	badSuite := parse(testECHConfig(t, 4, "public.example", key))
+	badSuite[0].SymmetricCipherSuite = []echCipher{{KDFID: 0xff, AEADID: hpke.AEAD_AES_128_GCM}, {KDFID: hpke.KDF_HKDF_SHA384, AEADID: hpke.AEAD_ChaCha20Poly1305}}
+
+	list := append(append(append(badName, badKEM...), mandatory...), badSuite...)
+	ec, cs := pickECHConfig(list)
+	if ec == nil || ec.ConfigID != 4 {
+		t.Fatalf("expected to pick the last config, got %+v", ec)
+	}
+	if cs.KDFID != hpke.KDF_HKDF_SHA384 || cs.AEADID != hpke.AEAD_ChaCha20Poly1305 {
+		t.Errorf("picked an unsupported cipher suite %+v", cs)
+	}
+}
+
+// echTestClientHello returns the outer ClientHello sent by a client using
+// the given ECHConfig, along with the client's ECH state.
+func echTestClientHello(t *testing.T, config *Config) (*clientHelloMsg, *echClientContext) {
+	t.Helper()
+	c := &Conn{config: config}
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ech, err := c.newECHClientContext(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ech.splitClientHello(c, hello); err != nil {
+		t.Fatal(err)
+	}
+	return hello, ech
+}
+
+func TestECHClientHello(t *testing.T) {
+	key := testECHKey(t)
+	echConfig := testECHConfig(t, 7, "public.example", key.PublicKey().Bytes())
+	chrome, err := ClientHelloPreset(PresetChrome102)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []*ClientHelloSpec{nil, chrome} {
+		config := testConfig.Clone()
+		config.Rand = rand.Reader
+		config.MinVersion = 0
+		config.ServerName = "secret.example"
+		config.ClientHelloSpec = spec
+		config.EncryptedClientHelloConfigList = testECHConfigList(echConfig)
+		hello, ech := echTestClientHello(t, config)
+
+		outerBytes, err := hello.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outer clientHelloMsg
+		if !outer.unmarshal(outerBytes) {
+			t.Fatal("cannot unmarshal the outer ClientHello")
+		}
+		if outer.serverName != "public.example" {
+			t.Errorf("outer ClientHello has server name %q", outer.serverName)
+		}
+		if bytes.Equal(outer.random, ech.innerHello.random) {
+			t.Error("the inner and outer ClientHello have the same random")
+		}
+		for _, vers := range outer.supportedVersions {
+			// The Chrome preset explicitly offers TLS 1.2, as Chrome does.
+			if spec == nil && vers < VersionTLS13 && !isGREASEValue(vers) {
+				t.Errorf("the outer ClientHello offers version %x", vers)
+			}
+		}
+
+		s := cryptobyte.String(outer.encryptedClientHello)
+		var echType, configID uint8
+		var kdfID, aeadID uint16
+		var enc, payload []byte
+		if !s.ReadUint8(&echType) || !s.ReadUint16(&kdfID) || !s.ReadUint16(&aeadID) ||
+			!s.ReadUint8(&configID) || !readUint16LengthPrefixed(&s, &enc) ||
+			!readUint16LengthPrefixed(&s, &payload) || !s.Empty() {
+			t.Fatal("malformed encrypted_client_hello extension")
+		}
+		if echType != 0 || configID != 7 || kdfID != hpke.KDF_HKDF_SHA256 || aeadID != hpke.AEAD_AES_128_GCM {
+			t.Errorf("unexpected encrypted_client_hello extension %x", outer.encryptedClientHello)
+		}
+
+		info := append([]byte("tls ech\x00"), echConfig...)
+		recipient, err := hpke.SetupRecipient(hpke.DHKEM_X25519_HKDF_SHA256, kdfID, aeadID, key, info, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aad := bytes.Replace(outerBytes[4:], payload, make([]byte, len(payload)), 1)
+		encoded, err := recipient.Open(aad, payload)
+		if err != nil {
+			t.Fatalf("cannot decrypt the inner ClientHello: %v", err)
+		}
+		if len(encoded)%32 != 0 {
+			t.Errorf("the encoded inner ClientHello is not padded: %d bytes", len(encoded))
+		}
+
+		// Rebuild the inner ClientHello using the outer session ID.
+		innerBytes, err := ech.innerHello.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionID := outer.sessionId
+		want := append([]byte{}, innerBytes[4:38]...)
+		want = append(want, 0)
+		want = append(want, innerBytes[39+len(sessionID):]...)
+		if !bytes.Equal(encoded[:len(want)], want) || !bytes.Equal(encoded[len(want):], make([]byte, len(encoded)-len(want))) {
+			t.Fatal("the encrypted inner ClientHello does not match")
+		}
+		var inner clientHelloMsg
+		if !inner.unmarshal(innerBytes) {
+			t.Fatal("cannot unmarshal the inner ClientHello")
+		}
+		if inner.serverName != "secret.example" || !bytes.Equal(inner.encryptedClientHello, []byte{1}) ||
+			!bytes.Equal(inner.sessionId, sessionID) {
+			t.Errorf("unexpected inner ClientHello: server name %q, encrypted_client_hello %x",
+				inner.serverName, inner.encryptedClientHello)
+		}
+	}
+}
+
+func TestECHClientConfigErrors(t *testing.T) {
+	key := testECHKey(t)
+	config := testConfig.Clone()
+	config.ServerName = "secret.example"
+	config.EncryptedClientHelloConfigList = testECHConfigList(testECHConfig(t, 1, "public.example", key.PublicKey().Bytes()))
+	for _, tt := range []struct {
+		name string
+		edit func(*Config)
+		want string
+	}{
+		{"MinVersion", func(c *Config) { c.MinVersion = VersionTLS12 }, "MinVersion"},
+		{"MaxVersion", func(c *Config) { c.MinVersion, c.MaxVersion = 0, VersionTLS12 }, "no supported versions"},
+		{"Malformed", func(c *Config) { c.MinVersion, c.EncryptedClientHelloConfigList = 0, []byte{1} }, "malformed"},
+		{"NoValidConfigs", func(c *Config) {
+			c.MinVersion = 0
+			c.EncryptedClientHelloConfigList = testECHConfigList(testECHConfig(t, 1, "localhost", key.PublicKey().Bytes()))
+		}, "no valid configs"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := config.Clone()
+			tt.edit(clientConfig)
+			c := &Conn{config: clientConfig}
+			hello, _, err := c.makeClientHello()
+			if err == nil {
+				_, err = c.newECHClientContext(hello)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestECHAcceptConfirmation checks how the client processes a ServerHello
+// from a server that accepts ECH, which we emulate here by computing the
+// acceptance confirmation as a server would.
+func TestECHAcceptConfirmation(t *testing.T) {
+	key := testECHKey(t)
+	config := testConfig.Clone()
+	config.Rand = rand.Reader
+	config.MinVersion = 0
+	config.ServerName = "secret.example"
+	config.EncryptedClientHelloConfigList = testECHConfigList(testECHConfig(t, 1, "public.example", key.PublicKey().Bytes()))
+
+	for _, accept := range []bool{true, false} {
+		outer, ech := echTestClientHello(t, config)
+		c := &Conn{config: config, serverName: outer.serverName}
+		suite := cipherSuiteTLS13ByID(TLS_AES_128_GCM_SHA256)
+		hs := &clientHandshakeStateTLS13{
+			c:          c,
+			hello:      outer,
+			suite:      suite,
+			transcript: suite.hash.New(),
+			echContext: ech,
+		}
+		ech.innerTranscript = suite.hash.New()
+		if err := transcriptMsg(ech.innerHello, ech.innerTranscript); err != nil {
+			t.Fatal(err)
+		}
+
+		serverHello := &serverHelloMsg{
+			vers:             VersionTLS12,
+			random:           make([]byte, 32),
+			sessionId:        outer.sessionId,
+			cipherSuite:      suite.id,
+			supportedVersion: VersionTLS13,
+			serverShare:      keyShare{group: X25519, data: make([]byte, 32)},
+		}
+		rand.Read(serverHello.random[:24])
+		if accept {
+			raw, err := serverHello.marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			transcript := cloneHash(ech.innerTranscript, suite.hash)
+			transcript.Write(raw)
+			copy(serverHello.random[24:], echAcceptConfirmation(suite, ech.innerHello.random, "ech accept confirmation", transcript))
+			serverHello.raw = nil
+		}
+		if _, err := serverHello.marshal(); err != nil {
+			t.Fatal(err)
+		}
+		hs.serverHello = serverHello
+
+		if err := hs.processECHServerHello(); err != nil {
+			t.Fatal(err)
+		}
+		if c.echAccepted != accept || ech.echRejected == accept {
+			t.Fatalf("accept=%v: got echAccepted %v, echRejected %v", accept, c.echAccepted, ech.echRejected)
+		}
+		if accept && (hs.hello != ech.innerHello || hs.transcript != ech.innerTranscript || c.serverName != "secret.example") {
+			t.Error("the handshake did not switch to the inner ClientHello")
+		}
+		if !accept && (hs.hello != outer || c.serverName != "public.example") {
+			t.Error("the handshake switched to the inner ClientHello")
+		}
+	}
+}
+
+// echRejectionHandshake runs a handshake between an ECH client and a server
+// that does not support ECH, returning the client and server errors.
+func echRejectionHandshake(t *testing.T, clientConfig, serverConfig *Config) (clientErr, serverErr error) {
+	t.Helper()
+	c, s := localPipe(t)
+	done := make(chan error)
+	go func() {
+		server := Server(s, serverConfig)
+		err := server.Handshake()
+		if err == nil {
+			// The client sends the ech_required alert after its Finished
+			// message, so the server only sees it after the handshake.
+			_, err = server.Read(make([]byte, 1))
+		}
+		s.Close()
+		done <- err
+	}()
+	client := Client(c, clientConfig)
+	clientErr = client.Handshake()
+	c.Close()
+	return clientErr, <-done
+}
+
+func TestECHRejected(t *testing.T) {
+	issuer, err := x509.ParseCertificate(testRSACertificateIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(issuer)
+	now := func() time.Time { return time.Unix(1476984729, 0) }
+
+	key := testECHKey(t)
+	newClientConfig := func(publicName string) *Config {
+		config := testConfig.Clone()
+		config.Time = now
+		config.RootCAs = rootCAs
+		config.InsecureSkipVerify = false
+		config.MinVersion = 0
+		config.ServerName = "secret.example"
+		config.EncryptedClientHelloConfigList = testECHConfigList(testECHConfig(t, 1, publicName, key.PublicKey().Bytes()))
+		return config
+	}
+
+	var sni string
+	serverConfig := testConfig.Clone()
+	serverConfig.Time = now
+	serverConfig.ClientAuth = RequestClientCert
+	serverConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+		sni = chi.ServerName
+		return nil, nil
+	}
+
+	t.Run("Verified", func(t *testing.T) {
+		clientConfig := newClientConfig("example.golang")
+		clientConfig.VerifyConnection = func(ConnectionState) error {
+			return errors.New("VerifyConnection must not be called")
+		}
+		clientConfig.Certificates = testConfig.Certificates[:1]
+		clientErr, serverErr := echRejectionHandshake(t, clientConfig, serverConfig)
+		var echErr *ECHRejectionError
+		if !errors.As(clientErr, &echErr) {
+			t.Fatalf("expected an ECHRejectionError, got %v", clientErr)
+		}
+		if echErr.RetryConfigList != nil {
+			t.Errorf("unexpected retry configs %x", echErr.RetryConfigList)
+		}
+		if serverErr == nil || !strings.Contains(serverErr.Error(), "encrypted client hello required") {
+			t.Errorf("expected an ech_required alert, got %v", serverErr)
+		}
+		if sni != "example.golang" {
+			t.Errorf("the server saw server name %q", sni)
+		}
+	})
+
+	t.Run("WrongPublicName", func(t *testing.T) {
+		clientErr, _ := echRejectionHandshake(t, newClientConfig("public.example"), serverConfig)
+		var certErr *CertificateVerificationError
+		if !errors.As(clientErr, &certErr) {
+			t.Fatalf("expected a CertificateVerificationError, got %v", clientErr)
+		}
+	})
+
+	t.Run("RejectionVerify", func(t *testing.T) {
+		clientConfig := newClientConfig("public.example")
+		var called bool
+		clientConfig.EncryptedClientHelloRejectionVerify = func(cs ConnectionState) error {
+			called = true
+			if len(cs.PeerCertificates) != 1 || cs.ServerName != "public.example" {
+				t.Errorf("unexpected ConnectionState: %d certificates, server name %q", len(cs.PeerCertificates), cs.ServerName)
+			}
+			return nil
+		}
+		clientErr, _ := echRejectionHandshake(t, clientConfig, serverConfig)
+		var echErr *ECHRejectionError
+		if !errors.As(clientErr, &echErr) {
+			t.Fatalf("expected an ECHRejectionError, got %v", clientErr)
+		}
+		if !called {
+			t.Error("EncryptedClientHelloRejectionVerify was not called")
+		}
+	})
+}
+
+func TestGenerateEncryptedClientHelloKey(t *testing.T) {
+	key, err := GenerateEncryptedClientHelloKey(nil, 7, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.SendAsRetry {
+		t.Error("the generated key does not have SendAsRetry set")
+	}
+	list, err := MarshalEncryptedClientHelloConfigList([]EncryptedClientHelloKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := parseECHConfigList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, cs := pickECHConfig(configs)
+	if ec == nil {
+		t.Fatal("the generated config is not usable")
+	}
+	if ec.ConfigID != 7 || string(ec.PublicName) != "public.example" || !bytes.Equal(ec.raw, key.Config) ||
+		cs != (echCipher{hpke.KDF_HKDF_SHA256, hpke.AEAD_AES_128_GCM}) {
+		t.Errorf("unexpected config: %+v", ec)
+	}
+	priv, err := hpke.ParseHPKEPrivateKey(ec.KemID, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(priv.PublicKey().Bytes(), ec.PublicKey) {
+		t.Error("the private key does not match the config public key")
+	}
+
+	if _, err := GenerateEncryptedClientHelloKey(nil, 1, "localhost"); err == nil {
+		t.Error("expected an error generating a key with an invalid public name")
+	}
+	if _, err := MarshalEncryptedClientHelloConfigList([]EncryptedClientHelloKey{{Config: key.Config[1:]}}); err == nil {
+		t.Error("expected an error marshaling a malformed config")
+	}
+}
+
+// newECHTestConfigs returns a client and a server Config that negotiate ECH,
+// with the inner server name "example.golang", which matches the server
+// certificate, and the public name "public.example". The server fails the
+// handshake if it selects a certificate for any other name.
+func newECHTestConfigs(t *testing.T) (clientConfig, serverConfig *Config) {
+	t.Helper()
+	issuer, err := x509.ParseCertificate(testRSACertificateIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateEncryptedClientHelloKey(nil, 1, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configList, err := MarshalEncryptedClientHelloConfigList([]EncryptedClientHelloKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig = testConfig.Clone()
+	serverConfig.Time = testTime
+	serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{key}
+	serverConfig.GetCertificate = func(chi *ClientHelloInfo) (*Certificate, error) {
+		if chi.ServerName != "example.golang" {
+			return nil, errors.New("unexpected server name " + chi.ServerName)
+		}
+		return &testConfig.Certificates[0], nil
+	}
+
+	clientConfig = testConfig.Clone()
+	clientConfig.Time = testTime
+	clientConfig.RootCAs = x509.NewCertPool()
+	clientConfig.RootCAs.AddCert(issuer)
+	clientConfig.InsecureSkipVerify = false
+	clientConfig.MinVersion = 0
+	clientConfig.ServerName = "example.golang"
+	clientConfig.EncryptedClientHelloConfigList = configList
+	return clientConfig, serverConfig
+}
+
+func TestECHAccepted(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		setup func(clientConfig, serverConfig *Config)
+	}{
+		{"Default", func(clientConfig, serverConfig *Config) {}},
+		{"HelloRetryRequest", func(clientConfig, serverConfig *Config) {
+			serverConfig.CurvePreferences = []CurveID{CurveP256}
+		}},
+		{"ClientHelloSpec", func(clientConfig, serverConfig *Config) {
+			clientConfig.ClientHelloSpec, _ = ClientHelloPreset(PresetChrome102)
+		}},
+		{"GREASE", func(clientConfig, serverConfig *Config) {
+			clientConfig.GREASE = true
+		}},
+		{"GetEncryptedClientHelloKeys", func(clientConfig, serverConfig *Config) {
+			keys := serverConfig.EncryptedClientHelloKeys
+			serverConfig.EncryptedClientHelloKeys = nil
+			serverConfig.GetEncryptedClientHelloKeys = func(chi *ClientHelloInfo) ([]EncryptedClientHelloKey, error) {
+				if chi.ServerName != "public.example" {
+					t.Errorf("GetEncryptedClientHelloKeys got server name %q", chi.ServerName)
+				}
+				return keys, nil
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientConfig, serverConfig := newECHTestConfigs(t)
+			test.setup(clientConfig, serverConfig)
+			ss, cs, err := testHandshake(t, clientConfig, serverConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ss.ECHAccepted || !cs.ECHAccepted {
+				t.Errorf("got ECHAccepted %v on the server and %v on the client", ss.ECHAccepted, cs.ECHAccepted)
+			}
+			if ss.ServerName != "example.golang" || cs.ServerName != "example.golang" {
+				t.Errorf("got server name %q on the server and %q on the client", ss.ServerName, cs.ServerName)
+			}
+			if cs.Version != VersionTLS13 {
+				t.Errorf("got version %x", cs.Version)
+			}
+		})
+	}
+}
+
+func TestECHRetryConfigs(t *testing.T) {
+	clientConfig, serverConfig := newECHTestConfigs(t)
+	// The client uses a stale config, with the public name matching the
+	// server certificate, so that it is able to authenticate the rejection.
+	staleKey, err := GenerateEncryptedClientHelloKey(nil, 1, "example.golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.EncryptedClientHelloConfigList, err = MarshalEncryptedClientHelloConfigList([]EncryptedClientHelloKey{staleKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notRetry, err := GenerateEncryptedClientHelloKey(nil, 2, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notRetry.SendAsRetry = false
+	serverConfig.EncryptedClientHelloKeys = append(serverConfig.EncryptedClientHelloKeys, notRetry)
+
+	clientErr, serverErr := echRejectionHandshake(t, clientConfig, serverConfig)
+	var echErr *ECHRejectionError
+	if !errors.As(clientErr, &echErr) {
+		t.Fatalf("expected an ECHRejectionError, got %v", clientErr)
+	}
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "encrypted client hello required") {
+		t.Errorf("expected an ech_required alert, got %v", serverErr)
+	}
+	want, err := MarshalEncryptedClientHelloConfigList(serverConfig.EncryptedClientHelloKeys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echErr.RetryConfigList, want) {
+		t.Errorf("got retry configs %x, want %x", echErr.RetryConfigList, want)
+	}
+
+	clientConfig.EncryptedClientHelloConfigList = echErr.RetryConfigList
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.ECHAccepted {
+		t.Error("ECH was not accepted using the retry configs")
+	}
+}
+
+func TestECHServerNotOffered(t *testing.T) {
+	_, serverConfig := newECHTestConfigs(t)
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+	ss, _, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.ECHAccepted {
+		t.Error("ECH accepted without the client offering it")
+	}
+}
+
+func TestECHGREASEClientHello(t *testing.T) {
+	config := testConfig.Clone()
+	config.Rand = rand.Reader
+	config.MinVersion = 0
+	config.EncryptedClientHelloGREASE = true
+
+	for _, preset := range []string{"", PresetChrome102} {
+		config.ClientHelloSpec = nil
+		if preset != "" {
+			config.ClientHelloSpec, _ = ClientHelloPreset(preset)
+		}
+		c := &Conn{config: config}
+		hello, _, err := c.makeClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		echType, cs, _, encap, payload, err := parseECHExt(hello.encryptedClientHello)
+		if err != nil {
+			t.Fatalf("%q: %v", preset, err)
+		}
+		if echType != outerECHExt || cs.KDFID != hpke.KDF_HKDF_SHA256 {
+			t.Errorf("%q: unexpected extension type %d, cipher suite %+v", preset, echType, cs)
+		}
+		if _, ok := hpke.SupportedAEADs[cs.AEADID]; !ok {
+			t.Errorf("%q: unexpected AEAD %x", preset, cs.AEADID)
+		}
+		if _, err := hpke.ParseHPKEPublicKey(hpke.DHKEM_X25519_HKDF_SHA256, encap); err != nil {
+			t.Errorf("%q: invalid encapsulated key: %v", preset, err)
+		}
+		if l := len(payload) - 16; l < 128 || l > 224 || l%32 != 0 {
+			t.Errorf("%q: unexpected payload length %d", preset, len(payload))
+		}
+		raw, err := hello.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(raw, hello.encryptedClientHello) {
+			t.Errorf("%q: the marshaled ClientHello does not contain the extension", preset)
+		}
+
+		other, _, err := c.makeClientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(other.encryptedClientHello, hello.encryptedClientHello) {
+			t.Errorf("%q: the extension is not random", preset)
+		}
+	}
+
+	config.ClientHelloSpec = nil
+	config.MaxVersion = VersionTLS12
+	hello, _, err := (&Conn{config: config}).makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.encryptedClientHello != nil {
+		t.Error("sent a GREASE ECH extension without offering TLS 1.3")
+	}
+}
+
+func TestECHGREASEHandshake(t *testing.T) {
+	_, echServerConfig := newECHTestConfigs(t)
+	for _, test := range []struct {
+		name         string
+		serverConfig *Config
+	}{
+		{"NoECH", testConfig},
+		{"ECHKeys", echServerConfig},
+		{"HelloRetryRequest", func() *Config {
+			config := echServerConfig.Clone()
+			config.CurvePreferences = []CurveID{CurveP256}
+			return config
+		}()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientConfig := testConfig.Clone()
+			clientConfig.ServerName = "example.golang"
+			clientConfig.EncryptedClientHelloGREASE = true
+			ss, cs, err := testHandshake(t, clientConfig, test.serverConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ss.ECHAccepted || cs.ECHAccepted {
+				t.Error("ECH accepted with a GREASE extension")
+			}
+			if cs.Version != VersionTLS13 {
+				t.Errorf("got version %x", cs.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package fingerprint computes the JA3, JA3S, JA4, and JA4S fingerprints of
+// TLS ClientHello and ServerHello messages.
+//
+// The messages are parsed by the tls package, whose ClientHelloMessage and
+// ServerHelloMessage Fingerprint methods return the inputs to the
+// fingerprints.
+//
+// See https://github.com/salesforce/ja3 for JA3 and JA3S, and
+// https://github.com/FoxIO-LLC/ja4 for JA4 and JA4S.
+package fingerprint
+
+const (
+	extensionServerName = 0
+	extensionALPN       = 16
+)
+
+// ClientHello contains the fields of a ClientHello message that contribute
+// to its fingerprints. All the lists are in the order of the message and
+// include GREASE values, which the fingerprints ignore.
+type ClientHello struct {
+	// Version is the legacy_version field.
+	Version uint16
+
+	CipherSuites []uint16
+
+	// Extensions lists the types of the extensions.
+	Extensions []uint16
+
+	// ServerName is the host name in the server_name extension.
+	ServerName string
+
+	SupportedGroups     []uint16
+	SupportedPoints     []uint8
+	SignatureAlgorithms []uint16
+	ALPNProtocols       []string
+	SupportedVersions   []uint16
+}
+
+// ServerHello contains the fields of a ServerHello message that contribute
+// to its fingerprints.
+type ServerHello struct {
+	// Version is the legacy_version field.
+	Version uint16
+
+	CipherSuite uint16
+
+	// Extensions lists the types of the extensions, in order.
+	Extensions []uint16
+
+	// SupportedVersion is the version selected by the server in the
+	// supported_versions extension, or zero.
+	SupportedVersion uint16
+
+	// ALPNProtocol is the protocol selected by the server in the ALPN
+	// extension, if any.
+	ALPNProtocol string
+}
+
+// isGREASE reports whether v is one of the GREASE values reserved by RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns the values in list that are not GREASE values.
+func withoutGREASE(list []uint16) []uint16 {
+	var out []uint16
+	for _, v := range list {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
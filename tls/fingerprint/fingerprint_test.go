@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fingerprint
+
+import "testing"
+
+// chromeClientHello has the fields of a ClientHello sent by Chrome, as in
+// the JA4 documentation.
+var chromeClientHello = &ClientHello{
+	Version: 0x0303,
+	CipherSuites: []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+		0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+	Extensions: []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010,
+		0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x3a3a},
+	ServerName:      "example.com",
+	SupportedGroups: []uint16{0x4a4a, 0x001d, 0x0017, 0x0018},
+	SupportedPoints: []uint8{0},
+	SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501,
+		0x0806, 0x0601},
+	ALPNProtocols:     []string{"h2", "http/1.1"},
+	SupportedVersions: []uint16{0x5a5a, 0x0304, 0x0303},
+}
+
+func TestClientHelloJA3(t *testing.T) {
+	want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	if got := chromeClientHello.JA3String(); got != want {
+		t.Errorf("got JA3 string %q, want %q", got, want)
+	}
+	if got, want := chromeClientHello.JA3(), md5Hex(want); got != want || len(got) != 32 {
+		t.Errorf("got JA3 %q, want %q", got, want)
+	}
+}
+
+func TestClientHelloJA4(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(m *ClientHello)
+		want string
+	}{
+		{"Chrome", func(m *ClientHello) {}, "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"NoSNI", func(m *ClientHello) { m.ServerName = "" }, "t13i1516h2_8daaf6152771_e5627efa2ab1"},
+		{"NoALPN", func(m *ClientHello) { m.ALPNProtocols = nil }, "t13d151600_8daaf6152771_e5627efa2ab1"},
+		{"HexALPN", func(m *ClientHello) { m.ALPNProtocols = []string{"\xab\xcd"} }, "t13d1516ad_8daaf6152771_e5627efa2ab1"},
+		{"TLS12", func(m *ClientHello) { m.SupportedVersions = nil }, "t12d1516h2_8daaf6152771_e5627efa2ab1"},
+		{"NoExtensions", func(m *ClientHello) { m.Extensions = nil; m.ServerName = ""; m.ALPNProtocols = nil },
+			"t13i150000_8daaf6152771_000000000000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := *chromeClientHello
+			tc.edit(&m)
+			if got := m.JA4(); got != tc.want {
+				t.Errorf("got JA4 %q, want %q", got, tc.want)
+			}
+		})
+	}
+	if got, want := chromeClientHello.JA4QUIC(), "q13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("got JA4 %q, want %q", got, want)
+	}
+}
+
+func TestServerHelloFingerprints(t *testing.T) {
+	m := &ServerHello{
+		Version:          0x0303,
+		CipherSuite:      0x1301,
+		Extensions:       []uint16{0x0033, 0x002b},
+		SupportedVersion: 0x0304,
+	}
+	if got, want := m.JA3SString(), "771,4865,51-43"; got != want {
+		t.Errorf("got JA3S string %q, want %q", got, want)
+	}
+	if got, want := m.JA3S(), md5Hex("771,4865,51-43"); got != want {
+		t.Errorf("got JA3S %q, want %q", got, want)
+	}
+	if got, want := m.JA4S(), "t130200_1301_234ea6891581"; got != want {
+		t.Errorf("got JA4S %q, want %q", got, want)
+	}
+	m.ALPNProtocol = "h2"
+	m.Extensions = append(m.Extensions, 0x0010)
+	if got, want := m.JA4SQUIC(), "q1303h2_1301_"; got[:len(want)] != want {
+		t.Errorf("got JA4S %q, want prefix %q", got, want)
+	}
+}
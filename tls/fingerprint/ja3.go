@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fingerprint
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// JA3String returns the JA3 string of m, before hashing: the decimal values
+// of the version, cipher suites, extensions, supported groups, and point
+// formats, without GREASE values.
+func (m *ClientHello) JA3String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(m.Version)))
+	b.WriteByte(',')
+	writeDecimalList(&b, withoutGREASE(m.CipherSuites))
+	b.WriteByte(',')
+	writeDecimalList(&b, withoutGREASE(m.Extensions))
+	b.WriteByte(',')
+	writeDecimalList(&b, withoutGREASE(m.SupportedGroups))
+	b.WriteByte(',')
+	for i, p := range m.SupportedPoints {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(p)))
+	}
+	return b.String()
+}
+
+// JA3 returns the JA3 fingerprint of m, the hex-encoded MD5 hash of its
+// JA3String.
+func (m *ClientHello) JA3() string {
+	return md5Hex(m.JA3String())
+}
+
+// JA3SString returns the JA3S string of m, before hashing: the decimal
+// values of the version, cipher suite, and extensions.
+func (m *ServerHello) JA3SString() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(m.Version)))
+	b.WriteByte(',')
+	b.WriteString(strconv.Itoa(int(m.CipherSuite)))
+	b.WriteByte(',')
+	writeDecimalList(&b, withoutGREASE(m.Extensions))
+	return b.String()
+}
+
+// JA3S returns the JA3S fingerprint of m, the hex-encoded MD5 hash of its
+// JA3SString.
+func (m *ServerHello) JA3S() string {
+	return md5Hex(m.JA3SString())
+}
+
+func writeDecimalList(b *strings.Builder, list []uint16) {
+	for i, v := range list {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
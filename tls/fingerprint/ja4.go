@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JA4 returns the JA4 fingerprint of m, for a ClientHello sent over TCP.
+func (m *ClientHello) JA4() string {
+	return m.ja4(false)
+}
+
+// JA4QUIC is like JA4, but for a ClientHello sent over QUIC.
+func (m *ClientHello) JA4QUIC() string {
+	return m.ja4(true)
+}
+
+func (m *ClientHello) ja4(quic bool) string {
+	version := m.Version
+	if versions := withoutGREASE(m.SupportedVersions); len(versions) > 0 {
+		version = versions[0]
+		for _, v := range versions[1:] {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	sni := byte('i')
+	if m.ServerName != "" {
+		sni = 'd'
+	}
+	var alpn string
+	if len(m.ALPNProtocols) > 0 {
+		alpn = m.ALPNProtocols[0]
+	}
+	suites := withoutGREASE(m.CipherSuites)
+	extensions := withoutGREASE(m.Extensions)
+	a := fmt.Sprintf("%c%s%c%02d%02d%s", transport(quic), versionString(version), sni,
+		count(len(suites)), count(len(extensions)), alpnString(alpn))
+
+	sorted := append([]uint16(nil), suites...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	b := truncatedHash(hexList(sorted))
+
+	sorted = sorted[:0]
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sorted = append(sorted, ext)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c := hexList(sorted)
+	if algs := withoutGREASE(m.SignatureAlgorithms); len(algs) > 0 {
+		c += "_" + hexList(algs)
+	}
+	if len(sorted) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+// JA4S returns the JA4S fingerprint of m, for a ServerHello sent over TCP.
+func (m *ServerHello) JA4S() string {
+	return m.ja4s(false)
+}
+
+// JA4SQUIC is like JA4S, but for a ServerHello sent over QUIC.
+func (m *ServerHello) JA4SQUIC() string {
+	return m.ja4s(true)
+}
+
+func (m *ServerHello) ja4s(quic bool) string {
+	version := m.Version
+	if m.SupportedVersion != 0 {
+		version = m.SupportedVersion
+	}
+	extensions := withoutGREASE(m.Extensions)
+	return fmt.Sprintf("%c%s%02d%s_%04x_%s", transport(quic), versionString(version),
+		count(len(extensions)), alpnString(m.ALPNProtocol), m.CipherSuite,
+		truncatedHash(hexList(extensions)))
+}
+
+func transport(quic bool) byte {
+	if quic {
+		return 'q'
+	}
+	return 't'
+}
+
+func versionString(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// count caps the number of cipher suites or extensions at two digits.
+func count(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+// alpnString returns the first and last characters of the ALPN protocol, or
+// of its hex encoding if they are not alphanumeric, or "00" if empty.
+func alpnString(proto string) string {
+	if proto == "" {
+		return "00"
+	}
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(proto))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func hexList(list []uint16) string {
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA-256 hash of
+// s, or twelve zeros if s is empty.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])[:12]
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloFragmentation controls how a client splits its ClientHello
+// across several TLS records. Some middleboxes only inspect the first
+// record of a connection, so fragmenting the ClientHello may hide the
+// server_name from them.
+//
+// The split points from all the fields are combined. Unless
+// Config.ClientHelloSegmentation is set, the records are written to the
+// connection with a single Write call, so how they are split into TCP
+// segments is up to the operating system.
+//
+// Fragmentation applies to every ClientHello, including the one sent after
+// a HelloRetryRequest, and is ignored by QUIC connections.
+type ClientHelloFragmentation struct {
+	// Offsets contains split points, as offsets within the ClientHello
+	// handshake message, including its four bytes header. Offsets that are
+	// not inside the message are ignored.
+	Offsets []int
+
+	// RecordSize, if positive, is the maximum size of each fragment.
+	RecordSize int
+
+	// SplitSNI, when true, adds a split point in the middle of the host
+	// name in the server_name extension, if any.
+	SplitSNI bool
+
+	// RandomSplits is the number of split points chosen at random, using
+	// Config.Rand, for each ClientHello.
+	RandomSplits int
+}
+
+// splitPoints returns the sorted, unique offsets at which to split the
+// marshaled ClientHello data.
+func (f *ClientHelloFragmentation) splitPoints(data []byte, rand io.Reader) ([]int, error) {
+	points := append([]int(nil), f.Offsets...)
+	if f.RecordSize > 0 {
+		for offset := f.RecordSize; offset < len(data); offset += f.RecordSize {
+			points = append(points, offset)
+		}
+	}
+	if f.SplitSNI {
+		if offset, ok := clientHelloSNIOffset(data); ok {
+			points = append(points, offset)
+		}
+	}
+	if f.RandomSplits > 0 && len(data) > 1 {
+		var buf [4]byte
+		for i := 0; i < f.RandomSplits; i++ {
+			if _, err := io.ReadFull(rand, buf[:]); err != nil {
+				return nil, errors.New("tls: short read from Rand: " + err.Error())
+			}
+			points = append(points, 1+int(binary.BigEndian.Uint32(buf[:])%uint32(len(data)-1)))
+		}
+	}
+	sort.Ints(points)
+	var unique []int
+	for _, offset := range points {
+		if offset <= 0 || offset >= len(data) {
+			continue
+		}
+		if len(unique) > 0 && unique[len(unique)-1] == offset {
+			continue
+		}
+		unique = append(unique, offset)
+	}
+	return unique, nil
+}
+
+// clientHelloSNIOffset returns the offset of the middle of the host name in
+// the server_name extension of the marshaled ClientHello data.
+func clientHelloSNIOffset(data []byte) (int, bool) {
+	s := cryptobyte.String(data)
+	var (
+		sessionID, suites, compression cryptobyte.String
+		exts                           cryptobyte.String
+	)
+	if !s.Skip(4) || !s.Skip(2) || !s.Skip(32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&suites) || !s.ReadUint8LengthPrefixed(&compression) ||
+		!s.ReadUint16LengthPrefixed(&exts) {
+		return 0, false
+	}
+	for !exts.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&extData) {
+			return 0, false
+		}
+		if extType != extensionServerName {
+			continue
+		}
+		var nameList, name cryptobyte.String
+		var nameType uint8
+		if !extData.ReadUint16LengthPrefixed(&nameList) || !nameList.ReadUint8(&nameType) ||
+			!nameList.ReadUint16LengthPrefixed(&name) || len(name) < 2 {
+			return 0, false
+		}
+		// The remaining bytes of s, exts, extData, and nameList follow the name.
+		nameStart := len(data) - len(s) - len(exts) - len(extData) - len(nameList) - len(name)
+		return nameStart + len(name)/2, true
+	}
+	return 0, false
+}
+
+// writeFragmentedClientHello writes the marshaled ClientHello data split
+// across several records according to c.config.ClientHelloFragmentation.
+// c.out must be locked.
+func (c *Conn) writeFragmentedClientHello(data []byte) (int, error) {
+	points, err := c.config.ClientHelloFragmentation.splitPoints(data, c.config.rand())
+	if err != nil {
+		return 0, err
+	}
+	buffering := c.buffering
+	c.buffering = true
+	var n, prev int
+	for _, offset := range append(points, len(data)) {
+		m, err := c.writeRecordLocked(recordTypeHandshake, data[prev:offset])
+		n += m
+		if err != nil {
+			c.buffering = buffering
+			return n, err
+		}
+		prev = offset
+	}
+	c.buffering = buffering
+	if !buffering {
+		if _, err := c.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
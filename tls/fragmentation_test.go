@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+func marshalTestClientHello(t *testing.T, config *Config) []byte {
+	t.Helper()
+	c := &Conn{config: config}
+	hello, _, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hello.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestClientHelloSNIOffset(t *testing.T) {
+	config := testConfig.Clone()
+	config.ServerName = "example.golang"
+	data := marshalTestClientHello(t, config)
+	offset, ok := clientHelloSNIOffset(data)
+	if !ok {
+		t.Fatal("server_name not found")
+	}
+	if want := bytes.Index(data, []byte("example.golang")) + len("example.golang")/2; offset != want {
+		t.Errorf("got offset %d, want %d", offset, want)
+	}
+
+	config.ServerName = ""
+	config.InsecureSkipVerify = true
+	if _, ok := clientHelloSNIOffset(marshalTestClientHello(t, config)); ok {
+		t.Error("unexpected server_name")
+	}
+}
+
+func TestClientHelloFragmentationSplitPoints(t *testing.T) {
+	data := make([]byte, 100)
+	f := &ClientHelloFragmentation{Offsets: []int{50, -1, 0, 100, 30, 30}, RecordSize: 40}
+	points, err := f.splitPoints(data, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{30, 40, 50, 80}; !reflect.DeepEqual(points, want) {
+		t.Errorf("got %v, want %v", points, want)
+	}
+
+	f = &ClientHelloFragmentation{RandomSplits: 200}
+	points, err = f.splitPoints(data, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) == 0 || len(points) > 99 || points[0] < 1 || points[len(points)-1] > 99 {
+		t.Errorf("unexpected random split points %v", points)
+	}
+}
+
+// clientHelloRecords runs a handshake and returns the lengths of the
+// handshake records sent by the client before it receives anything.
+func clientHelloRecords(t *testing.T, clientConfig, serverConfig *Config) []int {
+	t.Helper()
+	var tracer testTrace
+	clientConfig = clientConfig.Clone()
+	clientConfig.Tracer = tracer.tracer()
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	var lengths []int
+	for _, r := range tracer.events().records {
+		if !r.Sent {
+			break
+		}
+		if r.Type != byte(recordTypeHandshake) {
+			t.Errorf("unexpected record type %d", r.Type)
+		}
+		lengths = append(lengths, r.Length)
+	}
+	return lengths
+}
+
+func TestClientHelloFragmentation(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+	helloLen := len(marshalTestClientHello(t, clientConfig))
+	sniOffset, _ := clientHelloSNIOffset(marshalTestClientHello(t, clientConfig))
+	if helloLen <= 200 || helloLen > 300 {
+		t.Fatalf("unexpected ClientHello length %d", helloLen)
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    *ClientHelloFragmentation
+		want []int
+	}{
+		{"None", nil, []int{helloLen}},
+		{"Offsets", &ClientHelloFragmentation{Offsets: []int{1, 10}}, []int{1, 9, helloLen - 10}},
+		{"RecordSize", &ClientHelloFragmentation{RecordSize: 100},
+			[]int{100, 100, helloLen - 200}},
+		{"SplitSNI", &ClientHelloFragmentation{SplitSNI: true}, []int{sniOffset, helloLen - sniOffset}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig.ClientHelloFragmentation = tc.f
+			if got := clientHelloRecords(t, clientConfig, testConfig); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got records %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("Random", func(t *testing.T) {
+		clientConfig.ClientHelloFragmentation = &ClientHelloFragmentation{RandomSplits: 3}
+		clientConfig.Rand = rand.Reader
+		got := clientHelloRecords(t, clientConfig, testConfig)
+		total := 0
+		for _, n := range got {
+			total += n
+		}
+		if len(got) < 2 || total != helloLen {
+			t.Errorf("got records %v", got)
+		}
+	})
+
+	t.Run("HelloRetryRequest", func(t *testing.T) {
+		serverConfig := testConfig.Clone()
+		serverConfig.CurvePreferences = []CurveID{CurveP256}
+		clientConfig.ClientHelloFragmentation = &ClientHelloFragmentation{SplitSNI: true}
+		var tracer testTrace
+		clientConfig := clientConfig.Clone()
+		clientConfig.Tracer = tracer.tracer()
+		if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+			t.Fatal(err)
+		}
+		var handshakeRecords int
+		for _, r := range tracer.events().records {
+			if r.Sent && r.Type == byte(recordTypeHandshake) {
+				handshakeRecords++
+			}
+		}
+		if handshakeRecords != 4 {
+			t.Errorf("got %d plaintext handshake records, want 4", handshakeRecords)
+		}
+	})
+}
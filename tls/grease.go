@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"errors"
+	"io"
+)
+
+// GREASEPlaceholder is a placeholder for a GREASE value (see RFC 8701)
+// that may appear inside a [ClientHelloSpec] in place of a cipher suite,
+// group, version, signature algorithm, or extension type. The client
+// replaces each placeholder with a random GREASE value chosen for each
+// connection, using the same value for all the occurrences inside the
+// same list, as BoringSSL does.
+const GREASEPlaceholder uint16 = 0x0a0a
+
+// Indexes of the GREASE values used by a ClientHello, which mirror the
+// ones used by BoringSSL, plus the ones for signature algorithms and ALPN.
+const (
+	greaseCipher = iota
+	greaseGroup
+	greaseExtension1
+	greaseExtension2
+	greaseVersion
+	greaseSignatureAlgorithm
+	greaseALPN
+	greaseNumValues
+)
+
+// greaseValues contains the GREASE values used by a ClientHello.
+type greaseValues [greaseNumValues]uint16
+
+// newGREASEValues returns random GREASE values read from rand.
+func newGREASEValues(rand io.Reader) (*greaseValues, error) {
+	var seed [greaseNumValues]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	var values greaseValues
+	for idx := range values {
+		// GREASE values have the 0x?a?a form. See RFC 8701, Section 2.
+		value := uint16(seed[idx]&0xf0) | 0x0a
+		values[idx] = value<<8 | value
+	}
+	// The two GREASE extensions must differ, otherwise we would
+	// send the same extension twice.
+	if values[greaseExtension1] == values[greaseExtension2] {
+		values[greaseExtension2] ^= 0x1010
+	}
+	return &values, nil
+}
+
+// isGREASEValue returns whether value is a GREASE value. See RFC 8701.
+func isGREASEValue(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// replaceGREASE returns a copy of values where GREASEPlaceholder has been
+// replaced by the given GREASE value.
+func replaceGREASE[T ~uint16](values []T, grease uint16) []T {
+	if values == nil {
+		return nil
+	}
+	out := make([]T, len(values))
+	for idx, value := range values {
+		if uint16(value) == GREASEPlaceholder {
+			value = T(grease)
+		}
+		out[idx] = value
+	}
+	return out
+}
+
+// greaseALPNProtocol returns the GREASE ALPN protocol corresponding to the
+// given GREASE value. See RFC 8701, Section 2.
+func greaseALPNProtocol(value uint16) string {
+	return string([]byte{byte(value >> 8), byte(value)})
+}
+
+// isGREASEALPNProtocol returns whether proto is a GREASE ALPN protocol.
+func isGREASEALPNProtocol(proto string) bool {
+	return len(proto) == 2 && isGREASEValue(uint16(proto[0])<<8|uint16(proto[1]))
+}
+
+// addGREASE adds GREASE values to the default ClientHello, as Chromium
+// does, when Config.GREASE is set. A GREASE value is prepended to the
+// cipher suites, groups, key shares, versions, signature algorithms, and
+// ALPN protocols, and two GREASE extensions are sent, the first one empty
+// and at the beginning, the second one containing a single zero byte and
+// at the end, before pre_shared_key. The GREASE values do not change after
+// a HelloRetryRequest, while the GREASE key share is not sent again.
+func (m *clientHelloMsg) addGREASE(grease *greaseValues) {
+	m.cipherSuites = append([]uint16{grease[greaseCipher]}, m.cipherSuites...)
+	if len(m.supportedCurves) > 0 {
+		m.supportedCurves = append([]CurveID{CurveID(grease[greaseGroup])}, m.supportedCurves...)
+	}
+	if len(m.keyShares) > 0 {
+		// A GREASE key share contains a single zero byte, like in BoringSSL.
+		greaseShare := keyShare{group: CurveID(grease[greaseGroup]), data: []byte{0}}
+		m.keyShares = append([]keyShare{greaseShare}, m.keyShares...)
+	}
+	if len(m.supportedVersions) > 0 {
+		m.supportedVersions = append([]uint16{grease[greaseVersion]}, m.supportedVersions...)
+	}
+	if len(m.supportedSignatureAlgorithms) > 0 {
+		m.supportedSignatureAlgorithms = append([]SignatureScheme{
+			SignatureScheme(grease[greaseSignatureAlgorithm])}, m.supportedSignatureAlgorithms...)
+	}
+	if len(m.alpnProtocols) > 0 {
+		m.alpnProtocols = append([]string{greaseALPNProtocol(grease[greaseALPN])}, m.alpnProtocols...)
+	}
+	m.greaseExtensions = []uint16{grease[greaseExtension1], grease[greaseExtension2]}
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestNewGREASEValues(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		values, err := newGREASEValues(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx, value := range values {
+			if !isGREASEValue(value) {
+				t.Fatalf("value %d is not a GREASE value: %x", idx, value)
+			}
+		}
+		if values[greaseExtension1] == values[greaseExtension2] {
+			t.Fatal("the two GREASE extensions must differ")
+		}
+	}
+	if isGREASEValue(0x0a1a) || isGREASEValue(0x1301) {
+		t.Error("isGREASEValue accepts non-GREASE values")
+	}
+}
+
+func TestGREASEClientHello(t *testing.T) {
+	config := testConfig.Clone()
+	config.Rand = rand.Reader
+	config.ServerName = "example.golang"
+	config.NextProtos = []string{"h2", "http/1.1"}
+	config.GREASE = true
+	c := &Conn{config: config}
+
+	hello, keys, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || len(hello.keyShares) != 2 {
+		t.Fatalf("expected a GREASE key share and a real one, got %d key shares", len(hello.keyShares))
+	}
+	raw, err := hello.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := clientHelloExtensionTypes(t, raw)
+	first, last := types[0], types[len(types)-1]
+	if !isGREASEValue(first) || !isGREASEValue(last) || first == last {
+		t.Errorf("expected two distinct GREASE extensions, got %x", types)
+	}
+
+	// Make sure the server parser accepts the ClientHello and that the
+	// GREASE values are the first ones in each list.
+	var parsed clientHelloMsg
+	if !parsed.unmarshal(raw) {
+		t.Fatal("cannot unmarshal the ClientHello")
+	}
+	group := parsed.supportedCurves[0]
+	if !isGREASEValue(parsed.cipherSuites[0]) || !isGREASEValue(uint16(group)) ||
+		!isGREASEValue(parsed.supportedVersions[0]) ||
+		!isGREASEValue(uint16(parsed.supportedSignatureAlgorithms[0])) {
+		t.Errorf("expected GREASE values in cipher suites, groups, versions, and signature algorithms")
+	}
+	if parsed.keyShares[0].group != group || len(parsed.keyShares[0].data) != 1 {
+		t.Errorf("expected a GREASE key share for group %x, got %+v", group, parsed.keyShares[0])
+	}
+	if !isGREASEALPNProtocol(parsed.alpnProtocols[0]) || parsed.alpnProtocols[1] != "h2" {
+		t.Errorf("expected a GREASE ALPN protocol, got %q", parsed.alpnProtocols)
+	}
+	if len(config.NextProtos) != 2 {
+		t.Error("the Config's NextProtos must not be modified")
+	}
+}
+
+func TestGREASEHandshake(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		t.Run(VersionName(vers), func(t *testing.T) {
+			serverConfig := testConfig.Clone()
+			serverConfig.MaxVersion = vers
+			serverConfig.NextProtos = []string{"http/1.1", "h2"}
+
+			clientConfig := testConfig.Clone()
+			clientConfig.Rand = rand.Reader
+			clientConfig.NextProtos = []string{"h2"}
+			clientConfig.ClientSessionCache = NewLRUClientSessionCache(1)
+			clientConfig.GREASE = true
+
+			for _, wantResume := range []bool{false, true} {
+				_, cs, err := testHandshake(t, clientConfig, serverConfig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cs.Version != vers {
+					t.Errorf("got version %x, want %x", cs.Version, vers)
+				}
+				if cs.NegotiatedProtocol != "h2" {
+					t.Errorf("got ALPN protocol %q", cs.NegotiatedProtocol)
+				}
+				if cs.DidResume != wantResume {
+					t.Errorf("got DidResume %v, want %v", cs.DidResume, wantResume)
+				}
+			}
+		})
+	}
+}
+
+func TestGREASEHelloRetryRequest(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	clientConfig := testConfig.Clone()
+	clientConfig.Rand = rand.Reader
+	clientConfig.GREASE = true
+
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != VersionTLS13 {
+		t.Errorf("got version %x", cs.Version)
+	}
+}
+
+func TestGREASEALPNSelectedByServer(t *testing.T) {
+	grease := greaseALPNProtocol(0x3a3a)
+	if !isGREASEALPNProtocol(grease) || isGREASEALPNProtocol("h2") {
+		t.Fatal("isGREASEALPNProtocol is broken")
+	}
+	if err := checkALPN([]string{grease, "h2"}, grease, false); err == nil {
+		t.Error("expected an error when the server selects a GREASE ALPN protocol")
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"context"
 	"crypto"
-	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
@@ -40,10 +39,10 @@ type clientHandshakeState struct {
 
 var testingOnlyForceClientHelloSignatureAlgorithms []SignatureScheme
 
-func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
+func (c *Conn) makeClientHello() (*clientHelloMsg, []*keySharePrivateKey, error) {
 	config := c.config
-	if len(config.ServerName) == 0 && !config.InsecureSkipVerify {
-		return nil, nil, errors.New("tls: either ServerName or InsecureSkipVerify must be specified in the tls.Config")
+	if len(config.verifyServerName()) == 0 && !config.InsecureSkipVerify {
+		return nil, nil, errors.New("tls: either ServerName, CertificateServerName, or InsecureSkipVerify must be specified in the tls.Config")
 	}
 
 	nextProtosLength := 0
@@ -63,6 +62,17 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
 		return nil, nil, errors.New("tls: no supported versions satisfy MinVersion and MaxVersion")
 	}
 
+	if config.ClientHelloSpec != nil {
+		hello, keys, err := c.makeClientHelloFromSpec(config.ClientHelloSpec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := c.addECHGREASE(hello); err != nil {
+			return nil, nil, err
+		}
+		return hello, keys, nil
+	}
+
 	clientHelloVersion := config.maxSupportedVersion(roleClient)
 	// The version at the beginning of the ClientHello was capped at TLS 1.2
 	// for compatibility reasons. The supported_versions extension is used
@@ -79,7 +89,7 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
 		ocspStapling:                 true,
 		scts:                         true,
 		serverName:                   hostnameInSNI(config.ServerName),
-		supportedCurves:              config.curvePreferences(),
+		supportedCurves:              config.curvePreferences(supportedVersions[0]),
 		supportedPoints:              []uint8{pointFormatUncompressed},
 		secureRenegotiationSupported: true,
 		alpnProtocols:                config.NextProtos,
@@ -134,7 +144,7 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
 		hello.supportedSignatureAlgorithms = testingOnlyForceClientHelloSignatureAlgorithms
 	}
 
-	var key *ecdh.PrivateKey
+	var keys []*keySharePrivateKey
 	if hello.supportedVersions[0] == VersionTLS13 {
 		// Reset the list of ciphers when the client only supports TLS 1.3.
 		if len(hello.supportedVersions) == 1 {
@@ -146,15 +156,41 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
 			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13NoAES...)
 		}
 
-		curveID := config.curvePreferences()[0]
-		if _, ok := curveForCurveID(curveID); !ok {
-			return nil, nil, errors.New("tls: CurvePreferences includes unsupported curve")
+		curveIDs := config.KeyShareCurves
+		if len(curveIDs) == 0 {
+			curveIDs = config.curvePreferences(VersionTLS13)[:1]
+		}
+		for idx, curveID := range curveIDs {
+			if !isSupportedKeyShareGroup(curveID) {
+				return nil, nil, errors.New("tls: CurvePreferences includes unsupported curve")
+			}
+			if !config.supportsCurve(VersionTLS13, curveID) {
+				return nil, nil, errors.New("tls: KeyShareCurves includes a curve not in CurvePreferences")
+			}
+			for _, prev := range curveIDs[:idx] {
+				if prev == curveID {
+					return nil, nil, errors.New("tls: KeyShareCurves includes duplicate curves")
+				}
+			}
+			key, share, err := generateKeyShare(config.rand(), curveID)
+			if err != nil {
+				return nil, nil, err
+			}
+			hello.keyShares = append(hello.keyShares, share)
+			keys = append(keys, key)
 		}
-		key, err = generateECDHEKey(config.rand(), curveID)
+	}
+
+	if config.GREASE {
+		grease, err := newGREASEValues(config.rand())
 		if err != nil {
 			return nil, nil, err
 		}
-		hello.keyShares = []keyShare{{group: curveID, data: key.PublicKey().Bytes()}}
+		hello.addGREASE(grease)
+	}
+
+	if err := c.addECHGREASE(hello); err != nil {
+		return nil, nil, err
 	}
 
 	if c.quic != nil {
@@ -168,7 +204,7 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, *ecdh.PrivateKey, error) {
 		hello.quicTransportParameters = p
 	}
 
-	return hello, key, nil
+	return hello, keys, nil
 }
 
 func (c *Conn) clientHandshake(ctx context.Context) (err error) {
@@ -180,11 +216,14 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	// need to be reset.
 	c.didResume = false
 
-	hello, ecdheKey, err := c.makeClientHello()
+	hello, keyShareKeys, err := c.makeClientHello()
+	if err != nil {
+		return err
+	}
+	ech, err := c.newECHClientContext(hello)
 	if err != nil {
 		return err
 	}
-	c.serverName = hello.serverName
 
 	session, earlySecret, binderKey, err := c.loadSession(hello)
 	if err != nil {
@@ -206,6 +245,13 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 		}()
 	}
 
+	if ech != nil {
+		if err := ech.splitClientHello(c, hello); err != nil {
+			return err
+		}
+	}
+	c.serverName = hello.serverName
+
 	if _, err := c.writeHandshakeRecord(hello, nil); err != nil {
 		return err
 	}
@@ -213,7 +259,11 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	if hello.earlyData {
 		suite := cipherSuiteTLS13ByID(session.cipherSuite)
 		transcript := suite.hash.New()
-		if err := transcriptMsg(hello, transcript); err != nil {
+		transcriptHello := hello
+		if ech != nil {
+			transcriptHello = ech.innerHello
+		}
+		if err := transcriptMsg(transcriptHello, transcript); err != nil {
 			return err
 		}
 		earlyTrafficSecret := suite.deriveSecret(earlySecret, clientEarlyTrafficLabel, transcript)
@@ -221,6 +271,7 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	}
 
 	// serverHelloMsg is not included in the transcript
+	c.expectHandshake(typeServerHello)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -235,6 +286,10 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	if err := c.pickTLSVersion(serverHello); err != nil {
 		return err
 	}
+	if !hello.offersVersion(c.vers) {
+		c.sendAlert(alertProtocolVersion)
+		return fmt.Errorf("tls: server selected unadvertised protocol version %x", c.vers)
+	}
 
 	// If we are negotiating a protocol version that's lower than what we
 	// support, check for the server downgrade canaries.
@@ -250,14 +305,15 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 
 	if c.vers == VersionTLS13 {
 		hs := &clientHandshakeStateTLS13{
-			c:           c,
-			ctx:         ctx,
-			serverHello: serverHello,
-			hello:       hello,
-			ecdheKey:    ecdheKey,
-			session:     session,
-			earlySecret: earlySecret,
-			binderKey:   binderKey,
+			c:            c,
+			ctx:          ctx,
+			serverHello:  serverHello,
+			hello:        hello,
+			keyShareKeys: keyShareKeys,
+			session:      session,
+			earlySecret:  earlySecret,
+			binderKey:    binderKey,
+			echContext:   ech,
 		}
 
 		// In TLS 1.3, session tickets are delivered after the handshake.
@@ -285,12 +341,17 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (
 		return nil, nil, nil, nil
 	}
 
-	hello.ticketSupported = true
+	// When using a ClientHelloSpec, the spec already set the fields of the
+	// extensions it sends, and we must not offer the ones it does not send.
+	if hello.extensions == nil {
+		// ticketSupported is a TLS 1.2 extension, while ECH requires TLS 1.3.
+		hello.ticketSupported = c.config.EncryptedClientHelloConfigList == nil
 
-	if hello.supportedVersions[0] == VersionTLS13 {
-		// Require DHE on resumption as it guarantees forward secrecy against
-		// compromise of the session ticket key. See RFC 8446, Section 4.2.9.
-		hello.pskModes = []uint8{pskModeDHE}
+		if hello.offersVersion(VersionTLS13) {
+			// Require DHE on resumption as it guarantees forward secrecy against
+			// compromise of the session ticket key. See RFC 8446, Section 4.2.9.
+			hello.pskModes = []uint8{pskModeDHE}
+		}
 	}
 
 	// Session resumption is not allowed if renegotiating because
@@ -336,7 +397,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (
 			// The original connection had InsecureSkipVerify, while this doesn't.
 			return nil, nil, nil, nil
 		}
-		if err := session.peerCertificates[0].VerifyHostname(c.config.ServerName); err != nil {
+		if err := session.peerCertificates[0].VerifyHostname(c.config.verifyServerName()); err != nil {
 			return nil, nil, nil, nil
 		}
 	}
@@ -348,6 +409,11 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (
 			return nil, nil, nil, nil
 		}
 
+		// When using a ClientHelloSpec, make sure we send the ticket.
+		if hello.extensions != nil && !hello.hasExtension(extensionSessionTicket) {
+			return nil, nil, nil, nil
+		}
+
 		hello.sessionTicket = cs.ticket
 		return
 	}
@@ -376,7 +442,13 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (
 		return nil, nil, nil, nil
 	}
 
-	if c.quic != nil && session.EarlyData {
+	// When using a ClientHelloSpec, make sure we send the PSK.
+	if hello.extensions != nil && (!hello.hasExtension(extensionPreSharedKey) ||
+		!hello.hasExtension(extensionPSKModes)) {
+		return nil, nil, nil, nil
+	}
+
+	if c.quic != nil && session.EarlyData && (hello.extensions == nil || hello.hasExtension(extensionEarlyData)) {
 		// For 0-RTT, the cipher suite has to match exactly, and we need to be
 		// offering the same ALPN.
 		if mutualCipherSuiteTLS13(hello.cipherSuites, session.cipherSuite) != nil {
@@ -465,6 +537,7 @@ func (hs *clientHandshakeState) handshake() error {
 	c.buffering = true
 	c.didResume = isResume
 	if isResume {
+		c.traceNegotiated()
 		if err := hs.establishKeys(); err != nil {
 			return err
 		}
@@ -479,7 +552,7 @@ func (hs *clientHandshakeState) handshake() error {
 		// is a resumption. Resumptions currently don't reverify certificates so
 		// they don't call verifyServerCertificate. See Issue 31641.
 		if c.config.VerifyConnection != nil {
-			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 				c.sendAlert(alertBadCertificate)
 				return err
 			}
@@ -538,6 +611,7 @@ func (hs *clientHandshakeState) pickCipherSuite() error {
 func (hs *clientHandshakeState) doFullHandshake() error {
 	c := hs.c
 
+	c.expectHandshake(typeCertificate)
 	msg, err := c.readHandshake(&hs.finishedHash)
 	if err != nil {
 		return err
@@ -548,6 +622,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		return unexpectedMessageError(certMsg, msg)
 	}
 
+	c.expectHandshake(typeCertificateStatus, typeServerKeyExchange, typeCertificateRequest, typeServerHelloDone)
 	msg, err = c.readHandshake(&hs.finishedHash)
 	if err != nil {
 		return err
@@ -569,6 +644,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 		c.ocspResponse = cs.response
 
+		c.expectHandshake(typeServerKeyExchange, typeCertificateRequest, typeServerHelloDone)
 		msg, err = c.readHandshake(&hs.finishedHash)
 		if err != nil {
 			return err
@@ -604,11 +680,14 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			return err
 		}
 
+		c.expectHandshake(typeCertificateRequest, typeServerHelloDone)
 		msg, err = c.readHandshake(&hs.finishedHash)
 		if err != nil {
 			return err
 		}
 	}
+	c.curveID = keyAgreementCurveID(keyAgreement)
+	c.traceNegotiated()
 
 	var chainToSend *Certificate
 	var certRequested bool
@@ -622,6 +701,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			return err
 		}
 
+		c.expectHandshake(typeServerHelloDone)
 		msg, err = c.readHandshake(&hs.finishedHash)
 		if err != nil {
 			return err
@@ -740,6 +820,8 @@ func (hs *clientHandshakeState) establishKeys() error {
 
 	c.in.prepareCipherSpec(c.vers, serverCipher, serverHash)
 	c.out.prepareCipherSpec(c.vers, clientCipher, clientHash)
+	c.in.nextKey, c.in.nextIV = serverKey, serverIV
+	c.out.nextKey, c.out.nextIV = clientKey, clientIV
 	return nil
 }
 
@@ -762,6 +844,11 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 		return false, errors.New("tls: server selected unsupported compression format")
 	}
 
+	if err := checkServerHelloExtensions(hs.hello, hs.serverHello); err != nil {
+		c.sendAlert(alertUnsupportedExtension)
+		return false, err
+	}
+
 	if c.handshakes == 0 && hs.serverHello.secureRenegotiationSupported {
 		c.secureRenegotiation = true
 		if len(hs.serverHello.secureRenegotiation) != 0 {
@@ -815,6 +902,7 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 	c.activeCertHandles = hs.c.activeCertHandles
 	c.verifiedChains = hs.session.verifiedChains
 	c.ocspResponse = hs.session.ocspResponse
+	c.curveID = hs.session.curveID
 	// Let the ServerHello SCTs override the session SCTs from the original
 	// connection, if any are provided
 	if len(c.scts) == 0 && len(hs.session.scts) != 0 {
@@ -837,6 +925,10 @@ func checkALPN(clientProtos []string, serverProto string, quic bool) error {
 	if len(clientProtos) == 0 {
 		return errors.New("tls: server advertised unrequested ALPN extension")
 	}
+	if isGREASEALPNProtocol(serverProto) {
+		// RFC 8701, Section 3.1
+		return errors.New("tls: server selected a GREASE ALPN protocol")
+	}
 	for _, proto := range clientProtos {
 		if proto == serverProto {
 			return nil
@@ -855,6 +947,7 @@ func (hs *clientHandshakeState) readFinished(out []byte) error {
 	// finishedMsg is included in the transcript, but not until after we
 	// check the client version, since the state before this message was
 	// sent is used during verification.
+	c.expectHandshake(typeFinished)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -891,6 +984,7 @@ func (hs *clientHandshakeState) readSessionTicket() error {
 		return errors.New("tls: server sent unrequested session ticket")
 	}
 
+	c.expectHandshake(typeNewSessionTicket)
 	msg, err := c.readHandshake(&hs.finishedHash)
 	if err != nil {
 		return err
@@ -910,6 +1004,11 @@ func (hs *clientHandshakeState) saveSessionTicket() error {
 		return nil
 	}
 	c := hs.c
+	if c.config.ClientSessionCache == nil {
+		// A ClientHelloSpec may send the session_ticket extension even
+		// when there is no cache to store the ticket in.
+		return nil
+	}
 
 	cacheKey := c.clientSessionCacheKey()
 	if cacheKey == "" {
@@ -983,11 +1082,16 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 		certs[i] = cert.cert
 	}
 
-	if !c.config.InsecureSkipVerify {
+	echRejected := c.config.EncryptedClientHelloConfigList != nil && !c.echAccepted
+	if echRejected {
+		if err := c.verifyECHRejectionCertificate(certs); err != nil {
+			return err
+		}
+	} else if !c.config.InsecureSkipVerify {
 		opts := x509.VerifyOptions{
 			Roots:         c.config.RootCAs,
 			CurrentTime:   c.config.time(),
-			DNSName:       c.config.ServerName,
+			DNSName:       c.config.verifyServerName(),
 			Intermediates: x509.NewCertPool(),
 		}
 
@@ -1013,15 +1117,15 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 	c.activeCertHandles = activeHandles
 	c.peerCertificates = certs
 
-	if c.config.VerifyPeerCertificate != nil {
-		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+	if c.config.VerifyPeerCertificate != nil && !echRejected {
+		if err := c.callbackError(c.config.VerifyPeerCertificate(certificates, c.verifiedChains)); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
 	}
 
-	if c.config.VerifyConnection != nil {
-		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+	if c.config.VerifyConnection != nil && !echRejected {
+		if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
@@ -1098,7 +1202,8 @@ func certificateRequestInfoFromMsg(ctx context.Context, vers uint16, certReq *ce
 
 func (c *Conn) getClientCertificate(cri *CertificateRequestInfo) (*Certificate, error) {
 	if c.config.GetClientCertificate != nil {
-		return c.config.GetClientCertificate(cri)
+		cert, err := c.config.GetClientCertificate(cri)
+		return cert, c.callbackError(err)
 	}
 
 	for _, chain := range c.config.Certificates {
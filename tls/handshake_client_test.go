@@ -2841,3 +2841,56 @@ func TestHandshakeRSATooBig(t *testing.T) {
 		})
 	}
 }
+
+func TestCertificateServerName(t *testing.T) {
+	issuer, err := x509.ParseCertificate(testRSACertificateIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(issuer)
+	now := func() time.Time { return time.Unix(1476984729, 0) }
+
+	serverConfig := testConfig.Clone()
+	serverConfig.Time = now
+	serverConfig.Certificates = []Certificate{{
+		Certificate: [][]byte{testRSACertificate},
+		PrivateKey:  testRSAPrivateKey,
+	}}
+	serverConfig.NameToCertificate = nil
+
+	for _, tt := range []struct {
+		serverName, certificateServerName string
+		ok                                bool
+	}{
+		{"example.golang", "", true},
+		{"", "example.golang", true},
+		{"fake.example", "example.golang", true},
+		{"example.golang", "fake.example", false},
+	} {
+		clientConfig := testConfig.Clone()
+		clientConfig.Time = now
+		clientConfig.RootCAs = rootCAs
+		clientConfig.InsecureSkipVerify = false
+		clientConfig.ServerName = tt.serverName
+		clientConfig.CertificateServerName = tt.certificateServerName
+
+		ss, cs, err := testHandshake(t, clientConfig, serverConfig)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%q/%q: handshake succeeded, want a verification failure", tt.serverName, tt.certificateServerName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q/%q: handshake failed: %v", tt.serverName, tt.certificateServerName, err)
+			continue
+		}
+		if ss.ServerName != tt.serverName || cs.ServerName != tt.serverName {
+			t.Errorf("%q/%q: got SNI %q on the server and %q on the client", tt.serverName, tt.certificateServerName, ss.ServerName, cs.ServerName)
+		}
+		if len(cs.VerifiedChains) == 0 {
+			t.Errorf("%q/%q: no verified chains", tt.serverName, tt.certificateServerName)
+		}
+	}
+}
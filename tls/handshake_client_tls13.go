@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"context"
 	"crypto"
-	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rsa"
 	"errors"
@@ -17,11 +16,12 @@ import (
 )
 
 type clientHandshakeStateTLS13 struct {
-	c           *Conn
-	ctx         context.Context
-	serverHello *serverHelloMsg
-	hello       *clientHelloMsg
-	ecdheKey    *ecdh.PrivateKey
+	c            *Conn
+	ctx          context.Context
+	serverHello  *serverHelloMsg
+	hello        *clientHelloMsg
+	keyShareKeys []*keySharePrivateKey // one for each key share we sent
+	keyShareKey  *keySharePrivateKey   // the one selected by the server
 
 	session     *SessionState
 	earlySecret []byte
@@ -34,9 +34,16 @@ type clientHandshakeStateTLS13 struct {
 	transcript    hash.Hash
 	masterSecret  []byte
 	trafficSecret []byte // client_application_traffic_secret_0
+
+	// sendApplicationSettings is set when the server negotiated ALPS and
+	// the client must reply with its own EncryptedExtensions.
+	sendApplicationSettings bool
+
+	// echContext is the ECH state, if the client offered ECH.
+	echContext *echClientContext
 }
 
-// handshake requires hs.c, hs.hello, hs.serverHello, hs.ecdheKey, and,
+// handshake requires hs.c, hs.hello, hs.serverHello, hs.keyShareKeys, and,
 // optionally, hs.session, hs.earlySecret and hs.binderKey to be set.
 func (hs *clientHandshakeStateTLS13) handshake() error {
 	c := hs.c
@@ -53,7 +60,7 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	}
 
 	// Consistency check on the presence of a keyShare and its parameters.
-	if hs.ecdheKey == nil || len(hs.hello.keyShares) != 1 {
+	if len(hs.keyShareKeys) == 0 || len(hs.keyShareKeys) > len(hs.hello.keyShares) {
 		return c.sendAlert(alertInternalError)
 	}
 
@@ -67,6 +74,13 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		return err
 	}
 
+	if hs.echContext != nil {
+		hs.echContext.innerTranscript = hs.suite.hash.New()
+		if err := transcriptMsg(hs.echContext.innerHello, hs.echContext.innerTranscript); err != nil {
+			return err
+		}
+	}
+
 	if bytes.Equal(hs.serverHello.random, helloRetryRequestRandom) {
 		if err := hs.sendDummyChangeCipherSpec(); err != nil {
 			return err
@@ -76,6 +90,12 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		}
 	}
 
+	if hs.echContext != nil {
+		if err := hs.processECHServerHello(); err != nil {
+			return err
+		}
+	}
+
 	if err := transcriptMsg(hs.serverHello, hs.transcript); err != nil {
 		return err
 	}
@@ -99,6 +119,9 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.readServerFinished(); err != nil {
 		return err
 	}
+	if err := hs.sendClientEncryptedExtensions(); err != nil {
+		return err
+	}
 	if err := hs.sendClientCertificate(); err != nil {
 		return err
 	}
@@ -109,6 +132,11 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		return err
 	}
 
+	if hs.echContext != nil && hs.echContext.echRejected {
+		c.sendAlert(alertECHRequired)
+		return &ECHRejectionError{hs.echContext.retryConfigs}
+	}
+
 	c.isHandshakeComplete.Store(true)
 
 	return nil
@@ -189,6 +217,15 @@ func (hs *clientHandshakeStateTLS13) sendDummyChangeCipherSpec() error {
 func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	c := hs.c
 
+	if hs.echContext != nil {
+		if err := hs.processECHHelloRetryRequest(); err != nil {
+			return err
+		}
+	} else if hs.serverHello.encryptedClientHello != nil {
+		c.sendAlert(alertUnsupportedExtension)
+		return errors.New("tls: unexpected encrypted client hello extension in HelloRetryRequest")
+	}
+
 	// The first ClientHello gets double-hashed into the transcript upon a
 	// HelloRetryRequest. (The idea is that the server might offload transcript
 	// storage to the client in the cookie.) See RFC 8446, Section 4.4.1.
@@ -232,21 +269,21 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server selected unsupported group")
 		}
-		if sentID, _ := curveIDForCurve(hs.ecdheKey.Curve()); sentID == curveID {
+		if hs.keyShareKeyForGroup(curveID) != nil {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server sent an unnecessary HelloRetryRequest key_share")
 		}
-		if _, ok := curveForCurveID(curveID); !ok {
+		if !isSupportedKeyShareGroup(curveID) {
 			c.sendAlert(alertInternalError)
 			return errors.New("tls: CurvePreferences includes unsupported curve")
 		}
-		key, err := generateECDHEKey(c.config.rand(), curveID)
+		key, share, err := generateKeyShare(c.config.rand(), curveID)
 		if err != nil {
 			c.sendAlert(alertInternalError)
 			return err
 		}
-		hs.ecdheKey = key
-		hs.hello.keyShares = []keyShare{{group: curveID, data: key.PublicKey().Bytes()}}
+		hs.keyShareKeys = []*keySharePrivateKey{key}
+		hs.hello.keyShares = []keyShare{share}
 	}
 
 	hs.hello.raw = nil
@@ -287,11 +324,16 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 		c.quicRejectedEarlyData()
 	}
 
-	if _, err := hs.c.writeHandshakeRecord(hs.hello, hs.transcript); err != nil {
+	if c.echAccepted {
+		if err := hs.sendECHClientHello(); err != nil {
+			return err
+		}
+	} else if _, err := hs.c.writeHandshakeRecord(hs.hello, hs.transcript); err != nil {
 		return err
 	}
 
 	// serverHelloMsg is not included in the transcript
+	c.expectHandshake(typeServerHello)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -333,7 +375,7 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server did not send a key share")
 	}
-	if sentID, _ := curveIDForCurve(hs.ecdheKey.Curve()); hs.serverHello.serverShare.group != sentID {
+	if hs.keyShareKey = hs.keyShareKeyForGroup(hs.serverHello.serverShare.group); hs.keyShareKey == nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server selected unsupported group")
 	}
@@ -369,15 +411,23 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 	return nil
 }
 
+// keyShareKeyForGroup returns the private key of the key share we sent for
+// the given group, or nil if we did not send a key share for it.
+func (hs *clientHandshakeStateTLS13) keyShareKeyForGroup(group CurveID) *keySharePrivateKey {
+	for _, key := range hs.keyShareKeys {
+		if key.group == group {
+			return key
+		}
+	}
+	return nil
+}
+
 func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 	c := hs.c
+	c.curveID = hs.serverHello.serverShare.group
+	c.traceNegotiated()
 
-	peerKey, err := hs.ecdheKey.Curve().NewPublicKey(hs.serverHello.serverShare.data)
-	if err != nil {
-		c.sendAlert(alertIllegalParameter)
-		return errors.New("tls: invalid server key share")
-	}
-	sharedKey, err := hs.ecdheKey.ECDH(peerKey)
+	sharedKey, err := hs.keyShareKey.sharedKey(hs.serverHello.serverShare.data)
 	if err != nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid server key share")
@@ -426,6 +476,7 @@ func (hs *clientHandshakeStateTLS13) establishHandshakeKeys() error {
 func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 	c := hs.c
 
+	c.expectHandshake(typeEncryptedExtensions)
 	msg, err := c.readHandshake(hs.transcript)
 	if err != nil {
 		return err
@@ -468,6 +519,13 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 	if hs.hello.earlyData && !encryptedExtensions.earlyData {
 		c.quicRejectedEarlyData()
 	}
+	if encryptedExtensions.hasApplicationSettings {
+		if err := hs.checkApplicationSettings(); err != nil {
+			c.sendAlert(alertUnsupportedExtension)
+			return err
+		}
+		hs.sendApplicationSettings = true
+	}
 	if encryptedExtensions.earlyData {
 		if hs.session.cipherSuite != c.cipherSuite {
 			c.sendAlert(alertHandshakeFailure)
@@ -478,6 +536,14 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 			return errors.New("tls: server accepted 0-RTT with the wrong ALPN")
 		}
 	}
+	if hs.echContext != nil {
+		if hs.echContext.echRejected {
+			hs.echContext.retryConfigs = encryptedExtensions.echRetryConfigs
+		} else if encryptedExtensions.echRetryConfigs != nil {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server sent encrypted client hello retry configs after accepting encrypted client hello")
+		}
+	}
 
 	return nil
 }
@@ -492,7 +558,7 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		// is a resumption. Resumptions currently don't reverify certificates so
 		// they don't call verifyServerCertificate. See Issue 31641.
 		if c.config.VerifyConnection != nil {
-			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 				c.sendAlert(alertBadCertificate)
 				return err
 			}
@@ -500,6 +566,7 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 		return nil
 	}
 
+	c.expectHandshake(typeCertificateRequest, typeCertificate, typeCompressedCertificate)
 	msg, err := c.readHandshake(hs.transcript)
 	if err != nil {
 		return err
@@ -509,12 +576,20 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 	if ok {
 		hs.certReq = certReq
 
+		c.expectHandshake(typeCertificate, typeCompressedCertificate)
 		msg, err = c.readHandshake(hs.transcript)
 		if err != nil {
 			return err
 		}
 	}
 
+	if compressedMsg, ok := msg.(*compressedCertificateMsg); ok {
+		if msg, err = decompressCertificate(hs.hello.certCompressionAlgorithms, compressedMsg); err != nil {
+			c.sendAlert(alertBadCertificate)
+			return err
+		}
+	}
+
 	certMsg, ok := msg.(*certificateMsgTLS13)
 	if !ok {
 		c.sendAlert(alertUnexpectedMessage)
@@ -535,6 +610,7 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 	// certificateVerifyMsg is included in the transcript, but not until
 	// after we verify the handshake signature, since the state before
 	// this message was sent is used.
+	c.expectHandshake(typeCertificateVerify)
 	msg, err = c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -547,7 +623,8 @@ func (hs *clientHandshakeStateTLS13) readServerCertificate() error {
 	}
 
 	// See RFC 8446, Section 4.4.3.
-	if !isSupportedSignatureAlgorithm(certVerify.signatureAlgorithm, supportedSignatureAlgorithms()) {
+	if !isSupportedSignatureAlgorithm(certVerify.signatureAlgorithm, supportedSignatureAlgorithms()) ||
+		!isSupportedSignatureAlgorithm(certVerify.signatureAlgorithm, hs.hello.supportedSignatureAlgorithms) {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: certificate used with invalid signature algorithm")
 	}
@@ -579,6 +656,7 @@ func (hs *clientHandshakeStateTLS13) readServerFinished() error {
 	// finishedMsg is included in the transcript, but not until after we
 	// check the client version, since the state before this message was
 	// sent is used during verification.
+	c.expectHandshake(typeFinished)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -631,6 +709,16 @@ func (hs *clientHandshakeStateTLS13) sendClientCertificate() error {
 		return nil
 	}
 
+	if hs.echContext != nil && hs.echContext.echRejected {
+		// Do not authenticate to a server that rejected ECH, since it is
+		// not the server we meant to connect to. See draft-ietf-tls-esni,
+		// Section 6.1.7.
+		if _, err := hs.c.writeHandshakeRecord(&certificateMsgTLS13{}, hs.transcript); err != nil {
+			return err
+		}
+		return nil
+	}
+
 	cert, err := c.getClientCertificate(&CertificateRequestInfo{
 		AcceptableCAs:    hs.certReq.certificateAuthorities,
 		SignatureSchemes: hs.certReq.supportedSignatureAlgorithms,
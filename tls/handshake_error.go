@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// HandshakePhase describes what a Conn was doing when its handshake failed.
+type HandshakePhase uint8
+
+const (
+	// HandshakePhaseProcessing means that the Conn was neither sending nor
+	// receiving a handshake message, for example because it was building
+	// the first message or checking the last message received.
+	HandshakePhaseProcessing HandshakePhase = iota
+
+	// HandshakePhaseSending means that the Conn was sending a handshake
+	// message or a ChangeCipherSpec record.
+	HandshakePhaseSending
+
+	// HandshakePhaseReceiving means that the Conn was waiting for or reading
+	// the handshake message following the last message received.
+	HandshakePhaseReceiving
+)
+
+func (p HandshakePhase) String() string {
+	switch p {
+	case HandshakePhaseProcessing:
+		return "processing"
+	case HandshakePhaseSending:
+		return "sending"
+	case HandshakePhaseReceiving:
+		return "receiving"
+	}
+	return "unknown"
+}
+
+// HandshakeError is returned by the Conn methods that run the handshake, such
+// as Handshake and HandshakeContext, when the handshake fails. It wraps the
+// error that caused the failure, and describes how far the handshake got.
+//
+// Error returns the text of the wrapped error, so that inspecting a failure
+// with errors.As or errors.Is, or through the fields of HandshakeError, does
+// not depend on the text of the error.
+//
+// Only the errors detected by this package are wrapped. The errors returned
+// by the underlying connection, including io.EOF and net.Error, the context
+// errors, and the errors returned by the Config callbacks, such as
+// VerifyPeerCertificate, are returned as they are, so that comparing them
+// with == and type assertions keep working.
+type HandshakeError struct {
+	// Err is the error that caused the handshake to fail.
+	Err error
+
+	// Phase is what the Conn was doing when the handshake failed. If
+	// Phase is HandshakePhaseReceiving, the Conn was waiting for the
+	// message following LastMessageReceived, or for the first message
+	// from the peer if LastMessageReceived is nil.
+	Phase HandshakePhase
+
+	// ExpectedMessages are the types of the handshake messages, for
+	// example 2 for ServerHello, that the Conn accepted as the next message
+	// from the peer, if the handshake failed before one of them was read.
+	// Together with Phase, they describe the handshake step that failed:
+	// with HandshakePhaseReceiving the Conn was waiting for or reading one
+	// of these messages, for example "waiting for ServerHello", and with
+	// HandshakePhaseProcessing it received LastMessageReceived, which is
+	// not one of them or could not be parsed. ExpectedMessages is nil if
+	// the handshake failed while processing an expected message, or while
+	// sending.
+	ExpectedMessages []uint8
+
+	// LastMessageSent and LastMessageReceived are the last handshake
+	// messages sent and received during the handshake, or nil if none.
+	LastMessageSent     *HandshakeMessageInfo
+	LastMessageReceived *HandshakeMessageInfo
+
+	// SentAlert is the fatal alert sent to the peer, if any. When using a
+	// QUIC transport, it is the alert reported to the QUIC layer.
+	SentAlert *AlertError
+
+	// ReceivedAlert is the fatal alert received from the peer, if any.
+	ReceivedAlert *AlertError
+
+	// BytesSent and BytesReceived are the number of bytes written to and
+	// read from the underlying connection, including the records sent
+	// before the handshake, if any. They are zero when using a QUIC
+	// transport.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+func (e *HandshakeError) Error() string { return e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the wrapped error is a net.Error timeout.
+func (e *HandshakeError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// Temporary always returns false, since a handshake failure is permanent.
+func (e *HandshakeError) Temporary() bool { return false }
+
+// newHandshakeError wraps the error returned by a handshake. c.in must be
+// locked.
+func (c *Conn) newHandshakeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*HandshakeError); ok {
+		return err
+	}
+	if c.externalErr != nil && errors.Is(err, c.externalErr) || errors.Is(err, io.EOF) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	e := &HandshakeError{
+		Err:           err,
+		Phase:         c.handshakePhase,
+		BytesSent:     c.bytesSent,
+		BytesReceived: c.bytesReceived,
+	}
+	if c.expectedMessages != nil {
+		e.ExpectedMessages = append([]uint8(nil), c.expectedMessages...)
+	}
+	if m := c.lastMessageSent; m != nil {
+		last := *m
+		e.LastMessageSent = &last
+	}
+	if m := c.lastMessageReceived; m != nil {
+		last := *m
+		e.LastMessageReceived = &last
+	}
+
+	c.out.Lock()
+	outErr := c.out.err
+	c.out.Unlock()
+	if a, ok := alertFromOpError(outErr, "local error"); ok {
+		e.SentAlert = &a
+	}
+	if a, ok := alertFromOpError(c.in.err, "remote error"); ok {
+		e.ReceivedAlert = &a
+	}
+	return e
+}
+
+// transportError records an error returned by the underlying connection, so
+// that newHandshakeError does not wrap it.
+func (c *Conn) transportError(err error) {
+	if err != nil {
+		c.externalErr = err
+	}
+}
+
+// callbackError records an error returned by a Config callback, so that
+// newHandshakeError does not wrap it, and returns it.
+func (c *Conn) callbackError(err error) error {
+	if err != nil {
+		c.externalErr = err
+	}
+	return err
+}
+
+// alertFromOpError returns the alert wrapped by err, if err wraps a
+// net.OpError with the given Op.
+func alertFromOpError(err error, op string) (AlertError, bool) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != op {
+		return 0, false
+	}
+	var a alert
+	if !errors.As(opErr.Err, &a) {
+		return 0, false
+	}
+	return AlertError(a), true
+}
+
+// expectHandshake records the types of the handshake messages that the
+// following readHandshake call accepts, which are reported by HandshakeError
+// until one of them is read.
+func (c *Conn) expectHandshake(types ...uint8) {
+	c.expectedMessages = types
+}
+
+// receivedHandshake is called when readHandshake reads a message of the
+// given type.
+func (c *Conn) receivedHandshake(typ uint8) {
+	for _, expected := range c.expectedMessages {
+		if expected == typ {
+			c.expectedMessages = nil
+			return
+		}
+	}
+}
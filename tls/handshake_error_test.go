@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func asHandshakeError(t *testing.T, err error) *HandshakeError {
+	t.Helper()
+	var he *HandshakeError
+	if !errors.As(err, &he) {
+		t.Fatalf("got error %v (%T), want a HandshakeError", err, err)
+	}
+	if he.Error() != he.Err.Error() {
+		t.Errorf("got text %q, want %q", he.Error(), he.Err.Error())
+	}
+	return he
+}
+
+func checkAlert(t *testing.T, name string, got *AlertError, want alert) {
+	t.Helper()
+	if got == nil || *got != AlertError(want) {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+	}
+}
+
+func checkLastMessage(t *testing.T, name string, got *HandshakeMessageInfo, want uint8) {
+	t.Helper()
+	if got == nil || got.Type != want {
+		t.Errorf("%s: got %+v, want message type %d", name, got, want)
+	}
+}
+
+func checkExpectedMessages(t *testing.T, name string, got []uint8, want ...uint8) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got expected messages %v, want %v", name, got, want)
+	}
+}
+
+func TestHandshakeErrorCertificate(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.InsecureSkipVerify = false
+	clientConfig.ServerName = "example.golang"
+	clientConfig.RootCAs = x509.NewCertPool()
+
+	serverErr, clientErr := testHandshakeErrors(t, clientConfig, testConfig)
+
+	ce := asHandshakeError(t, clientErr)
+	var verifyErr *CertificateVerificationError
+	if !errors.As(ce, &verifyErr) {
+		t.Errorf("got client error %v, want a CertificateVerificationError", ce.Err)
+	}
+	if ce.Phase != HandshakePhaseProcessing {
+		t.Errorf("got client phase %v", ce.Phase)
+	}
+	checkExpectedMessages(t, "client", ce.ExpectedMessages)
+	checkLastMessage(t, "client last sent", ce.LastMessageSent, typeClientHello)
+	checkLastMessage(t, "client last received", ce.LastMessageReceived, typeCertificate)
+	checkAlert(t, "client sent alert", ce.SentAlert, alertBadCertificate)
+	if ce.ReceivedAlert != nil {
+		t.Errorf("unexpected client received alert %v", *ce.ReceivedAlert)
+	}
+
+	se := asHandshakeError(t, serverErr)
+	if se.Phase != HandshakePhaseReceiving {
+		t.Errorf("got server phase %v", se.Phase)
+	}
+	checkExpectedMessages(t, "server", se.ExpectedMessages, typeFinished)
+	checkLastMessage(t, "server last sent", se.LastMessageSent, typeFinished)
+	checkLastMessage(t, "server last received", se.LastMessageReceived, typeClientHello)
+	checkAlert(t, "server received alert", se.ReceivedAlert, alertBadCertificate)
+	if se.SentAlert != nil {
+		t.Errorf("unexpected server sent alert %v", *se.SentAlert)
+	}
+	if se.BytesSent == 0 || se.BytesReceived == 0 || se.BytesSent != ce.BytesReceived {
+		t.Errorf("server sent %d and received %d bytes, client received %d bytes",
+			se.BytesSent, se.BytesReceived, ce.BytesReceived)
+	}
+}
+
+func TestHandshakeErrorNoSharedCipherSuite(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.MaxVersion = VersionTLS12
+	clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	serverConfig := testConfig.Clone()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+
+	_, clientErr := testHandshakeErrors(t, clientConfig, serverConfig)
+	ce := asHandshakeError(t, clientErr)
+	if ce.Phase != HandshakePhaseReceiving {
+		t.Errorf("got phase %v", ce.Phase)
+	}
+	checkExpectedMessages(t, "client", ce.ExpectedMessages, typeServerHello)
+	checkLastMessage(t, "last sent", ce.LastMessageSent, typeClientHello)
+	if ce.LastMessageReceived != nil {
+		t.Errorf("unexpected last received message %+v", ce.LastMessageReceived)
+	}
+	checkAlert(t, "received alert", ce.ReceivedAlert, alertHandshakeFailure)
+	if want := int64(recordHeaderLen + len(ce.LastMessageSent.Raw)); ce.BytesSent != want {
+		t.Errorf("got %d bytes sent, want %d", ce.BytesSent, want)
+	}
+	if want := int64(recordHeaderLen + 2); ce.BytesReceived != want {
+		t.Errorf("got %d bytes received, want %d", ce.BytesReceived, want)
+	}
+}
+
+func TestHandshakeErrorExternal(t *testing.T) {
+	// The errors of the underlying connection are returned as they are.
+	c, s := localPipe(t)
+	go c.Close()
+	err := Server(s, testConfig).Handshake()
+	s.Close()
+	if err != io.EOF {
+		t.Errorf("got error %v (%T), want io.EOF", err, err)
+	}
+
+	// So are the errors of the Config callbacks, even when we send an alert.
+	callbackErr := errors.New("callback error")
+	clientConfig := testConfig.Clone()
+	clientConfig.VerifyConnection = func(ConnectionState) error { return callbackErr }
+	c, s = localPipe(t)
+	go func() {
+		Server(s, testConfig).Handshake()
+		s.Close()
+	}()
+	err = Client(c, clientConfig).Handshake()
+	c.Close()
+	if err != callbackErr {
+		t.Errorf("got error %v (%T), want the callback error", err, err)
+	}
+}
+
+func TestHandshakeErrorUnexpectedMessage(t *testing.T) {
+	c, s := localPipe(t)
+	go func() {
+		io.ReadFull(s, make([]byte, recordHeaderLen))
+		// A ServerHelloDone instead of a ServerHello.
+		s.Write([]byte{byte(recordTypeHandshake), 3, 3, 0, 4, typeServerHelloDone, 0, 0, 0})
+		io.Copy(io.Discard, s)
+	}()
+	err := Client(c, testConfig).Handshake()
+	c.Close()
+	ce := asHandshakeError(t, err)
+	if ce.Phase != HandshakePhaseProcessing {
+		t.Errorf("got phase %v", ce.Phase)
+	}
+	checkExpectedMessages(t, "client", ce.ExpectedMessages, typeServerHello)
+	checkLastMessage(t, "last received", ce.LastMessageReceived, typeServerHelloDone)
+	checkAlert(t, "sent alert", ce.SentAlert, alertUnexpectedMessage)
+}
+
+// testHandshakeErrors runs a handshake that is expected to fail on both
+// sides and returns the errors.
+func testHandshakeErrors(t *testing.T, clientConfig, serverConfig *Config) (serverErr, clientErr error) {
+	t.Helper()
+	c, s := localPipe(t)
+	errChan := make(chan error, 1)
+	go func() {
+		server := Server(s, serverConfig)
+		err := server.Handshake()
+		if err == nil {
+			// Read the client's response to the server flight.
+			_, err = server.Read(make([]byte, 1))
+		}
+		s.Close()
+		errChan <- err
+	}()
+	clientErr = Client(c, clientConfig).Handshake()
+	c.Close()
+	serverErr = <-errChan
+	if clientErr == nil || serverErr == nil {
+		t.Fatalf("got client error %v and server error %v, want two errors", clientErr, serverErr)
+	}
+	return serverErr, clientErr
+}
@@ -95,14 +95,36 @@ type clientHelloMsg struct {
 	pskIdentities                    []pskIdentity
 	pskBinders                       [][]byte
 	quicTransportParameters          []byte
+	encryptedClientHello             []byte
+
+	// extensions, when not nil, contains the extensions to send, in
+	// order, as specified by the Config's ClientHelloSpec.
+	extensions []ClientHelloExtension
+
+	// certCompressionAlgorithms and applicationSettingsProtocols are
+	// only sent by clients using a ClientHelloSpec.
+	certCompressionAlgorithms    []uint16
+	applicationSettingsProtocols []string
+
+	// greaseExtensions contains the types of the two GREASE extensions
+	// sent when Config.GREASE is set. See addGREASE.
+	greaseExtensions []uint16
 }
 
 func (m *clientHelloMsg) marshal() ([]byte, error) {
 	if m.raw != nil {
 		return m.raw, nil
 	}
+	if m.extensions != nil {
+		return m.marshalWithExtensions()
+	}
 
 	var exts cryptobyte.Builder
+	if len(m.greaseExtensions) > 0 {
+		// RFC 8701, Section 3.1
+		exts.AddUint16(m.greaseExtensions[0])
+		exts.AddUint16(0) // empty extension_data
+	}
 	if len(m.serverName) > 0 {
 		// RFC 6066, Section 3
 		exts.AddUint16(extensionServerName)
@@ -260,6 +282,20 @@ func (m *clientHelloMsg) marshal() ([]byte, error) {
 			exts.AddBytes(m.quicTransportParameters)
 		})
 	}
+	if len(m.encryptedClientHello) > 0 {
+		// draft-ietf-tls-esni, Section 5
+		exts.AddUint16(extensionEncryptedClientHello)
+		exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+			exts.AddBytes(m.encryptedClientHello)
+		})
+	}
+	if len(m.greaseExtensions) > 1 {
+		// RFC 8701, Section 3.1
+		exts.AddUint16(m.greaseExtensions[1])
+		exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+			exts.AddUint8(0)
+		})
+	}
 	if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
 		// RFC 8446, Section 4.2.11
 		exts.AddUint16(extensionPreSharedKey)
@@ -582,6 +618,12 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 			if !extData.CopyBytes(m.quicTransportParameters) {
 				return false
 			}
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni, Section 5
+			m.encryptedClientHello = make([]byte, len(extData))
+			if !extData.CopyBytes(m.encryptedClientHello) {
+				return false
+			}
 		case extensionPreSharedKey:
 			// RFC 8446, Section 4.2.11
 			if !extensions.Empty() {
@@ -648,6 +690,11 @@ type serverHelloMsg struct {
 	// HelloRetryRequest extensions
 	cookie        []byte
 	selectedGroup CurveID
+
+	// encryptedClientHello is only sent in a HelloRetryRequest, where it
+	// contains the ECH acceptance confirmation. See draft-ietf-tls-esni,
+	// Section 7.2.1.
+	encryptedClientHello []byte
 }
 
 func (m *serverHelloMsg) marshal() ([]byte, error) {
@@ -742,6 +789,12 @@ func (m *serverHelloMsg) marshal() ([]byte, error) {
 			})
 		})
 	}
+	if len(m.encryptedClientHello) > 0 {
+		exts.AddUint16(extensionEncryptedClientHello)
+		exts.AddUint16LengthPrefixed(func(exts *cryptobyte.Builder) {
+			exts.AddBytes(m.encryptedClientHello)
+		})
+	}
 
 	extBytes, err := exts.Bytes()
 	if err != nil {
@@ -875,6 +928,12 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				len(m.supportedPoints) == 0 {
 				return false
 			}
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni, Section 7.2.1
+			m.encryptedClientHello = make([]byte, len(extData))
+			if !extData.CopyBytes(m.encryptedClientHello) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -893,6 +952,16 @@ type encryptedExtensionsMsg struct {
 	alpnProtocol            string
 	quicTransportParameters []byte
 	earlyData               bool
+
+	// hasApplicationSettings and applicationSettings contain the
+	// ALPS extension, which is only used by clients using a
+	// ClientHelloSpec.
+	hasApplicationSettings bool
+	applicationSettings    []byte
+
+	// echRetryConfigs is the ECHConfigList sent by a server that
+	// rejected ECH. See draft-ietf-tls-esni, Section 7.1.
+	echRetryConfigs []byte
 }
 
 func (m *encryptedExtensionsMsg) marshal() ([]byte, error) {
@@ -926,6 +995,20 @@ func (m *encryptedExtensionsMsg) marshal() ([]byte, error) {
 				b.AddUint16(extensionEarlyData)
 				b.AddUint16(0) // empty extension_data
 			}
+			if m.hasApplicationSettings {
+				// draft-vvv-tls-alps, Section 4
+				b.AddUint16(extensionApplicationSettings)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.applicationSettings)
+				})
+			}
+			if len(m.echRetryConfigs) > 0 {
+				// draft-ietf-tls-esni, Section 5
+				b.AddUint16(extensionEncryptedClientHello)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.echRetryConfigs)
+				})
+			}
 		})
 	})
 
@@ -972,6 +1055,16 @@ func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 		case extensionEarlyData:
 			// RFC 8446, Section 4.2.10
 			m.earlyData = true
+		case extensionApplicationSettings:
+			// draft-vvv-tls-alps, Section 4
+			m.hasApplicationSettings = true
+			extData.ReadBytes(&m.applicationSettings, len(extData))
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni, Section 5
+			m.echRetryConfigs = make([]byte, len(extData))
+			if !extData.CopyBytes(m.echRetryConfigs) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -40,7 +40,7 @@ type serverHandshakeState struct {
 
 // serverHandshake performs a TLS handshake as a server.
 func (c *Conn) serverHandshake(ctx context.Context) error {
-	clientHello, err := c.readClientHello(ctx)
+	clientHello, ech, err := c.readClientHello(ctx)
 	if err != nil {
 		return err
 	}
@@ -50,6 +50,7 @@ func (c *Conn) serverHandshake(ctx context.Context) error {
 			c:           c,
 			ctx:         ctx,
 			clientHello: clientHello,
+			echContext:  ech,
 		}
 		return hs.handshake()
 	}
@@ -130,17 +131,36 @@ func (hs *serverHandshakeState) handshake() error {
 }
 
 // readClientHello reads a ClientHello message and selects the protocol version.
-func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
+func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, *echServerContext, error) {
 	// clientHelloMsg is included in the transcript, but we haven't initialized
 	// it yet. The respective handshake functions will record it themselves.
+	c.expectHandshake(typeClientHello)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	clientHello, ok := msg.(*clientHelloMsg)
 	if !ok {
 		c.sendAlert(alertUnexpectedMessage)
-		return nil, unexpectedMessageError(clientHello, msg)
+		return nil, nil, unexpectedMessageError(clientHello, msg)
+	}
+
+	// ECH processing has to be done before any other negotiation based on
+	// the contents of the ClientHello, since we may swap it out completely.
+	var ech *echServerContext
+	if len(clientHello.encryptedClientHello) != 0 {
+		echKeys := c.config.EncryptedClientHelloKeys
+		if c.config.GetEncryptedClientHelloKeys != nil {
+			echKeys, err = c.config.GetEncryptedClientHelloKeys(clientHelloInfo(ctx, c, clientHello))
+			if err != nil {
+				c.sendAlert(alertInternalError)
+				return nil, nil, c.callbackError(err)
+			}
+		}
+		clientHello, ech, err = c.processECHClientHello(clientHello, echKeys)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	var configForClient *Config
@@ -149,7 +169,7 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 		chi := clientHelloInfo(ctx, c, clientHello)
 		if configForClient, err = c.config.GetConfigForClient(chi); err != nil {
 			c.sendAlert(alertInternalError)
-			return nil, err
+			return nil, nil, c.callbackError(err)
 		} else if configForClient != nil {
 			c.config = configForClient
 		}
@@ -163,7 +183,7 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 	c.vers, ok = c.config.mutualVersion(roleServer, clientVersions)
 	if !ok {
 		c.sendAlert(alertProtocolVersion)
-		return nil, fmt.Errorf("tls: client offered only unsupported versions: %x", clientVersions)
+		return nil, nil, fmt.Errorf("tls: client offered only unsupported versions: %x", clientVersions)
 	}
 	c.haveVers = true
 	c.in.version = c.vers
@@ -173,7 +193,16 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 		tls10server.IncNonDefault()
 	}
 
-	return clientHello, nil
+	// A client-facing server must only accept ECH with TLS 1.3, while a
+	// backend server, which only sees the inner ClientHello, may not be able
+	// to expect the client-facing server to enforce it. See
+	// draft-ietf-tls-esni, Section 7.1.
+	if c.vers != VersionTLS13 && (ech != nil && !ech.inner) {
+		c.sendAlert(alertIllegalParameter)
+		return nil, nil, errors.New("tls: Encrypted Client Hello cannot be used pre-TLS 1.3")
+	}
+
+	return clientHello, ech, nil
 }
 
 func (hs *serverHandshakeState) processClientHello() error {
@@ -239,6 +268,7 @@ func (hs *serverHandshakeState) processClientHello() error {
 		if err == errNoCertificates {
 			c.sendAlert(alertUnrecognizedName)
 		} else {
+			c.callbackError(err)
 			c.sendAlert(alertInternalError)
 		}
 		return err
@@ -247,7 +277,7 @@ func (hs *serverHandshakeState) processClientHello() error {
 		hs.hello.scts = hs.cert.SignedCertificateTimestamps
 	}
 
-	hs.ecdheOk = supportsECDHE(c.config, hs.clientHello.supportedCurves, hs.clientHello.supportedPoints)
+	hs.ecdheOk = supportsECDHE(c.config, c.vers, hs.clientHello.supportedCurves, hs.clientHello.supportedPoints)
 
 	if hs.ecdheOk && len(hs.clientHello.supportedPoints) > 0 {
 		// Although omitting the ec_point_formats extension is permitted, some
@@ -318,10 +348,10 @@ func negotiateALPN(serverProtos, clientProtos []string, quic bool) (string, erro
 
 // supportsECDHE returns whether ECDHE key exchanges can be used with this
 // pre-TLS 1.3 client.
-func supportsECDHE(c *Config, supportedCurves []CurveID, supportedPoints []uint8) bool {
+func supportsECDHE(c *Config, version uint16, supportedCurves []CurveID, supportedPoints []uint8) bool {
 	supportsCurve := false
 	for _, curve := range supportedCurves {
-		if c.supportsCurve(curve) {
+		if c.supportsCurve(version, curve) {
 			supportsCurve = true
 			break
 		}
@@ -422,7 +452,7 @@ func (hs *serverHandshakeState) checkForResumption() error {
 	if c.config.UnwrapSession != nil {
 		ss, err := c.config.UnwrapSession(hs.clientHello.sessionTicket, c.connectionStateLocked())
 		if err != nil {
-			return err
+			return c.callbackError(err)
 		}
 		if ss == nil {
 			return nil
@@ -503,6 +533,7 @@ func (hs *serverHandshakeState) checkForResumption() error {
 	c.scts = sessionState.scts
 	c.verifiedChains = sessionState.verifiedChains
 	c.extMasterSecret = sessionState.extMasterSecret
+	c.curveID = sessionState.curveID
 	hs.sessionState = sessionState
 	hs.suite = suite
 	c.didResume = true
@@ -514,6 +545,7 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 
 	hs.hello.cipherSuite = hs.suite.id
 	c.cipherSuite = hs.suite.id
+	c.traceNegotiated()
 	// We echo the client's session ID in the ServerHello to let it know
 	// that we're doing a resumption.
 	hs.hello.sessionId = hs.clientHello.sessionId
@@ -531,7 +563,7 @@ func (hs *serverHandshakeState) doResumeHandshake() error {
 	}
 
 	if c.config.VerifyConnection != nil {
-		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+		if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
@@ -585,6 +617,8 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		c.sendAlert(alertHandshakeFailure)
 		return err
 	}
+	c.curveID = keyAgreementCurveID(keyAgreement)
+	c.traceNegotiated()
 	if skx != nil {
 		if _, err := hs.c.writeHandshakeRecord(skx, &hs.finishedHash); err != nil {
 			return err
@@ -628,6 +662,11 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 
 	var pub crypto.PublicKey // public key for client auth, if any
 
+	if c.config.ClientAuth >= RequestClientCert {
+		c.expectHandshake(typeCertificate)
+	} else {
+		c.expectHandshake(typeClientKeyExchange)
+	}
 	msg, err := c.readHandshake(&hs.finishedHash)
 	if err != nil {
 		return err
@@ -651,13 +690,14 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 			pub = c.peerCertificates[0].PublicKey
 		}
 
+		c.expectHandshake(typeClientKeyExchange)
 		msg, err = c.readHandshake(&hs.finishedHash)
 		if err != nil {
 			return err
 		}
 	}
 	if c.config.VerifyConnection != nil {
-		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+		if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
@@ -698,6 +738,7 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		// certificateVerifyMsg is included in the transcript, but not until
 		// after we verify the handshake signature, since the state before
 		// this message was sent is used.
+		c.expectHandshake(typeCertificateVerify)
 		msg, err = c.readHandshake(nil)
 		if err != nil {
 			return err
@@ -764,6 +805,8 @@ func (hs *serverHandshakeState) establishKeys() error {
 
 	c.in.prepareCipherSpec(c.vers, clientCipher, clientHash)
 	c.out.prepareCipherSpec(c.vers, serverCipher, serverHash)
+	c.in.nextKey, c.in.nextIV = clientKey, clientIV
+	c.out.nextKey, c.out.nextIV = serverKey, serverIV
 
 	return nil
 }
@@ -778,6 +821,7 @@ func (hs *serverHandshakeState) readFinished(out []byte) error {
 	// finishedMsg is included in the transcript, but not until after we
 	// check the client version, since the state before this message was
 	// sent is used during verification.
+	c.expectHandshake(typeFinished)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -824,7 +868,7 @@ func (hs *serverHandshakeState) sendSessionTicket() error {
 	if c.config.WrapSession != nil {
 		m.ticket, err = c.config.WrapSession(c.connectionStateLocked(), state)
 		if err != nil {
-			return err
+			return c.callbackError(err)
 		}
 	} else {
 		stateBytes, err := state.Bytes()
@@ -933,7 +977,7 @@ func (c *Conn) processCertsFromClient(certificate Certificate) error {
 	}
 
 	if c.config.VerifyPeerCertificate != nil {
-		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+		if err := c.callbackError(c.config.VerifyPeerCertificate(certificates, c.verifiedChains)); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
@@ -947,7 +991,6 @@ func clientHelloInfo(ctx context.Context, c *Conn, clientHello *clientHelloMsg)
 	if len(clientHello.supportedVersions) == 0 {
 		supportedVersions = supportedVersionsFromMax(clientHello.vers)
 	}
-
 	return &ClientHelloInfo{
 		CipherSuites:      clientHello.cipherSuites,
 		ServerName:        clientHello.serverName,
@@ -956,8 +999,11 @@ func clientHelloInfo(ctx context.Context, c *Conn, clientHello *clientHelloMsg)
 		SignatureSchemes:  clientHello.supportedSignatureAlgorithms,
 		SupportedProtos:   clientHello.alpnProtocols,
 		SupportedVersions: supportedVersions,
+		Extensions:        clientHello.extensionTypes(),
 		Conn:              c.conn,
 		config:            c.config,
 		ctx:               ctx,
+		hello:             clientHello,
+		quic:              c.quic != nil,
 	}
 }
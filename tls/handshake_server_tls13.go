@@ -40,6 +40,7 @@ type serverHandshakeStateTLS13 struct {
 	trafficSecret   []byte // client_application_traffic_secret_0
 	transcript      hash.Hash
 	clientFinished  []byte
+	echContext      *echServerContext
 }
 
 func (hs *serverHandshakeStateTLS13) handshake() error {
@@ -182,7 +183,7 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	var selectedGroup CurveID
 	var clientKeyShare *keyShare
 GroupSelection:
-	for _, preferredGroup := range c.config.curvePreferences() {
+	for _, preferredGroup := range c.config.curvePreferences(c.vers) {
 		for _, ks := range hs.clientHello.keyShares {
 			if ks.group == preferredGroup {
 				selectedGroup = ks.group
@@ -211,26 +212,22 @@ GroupSelection:
 		clientKeyShare = &hs.clientHello.keyShares[0]
 	}
 
-	if _, ok := curveForCurveID(selectedGroup); !ok {
+	if !isSupportedKeyShareGroup(selectedGroup) {
 		c.sendAlert(alertInternalError)
 		return errors.New("tls: CurvePreferences includes unsupported curve")
 	}
-	key, err := generateECDHEKey(c.config.rand(), selectedGroup)
-	if err != nil {
-		c.sendAlert(alertInternalError)
-		return err
-	}
-	hs.hello.serverShare = keyShare{group: selectedGroup, data: key.PublicKey().Bytes()}
-	peerKey, err := key.Curve().NewPublicKey(clientKeyShare.data)
-	if err != nil {
-		c.sendAlert(alertIllegalParameter)
-		return errors.New("tls: invalid client key share")
-	}
-	hs.sharedKey, err = key.ECDH(peerKey)
-	if err != nil {
+	serverShare, sharedKey, err := serverKeyShare(c.config.rand(), selectedGroup, clientKeyShare.data)
+	if err == errInvalidKeyShare {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: invalid client key share")
+	} else if err != nil {
+		c.sendAlert(alertInternalError)
+		return err
 	}
+	hs.hello.serverShare = keyShare{group: selectedGroup, data: serverShare}
+	hs.sharedKey = sharedKey
+	c.curveID = selectedGroup
+	c.traceNegotiated()
 
 	selectedProto, err := negotiateALPN(c.config.NextProtos, hs.clientHello.alpnProtocols, c.quic != nil)
 	if err != nil {
@@ -300,7 +297,7 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 			var err error
 			sessionState, err = c.config.UnwrapSession(identity.label, c.connectionStateLocked())
 			if err != nil {
-				return err
+				return c.callbackError(err)
 			}
 			if sessionState == nil {
 				continue
@@ -444,6 +441,7 @@ func (hs *serverHandshakeStateTLS13) pickCertificate() error {
 		if err == errNoCertificates {
 			c.sendAlert(alertUnrecognizedName)
 		} else {
+			c.callbackError(err)
 			c.sendAlert(alertInternalError)
 		}
 		return err
@@ -497,6 +495,12 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		selectedGroup:     selectedGroup,
 	}
 
+	if hs.echContext != nil {
+		if err := hs.processECHHelloRetryRequest(helloRetryRequest); err != nil {
+			return err
+		}
+	}
+
 	if _, err := hs.c.writeHandshakeRecord(helloRetryRequest, hs.transcript); err != nil {
 		return err
 	}
@@ -506,6 +510,7 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 	}
 
 	// clientHelloMsg is not included in the transcript.
+	c.expectHandshake(typeClientHello)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -517,6 +522,13 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		return unexpectedMessageError(clientHello, msg)
 	}
 
+	if hs.echContext != nil {
+		clientHello, err = hs.processECHSecondClientHello(clientHello)
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(clientHello.keyShares) != 1 || clientHello.keyShares[0].group != selectedGroup {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: client sent invalid key share in second ClientHello")
@@ -597,6 +609,12 @@ func illegalClientHelloChange(ch, ch1 *clientHelloMsg) bool {
 func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	c := hs.c
 
+	if hs.echContext != nil {
+		if err := hs.setECHAcceptConfirmation(); err != nil {
+			return err
+		}
+	}
+
 	if err := transcriptMsg(hs.clientHello, hs.transcript); err != nil {
 		return err
 	}
@@ -653,6 +671,11 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		encryptedExtensions.earlyData = hs.earlyData
 	}
 
+	encryptedExtensions.echRetryConfigs, err = hs.echRetryConfigs()
+	if err != nil {
+		return err
+	}
+
 	if _, err := hs.c.writeHandshakeRecord(encryptedExtensions, hs.transcript); err != nil {
 		return err
 	}
@@ -846,7 +869,7 @@ func (c *Conn) sendSessionTicket(earlyData bool) error {
 	if c.config.WrapSession != nil {
 		m.label, err = c.config.WrapSession(c.connectionStateLocked(), state)
 		if err != nil {
-			return err
+			return c.callbackError(err)
 		}
 	} else {
 		stateBytes, err := state.Bytes()
@@ -890,7 +913,7 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 		// Make sure the connection is still being verified whether or not
 		// the server requested a client certificate.
 		if c.config.VerifyConnection != nil {
-			if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 				c.sendAlert(alertBadCertificate)
 				return err
 			}
@@ -901,6 +924,7 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 	// If we requested a client certificate, then the client must send a
 	// certificate message. If it's empty, no CertificateVerify is sent.
 
+	c.expectHandshake(typeCertificate)
 	msg, err := c.readHandshake(hs.transcript)
 	if err != nil {
 		return err
@@ -917,7 +941,7 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 	}
 
 	if c.config.VerifyConnection != nil {
-		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+		if err := c.callbackError(c.config.VerifyConnection(c.connectionStateLocked())); err != nil {
 			c.sendAlert(alertBadCertificate)
 			return err
 		}
@@ -927,6 +951,7 @@ func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
 		// certificateVerifyMsg is included in the transcript, but not until
 		// after we verify the handshake signature, since the state before
 		// this message was sent is used.
+		c.expectHandshake(typeCertificateVerify)
 		msg, err = c.readHandshake(nil)
 		if err != nil {
 			return err
@@ -976,6 +1001,7 @@ func (hs *serverHandshakeStateTLS13) readClientFinished() error {
 	c := hs.c
 
 	// finishedMsg is not included in the transcript.
+	c.expectHandshake(typeFinished)
 	msg, err := c.readHandshake(nil)
 	if err != nil {
 		return err
@@ -0,0 +1,464 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ooni/oocrypto/tls/fingerprint"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ClientHelloMessage is a ClientHello handshake message. It is parsed and
+// marshaled with the same code used by the handshake, so it can decode
+// captured handshakes and build ClientHello messages for tests.
+//
+// The handshake messages that can be parsed and marshaled this way are
+// ClientHello, ServerHello, and the TLS 1.3 EncryptedExtensions and
+// Certificate, which are what passive observers and analysis tools look at.
+// The other handshake messages are not exported.
+//
+// The fields after Extensions contain the decoded values of the extensions
+// this package knows about. An extension sets its field even if it appears
+// in Extensions with custom Data, so the fields reflect what was parsed.
+type ClientHelloMessage struct {
+	// Version is the legacy_version field.
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+
+	// Extensions contains the extensions, in order, with their raw
+	// extension_data. When marshaling, it has the same meaning as
+	// ClientHelloSpec.Extensions: an extension with nil Data is generated
+	// from the fields below, and a nil Extensions uses the default layout
+	// of this package, omitting the extensions that only a ClientHelloSpec
+	// can send.
+	Extensions []ClientHelloExtension
+
+	ServerName                   string
+	OCSPStapling                 bool
+	SupportedCurves              []CurveID
+	SupportedPoints              []uint8
+	SessionTicketSupported       bool
+	SessionTicket                []byte
+	SignatureAlgorithms          []SignatureScheme
+	SignatureAlgorithmsCert      []SignatureScheme
+	SecureRenegotiationSupported bool
+	SecureRenegotiation          []byte
+	ExtendedMasterSecret         bool
+	ALPNProtocols                []string
+	SCTs                         bool
+	SupportedVersions            []uint16
+	Cookie                       []byte
+	KeyShares                    []KeyShare
+	EarlyData                    bool
+	PSKModes                     []uint8
+	PSKIdentities                []PSKIdentity
+	PSKBinders                   [][]byte
+	QUICTransportParameters      []byte
+	EncryptedClientHello         []byte
+	CertCompressionAlgorithms    []uint16
+	ApplicationSettingsProtocols []string
+}
+
+// ServerHelloMessage is a ServerHello handshake message, including a
+// HelloRetryRequest. See ClientHelloMessage.
+type ServerHelloMessage struct {
+	// Version is the legacy_version field.
+	Version           uint16
+	Random            []byte
+	SessionID         []byte
+	CipherSuite       uint16
+	CompressionMethod uint8
+
+	// Extensions contains the extensions, in order, with their raw
+	// extension_data. When marshaling, an extension with nil Data is
+	// generated from the fields below, or omitted if they do not set it,
+	// and a nil Extensions uses the default layout of this package.
+	Extensions []Extension
+
+	OCSPStapling                 bool
+	SessionTicketSupported       bool
+	SecureRenegotiationSupported bool
+	SecureRenegotiation          []byte
+	ExtendedMasterSecret         bool
+	ALPNProtocol                 string
+	SCTs                         [][]byte
+	SupportedVersion             uint16
+	KeyShare                     KeyShare
+	SelectedIdentityPresent      bool
+	SelectedIdentity             uint16
+	SupportedPoints              []uint8
+
+	// Cookie and SelectedGroup are only sent in a HelloRetryRequest.
+	Cookie        []byte
+	SelectedGroup CurveID
+
+	// EncryptedClientHello is only sent in a HelloRetryRequest, where it
+	// contains the ECH acceptance confirmation.
+	EncryptedClientHello []byte
+}
+
+// Extension is an extension inside a handshake message, other than
+// ClientHelloMessage which uses ClientHelloExtension.
+type Extension struct {
+	Type uint16
+
+	// Data is the raw extension_data.
+	Data []byte
+}
+
+// KeyShare is an entry of the TLS 1.3 key_share extension. See RFC 8446,
+// Section 4.2.8.
+type KeyShare struct {
+	Group CurveID
+	Data  []byte
+}
+
+// PSKIdentity is an entry of the TLS 1.3 pre_shared_key extension. See RFC
+// 8446, Section 4.2.11.
+type PSKIdentity struct {
+	Identity            []byte
+	ObfuscatedTicketAge uint32
+}
+
+var (
+	errInvalidClientHello = errors.New("tls: invalid ClientHello message")
+	errInvalidServerHello = errors.New("tls: invalid ServerHello message")
+)
+
+// ParseClientHello parses a ClientHello handshake message, starting with its
+// four bytes header. The returned message does not alias data.
+func ParseClientHello(data []byte) (*ClientHelloMessage, error) {
+	data = bytes.Clone(data)
+	var m clientHelloMsg
+	if len(data) == 0 || data[0] != typeClientHello || !m.unmarshal(data) {
+		return nil, errInvalidClientHello
+	}
+	hello, ok := newClientHelloMessage(&m)
+	if !ok {
+		return nil, errInvalidClientHello
+	}
+	for _, ext := range hello.Extensions {
+		// The ClientHello parser ignores these extensions, which only
+		// clients using a ClientHelloSpec send.
+		if ext.Type == extensionCompressCertificate || ext.Type == extensionApplicationSettings {
+			if err := m.setExtensionFromData(ext); err != nil {
+				return nil, errInvalidClientHello
+			}
+		}
+	}
+	hello.CertCompressionAlgorithms = m.certCompressionAlgorithms
+	hello.ApplicationSettingsProtocols = m.applicationSettingsProtocols
+	return hello, nil
+}
+
+// newClientHelloMessage returns the ClientHelloMessage for m, which was
+// unmarshaled, aliasing it.
+func newClientHelloMessage(m *clientHelloMsg) (*ClientHelloMessage, bool) {
+	extensions, ok := helloExtensions(m.raw, m.extensionsOffset())
+	if !ok {
+		return nil, false
+	}
+	hello := &ClientHelloMessage{
+		Version:                      m.vers,
+		Random:                       m.random,
+		SessionID:                    m.sessionId,
+		CipherSuites:                 m.cipherSuites,
+		CompressionMethods:           m.compressionMethods,
+		ServerName:                   m.serverName,
+		OCSPStapling:                 m.ocspStapling,
+		SupportedCurves:              m.supportedCurves,
+		SupportedPoints:              m.supportedPoints,
+		SessionTicketSupported:       m.ticketSupported,
+		SessionTicket:                m.sessionTicket,
+		SignatureAlgorithms:          m.supportedSignatureAlgorithms,
+		SignatureAlgorithmsCert:      m.supportedSignatureAlgorithmsCert,
+		SecureRenegotiationSupported: m.secureRenegotiationSupported,
+		SecureRenegotiation:          m.secureRenegotiation,
+		ExtendedMasterSecret:         m.extendedMasterSecret,
+		ALPNProtocols:                m.alpnProtocols,
+		SCTs:                         m.scts,
+		SupportedVersions:            m.supportedVersions,
+		Cookie:                       m.cookie,
+		EarlyData:                    m.earlyData,
+		PSKModes:                     m.pskModes,
+		PSKBinders:                   m.pskBinders,
+		QUICTransportParameters:      m.quicTransportParameters,
+		EncryptedClientHello:         m.encryptedClientHello,
+	}
+	if extensions != nil {
+		hello.Extensions = make([]ClientHelloExtension, 0, len(extensions))
+	}
+	for _, ext := range extensions {
+		hello.Extensions = append(hello.Extensions, ClientHelloExtension{Type: ext.Type, Data: ext.Data})
+	}
+	for _, ks := range m.keyShares {
+		hello.KeyShares = append(hello.KeyShares, KeyShare{Group: ks.group, Data: ks.data})
+	}
+	for _, psk := range m.pskIdentities {
+		hello.PSKIdentities = append(hello.PSKIdentities, PSKIdentity{
+			Identity:            psk.label,
+			ObfuscatedTicketAge: psk.obfuscatedTicketAge,
+		})
+	}
+	return hello, true
+}
+
+// Marshal returns the ClientHello handshake message, including its four
+// bytes header.
+func (hello *ClientHelloMessage) Marshal() ([]byte, error) {
+	m := &clientHelloMsg{
+		vers:                             hello.Version,
+		random:                           hello.Random,
+		sessionId:                        hello.SessionID,
+		cipherSuites:                     hello.CipherSuites,
+		compressionMethods:               hello.CompressionMethods,
+		serverName:                       hello.ServerName,
+		ocspStapling:                     hello.OCSPStapling,
+		supportedCurves:                  hello.SupportedCurves,
+		supportedPoints:                  hello.SupportedPoints,
+		ticketSupported:                  hello.SessionTicketSupported,
+		sessionTicket:                    hello.SessionTicket,
+		supportedSignatureAlgorithms:     hello.SignatureAlgorithms,
+		supportedSignatureAlgorithmsCert: hello.SignatureAlgorithmsCert,
+		secureRenegotiationSupported:     hello.SecureRenegotiationSupported,
+		secureRenegotiation:              hello.SecureRenegotiation,
+		extendedMasterSecret:             hello.ExtendedMasterSecret,
+		alpnProtocols:                    hello.ALPNProtocols,
+		scts:                             hello.SCTs,
+		supportedVersions:                hello.SupportedVersions,
+		cookie:                           hello.Cookie,
+		earlyData:                        hello.EarlyData,
+		pskModes:                         hello.PSKModes,
+		pskBinders:                       hello.PSKBinders,
+		quicTransportParameters:          hello.QUICTransportParameters,
+		encryptedClientHello:             hello.EncryptedClientHello,
+		extensions:                       hello.Extensions,
+		certCompressionAlgorithms:        hello.CertCompressionAlgorithms,
+		applicationSettingsProtocols:     hello.ApplicationSettingsProtocols,
+	}
+	for _, ks := range hello.KeyShares {
+		m.keyShares = append(m.keyShares, keyShare{group: ks.Group, data: ks.Data})
+	}
+	for _, psk := range hello.PSKIdentities {
+		m.pskIdentities = append(m.pskIdentities, pskIdentity{
+			label:               psk.Identity,
+			obfuscatedTicketAge: psk.ObfuscatedTicketAge,
+		})
+	}
+	return m.marshal()
+}
+
+// ParseServerHello parses a ServerHello handshake message, starting with its
+// four bytes header. The returned message does not alias data.
+func ParseServerHello(data []byte) (*ServerHelloMessage, error) {
+	data = bytes.Clone(data)
+	var m serverHelloMsg
+	if len(data) == 0 || data[0] != typeServerHello || !m.unmarshal(data) {
+		return nil, errInvalidServerHello
+	}
+	hello, ok := newServerHelloMessage(&m)
+	if !ok {
+		return nil, errInvalidServerHello
+	}
+	return hello, nil
+}
+
+// newServerHelloMessage returns the ServerHelloMessage for m, which was
+// unmarshaled, aliasing it.
+func newServerHelloMessage(m *serverHelloMsg) (*ServerHelloMessage, bool) {
+	extensions, ok := helloExtensions(m.raw, 2+32+1+len(m.sessionId)+2+1)
+	if !ok {
+		return nil, false
+	}
+	hello := &ServerHelloMessage{
+		Version:                      m.vers,
+		Random:                       m.random,
+		SessionID:                    m.sessionId,
+		CipherSuite:                  m.cipherSuite,
+		CompressionMethod:            m.compressionMethod,
+		OCSPStapling:                 m.ocspStapling,
+		SessionTicketSupported:       m.ticketSupported,
+		SecureRenegotiationSupported: m.secureRenegotiationSupported,
+		SecureRenegotiation:          m.secureRenegotiation,
+		ExtendedMasterSecret:         m.extendedMasterSecret,
+		ALPNProtocol:                 m.alpnProtocol,
+		SCTs:                         m.scts,
+		SupportedVersion:             m.supportedVersion,
+		KeyShare:                     KeyShare{Group: m.serverShare.group, Data: m.serverShare.data},
+		SelectedIdentityPresent:      m.selectedIdentityPresent,
+		SelectedIdentity:             m.selectedIdentity,
+		SupportedPoints:              m.supportedPoints,
+		Cookie:                       m.cookie,
+		SelectedGroup:                m.selectedGroup,
+		EncryptedClientHello:         m.encryptedClientHello,
+		Extensions:                   extensions,
+	}
+	return hello, true
+}
+
+// Fingerprint returns the fields of the message that contribute to its JA3
+// and JA4 fingerprints.
+func (hello *ClientHelloMessage) Fingerprint() *fingerprint.ClientHello {
+	fp := &fingerprint.ClientHello{
+		Version:           hello.Version,
+		CipherSuites:      hello.CipherSuites,
+		ServerName:        hello.ServerName,
+		SupportedPoints:   hello.SupportedPoints,
+		ALPNProtocols:     hello.ALPNProtocols,
+		SupportedVersions: hello.SupportedVersions,
+	}
+	for _, ext := range hello.Extensions {
+		fp.Extensions = append(fp.Extensions, ext.Type)
+	}
+	for _, group := range hello.SupportedCurves {
+		fp.SupportedGroups = append(fp.SupportedGroups, uint16(group))
+	}
+	for _, alg := range hello.SignatureAlgorithms {
+		fp.SignatureAlgorithms = append(fp.SignatureAlgorithms, uint16(alg))
+	}
+	return fp
+}
+
+// Fingerprint returns the fields of the message that contribute to its JA3S
+// and JA4S fingerprints.
+func (hello *ServerHelloMessage) Fingerprint() *fingerprint.ServerHello {
+	fp := &fingerprint.ServerHello{
+		Version:          hello.Version,
+		CipherSuite:      hello.CipherSuite,
+		SupportedVersion: hello.SupportedVersion,
+		ALPNProtocol:     hello.ALPNProtocol,
+	}
+	for _, ext := range hello.Extensions {
+		fp.Extensions = append(fp.Extensions, ext.Type)
+	}
+	return fp
+}
+
+// IsHelloRetryRequest reports whether the message is a HelloRetryRequest.
+func (hello *ServerHelloMessage) IsHelloRetryRequest() bool {
+	return bytes.Equal(hello.Random, helloRetryRequestRandom)
+}
+
+// Marshal returns the ServerHello handshake message, including its four
+// bytes header.
+func (hello *ServerHelloMessage) Marshal() ([]byte, error) {
+	m := &serverHelloMsg{
+		vers:                         hello.Version,
+		random:                       hello.Random,
+		sessionId:                    hello.SessionID,
+		cipherSuite:                  hello.CipherSuite,
+		compressionMethod:            hello.CompressionMethod,
+		ocspStapling:                 hello.OCSPStapling,
+		ticketSupported:              hello.SessionTicketSupported,
+		secureRenegotiationSupported: hello.SecureRenegotiationSupported,
+		secureRenegotiation:          hello.SecureRenegotiation,
+		extendedMasterSecret:         hello.ExtendedMasterSecret,
+		alpnProtocol:                 hello.ALPNProtocol,
+		scts:                         hello.SCTs,
+		supportedVersion:             hello.SupportedVersion,
+		serverShare:                  keyShare{group: hello.KeyShare.Group, data: hello.KeyShare.Data},
+		selectedIdentityPresent:      hello.SelectedIdentityPresent,
+		selectedIdentity:             hello.SelectedIdentity,
+		supportedPoints:              hello.SupportedPoints,
+		cookie:                       hello.Cookie,
+		selectedGroup:                hello.SelectedGroup,
+		encryptedClientHello:         hello.EncryptedClientHello,
+	}
+	data, err := m.marshal()
+	if err != nil {
+		return nil, err
+	}
+	return reorderExtensions(data, 2+32+1+len(m.sessionId)+2+1, hello.Extensions)
+}
+
+// reorderExtensions returns the marshaled handshake message in data, whose
+// extensions start after the four bytes header and offset bytes of fixed
+// fields, with the extensions reordered and replaced by those with custom
+// data in exts. The generated extensions not in exts are dropped. If exts is
+// nil, data is returned unchanged.
+func reorderExtensions(data []byte, offset int, exts []Extension) ([]byte, error) {
+	if exts == nil {
+		return data, nil
+	}
+	generated, ok := helloExtensions(data, offset)
+	if !ok {
+		return nil, errors.New("tls: invalid marshaled message")
+	}
+	var b cryptobyte.Builder
+	b.AddUint8(data[0])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(data[4 : 4+offset])
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, ext := range exts {
+				extData := ext.Data
+				if extData == nil {
+					for _, gen := range generated {
+						if gen.Type == ext.Type {
+							extData = gen.Data
+							break
+						}
+					}
+					if extData == nil {
+						continue
+					}
+				}
+				b.AddUint16(ext.Type)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(extData)
+				})
+			}
+		})
+	})
+	return b.Bytes()
+}
+
+// extensionTypes returns the types of the extensions of a marshaled
+// ClientHello, in order, or nil if it cannot be parsed.
+func (m *clientHelloMsg) extensionTypes() []uint16 {
+	extensions, ok := helloExtensions(m.raw, m.extensionsOffset())
+	if !ok {
+		return nil
+	}
+	types := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		types = append(types, ext.Type)
+	}
+	return types
+}
+
+// extensionsOffset returns the length of the fixed fields of a marshaled
+// ClientHello, which precede its extensions.
+func (m *clientHelloMsg) extensionsOffset() int {
+	return 2 + 32 + 1 + len(m.sessionId) + 2 + 2*len(m.cipherSuites) + 1 + len(m.compressionMethods)
+}
+
+// helloExtensions returns the extensions of the marshaled handshake message
+// in data, whose extensions start after the four bytes header and offset
+// bytes of fixed fields. The extensions alias data.
+func helloExtensions(data []byte, offset int) ([]Extension, bool) {
+	s := cryptobyte.String(data)
+	if !s.Skip(4 + offset) {
+		return nil, false
+	}
+	if s.Empty() {
+		return nil, true
+	}
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) || !s.Empty() {
+		return nil, false
+	}
+	extensions := []Extension{}
+	for !exts.Empty() {
+		var ext Extension
+		if !exts.ReadUint16(&ext.Type) || !exts.ReadUint16LengthPrefixed((*cryptobyte.String)(&ext.Data)) {
+			return nil, false
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions, true
+}
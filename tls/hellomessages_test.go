@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestClientHelloMessageRoundTrip(t *testing.T) {
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 100; i++ {
+		v, _ := quick.Value(reflect.TypeOf(&clientHelloMsg{}), rand)
+		raw, err := v.Interface().(*clientHelloMsg).marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello, err := ParseClientHello(raw)
+		if err != nil {
+			t.Fatalf("parsing %x: %v", raw, err)
+		}
+		got, err := hello.Marshal()
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("marshaling with the parsed extensions: got %x, %v, want %x", got, err, raw)
+		}
+		// The fields alone must be enough to rebuild the message.
+		hello.Extensions = nil
+		if got, err := hello.Marshal(); err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("marshaling from the fields: got %x, %v, want %x", got, err, raw)
+		}
+	}
+}
+
+func TestServerHelloMessageRoundTrip(t *testing.T) {
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 100; i++ {
+		v, _ := quick.Value(reflect.TypeOf(&serverHelloMsg{}), rand)
+		raw, err := v.Interface().(*serverHelloMsg).marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello, err := ParseServerHello(raw)
+		if err != nil {
+			t.Fatalf("parsing %x: %v", raw, err)
+		}
+		got, err := hello.Marshal()
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("marshaling with the parsed extensions: got %x, %v, want %x", got, err, raw)
+		}
+		hello.Extensions = nil
+		if got, err := hello.Marshal(); err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("marshaling from the fields: got %x, %v, want %x", got, err, raw)
+		}
+	}
+}
+
+func TestClientHelloMessagePresets(t *testing.T) {
+	for _, name := range ClientHelloPresetNames() {
+		raw := presetClientHello(t, name)
+		hello, err := ParseClientHello(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := hello.Marshal(); err != nil || !bytes.Equal(got, raw) {
+			t.Errorf("%s: the marshaled ClientHello does not match", name)
+		}
+		if hello.ServerName != "example.golang" || len(hello.KeyShares) == 0 {
+			t.Errorf("%s: got ServerName %q and %d key shares", name, hello.ServerName, len(hello.KeyShares))
+		}
+	}
+
+	hello, err := ParseClientHello(presetClientHello(t, PresetChrome102))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hello.CertCompressionAlgorithms, []uint16{CertCompressionBrotli}) ||
+		!reflect.DeepEqual(hello.ApplicationSettingsProtocols, []string{"h2"}) {
+		t.Errorf("got compress_certificate %v and application_settings %v",
+			hello.CertCompressionAlgorithms, hello.ApplicationSettingsProtocols)
+	}
+
+	// Replace the server name, letting Marshal generate the extension.
+	for i := range hello.Extensions {
+		if hello.Extensions[i].Type == ExtensionServerName {
+			hello.Extensions[i].Data = nil
+		}
+	}
+	hello.ServerName = "other.example"
+	raw, err := hello.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParseClientHello(raw); err != nil || parsed.ServerName != "other.example" {
+		t.Errorf("got %v, %v", parsed, err)
+	}
+}
+
+func TestServerHelloMessageHandshake(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+	_, cs, err := testHandshake(t, recordingConfig(), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hrr, err := ParseServerHello(cs.HandshakeTranscript[1].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hrr.IsHelloRetryRequest() || hrr.SelectedGroup != CurveP256 {
+		t.Errorf("unexpected HelloRetryRequest %+v", hrr)
+	}
+	sh, err := ParseServerHello(cs.HandshakeTranscript[3].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.IsHelloRetryRequest() || sh.SupportedVersion != VersionTLS13 || sh.KeyShare.Group != CurveP256 ||
+		sh.CipherSuite != cs.CipherSuite || !bytes.Equal(sh.Random, cs.ServerRandom) {
+		t.Errorf("unexpected ServerHello %+v", sh)
+	}
+	want := []Extension{
+		{Type: extensionSupportedVersions, Data: []byte{3, 4}},
+		{Type: extensionKeyShare, Data: sh.Extensions[1].Data},
+	}
+	if !reflect.DeepEqual(sh.Extensions, want) {
+		t.Errorf("got extensions %v, want %v", sh.Extensions, want)
+	}
+
+	// Reorder the extensions.
+	sh.Extensions = []Extension{{Type: extensionKeyShare}, {Type: extensionSupportedVersions}}
+	raw, err := sh.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reordered, err := ParseServerHello(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reordered.Extensions[0].Type != extensionKeyShare || reordered.KeyShare.Group != CurveP256 {
+		t.Errorf("unexpected reordered ServerHello %+v", reordered)
+	}
+
+	for _, bad := range [][]byte{nil, {typeClientHello, 0, 0, 0}, raw[:len(raw)-1]} {
+		if _, err := ParseServerHello(bad); err == nil {
+			t.Errorf("parsing %x: expected an error", bad)
+		}
+	}
+	if _, err := ParseClientHello(raw); err == nil {
+		t.Error("parsing a ServerHello as a ClientHello: expected an error")
+	}
+}
+
+func TestClientHelloMessageFingerprint(t *testing.T) {
+	hello, err := ParseClientHello(presetClientHello(t, PresetChrome102))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := hello.Fingerprint()
+	if len(fp.Extensions) != len(hello.Extensions) || fp.Extensions[0] != hello.Extensions[0].Type {
+		t.Errorf("got extensions %v", fp.Extensions)
+	}
+	// The GREASE values are kept, and ignored by the fingerprints.
+	if !isGREASEValue(fp.CipherSuites[0]) || !isGREASEValue(fp.SupportedGroups[0]) ||
+		!isGREASEValue(fp.SupportedVersions[0]) {
+		t.Errorf("unexpected fingerprint inputs %+v", fp)
+	}
+	if fp.ServerName != "example.golang" || !reflect.DeepEqual(fp.ALPNProtocols, hello.ALPNProtocols) ||
+		len(fp.SignatureAlgorithms) != len(hello.SignatureAlgorithms) {
+		t.Errorf("unexpected fingerprint inputs %+v", fp)
+	}
+	if got, want := fp.JA4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("got JA4 %q, want %q", got, want)
+	}
+}
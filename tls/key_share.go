@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"io"
+
+	"github.com/ooni/oocrypto/internal/mlkem768"
+	"golang.org/x/crypto/sha3"
+)
+
+// This file implements the TLS 1.3 key shares, including the hybrid
+// post-quantum groups, which concatenate an X25519 key share and an
+// ML-KEM-768 (or Kyber768) one:
+//
+//   - X25519MLKEM768 (draft-kwiatkowski-tls-ecdhe-mlkem) sends the ML-KEM
+//     encapsulation key or ciphertext first, and uses the ML-KEM shared
+//     secret followed by the X25519 one;
+//
+//   - X25519Kyber768Draft00 (draft-tls-westerbaan-xyber768d00) sends the
+//     X25519 key share first, and uses the X25519 shared secret followed by
+//     the Kyber768 one.
+
+const x25519PublicKeySize = 32
+
+// isHybridGroup reports whether group is one of the hybrid post-quantum
+// groups, which are only used in TLS 1.3.
+func isHybridGroup(group CurveID) bool {
+	return group == X25519MLKEM768 || group == X25519Kyber768Draft00
+}
+
+// isSupportedKeyShareGroup reports whether we are able to generate a TLS 1.3
+// key share for group.
+func isSupportedKeyShareGroup(group CurveID) bool {
+	_, ok := curveForCurveID(group)
+	return ok || isHybridGroup(group)
+}
+
+// keySharePrivateKey is the private key of a key share sent by the client.
+type keySharePrivateKey struct {
+	group CurveID
+	ecdhe *ecdh.PrivateKey
+	mlkem *mlkem768.DecapsulationKey // only for the hybrid groups
+}
+
+// generateKeyShare generates a new client key share for group.
+func generateKeyShare(rand io.Reader, group CurveID) (*keySharePrivateKey, keyShare, error) {
+	if !isHybridGroup(group) {
+		key, err := generateECDHEKey(rand, group)
+		if err != nil {
+			return nil, keyShare{}, err
+		}
+		return &keySharePrivateKey{group: group, ecdhe: key},
+			keyShare{group: group, data: key.PublicKey().Bytes()}, nil
+	}
+	key, err := generateECDHEKey(rand, X25519)
+	if err != nil {
+		return nil, keyShare{}, err
+	}
+	dk, err := mlkem768.GenerateKey(rand)
+	if err != nil {
+		return nil, keyShare{}, err
+	}
+	var data []byte
+	if group == X25519MLKEM768 {
+		data = append(dk.EncapsulationKey().Bytes(), key.PublicKey().Bytes()...)
+	} else {
+		data = append(key.PublicKey().Bytes(), dk.EncapsulationKey().Bytes()...)
+	}
+	return &keySharePrivateKey{group: group, ecdhe: key, mlkem: dk},
+		keyShare{group: group, data: data}, nil
+}
+
+var errInvalidKeyShare = errors.New("tls: invalid key share")
+
+// sharedKey returns the shared secret given the server key share data.
+func (k *keySharePrivateKey) sharedKey(serverShare []byte) ([]byte, error) {
+	if k.mlkem == nil {
+		return ecdheSharedKey(k.ecdhe, serverShare)
+	}
+	if len(serverShare) != mlkem768.CiphertextSize+x25519PublicKeySize {
+		return nil, errInvalidKeyShare
+	}
+	if k.group == X25519MLKEM768 {
+		ciphertext, ecdheShare := serverShare[:mlkem768.CiphertextSize], serverShare[mlkem768.CiphertextSize:]
+		mlkemSecret, err := k.mlkem.Decapsulate(ciphertext)
+		if err != nil {
+			return nil, errInvalidKeyShare
+		}
+		ecdheSecret, err := ecdheSharedKey(k.ecdhe, ecdheShare)
+		if err != nil {
+			return nil, err
+		}
+		return append(mlkemSecret, ecdheSecret...), nil
+	}
+	ecdheShare, ciphertext := serverShare[:x25519PublicKeySize], serverShare[x25519PublicKeySize:]
+	ecdheSecret, err := ecdheSharedKey(k.ecdhe, ecdheShare)
+	if err != nil {
+		return nil, err
+	}
+	mlkemSecret, err := k.mlkem.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, errInvalidKeyShare
+	}
+	return append(ecdheSecret, kyberSharedSecret(mlkemSecret, ciphertext)...), nil
+}
+
+// serverKeyShare returns the server key share data for group given the
+// client key share data, along with the shared secret.
+func serverKeyShare(rand io.Reader, group CurveID, clientShare []byte) (serverShare, sharedKey []byte, err error) {
+	if !isHybridGroup(group) {
+		key, err := generateECDHEKey(rand, group)
+		if err != nil {
+			return nil, nil, err
+		}
+		sharedKey, err := ecdheSharedKey(key, clientShare)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key.PublicKey().Bytes(), sharedKey, nil
+	}
+	if len(clientShare) != mlkem768.EncapsulationKeySize+x25519PublicKeySize {
+		return nil, nil, errInvalidKeyShare
+	}
+	var encapsulationKey, ecdheShare []byte
+	if group == X25519MLKEM768 {
+		encapsulationKey, ecdheShare = clientShare[:mlkem768.EncapsulationKeySize], clientShare[mlkem768.EncapsulationKeySize:]
+	} else {
+		ecdheShare, encapsulationKey = clientShare[:x25519PublicKeySize], clientShare[x25519PublicKeySize:]
+	}
+	key, err := generateECDHEKey(rand, X25519)
+	if err != nil {
+		return nil, nil, err
+	}
+	ecdheSecret, err := ecdheSharedKey(key, ecdheShare)
+	if err != nil {
+		return nil, nil, err
+	}
+	ek, err := mlkem768.NewEncapsulationKey(encapsulationKey)
+	if err != nil {
+		return nil, nil, errInvalidKeyShare
+	}
+	mlkemSecret, ciphertext, err := ek.Encapsulate(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	if group == X25519MLKEM768 {
+		return append(ciphertext, key.PublicKey().Bytes()...), append(mlkemSecret, ecdheSecret...), nil
+	}
+	return append(key.PublicKey().Bytes(), ciphertext...),
+		append(ecdheSecret, kyberSharedSecret(mlkemSecret, ciphertext)...), nil
+}
+
+// ecdheSharedKey returns the ECDH shared secret between key and the peer
+// key share data.
+func ecdheSharedKey(key *ecdh.PrivateKey, peerShare []byte) ([]byte, error) {
+	peerKey, err := key.Curve().NewPublicKey(peerShare)
+	if err != nil {
+		return nil, errInvalidKeyShare
+	}
+	sharedKey, err := key.ECDH(peerKey)
+	if err != nil {
+		return nil, errInvalidKeyShare
+	}
+	return sharedKey, nil
+}
+
+// kyberSharedSecret returns the Kyber768 (round 3) shared secret given the
+// ML-KEM-768 one. Compared to Kyber, ML-KEM removed a final hashing step,
+// which we compute here as SHAKE-256(K || SHA3-256(c), 32). Kyber also hashes
+// the random message and uses a different implicit rejection, neither of
+// which affects interoperability. See
+// https://words.filippo.io/mlkem768/#bonus-track-using-a-ml-kem-implementation-as-kyber-v3.
+func kyberSharedSecret(K, c []byte) []byte {
+	h := sha3.NewShake256()
+	h.Write(K)
+	ch := sha3.Sum256(c)
+	h.Write(ch[:])
+	out := make([]byte, 32)
+	h.Read(out)
+	return out
+}
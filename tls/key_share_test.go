@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/ooni/oocrypto/internal/mlkem768"
+)
+
+func TestKeyShareRoundTrip(t *testing.T) {
+	for _, group := range []CurveID{X25519, CurveP256, X25519MLKEM768, X25519Kyber768Draft00} {
+		t.Run(group.String(), func(t *testing.T) {
+			key, share, err := generateKeyShare(rand.Reader, group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if share.group != group {
+				t.Fatalf("got group %v", share.group)
+			}
+			serverShare, serverSecret, err := serverKeyShare(rand.Reader, group, share.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientSecret, err := key.sharedKey(serverShare)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(clientSecret, serverSecret) {
+				t.Fatal("client and server shared secrets differ")
+			}
+			if isHybridGroup(group) {
+				if len(share.data) != mlkem768.EncapsulationKeySize+x25519PublicKeySize {
+					t.Errorf("got client key share of %d bytes", len(share.data))
+				}
+				if len(serverShare) != mlkem768.CiphertextSize+x25519PublicKeySize {
+					t.Errorf("got server key share of %d bytes", len(serverShare))
+				}
+				if len(clientSecret) != 64 {
+					t.Errorf("got shared secret of %d bytes", len(clientSecret))
+				}
+			}
+
+			if _, _, err := serverKeyShare(rand.Reader, group, share.data[1:]); err != errInvalidKeyShare {
+				t.Errorf("truncated client key share: got %v", err)
+			}
+			if _, err := key.sharedKey(serverShare[1:]); err != errInvalidKeyShare {
+				t.Errorf("truncated server key share: got %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyShareHybridLayout(t *testing.T) {
+	// The two hybrid groups carry the same components in opposite orders.
+	key, share, err := generateKeyShare(rand.Reader, X25519MLKEM768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(share.data, key.mlkem.EncapsulationKey().Bytes()) ||
+		!bytes.HasSuffix(share.data, key.ecdhe.PublicKey().Bytes()) {
+		t.Error("X25519MLKEM768 key share must be the ML-KEM key followed by the X25519 one")
+	}
+	key, share, err = generateKeyShare(rand.Reader, X25519Kyber768Draft00)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(share.data, key.ecdhe.PublicKey().Bytes()) ||
+		!bytes.HasSuffix(share.data, key.mlkem.EncapsulationKey().Bytes()) {
+		t.Error("X25519Kyber768Draft00 key share must be the X25519 key followed by the Kyber one")
+	}
+}
+
+func TestHybridKeyExchange(t *testing.T) {
+	for _, group := range []CurveID{X25519MLKEM768, X25519Kyber768Draft00} {
+		t.Run(group.String(), func(t *testing.T) {
+			serverConfig := testConfig.Clone()
+			serverConfig.CurvePreferences = []CurveID{group}
+
+			clientConfig := testConfig.Clone()
+			clientConfig.CurvePreferences = []CurveID{group, X25519}
+			c := &Conn{config: clientConfig}
+			hello, keys, err := c.makeClientHello()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || len(hello.keyShares) != 1 || hello.keyShares[0].group != group {
+				t.Fatal("expected a single hybrid key share")
+			}
+
+			_, cs, err := testHandshake(t, clientConfig, serverConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.Version != VersionTLS13 {
+				t.Errorf("got version %x", cs.Version)
+			}
+		})
+	}
+}
+
+func TestHybridKeyExchangeHelloRetryRequest(t *testing.T) {
+	for _, group := range []CurveID{X25519MLKEM768, X25519Kyber768Draft00} {
+		t.Run(group.String(), func(t *testing.T) {
+			// The client sends an X25519 key share and the server asks
+			// for a hybrid one, and vice versa.
+			for _, prefs := range [][]CurveID{{X25519, group}, {group, CurveP256}} {
+				serverConfig := testConfig.Clone()
+				serverConfig.CurvePreferences = prefs[1:]
+				clientConfig := testConfig.Clone()
+				clientConfig.CurvePreferences = prefs
+				_, cs, err := testHandshake(t, clientConfig, serverConfig)
+				if err != nil {
+					t.Fatalf("%v: %v", prefs, err)
+				}
+				if cs.Version != VersionTLS13 {
+					t.Errorf("%v: got version %x", prefs, cs.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestHybridKeyExchangeTLS12(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.MaxVersion = VersionTLS12
+	clientConfig.CurvePreferences = []CurveID{X25519MLKEM768, X25519}
+	c := &Conn{config: clientConfig}
+	hello, keys, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != nil || len(hello.keyShares) != 0 {
+		t.Error("expected no key shares in a TLS 1.2 ClientHello")
+	}
+	for _, curve := range hello.supportedCurves {
+		if isHybridGroup(curve) {
+			t.Errorf("TLS 1.2 ClientHello offers %v", curve)
+		}
+	}
+
+	// A TLS 1.2 server must skip the hybrid groups even when the client
+	// offers them, since they cannot be used in ServerKeyExchange.
+	serverConfig := testConfig.Clone()
+	serverConfig.MaxVersion = VersionTLS12
+	serverConfig.CurvePreferences = []CurveID{X25519MLKEM768, X25519}
+	clientConfig = testConfig.Clone()
+	clientConfig.ClientHelloSpec = testClientHelloSpec()
+	clientConfig.ClientHelloSpec.SupportedCurves = []CurveID{X25519MLKEM768, X25519}
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != VersionTLS12 {
+		t.Errorf("got version %x", cs.Version)
+	}
+
+	serverConfig.CurvePreferences = []CurveID{X25519MLKEM768}
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Error("expected an error when the only common group is a hybrid one")
+	}
+}
+
+func TestClientHelloSpecHybridKeyShare(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.ClientHelloSpec = testClientHelloSpec()
+	clientConfig.ClientHelloSpec.SupportedCurves = []CurveID{X25519MLKEM768, X25519, CurveP256}
+	clientConfig.ClientHelloSpec.KeyShareCurves = []CurveID{X25519MLKEM768, X25519}
+
+	for _, prefs := range [][]CurveID{{X25519MLKEM768}, {X25519}, {CurveP256}} {
+		serverConfig := testConfig.Clone()
+		serverConfig.CurvePreferences = prefs
+		_, cs, err := testHandshake(t, clientConfig, serverConfig)
+		if err != nil {
+			t.Fatalf("%v: %v", prefs, err)
+		}
+		if cs.Version != VersionTLS13 {
+			t.Errorf("%v: got version %x", prefs, cs.Version)
+		}
+	}
+}
+
+// countClientWrites runs a handshake and returns the number of Write calls
+// done by the client, which grows when the server sends a HelloRetryRequest.
+func countClientWrites(t *testing.T, clientConfig, serverConfig *Config) int {
+	t.Helper()
+	c, s := localPipe(t)
+	wcc := &writeCountingConn{Conn: c}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- Server(s, serverConfig).Handshake()
+		s.Close()
+	}()
+	cli := Client(wcc, clientConfig)
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+	return wcc.numWrites
+}
+
+func TestKeyShareCurves(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.CurvePreferences = []CurveID{X25519MLKEM768, X25519, CurveP256}
+	clientConfig.KeyShareCurves = []CurveID{X25519MLKEM768, CurveP256}
+	c := &Conn{config: clientConfig}
+	hello, keys, err := c.makeClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || len(hello.keyShares) != 2 ||
+		hello.keyShares[0].group != X25519MLKEM768 || hello.keyShares[1].group != CurveP256 {
+		t.Fatalf("unexpected key shares: %v", hello.keyShares)
+	}
+
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{X25519}
+	withHRR := countClientWrites(t, clientConfig, serverConfig)
+	for _, group := range []CurveID{X25519MLKEM768, CurveP256} {
+		serverConfig.CurvePreferences = []CurveID{group}
+		if n := countClientWrites(t, clientConfig, serverConfig); n >= withHRR {
+			t.Errorf("%v: got %d client writes, expected fewer than %d", group, n, withHRR)
+		}
+	}
+
+	for _, curves := range [][]CurveID{
+		{X25519, X25519},     // duplicate
+		{CurveP384},          // not in CurvePreferences
+		{X25519, CurveID(1)}, // unsupported
+	} {
+		clientConfig.KeyShareCurves = curves
+		if _, _, err := c.makeClientHello(); err == nil {
+			t.Errorf("%v: expected an error", curves)
+		}
+	}
+}
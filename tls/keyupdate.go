@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import "errors"
+
+// KeyUpdatePolicy controls when a TLS 1.3 Conn updates the keys it uses to
+// send records, by sending a KeyUpdate message (see RFC 8446, Section 4.6.3),
+// in addition to the updates requested by the peer or with Conn.UpdateKeys.
+// Long-lived connections can use it to stay below the usage limits of their
+// AEAD.
+//
+// The limits count the records and bytes of content sent with the current
+// keys, and are checked before sending application data. When the record
+// layer is offloaded to the kernel (see Config.KernelTLS), the number of
+// records is estimated from the number of bytes. KeyUpdatePolicy is ignored
+// by QUIC connections.
+type KeyUpdatePolicy struct {
+	// Bytes, if positive, is the maximum number of bytes sent with the same
+	// keys.
+	Bytes int64
+
+	// Records, if positive, is the maximum number of records sent with the
+	// same keys.
+	Records int64
+
+	// RequestPeerUpdate, when true, causes the KeyUpdate messages to ask the
+	// peer to update its own keys as well.
+	RequestPeerUpdate bool
+}
+
+// UpdateKeys sends a TLS 1.3 KeyUpdate message and updates the keys used to
+// send records. If requestPeerUpdate is true, the message asks the peer to
+// update its keys too, which it does when it next reads from the connection.
+//
+// UpdateKeys runs the handshake, if it has not yet been run, and returns an
+// error if the connection does not use TLS 1.3 or uses QUIC.
+func (c *Conn) UpdateKeys(requestPeerUpdate bool) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.quic != nil {
+		return errors.New("tls: UpdateKeys is not supported with QUIC")
+	}
+	if c.vers != VersionTLS13 {
+		return errors.New("tls: UpdateKeys requires TLS 1.3")
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	return c.out.setErrorLocked(c.sendKeyUpdateLocked(requestPeerUpdate))
+}
+
+// sendKeyUpdateLocked sends a KeyUpdate message and updates the sending keys.
+// c.out must be locked.
+func (c *Conn) sendKeyUpdateLocked(requestPeerUpdate bool) error {
+	cipherSuite := cipherSuiteTLS13ByID(c.cipherSuite)
+	if cipherSuite == nil {
+		return c.sendAlertLocked(alertInternalError)
+	}
+
+	msg := &keyUpdateMsg{updateRequested: requestPeerUpdate}
+	msgBytes, err := msg.marshal()
+	if err != nil {
+		return err
+	}
+	c.addHandshakeMessage(true, msgBytes)
+	if _, err := c.writeRecordLocked(recordTypeHandshake, msgBytes); err != nil {
+		return err
+	}
+
+	newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
+	c.out.setTrafficSecret(cipherSuite, QUICEncryptionLevelApplication, newSecret)
+	c.out.keyGeneration.Add(1)
+	return c.rekeyKernelTLS(&c.out)
+}
+
+// autoUpdateKeys sends a KeyUpdate message before a record of type typ
+// carrying n bytes of content, if required by c.config.KeyUpdatePolicy. It
+// returns how many of those bytes can be sent before the next update.
+// c.out must be locked.
+func (c *Conn) autoUpdateKeys(typ recordType, n int) (int, error) {
+	p := c.config.KeyUpdatePolicy
+	if p == nil || typ != recordTypeApplicationData || c.vers != VersionTLS13 || c.quic != nil {
+		return n, nil
+	}
+	if p.Bytes > 0 && c.out.trafficBytes >= p.Bytes || p.Records > 0 && c.out.trafficRecords >= p.Records {
+		if err := c.sendKeyUpdateLocked(p.RequestPeerUpdate); err != nil {
+			return 0, err
+		}
+	}
+	if p.Bytes > 0 && int64(n) > p.Bytes-c.out.trafficBytes {
+		n = int(p.Bytes - c.out.trafficBytes)
+	}
+	if p.Records > 0 && int64(n) > (p.Records-c.out.trafficRecords)*maxPlaintext {
+		n = int((p.Records - c.out.trafficRecords) * maxPlaintext)
+	}
+	return n, nil
+}
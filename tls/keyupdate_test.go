@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"io"
+	"testing"
+)
+
+// keyUpdatePipe returns a client and a server Conn which completed the
+// handshake over a local TCP connection.
+func keyUpdatePipe(t *testing.T, clientConfig *Config) (client, server *Conn) {
+	t.Helper()
+	c, s := localPipe(t)
+	client = Client(c, clientConfig)
+	server = Server(s, testConfig)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func checkKeyGenerations(t *testing.T, name string, c *Conn, write, read uint64) {
+	t.Helper()
+	state := c.ConnectionState()
+	if state.WriteKeyGeneration != write || state.ReadKeyGeneration != read {
+		t.Errorf("%s: got write generation %d and read generation %d, want %d and %d",
+			name, state.WriteKeyGeneration, state.ReadKeyGeneration, write, read)
+	}
+}
+
+// transfer writes n bytes from w to r, with Write calls of at most size
+// bytes, and reads them from r.
+func transfer(t *testing.T, w, r *Conn, n, size int) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, size)
+		for sent := 0; sent < n; sent += size {
+			if n-sent < size {
+				buf = buf[:n-sent]
+			}
+			if _, err := w.Write(buf); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+	client, server := keyUpdatePipe(t, testConfig)
+	checkKeyGenerations(t, "client", client, 0, 0)
+
+	if err := client.UpdateKeys(true); err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, client, server, 10, 10)
+	// The server responds with its own KeyUpdate, read by the client.
+	transfer(t, server, client, 10, 10)
+	checkKeyGenerations(t, "client", client, 1, 1)
+	checkKeyGenerations(t, "server", server, 1, 1)
+
+	if err := client.UpdateKeys(false); err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, client, server, 10, 10)
+	transfer(t, server, client, 10, 10)
+	checkKeyGenerations(t, "client", client, 2, 1)
+	checkKeyGenerations(t, "server", server, 1, 2)
+
+	clientConfig := testConfig.Clone()
+	clientConfig.MaxVersion = VersionTLS12
+	client, _ = keyUpdatePipe(t, clientConfig)
+	if err := client.UpdateKeys(false); err == nil {
+		t.Error("UpdateKeys succeeded with TLS 1.2")
+	}
+}
+
+func TestKeyUpdatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  KeyUpdatePolicy
+		n, size int
+		want    uint64
+	}{
+		{"Records", KeyUpdatePolicy{Records: 3}, 10, 1, 3},
+		{"Bytes", KeyUpdatePolicy{Bytes: 1000}, 2500, 2500, 2},
+		{"BytesAndRecords", KeyUpdatePolicy{Bytes: 1000, Records: 2}, 2500, 100, 12},
+		{"LargeWrite", KeyUpdatePolicy{Records: 2}, 5 * maxPlaintext, 5 * maxPlaintext, 2},
+		{"RequestPeerUpdate", KeyUpdatePolicy{Bytes: 1000, RequestPeerUpdate: true}, 2500, 2500, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig := testConfig.Clone()
+			clientConfig.KeyUpdatePolicy = &tc.policy
+			clientConfig.DynamicRecordSizingDisabled = true
+			client, server := keyUpdatePipe(t, clientConfig)
+			transfer(t, client, server, tc.n, tc.size)
+			checkKeyGenerations(t, "client", client, tc.want, 0)
+			var serverWrite uint64
+			if tc.policy.RequestPeerUpdate {
+				serverWrite = tc.want
+			}
+			checkKeyGenerations(t, "server", server, serverWrite, tc.want)
+		})
+	}
+}
@@ -0,0 +1,354 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/cpu"
+)
+
+// errKernelTLSUnsupported is returned when kernel TLS is not available on
+// this platform.
+var errKernelTLSUnsupported = errors.New("tls: kernel TLS is not supported on this platform")
+
+// kernelTLS is the state of a Conn whose record layer is offloaded to the
+// kernel, in one or both directions. It does not change once published
+// through Conn.kernelTLS. See Config.KernelTLS.
+type kernelTLS struct {
+	conn *net.TCPConn
+	raw  syscall.RawConn
+	tx   bool
+	rx   bool
+
+	// buf and oob are used to receive records and their control messages
+	// when rx is true. Conn.in must be locked to use them.
+	buf, oob []byte
+}
+
+// KernelTLS reports whether the record layer for writing and reading is
+// offloaded to the kernel. See Config.KernelTLS.
+func (c *Conn) KernelTLS() (tx, rx bool) {
+	if k := c.kernelTLS.Load(); k != nil {
+		return k.tx, k.rx
+	}
+	return false, false
+}
+
+// enableKernelTLS tries to offload the record layer to the kernel, according
+// to c.config.KernelTLS, after the handshake completed successfully. If the
+// record layer cannot be offloaded, the Conn keeps using its own, but once
+// the tls upper layer protocol is attached to the socket, which cannot be
+// undone, failing to install the keys is a fatal error. c.in must be locked.
+func (c *Conn) enableKernelTLS() error {
+	if !c.config.KernelTLS || c.quic != nil || c.handshakes != 1 {
+		return nil
+	}
+	// Renegotiation would require installing the new keys in the middle of
+	// the record stream, which the kernel does not support.
+	if c.vers == VersionTLS12 && c.config.Renegotiation != RenegotiateNever {
+		return nil
+	}
+	tcpConn, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if !kernelTLSSupported(c.vers, c.cipherSuite) {
+		return nil
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	var txInfo, rxInfo []byte
+	// The kernel does not pad records, and must start from a record boundary.
+	if c.config.RecordPadding == nil && len(c.sendBuf) == 0 && c.out.err == nil {
+		txInfo, _ = c.kernelCryptoInfo(&c.out)
+	}
+	// Records already read from the connection were not seen by the kernel.
+	if c.rawInput.Len() == 0 && c.hand.Len() == 0 && c.in.err == nil {
+		rxInfo, _ = c.kernelCryptoInfo(&c.in)
+	}
+	if txInfo == nil && rxInfo == nil {
+		return nil
+	}
+	if err := kernelTLSEnable(raw); err != nil {
+		// The tls kernel module is not available.
+		return nil
+	}
+	k := &kernelTLS{conn: tcpConn, raw: raw, tx: txInfo != nil, rx: rxInfo != nil}
+	if k.tx {
+		if err := kernelTLSSetKey(raw, false, txInfo); err != nil {
+			return c.out.setErrorLocked(errors.New("tls: failed to install kernel TLS keys: " + err.Error()))
+		}
+	}
+	if k.rx {
+		if err := kernelTLSSetKey(raw, true, rxInfo); err != nil {
+			return c.out.setErrorLocked(errors.New("tls: failed to install kernel TLS keys: " + err.Error()))
+		}
+		k.buf = make([]byte, maxPlaintext)
+		k.oob = make([]byte, 64)
+	}
+	c.kernelTLS.Store(k)
+	return nil
+}
+
+var (
+	kernelVersionOnce        sync.Once
+	kernelMajor, kernelMinor int
+)
+
+// kernelVersionAtLeast reports whether the running kernel is Linux
+// major.minor or later, according to the release reported by uname(2).
+func kernelVersionAtLeast(major, minor int) bool {
+	kernelVersionOnce.Do(func() {
+		kernelMajor, kernelMinor = parseKernelRelease(kernelRelease())
+	})
+	return kernelMajor > major || kernelMajor == major && kernelMinor >= minor
+}
+
+// parseKernelRelease returns the major and minor version at the start of a
+// kernel release such as "6.14.0-15-generic", or zeros if there are none.
+func parseKernelRelease(release string) (major, minor int) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	end := 0
+	for end < len(parts[1]) && '0' <= parts[1][end] && parts[1][end] <= '9' {
+		end++
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1][:end])
+	if err1 != nil || err2 != nil {
+		return 0, 0
+	}
+	return major, minor
+}
+
+// kernelTLSSupported reports whether the running kernel can offload the
+// record layer of a connection using the given version and cipher suite,
+// without trying to, since the tls upper layer protocol cannot be detached
+// from a socket. TLS 1.3 requires Linux 6.14 or later, which can update the
+// keys after a KeyUpdate message.
+func kernelTLSSupported(version, suite uint16) bool {
+	cipherType, ok := kernelTLSCipher(suite)
+	if !ok {
+		return false
+	}
+	switch {
+	case version == VersionTLS13:
+		return kernelVersionAtLeast(6, 14)
+	case version != VersionTLS12:
+		return false
+	case cipherType == kernelTLSCipherChaCha20Poly1305:
+		return kernelVersionAtLeast(5, 11)
+	case cipherType == kernelTLSCipherAESGCM256:
+		return kernelVersionAtLeast(5, 2)
+	}
+	return kernelVersionAtLeast(4, 17)
+}
+
+// rekeyKernelTLS installs the current keys of hc, which must be c.in or
+// c.out, in the kernel, if the record layer for that direction is offloaded.
+// It is called after hc.setTrafficSecret. hc must be locked.
+func (c *Conn) rekeyKernelTLS(hc *halfConn) error {
+	k := c.kernelTLS.Load()
+	if k == nil {
+		return nil
+	}
+	rx := hc == &c.in
+	if rx && !k.rx || !rx && !k.tx {
+		return nil
+	}
+	info, ok := c.kernelCryptoInfo(hc)
+	if !ok {
+		return errors.New("tls: internal error: unsupported kernel TLS cipher suite")
+	}
+	if err := kernelTLSSetKey(k.raw, rx, info); err != nil {
+		return errors.New("tls: failed to update kernel TLS keys: " + err.Error())
+	}
+	return nil
+}
+
+// readKernelRecord reads the next record from a Conn whose record layer for
+// reading is offloaded to the kernel and processes it like readRecordOrCCS.
+// c.in must be locked.
+func (c *Conn) readKernelRecord(k *kernelTLS, expectChangeCipherSpec bool) error {
+	n, typ, err := kernelTLSRecv(k.raw, k.buf, k.oob)
+	if err != nil {
+		var a alert
+		if errors.As(err, &a) {
+			return c.in.setErrorLocked(c.sendAlert(a))
+		}
+		err = &net.OpError{Op: "read", Net: k.conn.LocalAddr().Network(), Source: k.conn.LocalAddr(), Addr: k.conn.RemoteAddr(), Err: err}
+		if e, ok := err.(net.Error); !ok || !e.Temporary() {
+			c.in.setErrorLocked(err)
+		}
+		return err
+	}
+	if n == 0 {
+		return c.in.setErrorLocked(io.EOF)
+	}
+	c.bytesReceived += int64(n)
+	// The application data is owned by k.buf, which is not read into until
+	// c.input is drained.
+	return c.processRecord(typ, k.buf[:n], expectChangeCipherSpec)
+}
+
+// writeKernelRecord writes a record of the given type to a Conn whose record
+// layer for writing is offloaded to the kernel, which splits it in several
+// records if needed. c.out must be locked.
+func (c *Conn) writeKernelRecord(k *kernelTLS, typ recordType, data []byte) (int, error) {
+	var n int
+	for len(data) > 0 {
+		m, err := c.autoUpdateKeys(typ, len(data))
+		if err != nil {
+			return n, err
+		}
+		if typ == recordTypeApplicationData {
+			m, err = k.conn.Write(data[:m])
+		} else {
+			m, err = kernelTLSSend(k.raw, typ, data[:m])
+			if err != nil {
+				err = &net.OpError{Op: "write", Net: k.conn.LocalAddr().Network(), Source: k.conn.LocalAddr(), Addr: k.conn.RemoteAddr(), Err: err}
+			}
+		}
+		c.bytesSent += int64(m)
+		c.out.trafficBytes += int64(m)
+		c.out.trafficRecords += int64((m + maxPlaintext - 1) / maxPlaintext)
+		n += m
+		data = data[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom. If the record layer for writing is
+// offloaded to the kernel, the data is copied by the underlying connection,
+// which uses sendfile(2) when r is an *os.File. Otherwise, or if
+// Config.KeyUpdatePolicy is set, ReadFrom is equivalent to copying r to c
+// with Write.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	k := c.kernelTLS.Load()
+	if k == nil || !k.tx || c.config.KeyUpdatePolicy != nil {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+
+	// interlock with Close, like Write
+	for {
+		x := c.activeCall.Load()
+		if x&1 != 0 {
+			return 0, net.ErrClosed
+		}
+		if c.activeCall.CompareAndSwap(x, x+2) {
+			break
+		}
+	}
+	defer c.activeCall.Add(-2)
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return 0, err
+	}
+	if c.closeNotifySent {
+		return 0, errShutdown
+	}
+	n, err := k.conn.ReadFrom(r)
+	c.bytesSent += n
+	return n, c.out.setErrorLocked(err)
+}
+
+// Values from linux/tls.h.
+const (
+	kernelTLSCipherAESGCM128        = 51
+	kernelTLSCipherAESGCM256        = 52
+	kernelTLSCipherChaCha20Poly1305 = 54
+)
+
+// kernelCryptoInfo returns the struct tls12_crypto_info_* describing the
+// current keys and sequence number of hc, which must be c.in or c.out, or
+// false if they cannot be offloaded to the kernel. hc must be locked.
+func (c *Conn) kernelCryptoInfo(hc *halfConn) ([]byte, bool) {
+	var key, iv []byte
+	switch c.vers {
+	case VersionTLS13:
+		suite := cipherSuiteTLS13ByID(c.cipherSuite)
+		if suite == nil || hc.trafficSecret == nil {
+			return nil, false
+		}
+		key, iv = suite.trafficKey(hc.trafficSecret)
+	case VersionTLS12:
+		key, iv = hc.key, hc.iv
+	default:
+		return nil, false
+	}
+
+	cipherType, ok := kernelTLSCipher(c.cipherSuite)
+	if !ok {
+		return nil, false
+	}
+	return marshalKernelCryptoInfo(c.vers, cipherType, key, iv, hc.seq), true
+}
+
+// kernelTLSCipher returns the kernel cipher type of a cipher suite, or false
+// if it cannot be offloaded to the kernel.
+func kernelTLSCipher(suite uint16) (uint16, bool) {
+	switch suite {
+	case TLS_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
+		return kernelTLSCipherAESGCM128, true
+	case TLS_AES_256_GCM_SHA384, TLS_RSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
+		return kernelTLSCipherAESGCM256, true
+	case TLS_CHACHA20_POLY1305_SHA256, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256:
+		return kernelTLSCipherChaCha20Poly1305, true
+	}
+	return 0, false
+}
+
+// marshalKernelCryptoInfo marshals a struct tls12_crypto_info_* from
+// linux/tls.h.
+func marshalKernelCryptoInfo(version, cipherType uint16, key, iv []byte, seq [8]byte) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	if cpu.IsBigEndian {
+		order = binary.BigEndian
+	}
+	info := make([]byte, 4, 4+12+len(key)+4+8)
+	order.PutUint16(info[0:], version)
+	order.PutUint16(info[2:], cipherType)
+	if cipherType == kernelTLSCipherChaCha20Poly1305 {
+		// The nonce is the IV XOR the sequence number, for both versions.
+		info = append(info, iv...)
+		info = append(info, key...)
+		return append(info, seq[:]...)
+	}
+	// AES-GCM nonces are made of a four bytes salt and an eight bytes part
+	// which in TLS 1.2 is explicit and set by us to the sequence number.
+	salt, explicitIV := iv[:4], iv[4:]
+	if version == VersionTLS12 {
+		salt, explicitIV = iv, seq[:]
+	}
+	info = append(info, explicitIV...)
+	info = append(info, key...)
+	info = append(info, salt...)
+	return append(info, seq[:]...)
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/tls.h.
+const (
+	kernelTLSTX            = 1
+	kernelTLSRX            = 2
+	kernelTLSSetRecordType = 1
+	kernelTLSGetRecordType = 2
+)
+
+// kernelRelease returns the release of the running kernel.
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+// kernelTLSEnable attaches the TLS upper layer protocol to the socket, which
+// fails if the tls kernel module is not available.
+func kernelTLSEnable(raw syscall.RawConn) error {
+	var err error
+	if cerr := raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_TCP, unix.TCP_ULP, "tls")
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
+
+// kernelTLSSetKey installs the keys described by info for receiving if rx is
+// true, or sending otherwise.
+func kernelTLSSetKey(raw syscall.RawConn, rx bool, info []byte) error {
+	opt := kernelTLSTX
+	if rx {
+		opt = kernelTLSRX
+	}
+	var err error
+	if cerr := raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_TLS, opt, string(info))
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
+
+// kernelTLSRecv reads the content of one or more records of the same type
+// into b. It returns zero bytes at EOF.
+func kernelTLSRecv(raw syscall.RawConn, b, oob []byte) (int, recordType, error) {
+	var n, oobn int
+	var err error
+	if cerr := raw.Read(func(fd uintptr) bool {
+		for {
+			n, oobn, _, _, err = unix.Recvmsg(int(fd), b, oob, 0)
+			if err != unix.EINTR {
+				return err != unix.EAGAIN
+			}
+		}
+	}); cerr != nil {
+		return 0, 0, cerr
+	}
+	switch err {
+	case nil:
+	case unix.EBADMSG:
+		return 0, 0, alertBadRecordMAC
+	case unix.EMSGSIZE:
+		return 0, 0, alertRecordOverflow
+	default:
+		return 0, 0, os.NewSyscallError("recvmsg", err)
+	}
+	typ := recordTypeApplicationData
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, 0, os.NewSyscallError("recvmsg", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_TLS && m.Header.Type == kernelTLSGetRecordType && len(m.Data) > 0 {
+			typ = recordType(m.Data[0])
+		}
+	}
+	return n, typ, nil
+}
+
+// kernelTLSSend writes b in records of type typ, which must not be
+// recordTypeApplicationData.
+func kernelTLSSend(raw syscall.RawConn, typ recordType, b []byte) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(1))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_TLS
+	h.Type = kernelTLSSetRecordType
+	h.SetLen(unix.CmsgLen(1))
+	oob[unix.CmsgLen(0)] = byte(typ)
+
+	var n int
+	var err error
+	if cerr := raw.Write(func(fd uintptr) bool {
+		for n < len(b) {
+			var m int
+			m, err = unix.SendmsgN(int(fd), b[n:], oob, nil, 0)
+			switch err {
+			case nil:
+				n += m
+			case unix.EINTR:
+			case unix.EAGAIN:
+				return false
+			default:
+				return true
+			}
+		}
+		return true
+	}); cerr != nil {
+		return n, cerr
+	}
+	return n, os.NewSyscallError("sendmsg", err)
+}
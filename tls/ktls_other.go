@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package tls
+
+import "syscall"
+
+func kernelRelease() string {
+	return ""
+}
+
+func kernelTLSEnable(raw syscall.RawConn) error {
+	return errKernelTLSUnsupported
+}
+
+func kernelTLSSetKey(raw syscall.RawConn, rx bool, info []byte) error {
+	return errKernelTLSUnsupported
+}
+
+func kernelTLSRecv(raw syscall.RawConn, b, oob []byte) (int, recordType, error) {
+	return 0, 0, errKernelTLSUnsupported
+}
+
+func kernelTLSSend(raw syscall.RawConn, typ recordType, b []byte) (int, error) {
+	return 0, errKernelTLSUnsupported
+}
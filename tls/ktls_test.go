@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMarshalKernelCryptoInfo(t *testing.T) {
+	key16 := bytes.Repeat([]byte{0x11}, 16)
+	key32 := bytes.Repeat([]byte{0x22}, 32)
+	seq := [8]byte{0, 0, 0, 0, 0, 0, 0, 7}
+	for _, tc := range []struct {
+		name       string
+		version    uint16
+		cipherType uint16
+		key, iv    []byte
+		want       string // without the leading version and cipher type
+	}{
+		{"TLS12-AES-128-GCM", VersionTLS12, kernelTLSCipherAESGCM128, key16, []byte{1, 2, 3, 4},
+			"0000000000000007" + strings.Repeat("11", 16) + "01020304" + "0000000000000007"},
+		{"TLS13-AES-256-GCM", VersionTLS13, kernelTLSCipherAESGCM256, key32, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			"05060708090a0b0c" + strings.Repeat("22", 32) + "01020304" + "0000000000000007"},
+		{"TLS13-ChaCha20-Poly1305", VersionTLS13, kernelTLSCipherChaCha20Poly1305, key32, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			"0102030405060708090a0b0c" + strings.Repeat("22", 32) + "0000000000000007"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info := marshalKernelCryptoInfo(tc.version, tc.cipherType, tc.key, tc.iv, seq)
+			if len(info) < 4 {
+				t.Fatalf("info too short: %x", info)
+			}
+			if got := hex.EncodeToString(info[4:]); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+var kernelTLSExpected = flag.Bool("ktls", false, "fail the kernel TLS tests if the record layer cannot be offloaded")
+
+// kernelTLSAvailable reports whether the tls kernel module is loaded.
+func kernelTLSAvailable() bool {
+	ulps, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_ulp")
+	return err == nil && strings.Contains(" "+strings.TrimSpace(string(ulps))+" ", " tls ")
+}
+
+// kernelTLSTransfer has the server send data with ReadFrom, and the client
+// send back its last bytes, optionally after updating the keys of both
+// sides. It returns which directions were offloaded by the client.
+func kernelTLSTransfer(t *testing.T, c, s net.Conn, clientConfig, serverConfig *Config, data []byte, keyUpdate bool) (tx, rx bool) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := Client(c, clientConfig)
+	server := Server(s, serverConfig)
+	defer client.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		f, err := os.Open(path)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer f.Close()
+		if _, err := server.ReadFrom(f); err != nil {
+			errc <- err
+			return
+		}
+		// Read the echo of the last bytes, then a close_notify.
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			errc <- err
+			return
+		}
+		if _, err := server.Read(buf); err != io.EOF {
+			t.Errorf("server got %v, want io.EOF", err)
+		}
+		errc <- nil
+	}()
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(client, got[:len(got)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if keyUpdate {
+		// The server processes the KeyUpdate, and sends its own, when it
+		// reads the echo.
+		if err := client.UpdateKeys(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.ReadFull(client, got[len(got)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data differs from sent data")
+	}
+	if _, err := client.Write(got[len(got)-5:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	tx, rx = client.KernelTLS()
+	t.Logf("client kernel TLS: tx %v, rx %v", tx, rx)
+	return tx, rx
+}
+
+// TestKernelTLS checks the offloaded record layer. It is skipped if the tls
+// kernel module is not loaded, unless the -ktls flag is set.
+func TestKernelTLS(t *testing.T) {
+	if runtime.GOOS != "linux" || !kernelTLSAvailable() {
+		if *kernelTLSExpected {
+			t.Fatal("-ktls is set, but the tls kernel module is not loaded")
+		}
+		t.Skip("tls kernel module not loaded")
+	}
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	for _, tc := range []struct {
+		name      string
+		version   uint16
+		suite     uint16
+		keyUpdate bool
+	}{
+		{"TLS12-AES-128-GCM", VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{"TLS12-AES-256-GCM", VersionTLS12, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, false},
+		{"TLS12-ChaCha20-Poly1305", VersionTLS12, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{"TLS13", VersionTLS13, 0, false},
+		{"TLS13-KeyUpdate", VersionTLS13, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			suite := tc.suite
+			if suite == 0 {
+				suite = TLS_AES_128_GCM_SHA256
+			}
+			if !kernelTLSSupported(tc.version, suite) {
+				if *kernelTLSExpected {
+					t.Fatal("-ktls is set, but the kernel is too old for this version and cipher suite")
+				}
+				t.Skip("the kernel is too old for this version and cipher suite")
+			}
+			clientConfig := testConfig.Clone()
+			clientConfig.MaxVersion = tc.version
+			if tc.suite != 0 {
+				clientConfig.CipherSuites = []uint16{tc.suite}
+			}
+			clientConfig.KernelTLS = true
+			serverConfig := testConfig.Clone()
+			serverConfig.KernelTLS = true
+
+			c, s := localPipe(t)
+			if tx, rx := kernelTLSTransfer(t, c, s, clientConfig, serverConfig, data, tc.keyUpdate); !tx || !rx {
+				t.Error("kernel TLS not enabled")
+			}
+		})
+	}
+}
+
+func TestParseKernelRelease(t *testing.T) {
+	for _, tc := range []struct {
+		release      string
+		major, minor int
+	}{
+		{"6.14.0-15-generic", 6, 14},
+		{"5.15.167.4-microsoft-standard-WSL2", 5, 15},
+		{"4.18.0-553.el8_10.x86_64", 4, 18},
+		{"6.1", 6, 1},
+		{"6.8rc1", 6, 8},
+		{"6", 0, 0},
+		{"", 0, 0},
+		{"x.y.z", 0, 0},
+	} {
+		major, minor := parseKernelRelease(tc.release)
+		if major != tc.major || minor != tc.minor {
+			t.Errorf("parseKernelRelease(%q) = %d, %d; want %d, %d", tc.release, major, minor, tc.major, tc.minor)
+		}
+	}
+}
+
+// TestKernelTLSFallback checks that a Conn that cannot offload its record
+// layer works as if Config.KernelTLS were false.
+func TestKernelTLSFallback(t *testing.T) {
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+
+	for _, tc := range []struct {
+		name    string
+		version uint16
+		suite   uint16
+		notTCP  bool
+	}{
+		{"TLS12-AES-128-CBC", VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, false},
+		{"TLS12-NotTCP", VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"TLS13-NotTCP", VersionTLS13, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig := testConfig.Clone()
+			clientConfig.MaxVersion = tc.version
+			if tc.suite != 0 {
+				clientConfig.CipherSuites = []uint16{tc.suite}
+			}
+			clientConfig.KernelTLS = true
+			serverConfig := testConfig.Clone()
+			serverConfig.KernelTLS = true
+
+			c, s := localPipe(t)
+			if tc.notTCP {
+				// Hide the *net.TCPConn.
+				c, s = struct{ net.Conn }{c}, struct{ net.Conn }{s}
+			}
+			keyUpdate := tc.version == VersionTLS13
+			if tx, rx := kernelTLSTransfer(t, c, s, clientConfig, serverConfig, data, keyUpdate); tx || rx {
+				t.Error("kernel TLS unexpectedly enabled")
+			}
+		})
+	}
+}
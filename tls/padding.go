@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+// RecordPadding controls the padding added to the records sent after the
+// handshake keys are established, which TLS 1.3 allows in order to hide the
+// length of their content from observers (see RFC 8446, Section 5.4).
+// Padding is only added to TLS 1.3 records, and is ignored by QUIC
+// connections.
+//
+// Padding is never larger than needed to reach the maximum record size, so
+// the length of a record sent with padding never exceeds the length of the
+// largest record without padding. If several fields are set, Func takes
+// precedence over MaxRecordSize, which takes precedence over BlockSize.
+type RecordPadding struct {
+	// BlockSize, if positive, causes the length of the content and padding
+	// of each record to be rounded up to a multiple of BlockSize.
+	BlockSize int
+
+	// MaxRecordSize, when true, causes each record to be padded to the
+	// maximum record size, which hides the length of the content entirely
+	// at the cost of sending 16 KiB for every record.
+	MaxRecordSize bool
+
+	// Func, if not nil, is called for each record with its content type and
+	// the length of its content, and returns the length of the padding to
+	// add. Negative values are treated as zero.
+	Func func(contentType uint8, length int) int
+}
+
+// paddingLen returns the length of the padding to add to a record with the
+// given content type and length.
+func (p *RecordPadding) paddingLen(typ recordType, n int) int {
+	var padding int
+	switch {
+	case p.Func != nil:
+		padding = p.Func(uint8(typ), n)
+	case p.MaxRecordSize:
+		padding = maxPlaintext - n
+	case p.BlockSize > 0:
+		padding = (p.BlockSize - n%p.BlockSize) % p.BlockSize
+	}
+	if padding < 0 {
+		return 0
+	}
+	if padding > maxPlaintext-n {
+		return maxPlaintext - n
+	}
+	return padding
+}
+
+// recordPaddingLen returns the length of the padding to add to the next
+// record of the given type and length, according to c.config.RecordPadding.
+// c.out must be locked.
+func (c *Conn) recordPaddingLen(typ recordType, n int) int {
+	if c.config.RecordPadding == nil || c.out.version != VersionTLS13 || c.out.cipher == nil {
+		return 0
+	}
+	return c.config.RecordPadding.paddingLen(typ, n)
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRecordPaddingLen(t *testing.T) {
+	for _, tc := range []struct {
+		p    RecordPadding
+		n    int
+		want int
+	}{
+		{RecordPadding{}, 5, 0},
+		{RecordPadding{BlockSize: 64}, 5, 59},
+		{RecordPadding{BlockSize: 64}, 64, 0},
+		{RecordPadding{BlockSize: 64}, 0, 0},
+		{RecordPadding{BlockSize: 1000}, maxPlaintext - 10, 10},
+		{RecordPadding{MaxRecordSize: true}, 5, maxPlaintext - 5},
+		{RecordPadding{MaxRecordSize: true, BlockSize: 64}, 5, maxPlaintext - 5},
+		{RecordPadding{Func: func(uint8, int) int { return 3 }, MaxRecordSize: true}, 5, 3},
+		{RecordPadding{Func: func(uint8, int) int { return -3 }}, 5, 0},
+		{RecordPadding{Func: func(uint8, int) int { return maxPlaintext }}, 5, maxPlaintext - 5},
+	} {
+		if got := tc.p.paddingLen(recordTypeApplicationData, tc.n); got != tc.want {
+			t.Errorf("%+v: paddingLen(%d) = %d, want %d", tc.p, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestRecordPadding(t *testing.T) {
+	const overhead = 1 + 16 // content type and AEAD tag
+	var funcTypes []uint8
+	for _, tc := range []struct {
+		name    string
+		padding *RecordPadding
+		version uint16
+		want    int
+	}{
+		{"None", nil, VersionTLS13, 5 + overhead},
+		{"BlockSize", &RecordPadding{BlockSize: 256}, VersionTLS13, 256 + overhead},
+		{"MaxRecordSize", &RecordPadding{MaxRecordSize: true}, VersionTLS13, maxPlaintext + overhead},
+		{"Func", &RecordPadding{Func: func(typ uint8, n int) int {
+			funcTypes = append(funcTypes, typ)
+			return 100
+		}}, VersionTLS13, 105 + overhead},
+		{"TLS12", &RecordPadding{MaxRecordSize: true}, VersionTLS12, 5 + 8 + 16},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var clientTrace, serverTrace testTrace
+			clientConfig := testConfig.Clone()
+			clientConfig.MaxVersion = tc.version
+			clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+			clientConfig.RecordPadding = tc.padding
+			clientConfig.Tracer = clientTrace.tracer()
+			serverConfig := testConfig.Clone()
+			serverConfig.Tracer = serverTrace.tracer()
+
+			c, s := localPipe(t)
+			client := Client(c, clientConfig)
+			server := Server(s, serverConfig)
+			defer client.Close()
+			defer server.Close()
+			errc := make(chan error, 1)
+			go func() {
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(server, buf); err != nil {
+					errc <- err
+					return
+				}
+				if string(buf) != "hello" {
+					t.Errorf("server read %q", buf)
+				}
+				_, err := server.Write([]byte("ok"))
+				errc <- err
+			}()
+			if err := client.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			sentBefore := len(clientTrace.events().records)
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			var sent []int
+			for _, r := range clientTrace.events().records[sentBefore:] {
+				if r.Sent {
+					sent = append(sent, r.Length)
+				}
+			}
+			if len(sent) != 1 || sent[0] != tc.want {
+				t.Errorf("got sent record lengths %v, want [%d]", sent, tc.want)
+			}
+		})
+	}
+	// The client encrypts its Finished message, the application data, and
+	// the close_notify alert.
+	if want := []uint8{byte(recordTypeHandshake), byte(recordTypeApplicationData), byte(recordTypeAlert)}; !reflect.DeepEqual(funcTypes, want) {
+		t.Errorf("Func called with content types %v", funcTypes)
+	}
+}
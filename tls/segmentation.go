@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"sort"
+	"time"
+)
+
+// ClientHelloSegmentation controls how a client writes the records carrying
+// its ClientHello to the underlying connection. Instead of a single Write
+// call, the records are written with several calls, optionally separated by
+// a delay. On TCP connections with Nagle's algorithm disabled, which is the
+// default for a net.TCPConn, each call is usually sent in its own segment,
+// so middleboxes that do not reassemble the stream only see a part of the
+// ClientHello.
+//
+// The split points from all the fields are combined. Segmentation is
+// independent from Config.ClientHelloFragmentation, which splits the
+// ClientHello across records: the offsets here count the bytes actually
+// written, including the headers of all the records.
+//
+// Segmentation applies to every ClientHello, including the one sent after
+// a HelloRetryRequest, and is ignored by QUIC connections.
+type ClientHelloSegmentation struct {
+	// Offsets contains split points, as offsets within the bytes written
+	// for the ClientHello, including the five bytes header of each record.
+	// Offsets that are not inside those bytes are ignored.
+	Offsets []int
+
+	// SegmentSize, if positive, is the maximum size of each write.
+	SegmentSize int
+
+	// SplitSNI, when true, adds a split point in the middle of the host
+	// name in the server_name extension, if any.
+	SplitSNI bool
+
+	// Delay is how long to wait between writes. The wait ends early when
+	// the context passed to HandshakeContext is done, failing the
+	// handshake, or when the write deadline set with SetDeadline or
+	// SetWriteDeadline expires.
+	Delay time.Duration
+}
+
+// splitPoints returns the sorted, unique offsets at which to split records,
+// which carry the ClientHello data.
+func (s *ClientHelloSegmentation) splitPoints(records, data []byte) []int {
+	n := len(records)
+	points := append([]int(nil), s.Offsets...)
+	if s.SegmentSize > 0 {
+		for offset := s.SegmentSize; offset < n; offset += s.SegmentSize {
+			points = append(points, offset)
+		}
+	}
+	if s.SplitSNI {
+		if offset, ok := clientHelloSNIOffset(data); ok {
+			if offset, ok := recordsOffset(records, offset); ok {
+				points = append(points, offset)
+			}
+		}
+	}
+	sort.Ints(points)
+	var unique []int
+	for _, offset := range points {
+		if offset <= 0 || offset >= n {
+			continue
+		}
+		if len(unique) > 0 && unique[len(unique)-1] == offset {
+			continue
+		}
+		unique = append(unique, offset)
+	}
+	return unique
+}
+
+// recordsOffset returns the offset within records of the byte at the given
+// offset within the data they carry.
+func recordsOffset(records []byte, offset int) (int, bool) {
+	var pos int
+	for len(records)-pos >= recordHeaderLen {
+		n := int(records[pos+3])<<8 | int(records[pos+4])
+		if offset < n {
+			return pos + recordHeaderLen + offset, true
+		}
+		offset -= n
+		pos += recordHeaderLen + n
+	}
+	return 0, false
+}
+
+// writeSegmentedClientHello writes the marshaled ClientHello data, in one or
+// more records according to c.config.ClientHelloFragmentation, and flushes
+// them to the connection with several writes according to
+// c.config.ClientHelloSegmentation. c.out must be locked.
+func (c *Conn) writeSegmentedClientHello(data []byte) (int, error) {
+	buffering := c.buffering
+	c.buffering = true
+	start := len(c.sendBuf)
+	var n int
+	var err error
+	if c.config.ClientHelloFragmentation != nil {
+		n, err = c.writeFragmentedClientHello(data)
+	} else {
+		n, err = c.writeRecordLocked(recordTypeHandshake, data)
+	}
+	c.buffering = buffering
+	if err != nil {
+		return n, err
+	}
+	if _, err := c.flushSegmented(c.config.ClientHelloSegmentation, start, data); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// flushSegmented writes c.sendBuf to the connection according to s, like
+// flush. The records carrying the ClientHello data start at c.sendBuf[start].
+func (c *Conn) flushSegmented(s *ClientHelloSegmentation, start int, data []byte) (int, error) {
+	buf := c.sendBuf
+	c.sendBuf = nil
+	c.buffering = false
+
+	var n, prev int
+	for i, offset := range append(s.splitPoints(buf[start:], data), len(buf)-start) {
+		end := start + offset
+		// Any record buffered before the ClientHello goes with the first
+		// segment, since prev starts at zero.
+		if i > 0 && s.Delay > 0 {
+			if err := c.waitSegmentDelay(s.Delay); err != nil {
+				return n, err
+			}
+		}
+		m, err := c.conn.Write(buf[prev:end])
+		c.bytesSent += int64(m)
+		c.transportError(err)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		prev = end
+	}
+	return n, nil
+}
+
+// waitSegmentDelay waits for d between two writes. It returns the error of
+// the context passed to HandshakeContext if it is done first, and it stops
+// waiting when the write deadline set on c expires, so that the following
+// write fails as it would have without the delay.
+func (c *Conn) waitSegmentDelay(d time.Duration) error {
+	if deadline := c.writeDeadline.Load(); deadline != nil && !deadline.IsZero() {
+		if remaining := time.Until(*deadline); remaining < d {
+			d = remaining
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	var done <-chan struct{}
+	if c.handshakeCtx != nil {
+		done = c.handshakeCtx.Done()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return c.handshakeCtx.Err()
+	}
+}
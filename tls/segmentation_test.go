@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeRecordingConn wraps a net.Conn and records the data and time of each
+// Write call.
+type writeRecordingConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes [][]byte
+	times  []time.Time
+}
+
+func (wrc *writeRecordingConn) Write(data []byte) (int, error) {
+	wrc.mu.Lock()
+	wrc.writes = append(wrc.writes, bytes.Clone(data))
+	wrc.times = append(wrc.times, time.Now())
+	wrc.mu.Unlock()
+	return wrc.Conn.Write(data)
+}
+
+// clientHelloWrites runs a handshake and returns the Write calls done by the
+// client to send its first ClientHello, and when they happened.
+func clientHelloWrites(t *testing.T, clientConfig *Config, wireLen int) ([][]byte, []time.Time) {
+	t.Helper()
+	c, s := localPipe(t)
+	wrc := &writeRecordingConn{Conn: c}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- Server(s, testConfig).Handshake()
+		s.Close()
+	}()
+	cli := Client(wrc, clientConfig)
+	if err := cli.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+
+	wrc.mu.Lock()
+	defer wrc.mu.Unlock()
+	var total int
+	for i, w := range wrc.writes {
+		total += len(w)
+		if total == wireLen {
+			return wrc.writes[:i+1], wrc.times[:i+1]
+		}
+	}
+	t.Fatalf("the first writes do not add up to %d bytes", wireLen)
+	return nil, nil
+}
+
+func writeLengths(writes [][]byte) []int {
+	var lengths []int
+	for _, w := range writes {
+		lengths = append(lengths, len(w))
+	}
+	return lengths
+}
+
+func TestClientHelloSegmentation(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+	hello := marshalTestClientHello(t, clientConfig)
+	sniOffset, _ := clientHelloSNIOffset(hello)
+	wireLen := recordHeaderLen + len(hello)
+
+	for _, tc := range []struct {
+		name string
+		f    *ClientHelloFragmentation
+		s    *ClientHelloSegmentation
+		want []int
+	}{
+		{"None", nil, nil, []int{wireLen}},
+		{"Offsets", nil, &ClientHelloSegmentation{Offsets: []int{1, 10, wireLen}},
+			[]int{1, 9, wireLen - 10}},
+		{"SegmentSize", nil, &ClientHelloSegmentation{SegmentSize: 100},
+			[]int{100, 100, wireLen - 200}},
+		{"SplitSNI", nil, &ClientHelloSegmentation{SplitSNI: true},
+			[]int{recordHeaderLen + sniOffset, len(hello) - sniOffset}},
+		{"Fragmented", &ClientHelloFragmentation{Offsets: []int{10}}, &ClientHelloSegmentation{SplitSNI: true},
+			[]int{2*recordHeaderLen + sniOffset, len(hello) - sniOffset}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig.ClientHelloFragmentation = tc.f
+			clientConfig.ClientHelloSegmentation = tc.s
+			n := wireLen
+			if tc.f != nil {
+				n += len(tc.f.Offsets) * recordHeaderLen
+			}
+			writes, _ := clientHelloWrites(t, clientConfig, n)
+			if got := writeLengths(writes); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got writes %v, want %v", got, tc.want)
+			}
+			if tc.s != nil && tc.s.SplitSNI {
+				if bytes.Contains(writes[0], []byte("example.golang")) ||
+					!bytes.HasSuffix(writes[0], []byte("example")) {
+					t.Errorf("the first write does not end in the middle of the server name")
+				}
+			}
+		})
+	}
+
+	t.Run("Delay", func(t *testing.T) {
+		const delay = 20 * time.Millisecond
+		clientConfig.ClientHelloFragmentation = nil
+		clientConfig.ClientHelloSegmentation = &ClientHelloSegmentation{Offsets: []int{10, 20}, Delay: delay}
+		writes, times := clientHelloWrites(t, clientConfig, wireLen)
+		if len(writes) != 3 {
+			t.Fatalf("got writes %v", writeLengths(writes))
+		}
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < delay {
+				t.Errorf("write %d happened %v after the previous one, want at least %v", i, d, delay)
+			}
+		}
+	})
+}
+
+func TestClientHelloSegmentationDelayInterrupted(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.ClientHelloSegmentation = &ClientHelloSegmentation{Offsets: []int{10}, Delay: time.Hour}
+
+	for _, tc := range []struct {
+		name    string
+		start   func(cli *Conn) error
+		wantErr error
+	}{
+		{"Context", func(cli *Conn) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			return cli.HandshakeContext(ctx)
+		}, context.DeadlineExceeded},
+		{"Deadline", func(cli *Conn) error {
+			cli.SetDeadline(time.Now().Add(50 * time.Millisecond))
+			return cli.Handshake()
+		}, os.ErrDeadlineExceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, s := localPipe(t)
+			defer s.Close()
+			go io.Copy(io.Discard, s)
+			cli := Client(c, clientConfig)
+			defer cli.Close()
+
+			errChan := make(chan error, 1)
+			go func() { errChan <- tc.start(cli) }()
+			select {
+			case err := <-errChan:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("got error %v, want %v", err, tc.wantErr)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the handshake did not stop while waiting between writes")
+			}
+		})
+	}
+}
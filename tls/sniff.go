@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// SniffConn is a net.Conn that parses the first ClientHello sent by the
+// client without consuming it: Read returns the bytes read to parse the
+// ClientHello, followed by the rest of the stream.
+type SniffConn struct {
+	net.Conn
+
+	once  sync.Once
+	hello *ClientHelloMessage
+	err   error
+
+	// buf contains the bytes read while sniffing and not yet returned by
+	// Read.
+	buf bytes.Buffer
+}
+
+// NewSniffConn returns a SniffConn reading from conn.
+func NewSniffConn(conn net.Conn) *SniffConn {
+	return &SniffConn{Conn: conn}
+}
+
+// ClientHello reads the first ClientHello from the connection, if not done
+// already, and returns it. It returns an error if the client does not start
+// with a well-formed ClientHello or if reading fails, for example because
+// of a deadline set with SetReadDeadline. In any case, the bytes read are
+// still returned by Read.
+func (c *SniffConn) ClientHello() (*ClientHelloMessage, error) {
+	c.once.Do(c.sniff)
+	return c.hello, c.err
+}
+
+// Read reads data from the connection, starting with the bytes read by
+// ClientHello. If ClientHello was not called, Read calls it first, such
+// that ClientHello can be called at any time.
+func (c *SniffConn) Read(b []byte) (int, error) {
+	c.once.Do(c.sniff)
+	if c.buf.Len() > 0 {
+		return c.buf.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *SniffConn) sniff() {
+	var hand []byte
+	for len(hand) < 4 || len(hand) < 4+handshakeMessageLen(hand) {
+		hdr, err := c.readFull(recordHeaderLen)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if recordType(hdr[0]) != recordTypeHandshake {
+			c.err = errors.New("tls: first record does not look like a TLS handshake")
+			return
+		}
+		n := int(hdr[3])<<8 | int(hdr[4])
+		if n == 0 || n > maxPlaintext {
+			c.err = fmt.Errorf("tls: oversized or empty record received with length %d", n)
+			return
+		}
+		fragment, err := c.readFull(n)
+		if err != nil {
+			c.err = err
+			return
+		}
+		hand = append(hand, fragment...)
+		if len(hand) >= 4 {
+			if msgLen := handshakeMessageLen(hand); msgLen > maxHandshake {
+				c.err = fmt.Errorf("tls: handshake message of length %d bytes exceeds maximum of %d bytes", msgLen, maxHandshake)
+				return
+			}
+		}
+	}
+	c.hello, c.err = ParseClientHello(hand[:4+handshakeMessageLen(hand)])
+}
+
+// handshakeMessageLen returns the length of the body of the handshake
+// message starting at data, which must be at least four bytes long.
+func handshakeMessageLen(data []byte) int {
+	return int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+}
+
+// readFull reads exactly n bytes from the underlying connection, appending
+// them to c.buf, and returns them.
+func (c *SniffConn) readFull(n int) ([]byte, error) {
+	start := c.buf.Len()
+	if _, err := io.CopyN(&c.buf, c.Conn, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return c.buf.Bytes()[start:], nil
+}
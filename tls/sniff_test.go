@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSniffConn(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	ln = NewSniffListener(ln)
+
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+	clientConfig.NextProtos = []string{"h2", "http/1.1"}
+	clientConfig.ClientHelloFragmentation = &ClientHelloFragmentation{SplitSNI: true}
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		errc <- err
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := c.(*SniffConn)
+	hello, err := sc.ClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "example.golang" {
+		t.Errorf("got ServerName %q", hello.ServerName)
+	}
+	if len(hello.ALPNProtocols) != 2 || hello.ALPNProtocols[0] != "h2" {
+		t.Errorf("got ALPNProtocols %q", hello.ALPNProtocols)
+	}
+	if len(hello.SupportedVersions) == 0 || hello.SupportedVersions[0] != VersionTLS13 {
+		t.Errorf("got SupportedVersions %x", hello.SupportedVersions)
+	}
+	if hello.EncryptedClientHello != nil {
+		t.Error("unexpected encrypted_client_hello extension")
+	}
+
+	srv := Server(sc, testConfig)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(srv, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q", buf)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSniffConnReplay(t *testing.T) {
+	config := testConfig.Clone()
+	config.ServerName = "example.golang"
+	data := marshalTestClientHello(t, config)
+	var records []byte
+	for _, fragment := range [][]byte{data[:3], data[3:100], data[100:]} {
+		records = append(records, byte(recordTypeHandshake), 3, 1, byte(len(fragment)>>8), byte(len(fragment)))
+		records = append(records, fragment...)
+	}
+	stream := append(records, "trailing data"...)
+
+	c, s := localPipe(t)
+	defer c.Close()
+	go func() {
+		c.Write(stream)
+		c.Close()
+	}()
+	sc := NewSniffConn(s)
+	hello, err := sc.ClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "example.golang" {
+		t.Errorf("got ServerName %q", hello.ServerName)
+	}
+	got, err := io.ReadAll(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, stream) {
+		t.Error("replayed bytes differ from the bytes sent")
+	}
+}
+
+func TestSniffConnNotTLS(t *testing.T) {
+	for _, input := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"\x16\x03\x01",
+		"\x16\x03\x01\x00\x04\x01\x00\x00\x01\x00",
+	} {
+		input := input
+		c, s := localPipe(t)
+		go func() {
+			c.Write([]byte(input))
+			c.Close()
+		}()
+		sc := NewSniffConn(s)
+		if _, err := sc.ClientHello(); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+		got, err := io.ReadAll(sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != input {
+			t.Errorf("%q: got replayed bytes %q", input, got)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"context"
+	stdlibtls "crypto/tls"
+	"errors"
+)
+
+// stdlibError is an error returned by ConnStdlib. It wraps an error returned
+// by the underlying Conn, and converts the AlertError, RecordHeaderError and
+// CertificateVerificationError it wraps to the equivalent types exported by
+// crypto/tls, so that errors.As works with the types of both packages.
+type stdlibError struct {
+	err error
+}
+
+func (e *stdlibError) Error() string { return e.err.Error() }
+func (e *stdlibError) Unwrap() error { return e.err }
+
+// As implements the conversions for errors.As. Only the types that the
+// wrapped error contains are converted: like with crypto/tls, an AlertError
+// is only found when one is wrapped, which happens for QUIC connections.
+func (e *stdlibError) As(target any) bool {
+	switch target := target.(type) {
+	case *stdlibtls.RecordHeaderError:
+		var rhe RecordHeaderError
+		if !errors.As(e.err, &rhe) {
+			return false
+		}
+		*target = stdlibtls.RecordHeaderError{
+			Msg:          rhe.Msg,
+			RecordHeader: rhe.RecordHeader,
+			Conn:         rhe.Conn,
+		}
+		return true
+	case **stdlibtls.CertificateVerificationError:
+		var cve *CertificateVerificationError
+		if !errors.As(e.err, &cve) {
+			return false
+		}
+		*target = &stdlibtls.CertificateVerificationError{
+			UnverifiedCertificates: cve.UnverifiedCertificates,
+			Err:                    cve.Err,
+		}
+		return true
+	}
+	var ae AlertError
+	if errors.As(e.err, &ae) {
+		return stdlibAlertErrorAs(ae, target)
+	}
+	return false
+}
+
+// errorToStdlib returns err wrapped in a stdlibError, if it wraps an error
+// that stdlibError converts, and err otherwise. Transport errors such as
+// io.EOF are thus returned as they are, but handshake failures are wrapped in
+// a *HandshakeError, so callers must match them with errors.Is and errors.As
+// rather than comparing them with ==.
+func errorToStdlib(err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		ae  AlertError
+		rhe RecordHeaderError
+		cve *CertificateVerificationError
+	)
+	if !errors.As(err, &ae) && !errors.As(err, &rhe) && !errors.As(err, &cve) {
+		return err
+	}
+	return &stdlibError{err: err}
+}
+
+// Read is like Conn.Read but its errors also match the crypto/tls error
+// types with errors.As.
+func (c *ConnStdlib) Read(b []byte) (int, error) {
+	n, err := c.connStdlibUnderlyingConn.Read(b)
+	return n, errorToStdlib(err)
+}
+
+// Write is like Conn.Write but its errors also match the crypto/tls error
+// types with errors.As.
+func (c *ConnStdlib) Write(b []byte) (int, error) {
+	n, err := c.connStdlibUnderlyingConn.Write(b)
+	return n, errorToStdlib(err)
+}
+
+// Close is like Conn.Close but its errors also match the crypto/tls error
+// types with errors.As.
+func (c *ConnStdlib) Close() error {
+	return errorToStdlib(c.connStdlibUnderlyingConn.Close())
+}
+
+// HandshakeContext is like Conn.HandshakeContext but its errors also match
+// the crypto/tls error types with errors.As.
+func (c *ConnStdlib) HandshakeContext(ctx context.Context) error {
+	return errorToStdlib(c.connStdlibUnderlyingConn.HandshakeContext(ctx))
+}
@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.21
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// stdlibAlertErrorAs sets target to a, if target is a pointer to a crypto/tls
+// AlertError.
+func stdlibAlertErrorAs(a AlertError, target any) bool {
+	if target, ok := target.(*stdlibtls.AlertError); ok {
+		*target = stdlibtls.AlertError(a)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !go1.21
+
+package tls
+
+// stdlibAlertErrorAs returns false because crypto/tls does not export
+// AlertError before Go 1.21.
+func stdlibAlertErrorAs(a AlertError, target any) bool {
+	return false
+}
@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.21
+
+package tls
+
+import (
+	"context"
+	stdlibtls "crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestConnStdlibCertificateVerificationError(t *testing.T) {
+	config := &stdlibtls.Config{
+		ServerName: "example.golang",
+		Time:       testConfig.Time,
+	}
+	c, s := localPipe(t)
+	conn, err := NewClientConnStdlib(c, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := Server(s, testConfig)
+	defer server.Close()
+	go server.Handshake()
+
+	err = conn.HandshakeContext(context.Background())
+	var stdlibCVE *stdlibtls.CertificateVerificationError
+	if !errors.As(err, &stdlibCVE) {
+		t.Fatalf("got %v, want a crypto/tls CertificateVerificationError", err)
+	}
+	var cve *CertificateVerificationError
+	if !errors.As(err, &cve) {
+		t.Fatalf("got %v, want a CertificateVerificationError", err)
+	}
+	if len(stdlibCVE.UnverifiedCertificates) != 1 || stdlibCVE.UnverifiedCertificates[0] != cve.UnverifiedCertificates[0] || stdlibCVE.Err != cve.Err {
+		t.Errorf("got %+v, want %+v", stdlibCVE, cve)
+	}
+
+	// Like with crypto/tls, the alert is not wrapped as an AlertError.
+	var stdlibAlert stdlibtls.AlertError
+	if errors.As(err, &stdlibAlert) {
+		t.Errorf("got crypto/tls AlertError %v, want none", stdlibAlert)
+	}
+	var ourAlert AlertError
+	if errors.As(err, &ourAlert) {
+		t.Errorf("got AlertError %v, want none", ourAlert)
+	}
+	var he *HandshakeError
+	if !errors.As(err, &he) {
+		t.Fatalf("got %v, want a HandshakeError", err)
+	}
+	if he.SentAlert == nil || *he.SentAlert != AlertError(alertBadCertificate) {
+		t.Errorf("got SentAlert %v, want %v", he.SentAlert, alertBadCertificate)
+	}
+}
+
+func TestStdlibErrorAlertError(t *testing.T) {
+	// QUIC connections wrap the alert as an AlertError.
+	err := errorToStdlib(fmt.Errorf("%w%.0w", alert(alertBadCertificate), AlertError(alertBadCertificate)))
+	var stdlibAlert stdlibtls.AlertError
+	if !errors.As(err, &stdlibAlert) || stdlibAlert != stdlibtls.AlertError(alertBadCertificate) {
+		t.Errorf("got crypto/tls AlertError %v, want %v", stdlibAlert, alertBadCertificate)
+	}
+	var ourAlert AlertError
+	if !errors.As(err, &ourAlert) || ourAlert != AlertError(alertBadCertificate) {
+		t.Errorf("got AlertError %v, want %v", ourAlert, alertBadCertificate)
+	}
+	if err := errorToStdlib(alert(alertBadCertificate)); err != error(alert(alertBadCertificate)) {
+		t.Errorf("got %v, want the alert returned as it is", err)
+	}
+}
+
+func TestConnStdlibHandshakeError(t *testing.T) {
+	cve := &CertificateVerificationError{Err: errors.New("untrusted")}
+	tests := []struct {
+		name  string
+		err   error
+		check func(t *testing.T, err error)
+	}{{
+		name: "AlertError",
+		// QUIC connections wrap the alert as an AlertError.
+		err: fmt.Errorf("%w%.0w", alert(alertBadCertificate), AlertError(alertBadCertificate)),
+		check: func(t *testing.T, err error) {
+			var stdlibAlert stdlibtls.AlertError
+			if !errors.As(err, &stdlibAlert) || stdlibAlert != stdlibtls.AlertError(alertBadCertificate) {
+				t.Errorf("got crypto/tls AlertError %v, want %v", stdlibAlert, alertBadCertificate)
+			}
+		},
+	}, {
+		name: "CertificateVerificationError",
+		err:  cve,
+		check: func(t *testing.T, err error) {
+			var stdlibCVE *stdlibtls.CertificateVerificationError
+			if !errors.As(err, &stdlibCVE) || stdlibCVE.Err != cve.Err {
+				t.Errorf("got crypto/tls CertificateVerificationError %v, want %v", stdlibCVE, cve)
+			}
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &ConnStdlib{&connStdlibUnderlyingConnMockable{
+				MockHandshakeContext: func(ctx context.Context) error {
+					return &HandshakeError{Err: tt.err, Phase: HandshakePhaseReceiving}
+				},
+			}}
+			err := conn.HandshakeContext(context.Background())
+			var he *HandshakeError
+			if !errors.As(err, &he) || he.Err != tt.err {
+				t.Fatalf("got %v, want a HandshakeError wrapping %v", err, tt.err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want an error matching %v", err, tt.err)
+			}
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestConnStdlibRecordHeaderError(t *testing.T) {
+	c, s := localPipe(t)
+	conn, err := NewClientConnStdlib(c, &stdlibtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer s.Close()
+	go func() {
+		io.ReadAtLeast(s, make([]byte, 1), 1)
+		s.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+	}()
+
+	err = conn.HandshakeContext(context.Background())
+	var stdlibRHE stdlibtls.RecordHeaderError
+	if !errors.As(err, &stdlibRHE) {
+		t.Fatalf("got %v, want a crypto/tls RecordHeaderError", err)
+	}
+	var rhe RecordHeaderError
+	if !errors.As(err, &rhe) {
+		t.Fatalf("got %v, want a RecordHeaderError", err)
+	}
+	if stdlibRHE.Msg != rhe.Msg || stdlibRHE.RecordHeader != rhe.RecordHeader || stdlibRHE.Conn != rhe.Conn || rhe.Conn == nil {
+		t.Errorf("got %+v, want %+v", stdlibRHE, rhe)
+	}
+}
+
+func TestConnStdlibEOF(t *testing.T) {
+	c, s := localPipe(t)
+	conn, err := NewClientConnStdlib(c, &stdlibtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := Server(s, testConfig)
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	if err := conn.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Errors that do not wrap a converted type are returned as they are.
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.21
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// stdlibClientSessionCache adapts a crypto/tls ClientSessionCache to be used
+// as a ClientSessionCache, converting the sessions through their serialized
+// form, so that crypto/tls and this package can resume each other's sessions.
+type stdlibClientSessionCache struct {
+	cache stdlibtls.ClientSessionCache
+}
+
+// newStdlibClientSessionCache returns a ClientSessionCache storing sessions
+// in cache, or nil if this is not supported by the Go version.
+func newStdlibClientSessionCache(cache stdlibtls.ClientSessionCache) ClientSessionCache {
+	return &stdlibClientSessionCache{cache: cache}
+}
+
+// Get implements ClientSessionCache. Sessions which cannot be converted are
+// treated as missing.
+func (c *stdlibClientSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	cs, ok := c.cache.Get(sessionKey)
+	if !ok || cs == nil {
+		return nil, false
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil {
+		return nil, false
+	}
+	ourState, err := sessionStateFromStdlib(state)
+	if err != nil {
+		return nil, false
+	}
+	session, err := NewResumptionState(ticket, ourState)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+// Put implements ClientSessionCache. A nil cs removes the session, like
+// sessions which cannot be converted.
+func (c *stdlibClientSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	if cs == nil {
+		c.cache.Put(sessionKey, nil)
+		return
+	}
+	session, err := clientSessionStateToStdlib(cs)
+	if err != nil {
+		c.cache.Put(sessionKey, nil)
+		return
+	}
+	c.cache.Put(sessionKey, session)
+}
+
+// clientSessionStateToStdlib converts a *ClientSessionState to the equivalent
+// type exported by the Go standard library.
+func clientSessionStateToStdlib(cs *ClientSessionState) (*stdlibtls.ClientSessionState, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	stdlibState, err := sessionStateToStdlib(state)
+	if err != nil {
+		return nil, err
+	}
+	return stdlibtls.NewResumptionState(ticket, stdlibState)
+}
+
+// sessionStateFromStdlib converts a *crypto/tls.SessionState to a
+// *SessionState through its serialized form.
+func sessionStateFromStdlib(state *stdlibtls.SessionState) (*SessionState, error) {
+	data, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return parseSessionState(data, stdlibSessionCurveID)
+}
+
+// sessionStateToStdlib converts a *SessionState to the equivalent type
+// exported by the Go standard library.
+func sessionStateToStdlib(state *SessionState) (*stdlibtls.SessionState, error) {
+	data, err := state.bytes(stdlibSessionCurveID)
+	if err != nil {
+		return nil, err
+	}
+	return stdlibtls.ParseSessionState(data)
+}
+
+// setStdlibSessionTickets makes config encrypt and decrypt session tickets
+// with the keys of tickets, which are either the automatically rotated keys
+// it owns or the keys set with its SetSessionTicketKeys method, so that all
+// the configs converted from tickets share them.
+func setStdlibSessionTickets(config *Config, tickets *stdlibtls.Config) {
+	config.WrapSession = func(cs ConnectionState, state *SessionState) ([]byte, error) {
+		stdlibState, err := sessionStateToStdlib(state)
+		if err != nil {
+			return nil, err
+		}
+		return tickets.EncryptTicket(connectionStateToStdlib(cs), stdlibState)
+	}
+	config.UnwrapSession = func(identity []byte, cs ConnectionState) (*SessionState, error) {
+		stdlibState, err := tickets.DecryptTicket(identity, connectionStateToStdlib(cs))
+		if err != nil || stdlibState == nil {
+			return nil, err
+		}
+		state, err := sessionStateFromStdlib(stdlibState)
+		if err != nil {
+			// Like DecryptTicket, treat tickets we cannot use as missing.
+			return nil, nil
+		}
+		return state, nil
+	}
+}
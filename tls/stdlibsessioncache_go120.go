@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !go1.21
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// newStdlibClientSessionCache returns nil because crypto/tls cannot export
+// and import sessions before Go 1.21.
+func newStdlibClientSessionCache(cache stdlibtls.ClientSessionCache) ClientSessionCache {
+	return nil
+}
+
+// setStdlibSessionTickets does nothing because crypto/tls cannot encrypt and
+// decrypt session tickets on behalf of other packages before Go 1.21.
+func setStdlibSessionTickets(config *Config, tickets *stdlibtls.Config) {}
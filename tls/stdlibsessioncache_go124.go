@@ -0,0 +1,10 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.21 && !go1.25
+
+package tls
+
+// stdlibSessionCurveID reports whether crypto/tls records the key exchange
+// group of TLS 1.0–1.2 sessions in their serialized form, which it does not
+// before Go 1.25.
+const stdlibSessionCurveID = false
@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.21
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	stdlibtls "crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStdlibClientSessionCache(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		t.Run(VersionName(version), func(t *testing.T) {
+			cache := stdlibtls.NewLRUClientSessionCache(10)
+			config := &stdlibtls.Config{
+				ClientSessionCache: cache,
+				InsecureSkipVerify: true,
+				MaxVersion:         version,
+				ServerName:         "example.golang",
+				Time:               testConfig.Time,
+			}
+
+			// handshake runs a handshake with either a crypto/tls client or
+			// ours, and returns whether it resumed a session.
+			handshake := func(stdlib bool) bool {
+				t.Helper()
+				c, s := localPipe(t)
+				server := Server(s, testConfig)
+				defer server.Close()
+				errc := make(chan error, 1)
+				go func() {
+					// Write some data for the client to read the tickets.
+					_, err := server.Write([]byte("hello"))
+					errc <- err
+				}()
+				var client interface {
+					io.ReadWriteCloser
+					HandshakeContext(context.Context) error
+					ConnectionState() stdlibtls.ConnectionState
+				}
+				if stdlib {
+					client = stdlibtls.Client(c, config)
+				} else {
+					var err error
+					if client, err = NewClientConnStdlib(c, config); err != nil {
+						t.Fatal(err)
+					}
+				}
+				defer client.Close()
+				if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				return client.ConnectionState().DidResume
+			}
+
+			if handshake(true) {
+				t.Fatal("first crypto/tls handshake resumed")
+			}
+			if !handshake(false) {
+				t.Error("did not resume a crypto/tls session")
+			}
+			if _, ok := cache.Get("example.golang"); !ok {
+				t.Fatal("session not stored in the cache")
+			}
+			// Replace the cached session with one of ours, and resume it
+			// with crypto/tls.
+			cache.Put("example.golang", nil)
+			if handshake(false) {
+				t.Fatal("first handshake resumed")
+			}
+			if !handshake(true) {
+				t.Error("crypto/tls did not resume our session")
+			}
+		})
+	}
+}
+
+func TestNewServerConnStdlibResumption(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		t.Run(VersionName(version), func(t *testing.T) {
+			config := &stdlibtls.Config{
+				Certificates: []stdlibtls.Certificate{{
+					Certificate: testConfig.Certificates[0].Certificate,
+					PrivateKey:  testConfig.Certificates[0].PrivateKey,
+				}},
+				MaxVersion: version,
+				Time:       testConfig.Time,
+			}
+			clientConfig := testConfig.Clone()
+			clientConfig.ClientSessionCache = NewLRUClientSessionCache(10)
+			clientConfig.ServerName = "example.golang"
+
+			// handshake runs a handshake with either a crypto/tls server or
+			// one created by NewServerConnStdlib, and returns whether the
+			// client resumed a session.
+			handshake := func(stdlib bool) bool {
+				t.Helper()
+				c, s := localPipe(t)
+				var server io.WriteCloser
+				if stdlib {
+					server = stdlibtls.Server(s, config)
+				} else {
+					var err error
+					if server, err = NewServerConnStdlib(s, config); err != nil {
+						t.Fatal(err)
+					}
+				}
+				defer server.Close()
+				errc := make(chan error, 1)
+				go func() {
+					// Write some data for the client to read the tickets.
+					_, err := server.Write([]byte("hello"))
+					errc <- err
+				}()
+				client := Client(c, clientConfig)
+				defer client.Close()
+				if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				return client.ConnectionState().DidResume
+			}
+
+			if handshake(false) {
+				t.Fatal("first handshake resumed")
+			}
+			if !handshake(false) {
+				t.Error("did not resume across connections")
+			}
+			// The tickets encrypted with the old keys can no longer be used,
+			// and the new ones are shared with crypto/tls.
+			config.SetSessionTicketKeys([][32]byte{{1}})
+			if handshake(false) {
+				t.Error("resumed after SetSessionTicketKeys")
+			}
+			if !handshake(true) {
+				t.Error("crypto/tls did not resume our session")
+			}
+		})
+	}
+}
+
+func TestSessionStateStdlibConversion(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		t.Run(VersionName(version), func(t *testing.T) {
+			cache := stdlibtls.NewLRUClientSessionCache(10)
+			config := &stdlibtls.Config{
+				ClientSessionCache: cache,
+				CurvePreferences:   []stdlibtls.CurveID{stdlibtls.CurveP256},
+				InsecureSkipVerify: true,
+				MaxVersion:         version,
+				ServerName:         "example.golang",
+				Time:               testConfig.Time,
+			}
+			c, s := localPipe(t)
+			server := Server(s, testConfig)
+			defer server.Close()
+			errc := make(chan error, 1)
+			go func() {
+				// Write some data for the client to read the tickets.
+				_, err := server.Write([]byte("hello"))
+				errc <- err
+			}()
+			client := stdlibtls.Client(c, config)
+			defer client.Close()
+			if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			cs, ok := cache.Get("example.golang")
+			if !ok {
+				t.Fatal("session not stored in the cache")
+			}
+			_, state, err := cs.ResumptionState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ourState, err := sessionStateFromStdlib(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version == VersionTLS12 && stdlibSessionCurveID && ourState.curveID != CurveP256 {
+				t.Errorf("got curveID %v, want %v", ourState.curveID, CurveP256)
+			}
+			stdlibState, err := sessionStateToStdlib(ourState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := state.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := stdlibState.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("session changed by the conversion:\ngot  %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestNewClientConnStdlibSessionTickets(t *testing.T) {
+	conn, err := net.Dial("udp", "8.8.8.8:443") // we just want a valid conn
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := NewClientConnStdlib(conn, &stdlibtls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := client.connStdlibUnderlyingConn.(*Conn).config
+	if config.WrapSession != nil || config.UnwrapSession != nil {
+		t.Error("WrapSession and UnwrapSession set on a client config")
+	}
+	server, err := NewServerConnStdlib(conn, &stdlibtls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = server.connStdlibUnderlyingConn.(*Conn).config
+	if config.WrapSession == nil || config.UnwrapSession == nil {
+		t.Error("WrapSession and UnwrapSession not set on a server config")
+	}
+}
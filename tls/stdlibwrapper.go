@@ -30,28 +30,158 @@ var ErrIncompatibleStdlibConfig = errors.New("ootls: incompatible stdlib config"
 //
 // We currently support these fields:
 //
+// - Certificates
+//
+// - CipherSuites
+//
+// - ClientAuth (servers only)
+//
+// - ClientCAs (servers only)
+//
+// - ClientSessionCache, when using Go 1.21 or later, so that sessions can be
+// shared with crypto/tls connections
+//
+// - CurvePreferences
+//
 // - DynamicRecordSizingDisabled
 //
+// - EncryptedClientHelloConfigList, when using Go 1.23 or later
+//
+// - EncryptedClientHelloRejectionVerify, when using Go 1.23 or later
+//
+// - GetCertificate (servers only), whose ClientHelloInfo argument has a nil
+// Context, because crypto/tls does not allow setting it
+//
+// - GetClientCertificate, whose CertificateRequestInfo argument has a nil
+// Context, because crypto/tls does not allow setting it
+//
+// - GetConfigForClient (servers only), whose ClientHelloInfo argument has a
+// nil Context, and which fails the handshake if it returns a config
+// containing unsupported fields
+//
 // - InsecureSkipVerify
 //
+// - KeyLogWriter
+//
 // - MaxVersion
 //
 // - MinVersion
 //
 // - NextProtos
 //
+// - PreferServerCipherSuites, which is ignored
+//
+// - Rand
+//
+// - Renegotiation
+//
 // - RootCAs
 //
 // - ServerName
+//
+// - SessionTicketKey (servers only)
+//
+// - SessionTicketsDisabled
+//
+// - Time
+//
+// - VerifyConnection
+//
+// - VerifyPeerCertificate
 func NewClientConnStdlib(conn net.Conn, config *stdlibtls.Config) (*ConnStdlib, error) {
+	ourConfig, err := newConfigFromStdlib(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnStdlib{Client(conn, ourConfig)}, nil
+}
+
+// NewServerConnStdlib is like Server but takes in input a *crypto/tls.Config
+// rather than a *github.com/ooni/oocrypto/tls.Config.
+//
+// This function returns a *ConnStdlib type in case of success. It supports
+// the same config fields as NewClientConnStdlib, and returns
+// ErrIncompatibleStdlibConfig if unsupported fields have a nonzero value.
+//
+// When using Go 1.21 or later, session tickets are encrypted with the keys of
+// config, including the ones set with its SetSessionTicketKeys method, so
+// that sessions can be resumed across connections using the same config and
+// across crypto/tls servers using it. The configs returned by its
+// GetConfigForClient callback use their own keys only if their
+// SessionTicketKey is set. With older Go versions, sessions can only be
+// resumed across connections if SessionTicketKey is set.
+func NewServerConnStdlib(conn net.Conn, config *stdlibtls.Config) (*ConnStdlib, error) {
+	ourConfig, err := newConfigFromStdlib(config, config)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnStdlib{Server(conn, ourConfig)}, nil
+}
+
+// listenerStdlib is the net.Listener returned by NewListenerStdlib.
+type listenerStdlib struct {
+	net.Listener
+	config *Config
+}
+
+// Accept waits for and returns the next incoming connection, which is
+// a *ConnStdlib.
+func (l *listenerStdlib) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ConnStdlib{Server(c, l.config)}, nil
+}
+
+// NewListenerStdlib is like NewListener but takes in input a
+// *crypto/tls.Config rather than a *github.com/ooni/oocrypto/tls.Config,
+// and its Accept method returns *ConnStdlib connections.
+//
+// It supports the same config fields as NewClientConnStdlib, and returns
+// ErrIncompatibleStdlibConfig if unsupported fields have a nonzero value.
+func NewListenerStdlib(inner net.Listener, config *stdlibtls.Config) (net.Listener, error) {
+	ourConfig, err := newConfigFromStdlib(config, config)
+	if err != nil {
+		return nil, err
+	}
+	return &listenerStdlib{Listener: inner, config: ourConfig}, nil
+}
+
+// newConfigFromStdlib converts a *crypto/tls.Config to a *Config, returning
+// ErrIncompatibleStdlibConfig if it contains nonzero fields that we cannot
+// convert. Callbacks are wrapped to convert their arguments and results.
+// On servers, tickets is not nil and session tickets are encrypted with its
+// keys, while clients pass a nil tickets.
+func newConfigFromStdlib(config, tickets *stdlibtls.Config) (*Config, error) {
 	supportedFields := map[string]bool{
-		"DynamicRecordSizingDisabled": true,
-		"InsecureSkipVerify":          true,
-		"MaxVersion":                  true,
-		"MinVersion":                  true,
-		"NextProtos":                  true,
-		"RootCAs":                     true,
-		"ServerName":                  true,
+		"Certificates":                        true,
+		"CipherSuites":                        true,
+		"ClientAuth":                          true,
+		"ClientCAs":                           true,
+		"ClientSessionCache":                  true,
+		"CurvePreferences":                    true,
+		"DynamicRecordSizingDisabled":         true,
+		"EncryptedClientHelloConfigList":      true,
+		"EncryptedClientHelloRejectionVerify": true,
+		"GetCertificate":                      true,
+		"GetClientCertificate":                true,
+		"GetConfigForClient":                  true,
+		"InsecureSkipVerify":                  true,
+		"KeyLogWriter":                        true,
+		"MaxVersion":                          true,
+		"MinVersion":                          true,
+		"NextProtos":                          true,
+		"PreferServerCipherSuites":            true,
+		"Rand":                                true,
+		"Renegotiation":                       true,
+		"RootCAs":                             true,
+		"ServerName":                          true,
+		"SessionTicketKey":                    true,
+		"SessionTicketsDisabled":              true,
+		"Time":                                true,
+		"VerifyConnection":                    true,
+		"VerifyPeerCertificate":               true,
 	}
 	value := reflect.ValueOf(config).Elem()
 	kind := value.Type()
@@ -61,22 +191,134 @@ func NewClientConnStdlib(conn net.Conn, config *stdlibtls.Config) (*ConnStdlib,
 			continue
 		}
 		fieldKind := kind.Field(idx)
-		if supportedFields[fieldKind.Name] {
+		if supportedFields[fieldKind.Name] || !fieldKind.IsExported() {
 			continue
 		}
 		err := fmt.Errorf("%w: field %s is nonzero", ErrIncompatibleStdlibConfig, fieldKind.Name)
 		return nil, err
 	}
 	ourConfig := &Config{
+		CipherSuites:                config.CipherSuites,
+		ClientAuth:                  ClientAuthType(config.ClientAuth),
+		ClientCAs:                   config.ClientCAs,
 		DynamicRecordSizingDisabled: config.DynamicRecordSizingDisabled,
 		InsecureSkipVerify:          config.InsecureSkipVerify,
+		KeyLogWriter:                config.KeyLogWriter,
 		MaxVersion:                  config.MaxVersion,
 		MinVersion:                  config.MinVersion,
 		NextProtos:                  config.NextProtos,
+		PreferServerCipherSuites:    config.PreferServerCipherSuites,
+		Rand:                        config.Rand,
+		Renegotiation:               RenegotiationSupport(config.Renegotiation),
 		RootCAs:                     config.RootCAs,
 		ServerName:                  config.ServerName,
+		SessionTicketKey:            config.SessionTicketKey,
+		SessionTicketsDisabled:      config.SessionTicketsDisabled,
+		Time:                        config.Time,
+		VerifyPeerCertificate:       config.VerifyPeerCertificate,
 	}
-	return &ConnStdlib{Client(conn, ourConfig)}, nil
+	if tickets != nil {
+		setStdlibSessionTickets(ourConfig, tickets)
+	}
+	encryptedClientHelloFromStdlib(ourConfig, config)
+	if config.ClientSessionCache != nil {
+		ourConfig.ClientSessionCache = newStdlibClientSessionCache(config.ClientSessionCache)
+		if ourConfig.ClientSessionCache == nil {
+			err := fmt.Errorf("%w: field ClientSessionCache requires Go 1.21", ErrIncompatibleStdlibConfig)
+			return nil, err
+		}
+	}
+	for _, cert := range config.Certificates {
+		ourConfig.Certificates = append(ourConfig.Certificates, *certificateFromStdlib(&cert))
+	}
+	for _, curve := range config.CurvePreferences {
+		ourConfig.CurvePreferences = append(ourConfig.CurvePreferences, CurveID(curve))
+	}
+	if f := config.GetClientCertificate; f != nil {
+		ourConfig.GetClientCertificate = func(cri *CertificateRequestInfo) (*Certificate, error) {
+			cert, err := f(certificateRequestInfoToStdlib(cri))
+			if err != nil || cert == nil {
+				return nil, err
+			}
+			return certificateFromStdlib(cert), nil
+		}
+	}
+	if f := config.GetCertificate; f != nil {
+		ourConfig.GetCertificate = func(chi *ClientHelloInfo) (*Certificate, error) {
+			cert, err := f(clientHelloInfoToStdlib(chi))
+			if err != nil || cert == nil {
+				return nil, err
+			}
+			return certificateFromStdlib(cert), nil
+		}
+	}
+	if f := config.GetConfigForClient; f != nil {
+		ourConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+			config, err := f(clientHelloInfoToStdlib(chi))
+			if err != nil || config == nil {
+				return nil, err
+			}
+			if config.SessionTicketKey != ([32]byte{}) {
+				return newConfigFromStdlib(config, config)
+			}
+			return newConfigFromStdlib(config, tickets)
+		}
+	}
+	if f := config.VerifyConnection; f != nil {
+		ourConfig.VerifyConnection = func(state ConnectionState) error {
+			return f(connectionStateToStdlib(state))
+		}
+	}
+	return ourConfig, nil
+}
+
+// certificateFromStdlib converts a *crypto/tls.Certificate to a *Certificate.
+func certificateFromStdlib(cert *stdlibtls.Certificate) *Certificate {
+	ourCert := &Certificate{
+		Certificate:                 cert.Certificate,
+		PrivateKey:                  cert.PrivateKey,
+		OCSPStaple:                  cert.OCSPStaple,
+		SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+		Leaf:                        cert.Leaf,
+	}
+	for _, scheme := range cert.SupportedSignatureAlgorithms {
+		ourCert.SupportedSignatureAlgorithms = append(ourCert.SupportedSignatureAlgorithms, SignatureScheme(scheme))
+	}
+	return ourCert
+}
+
+// clientHelloInfoToStdlib converts a *ClientHelloInfo to a
+// *crypto/tls.ClientHelloInfo, whose Context is nil.
+func clientHelloInfoToStdlib(chi *ClientHelloInfo) *stdlibtls.ClientHelloInfo {
+	stdlibCHI := &stdlibtls.ClientHelloInfo{
+		CipherSuites:      chi.CipherSuites,
+		ServerName:        chi.ServerName,
+		SupportedPoints:   chi.SupportedPoints,
+		SupportedProtos:   chi.SupportedProtos,
+		SupportedVersions: chi.SupportedVersions,
+		Conn:              chi.Conn,
+	}
+	for _, curve := range chi.SupportedCurves {
+		stdlibCHI.SupportedCurves = append(stdlibCHI.SupportedCurves, stdlibtls.CurveID(curve))
+	}
+	for _, scheme := range chi.SignatureSchemes {
+		stdlibCHI.SignatureSchemes = append(stdlibCHI.SignatureSchemes, stdlibtls.SignatureScheme(scheme))
+	}
+	clientHelloExtensionsToStdlib(stdlibCHI, chi)
+	return stdlibCHI
+}
+
+// certificateRequestInfoToStdlib converts a *CertificateRequestInfo to a
+// *crypto/tls.CertificateRequestInfo, whose Context is nil.
+func certificateRequestInfoToStdlib(cri *CertificateRequestInfo) *stdlibtls.CertificateRequestInfo {
+	stdlibCRI := &stdlibtls.CertificateRequestInfo{
+		AcceptableCAs: cri.AcceptableCAs,
+		Version:       cri.Version,
+	}
+	for _, scheme := range cri.SignatureSchemes {
+		stdlibCRI.SignatureSchemes = append(stdlibCRI.SignatureSchemes, stdlibtls.SignatureScheme(scheme))
+	}
+	return stdlibCRI
 }
 
 // connStdlibUnderlyingConn is similar to oohttp.TLSConn but its ConnectionState
@@ -99,10 +341,16 @@ type connStdlibUnderlyingConn interface {
 	NetConn() net.Conn
 }
 
-// ConnStdlib is the Conn-like type returned by NewClientConnStdlib. This type
-// is pretty much like this package's Conn except that the ConnectionState method
-// returns crypto/tls's ConnectionState. This change is enough to make this
-// struct compatible with github.com/ooni/oohttp.TLSConn.
+// ConnStdlib is the Conn-like type returned by NewClientConnStdlib and
+// NewServerConnStdlib, and by the listener returned by NewListenerStdlib. This
+// type is pretty much like this package's Conn except that the ConnectionState
+// method returns crypto/tls's ConnectionState. This change is enough to make
+// this struct compatible with github.com/ooni/oohttp.TLSConn.
+//
+// The RecordHeaderError and CertificateVerificationError errors returned by
+// its methods also match the equivalent crypto/tls types with errors.As, so
+// that code written for crypto/tls can classify them. So do the AlertError
+// errors, which, like with crypto/tls, are only returned for QUIC.
 type ConnStdlib struct {
 	connStdlibUnderlyingConn
 }
@@ -123,20 +371,53 @@ var _ connStdlibOOHTTPTLSLikeConn = &ConnStdlib{} // ensure we implement this in
 
 // ConnectionState converts the underlying Conn's ConnectionState to the
 // equivalent type exported by the Go standard library.
+//
+// The ExportKeyingMaterial method of the returned ConnectionState cannot be
+// used, because crypto/tls does not allow setting the keying material
+// exporter: it panics when called. Use ExportKeyingMaterial instead.
 func (c *ConnStdlib) ConnectionState() stdlibtls.ConnectionState {
+	return connectionStateToStdlib(c.connStdlibUnderlyingConn.ConnectionState())
+}
+
+// ExportKeyingMaterial is the supported way of exporting keying material, as
+// specified in RFC 5705, in place of ConnectionState().ExportKeyingMaterial.
+// See ConnectionState.ExportKeyingMaterial.
+func (c *ConnStdlib) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
 	state := c.connStdlibUnderlyingConn.ConnectionState()
-	return stdlibtls.ConnectionState{
-		Version:                     state.Version,
-		HandshakeComplete:           state.HandshakeComplete,
-		DidResume:                   state.DidResume,
-		CipherSuite:                 state.CipherSuite,
-		NegotiatedProtocol:          state.NegotiatedProtocol,
-		NegotiatedProtocolIsMutual:  state.NegotiatedProtocolIsMutual,
-		ServerName:                  state.ServerName,
-		PeerCertificates:            state.PeerCertificates,
-		VerifiedChains:              state.VerifiedChains,
-		SignedCertificateTimestamps: state.SignedCertificateTimestamps,
-		OCSPResponse:                state.OCSPResponse,
-		TLSUnique:                   state.TLSUnique,
+	return state.ExportKeyingMaterial(label, context, length)
+}
+
+// connectionStateFieldNames maps the names of the crypto/tls ConnectionState
+// fields to the names of the equivalent fields of ConnectionState, when they
+// differ.
+var connectionStateFieldNames = map[string]string{
+	"HelloRetryRequest": "DidHelloRetryRequest",
+}
+
+// connectionStateToStdlib converts a ConnectionState to the equivalent type
+// exported by the Go standard library.
+//
+// The fields are copied by name, so that the fields added to crypto/tls after
+// the Go version this package is based on are set when we have them. The
+// unexported fields, such as the one used by ExportKeyingMaterial, are not
+// set.
+func connectionStateToStdlib(state ConnectionState) stdlibtls.ConnectionState {
+	var stdlibState stdlibtls.ConnectionState
+	src := reflect.ValueOf(state)
+	dst := reflect.ValueOf(&stdlibState).Elem()
+	for idx := 0; idx < dst.NumField(); idx++ {
+		fieldKind := dst.Type().Field(idx)
+		if !fieldKind.IsExported() {
+			continue
+		}
+		name := fieldKind.Name
+		if ours, ok := connectionStateFieldNames[name]; ok {
+			name = ours
+		}
+		value := src.FieldByName(name)
+		if value.IsValid() && value.Type().ConvertibleTo(fieldKind.Type) {
+			dst.Field(idx).Set(value.Convert(fieldKind.Type))
+		}
 	}
+	return stdlibState
 }
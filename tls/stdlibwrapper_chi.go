@@ -0,0 +1,13 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.24
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// clientHelloExtensionsToStdlib sets the Extensions field of stdlibCHI,
+// which crypto/tls exports since Go 1.24.
+func clientHelloExtensionsToStdlib(stdlibCHI *stdlibtls.ClientHelloInfo, chi *ClientHelloInfo) {
+	stdlibCHI.Extensions = chi.Extensions
+}
@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !go1.24
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// clientHelloExtensionsToStdlib does nothing because crypto/tls does not
+// export the extensions of the ClientHello before Go 1.24.
+func clientHelloExtensionsToStdlib(stdlibCHI *stdlibtls.ClientHelloInfo, chi *ClientHelloInfo) {}
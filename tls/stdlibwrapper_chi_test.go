@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.24
+
+package tls
+
+import (
+	"context"
+	stdlibtls "crypto/tls"
+	"testing"
+)
+
+func TestNewServerConnStdlibClientHelloExtensions(t *testing.T) {
+	cert := stdlibtls.Certificate{
+		Certificate: testConfig.Certificates[0].Certificate,
+		PrivateKey:  testConfig.Certificates[0].PrivateKey,
+	}
+	var extensions []uint16
+	config := &stdlibtls.Config{
+		GetCertificate: func(chi *stdlibtls.ClientHelloInfo) (*stdlibtls.Certificate, error) {
+			extensions = chi.Extensions
+			return &cert, nil
+		},
+		Time: testConfig.Time,
+	}
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+
+	c, s := localPipe(t)
+	server, err := NewServerConnStdlib(s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := Client(c, clientConfig)
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- client.Handshake() }()
+	if err := server.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint16]bool)
+	for _, ext := range extensions {
+		seen[ext] = true
+	}
+	for _, ext := range []uint16{extensionServerName, extensionSupportedVersions, extensionKeyShare} {
+		if !seen[ext] {
+			t.Errorf("extension %d missing from %v", ext, extensions)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.23
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// encryptedClientHelloFromStdlib sets the Encrypted Client Hello fields of
+// ourConfig from the equivalent fields of config, wrapping the callback to
+// convert its argument.
+func encryptedClientHelloFromStdlib(ourConfig *Config, config *stdlibtls.Config) {
+	ourConfig.EncryptedClientHelloConfigList = config.EncryptedClientHelloConfigList
+	if f := config.EncryptedClientHelloRejectionVerify; f != nil {
+		ourConfig.EncryptedClientHelloRejectionVerify = func(state ConnectionState) error {
+			return f(connectionStateToStdlib(state))
+		}
+	}
+}
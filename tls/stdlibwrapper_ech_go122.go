@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !go1.23
+
+package tls
+
+import stdlibtls "crypto/tls"
+
+// encryptedClientHelloFromStdlib does nothing because crypto/tls does not
+// support Encrypted Client Hello before Go 1.23.
+func encryptedClientHelloFromStdlib(ourConfig *Config, config *stdlibtls.Config) {}
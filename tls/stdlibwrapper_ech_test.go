@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.23
+
+package tls
+
+import (
+	"bytes"
+	stdlibtls "crypto/tls"
+	"errors"
+	"testing"
+)
+
+func TestNewConfigFromStdlibEncryptedClientHello(t *testing.T) {
+	key := testECHKey(t)
+	list := testECHConfigList(testECHConfig(t, 1, "public.example", key.PublicKey().Bytes()))
+	errRejected := errors.New("rejected")
+	var got stdlibtls.ConnectionState
+	config := &stdlibtls.Config{
+		EncryptedClientHelloConfigList: list,
+		EncryptedClientHelloRejectionVerify: func(state stdlibtls.ConnectionState) error {
+			got = state
+			return errRejected
+		},
+	}
+	ourConfig, err := newConfigFromStdlib(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ourConfig.EncryptedClientHelloConfigList, list) {
+		t.Error("EncryptedClientHelloConfigList was not copied")
+	}
+	if ourConfig.EncryptedClientHelloRejectionVerify == nil {
+		t.Fatal("EncryptedClientHelloRejectionVerify was not converted")
+	}
+	state := ConnectionState{Version: VersionTLS13, ServerName: "public.example"}
+	if err := ourConfig.EncryptedClientHelloRejectionVerify(state); err != errRejected {
+		t.Errorf("got error %v, want %v", err, errRejected)
+	}
+	if got.Version != VersionTLS13 || got.ServerName != "public.example" {
+		t.Errorf("callback got %+v", got)
+	}
+
+	ourConfig, err = newConfigFromStdlib(&stdlibtls.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ourConfig.EncryptedClientHelloRejectionVerify != nil {
+		t.Error("expected a nil EncryptedClientHelloRejectionVerify")
+	}
+}
@@ -3,10 +3,12 @@
 package tls
 
 import (
+	"bytes"
 	"context"
 	stdlibtls "crypto/tls"
 	"crypto/x509"
 	"errors"
+	"io"
 	"net"
 	"reflect"
 	"testing"
@@ -31,11 +33,20 @@ func TestNewClientConnStdlib(t *testing.T) {
 		},
 		err: nil,
 	}, {
-		name: "with unsupported fields",
+		name: "with converted fields",
 		config: &stdlibtls.Config{
 			Time: func() time.Time {
 				return time.Now()
 			},
+			CipherSuites:     []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CurvePreferences: []stdlibtls.CurveID{stdlibtls.X25519},
+			Renegotiation:    stdlibtls.RenegotiateOnceAsClient,
+		},
+		err: nil,
+	}, {
+		name: "with unsupported fields",
+		config: &stdlibtls.Config{
+			NameToCertificate: map[string]*stdlibtls.Certificate{"ooni.org": {}},
 		},
 		err: ErrIncompatibleStdlibConfig,
 	}}
@@ -151,3 +162,313 @@ func TestConnStdlib_ConnectionState(t *testing.T) {
 		})
 	}
 }
+
+// fillNonZero sets v, recursively, to a value that is not the zero value.
+func fillNonZero(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillNonZero(v.Index(0))
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			if v.Type().Field(idx).IsExported() {
+				fillNonZero(v.Field(idx))
+			}
+		}
+	}
+}
+
+func TestConnectionStateToStdlibFields(t *testing.T) {
+	// These crypto/tls fields have no equivalent in this package.
+	unsupported := map[string]bool{
+		"LocalCertificate": true,
+	}
+
+	var state ConnectionState
+	fillNonZero(reflect.ValueOf(&state).Elem())
+	stdlibState := reflect.ValueOf(connectionStateToStdlib(state))
+	for idx := 0; idx < stdlibState.NumField(); idx++ {
+		field := stdlibState.Type().Field(idx)
+		if !field.IsExported() || unsupported[field.Name] {
+			continue
+		}
+		if stdlibState.Field(idx).IsZero() {
+			t.Errorf("crypto/tls ConnectionState.%s was not set", field.Name)
+		}
+	}
+}
+
+func TestConnStdlibExportKeyingMaterial(t *testing.T) {
+	for _, version := range []uint16{VersionTLS12, VersionTLS13} {
+		config := testConfig.Clone()
+		config.MaxVersion = version
+		c, s := localPipe(t)
+		conn := &ConnStdlib{Client(c, config)}
+		defer conn.Close()
+		server := Server(s, config)
+		defer server.Close()
+		errc := make(chan error, 1)
+		go func() { errc <- server.Handshake() }()
+		if err := conn.HandshakeContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+
+		serverState := server.ConnectionState()
+		want, err := serverState.ExportKeyingMaterial("EXPORTER-test", []byte("context"), 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := conn.ExportKeyingMaterial("EXPORTER-test", []byte("context"), 32)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%x: ExportKeyingMaterial() = %x, %v; want %x", version, got, err, want)
+		}
+		state := conn.ConnectionState()
+		if state.CurveID == 0 || stdlibtls.CurveID(serverState.CurveID) != state.CurveID {
+			t.Errorf("%x: got CurveID %v, want %v", version, state.CurveID, serverState.CurveID)
+		}
+	}
+}
+
+func TestNewClientConnStdlibHandshake(t *testing.T) {
+	var (
+		keyLog                bytes.Buffer
+		verifyPeerCertificate bool
+		verifyConnection      *stdlibtls.ConnectionState
+		certificateRequest    *stdlibtls.CertificateRequestInfo
+	)
+	now := testConfig.Time()
+	config := &stdlibtls.Config{
+		Certificates: []stdlibtls.Certificate{{
+			Certificate: testConfig.Certificates[0].Certificate,
+			PrivateKey:  testConfig.Certificates[0].PrivateKey,
+		}},
+		CipherSuites:       []uint16{TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+		CurvePreferences:   []stdlibtls.CurveID{stdlibtls.CurveP256},
+		InsecureSkipVerify: true,
+		KeyLogWriter:       &keyLog,
+		MaxVersion:         VersionTLS12,
+		Rand:               zeroSource{},
+		ServerName:         "example.golang",
+		Time:               func() time.Time { return now },
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			verifyPeerCertificate = len(rawCerts) > 0
+			return nil
+		},
+		VerifyConnection: func(state stdlibtls.ConnectionState) error {
+			verifyConnection = &state
+			return nil
+		},
+	}
+
+	serverConfig := testConfig.Clone()
+	serverConfig.ClientAuth = RequireAnyClientCert
+	c, s := localPipe(t)
+	conn, err := NewClientConnStdlib(c, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := Server(s, serverConfig)
+	defer server.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := conn.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	state := conn.ConnectionState()
+	if state.CipherSuite != TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256 || state.Version != VersionTLS12 {
+		t.Errorf("got version %x and cipher suite %x", state.Version, state.CipherSuite)
+	}
+	if keyLog.Len() == 0 {
+		t.Error("KeyLogWriter was not used")
+	}
+	if !verifyPeerCertificate {
+		t.Error("VerifyPeerCertificate was not called")
+	}
+	if verifyConnection == nil || verifyConnection.ServerName != "example.golang" {
+		t.Errorf("VerifyConnection got %+v", verifyConnection)
+	}
+	if len(server.ConnectionState().PeerCertificates) != 1 {
+		t.Error("the client did not send its certificate")
+	}
+
+	config.Certificates = nil
+	config.GetClientCertificate = func(cri *stdlibtls.CertificateRequestInfo) (*stdlibtls.Certificate, error) {
+		certificateRequest = cri
+		return &stdlibtls.Certificate{
+			Certificate: testConfig.Certificates[0].Certificate,
+			PrivateKey:  testConfig.Certificates[0].PrivateKey,
+		}, nil
+	}
+	c, s = localPipe(t)
+	conn, err = NewClientConnStdlib(c, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server = Server(s, serverConfig)
+	defer server.Close()
+	go func() { errc <- server.Handshake() }()
+	if err := conn.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if certificateRequest == nil || certificateRequest.Version != VersionTLS12 || len(certificateRequest.SignatureSchemes) == 0 {
+		t.Errorf("GetClientCertificate got %+v", certificateRequest)
+	}
+	if len(server.ConnectionState().PeerCertificates) != 1 {
+		t.Error("the client did not send its certificate")
+	}
+}
+
+func TestNewServerConnStdlib(t *testing.T) {
+	cert := stdlibtls.Certificate{
+		Certificate: testConfig.Certificates[0].Certificate,
+		PrivateKey:  testConfig.Certificates[0].PrivateKey,
+	}
+	var (
+		getCertificate     *stdlibtls.ClientHelloInfo
+		getConfigForClient *stdlibtls.ClientHelloInfo
+	)
+	config := &stdlibtls.Config{
+		GetConfigForClient: func(chi *stdlibtls.ClientHelloInfo) (*stdlibtls.Config, error) {
+			getConfigForClient = chi
+			return &stdlibtls.Config{
+				GetCertificate: func(chi *stdlibtls.ClientHelloInfo) (*stdlibtls.Certificate, error) {
+					getCertificate = chi
+					return &cert, nil
+				},
+				ClientAuth: stdlibtls.RequireAnyClientCert,
+				NextProtos: []string{"h2"},
+				Time:       testConfig.Time,
+			}, nil
+		},
+	}
+	clientConfig := testConfig.Clone()
+	clientConfig.ServerName = "example.golang"
+	clientConfig.NextProtos = []string{"http/1.1", "h2"}
+
+	c, s := localPipe(t)
+	server, err := NewServerConnStdlib(s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := Client(c, clientConfig)
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- client.Handshake() }()
+	if err := server.HandshakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if getConfigForClient == nil || getConfigForClient.ServerName != "example.golang" ||
+		len(getConfigForClient.SupportedCurves) == 0 || len(getConfigForClient.SignatureSchemes) == 0 ||
+		getConfigForClient.Conn != s {
+		t.Errorf("GetConfigForClient got %+v", getConfigForClient)
+	}
+	if getCertificate == nil || getCertificate.ServerName != "example.golang" {
+		t.Errorf("GetCertificate got %+v", getCertificate)
+	}
+	state := server.ConnectionState()
+	if state.NegotiatedProtocol != "h2" || len(state.PeerCertificates) != 1 {
+		t.Errorf("unexpected connection state %+v", state)
+	}
+
+	config.GetConfigForClient = func(*stdlibtls.ClientHelloInfo) (*stdlibtls.Config, error) {
+		return &stdlibtls.Config{
+			NameToCertificate: map[string]*stdlibtls.Certificate{"example.golang": &cert},
+		}, nil
+	}
+	c, s = localPipe(t)
+	server, err = NewServerConnStdlib(s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client = Client(c, clientConfig)
+	defer client.Close()
+	go func() { errc <- client.Handshake() }()
+	if err := server.HandshakeContext(context.Background()); !errors.Is(err, ErrIncompatibleStdlibConfig) {
+		t.Errorf("got error %v, want ErrIncompatibleStdlibConfig", err)
+	}
+	<-errc
+}
+
+func TestNewListenerStdlib(t *testing.T) {
+	ln, err := NewListenerStdlib(newLocalListener(t), &stdlibtls.Config{
+		Certificates: []stdlibtls.Certificate{{
+			Certificate: testConfig.Certificates[0].Certificate,
+			PrivateKey:  testConfig.Certificates[0].PrivateKey,
+		}},
+		SessionTicketKey: [32]byte{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := stdlibtls.Dial("tcp", ln.Addr().String(), &stdlibtls.Config{
+			InsecureSkipVerify: true,
+			Time:               testConfig.Time,
+		})
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		errc <- err
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, ok := conn.(*ConnStdlib)
+	if !ok {
+		t.Fatalf("got %T, want *ConnStdlib", conn)
+	}
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if state := sc.ConnectionState(); !state.HandshakeComplete || state.Version != VersionTLS13 {
+		t.Errorf("unexpected connection state %+v", state)
+	}
+
+	inner := newLocalListener(t)
+	defer inner.Close()
+	if _, err := NewListenerStdlib(inner, &stdlibtls.Config{
+		NameToCertificate: map[string]*stdlibtls.Certificate{},
+	}); !errors.Is(err, ErrIncompatibleStdlibConfig) {
+		t.Errorf("got error %v, want ErrIncompatibleStdlibConfig", err)
+	}
+}
@@ -96,6 +96,9 @@ type SessionState struct {
 	// Client-side TLS 1.3-only fields.
 	useBy  uint64 // seconds since UNIX epoch
 	ageAdd uint32
+
+	// TLS 1.0–1.2 only fields.
+	curveID CurveID
 }
 
 // Bytes encodes the session, including any private fields, so that it can be
@@ -105,6 +108,12 @@ type SessionState struct {
 // The specific encoding should be considered opaque and may change incompatibly
 // between Go versions.
 func (s *SessionState) Bytes() ([]byte, error) {
+	return s.bytes(false)
+}
+
+// bytes implements Bytes. If withCurveID is true, the key exchange group of
+// TLS 1.0–1.2 sessions is appended, like crypto/tls does since Go 1.25.
+func (s *SessionState) bytes(withCurveID bool) ([]byte, error) {
 	var b cryptobyte.Builder
 	b.AddUint16(s.version)
 	if s.isClient {
@@ -160,6 +169,9 @@ func (s *SessionState) Bytes() ([]byte, error) {
 			b.AddBytes([]byte(s.alpnProtocol))
 		})
 	}
+	if s.version < VersionTLS13 && withCurveID {
+		b.AddUint16(uint16(s.curveID))
+	}
 	if s.isClient {
 		if s.version >= VersionTLS13 {
 			addUint64(&b, s.useBy)
@@ -179,6 +191,13 @@ func certificatesToBytesSlice(certs []*x509.Certificate) [][]byte {
 
 // ParseSessionState parses a [SessionState] encoded by [SessionState.Bytes].
 func ParseSessionState(data []byte) (*SessionState, error) {
+	return parseSessionState(data, false)
+}
+
+// parseSessionState implements ParseSessionState. If withCurveID is true,
+// TLS 1.0–1.2 sessions must end with their key exchange group, like
+// crypto/tls encodes them since Go 1.25.
+func parseSessionState(data []byte, withCurveID bool) (*SessionState, error) {
 	ss := &SessionState{}
 	s := cryptobyte.String(data)
 	var typ, extMasterSecret, earlyData uint8
@@ -265,6 +284,11 @@ func ParseSessionState(data []byte) (*SessionState, error) {
 		}
 		ss.alpnProtocol = string(alpn)
 	}
+	if ss.version < VersionTLS13 && withCurveID {
+		if !s.ReadUint16((*uint16)(&ss.curveID)) {
+			return nil, errors.New("tls: invalid session encoding")
+		}
+	}
 	if isClient := typ == 2; !isClient {
 		if !s.Empty() {
 			return nil, errors.New("tls: invalid session encoding")
@@ -302,6 +326,7 @@ func (c *Conn) sessionState() (*SessionState, error) {
 		isClient:          c.isClient,
 		extMasterSecret:   c.extMasterSecret,
 		verifiedChains:    c.verifiedChains,
+		curveID:           c.curveID,
 	}, nil
 }
 
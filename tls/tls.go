@@ -37,13 +37,14 @@ func Server(conn net.Conn, config *Config) *Conn {
 		config: config,
 	}
 	c.handshakeFn = c.serverHandshake
+	c.initKeyChangeTracing()
 	return c
 }
 
 // Client returns a new TLS client side connection
 // using conn as the underlying transport.
-// The config cannot be nil: users must set either ServerName or
-// InsecureSkipVerify in the config.
+// The config cannot be nil: users must set either ServerName,
+// CertificateServerName, or InsecureSkipVerify in the config.
 func Client(conn net.Conn, config *Config) *Conn {
 	c := &Conn{
 		conn:     conn,
@@ -51,6 +52,7 @@ func Client(conn net.Conn, config *Config) *Conn {
 		isClient: true,
 	}
 	c.handshakeFn = c.clientHandshake
+	c.initKeyChangeTracing()
 	return c
 }
 
@@ -81,6 +83,34 @@ func NewListener(inner net.Listener, config *Config) net.Listener {
 	return l
 }
 
+// A sniffListener implements a network listener (net.Listener) for
+// connections whose ClientHello can be inspected before deciding how to
+// handle them.
+type sniffListener struct {
+	net.Listener
+}
+
+// Accept waits for and returns the next incoming connection.
+// The returned connection is of type *SniffConn.
+func (l *sniffListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewSniffConn(c), nil
+}
+
+// NewSniffListener creates a Listener which accepts connections from an
+// inner Listener and wraps each connection with [NewSniffConn]. Accept does
+// not read from the connections, so a slow client does not block it.
+//
+// The caller can inspect the ClientHello of each connection, and then either
+// forward the connection, whose Read returns all the bytes sent by the
+// client, or terminate TLS by wrapping it with [Server].
+func NewSniffListener(inner net.Listener) net.Listener {
+	return &sniffListener{Listener: inner}
+}
+
 // Listen creates a TLS listener accepting connections on the
 // given network address using net.Listen.
 // The configuration config must be non-nil and must include
@@ -145,8 +175,10 @@ func dial(ctx context.Context, netDialer *net.Dialer, network, addr string, conf
 		config = defaultConfig()
 	}
 	// If no ServerName is set, infer the ServerName
-	// from the hostname we're connecting to.
-	if config.ServerName == "" {
+	// from the hostname we're connecting to, unless
+	// CertificateServerName is set, in which case the
+	// client does not send the SNI extension.
+	if config.ServerName == "" && config.CertificateServerName == "" {
 		// Make a copy to avoid polluting argument or default.
 		c := config.Clone()
 		c.ServerName = hostname
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+)
+
+// EncryptedExtensionsMessage is a TLS 1.3 EncryptedExtensions handshake
+// message. See ClientHelloMessage.
+type EncryptedExtensionsMessage struct {
+	// Extensions contains the extensions, in order, with their raw
+	// extension_data. When marshaling, it has the same meaning as
+	// ServerHelloMessage.Extensions.
+	Extensions []Extension
+
+	ALPNProtocol            string
+	QUICTransportParameters []byte
+	EarlyData               bool
+
+	// ApplicationSettings is the data of the application_settings
+	// extension, if HasApplicationSettings is true.
+	HasApplicationSettings bool
+	ApplicationSettings    []byte
+
+	// ECHRetryConfigs is the ECHConfigList sent by a server that rejected
+	// Encrypted Client Hello.
+	ECHRetryConfigs []byte
+}
+
+// CertificateMessageTLS13 is a TLS 1.3 Certificate handshake message. Only
+// the OCSP staple and the SCTs of the leaf certificate are parsed, and the
+// certificate_request_context must be empty. See ClientHelloMessage.
+type CertificateMessageTLS13 struct {
+	// Certificates is the certificate chain, in the order of the message,
+	// in DER encoding.
+	Certificates [][]byte
+
+	OCSPStaple []byte
+	SCTs       [][]byte
+}
+
+var (
+	errInvalidEncryptedExtensions = errors.New("tls: invalid EncryptedExtensions message")
+	errInvalidCertificate         = errors.New("tls: invalid Certificate message")
+)
+
+// ParseEncryptedExtensions parses an EncryptedExtensions handshake message,
+// starting with its four bytes header. The returned message does not alias
+// data.
+func ParseEncryptedExtensions(data []byte) (*EncryptedExtensionsMessage, error) {
+	data = bytes.Clone(data)
+	var m encryptedExtensionsMsg
+	if len(data) == 0 || data[0] != typeEncryptedExtensions || !m.unmarshal(data) {
+		return nil, errInvalidEncryptedExtensions
+	}
+	extensions, ok := helloExtensions(data, 0)
+	if !ok {
+		return nil, errInvalidEncryptedExtensions
+	}
+	return &EncryptedExtensionsMessage{
+		Extensions:              extensions,
+		ALPNProtocol:            m.alpnProtocol,
+		QUICTransportParameters: m.quicTransportParameters,
+		EarlyData:               m.earlyData,
+		HasApplicationSettings:  m.hasApplicationSettings,
+		ApplicationSettings:     m.applicationSettings,
+		ECHRetryConfigs:         m.echRetryConfigs,
+	}, nil
+}
+
+// Marshal returns the EncryptedExtensions handshake message, including its
+// four bytes header.
+func (ee *EncryptedExtensionsMessage) Marshal() ([]byte, error) {
+	m := &encryptedExtensionsMsg{
+		alpnProtocol:            ee.ALPNProtocol,
+		quicTransportParameters: ee.QUICTransportParameters,
+		earlyData:               ee.EarlyData,
+		hasApplicationSettings:  ee.HasApplicationSettings,
+		applicationSettings:     ee.ApplicationSettings,
+		echRetryConfigs:         ee.ECHRetryConfigs,
+	}
+	data, err := m.marshal()
+	if err != nil {
+		return nil, err
+	}
+	return reorderExtensions(data, 0, ee.Extensions)
+}
+
+// ParseCertificateTLS13 parses a TLS 1.3 Certificate handshake message,
+// starting with its four bytes header. The returned message does not alias
+// data.
+func ParseCertificateTLS13(data []byte) (*CertificateMessageTLS13, error) {
+	data = bytes.Clone(data)
+	var m certificateMsgTLS13
+	if len(data) == 0 || data[0] != typeCertificate || !m.unmarshal(data) {
+		return nil, errInvalidCertificate
+	}
+	return &CertificateMessageTLS13{
+		Certificates: m.certificate.Certificate,
+		OCSPStaple:   m.certificate.OCSPStaple,
+		SCTs:         m.certificate.SignedCertificateTimestamps,
+	}, nil
+}
+
+// Marshal returns the Certificate handshake message, including its four
+// bytes header.
+func (cert *CertificateMessageTLS13) Marshal() ([]byte, error) {
+	m := &certificateMsgTLS13{
+		certificate: Certificate{
+			Certificate:                 cert.Certificates,
+			OCSPStaple:                  cert.OCSPStaple,
+			SignedCertificateTimestamps: cert.SCTs,
+		},
+		ocspStapling: cert.OCSPStaple != nil,
+		scts:         cert.SCTs != nil,
+	}
+	return m.marshal()
+}
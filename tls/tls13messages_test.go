@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTLS13MessagesHandshake(t *testing.T) {
+	clientConfig := recordingConfig()
+	clientConfig.NextProtos = []string{"h2"}
+	serverConfig := testConfig.Clone()
+	serverConfig.NextProtos = []string{"h2"}
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := cs.HandshakeTranscript[2].Raw
+	ee, err := ParseEncryptedExtensions(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ee.ALPNProtocol != "h2" || len(ee.Extensions) != 1 || ee.Extensions[0].Type != extensionALPN {
+		t.Errorf("unexpected EncryptedExtensions %+v", ee)
+	}
+	if got, err := ee.Marshal(); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("the marshaled EncryptedExtensions does not match: %v", err)
+	}
+
+	// Replace the ALPN protocol, letting Marshal generate the extension.
+	ee.Extensions[0].Data = nil
+	ee.ALPNProtocol = "http/1.1"
+	raw, err = ee.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParseEncryptedExtensions(raw); err != nil || parsed.ALPNProtocol != "http/1.1" {
+		t.Errorf("got %+v, %v", parsed, err)
+	}
+
+	raw = cs.HandshakeTranscript[3].Raw
+	cert, err := ParseCertificateTLS13(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificates) != len(cs.PeerCertificates) {
+		t.Fatalf("got %d certificates, want %d", len(cert.Certificates), len(cs.PeerCertificates))
+	}
+	for i, c := range cs.PeerCertificates {
+		if !bytes.Equal(cert.Certificates[i], c.Raw) {
+			t.Errorf("certificate %d does not match", i)
+		}
+	}
+	if got, err := cert.Marshal(); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("the marshaled Certificate does not match: %v", err)
+	}
+
+	cert.OCSPStaple = []byte{1, 2, 3}
+	cert.SCTs = [][]byte{{4, 5}}
+	raw, err = cert.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseCertificateTLS13(raw)
+	if err != nil || !bytes.Equal(parsed.OCSPStaple, cert.OCSPStaple) || len(parsed.SCTs) != 1 {
+		t.Errorf("got %+v, %v", parsed, err)
+	}
+
+	for _, bad := range [][]byte{nil, {typeCertificate, 0, 0, 0}, raw[:len(raw)-1]} {
+		if _, err := ParseCertificateTLS13(bad); err == nil {
+			t.Errorf("parsing %x: expected an error", bad)
+		}
+	}
+	if _, err := ParseEncryptedExtensions(raw); err == nil {
+		t.Error("parsing a Certificate as EncryptedExtensions: expected an error")
+	}
+}
@@ -761,7 +761,7 @@ func TestWarningAlertFlood(t *testing.T) {
 }
 
 func TestCloneFuncFields(t *testing.T) {
-	const expectedCount = 8
+	const expectedCount = 10
 	called := 0
 
 	c1 := Config{
@@ -797,6 +797,14 @@ func TestCloneFuncFields(t *testing.T) {
 			called |= 1 << 7
 			return nil, nil
 		},
+		EncryptedClientHelloRejectionVerify: func(ConnectionState) error {
+			called |= 1 << 8
+			return nil
+		},
+		GetEncryptedClientHelloKeys: func(*ClientHelloInfo) ([]EncryptedClientHelloKey, error) {
+			called |= 1 << 9
+			return nil, nil
+		},
 	}
 
 	c2 := c1.Clone()
@@ -809,6 +817,8 @@ func TestCloneFuncFields(t *testing.T) {
 	c2.VerifyConnection(ConnectionState{})
 	c2.UnwrapSession(nil, ConnectionState{})
 	c2.WrapSession(ConnectionState{}, nil)
+	c2.EncryptedClientHelloRejectionVerify(ConnectionState{})
+	c2.GetEncryptedClientHelloKeys(nil)
 
 	if called != (1<<expectedCount)-1 {
 		t.Fatalf("expected %d calls but saw calls %b", expectedCount, called)
@@ -827,7 +837,7 @@ func TestCloneNonFuncFields(t *testing.T) {
 		switch fn := typ.Field(i).Name; fn {
 		case "Rand":
 			f.Set(reflect.ValueOf(io.Reader(os.Stdin)))
-		case "Time", "GetCertificate", "GetConfigForClient", "VerifyPeerCertificate", "VerifyConnection", "GetClientCertificate", "WrapSession", "UnwrapSession":
+		case "Time", "GetCertificate", "GetConfigForClient", "VerifyPeerCertificate", "VerifyConnection", "GetClientCertificate", "WrapSession", "UnwrapSession", "EncryptedClientHelloRejectionVerify", "GetEncryptedClientHelloKeys":
 			// DeepEqual can't compare functions. If you add a
 			// function field to this list, you must also change
 			// TestCloneFuncFields to ensure that the func field is
@@ -846,11 +856,11 @@ func TestCloneNonFuncFields(t *testing.T) {
 			f.Set(reflect.ValueOf(io.Writer(os.Stdout)))
 		case "NextProtos":
 			f.Set(reflect.ValueOf([]string{"a", "b"}))
-		case "ServerName":
+		case "ServerName", "CertificateServerName":
 			f.Set(reflect.ValueOf("b"))
 		case "ClientAuth":
 			f.Set(reflect.ValueOf(VerifyClientCertIfGiven))
-		case "InsecureSkipVerify", "SessionTicketsDisabled", "DynamicRecordSizingDisabled", "PreferServerCipherSuites":
+		case "InsecureSkipVerify", "SessionTicketsDisabled", "DynamicRecordSizingDisabled", "PreferServerCipherSuites", "GREASE", "EncryptedClientHelloGREASE", "KernelTLS", "RecordHandshakeTranscript":
 			f.Set(reflect.ValueOf(true))
 		case "MinVersion", "MaxVersion":
 			f.Set(reflect.ValueOf(uint16(VersionTLS12)))
@@ -858,10 +868,26 @@ func TestCloneNonFuncFields(t *testing.T) {
 			f.Set(reflect.ValueOf([32]byte{}))
 		case "CipherSuites":
 			f.Set(reflect.ValueOf([]uint16{1, 2}))
-		case "CurvePreferences":
+		case "CurvePreferences", "KeyShareCurves":
 			f.Set(reflect.ValueOf([]CurveID{CurveP256}))
 		case "Renegotiation":
 			f.Set(reflect.ValueOf(RenegotiateOnceAsClient))
+		case "ClientHelloFragmentation":
+			f.Set(reflect.ValueOf(&ClientHelloFragmentation{RecordSize: 1}))
+		case "ClientHelloSegmentation":
+			f.Set(reflect.ValueOf(&ClientHelloSegmentation{SegmentSize: 1}))
+		case "RecordPadding":
+			f.Set(reflect.ValueOf(&RecordPadding{BlockSize: 1}))
+		case "KeyUpdatePolicy":
+			f.Set(reflect.ValueOf(&KeyUpdatePolicy{Bytes: 1}))
+		case "Tracer":
+			f.Set(reflect.ValueOf(&Tracer{}))
+		case "ClientHelloSpec":
+			f.Set(reflect.ValueOf(&ClientHelloSpec{CipherSuites: []uint16{1, 2}}))
+		case "EncryptedClientHelloConfigList":
+			f.Set(reflect.ValueOf([]byte{'x'}))
+		case "EncryptedClientHelloKeys":
+			f.Set(reflect.ValueOf([]EncryptedClientHelloKey{{Config: []byte{'x'}, PrivateKey: []byte{'y'}}}))
 		case "mutex", "autoSessionTicketKeys", "sessionTicketKeys":
 			continue // these are unexported fields that are handled separately
 		default:
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import "time"
+
+// Tracer contains hooks called while a [Conn] or a [QUICConn] runs the
+// handshake and exchanges records, to observe the connection in detail,
+// for example to measure where a handshake stalls. Any hook may be nil.
+//
+// Hooks are called synchronously by the goroutine driving the connection,
+// possibly while holding the connection's internal locks, so they must not
+// call methods of the connection and should return quickly. The byte
+// slices passed to the hooks are only valid during the call.
+type Tracer struct {
+	// HandshakeMessage is called for each handshake message sent or
+	// received, including the post-handshake ones.
+	HandshakeMessage func(HandshakeMessageInfo)
+
+	// Record is called for each TLS record sent or received. It is not
+	// called by QUIC connections, which do not use TLS records.
+	Record func(RecordInfo)
+
+	// Alert is called for each alert sent or received. For QUIC
+	// connections, only the alerts sent are reported, as the QUIC
+	// transport carries them in its own frames.
+	Alert func(AlertInfo)
+
+	// KeyChange is called each time the keys protecting one direction of
+	// the connection change.
+	KeyChange func(KeyChangeInfo)
+
+	// Negotiated is called once per handshake, as soon as the version, the
+	// cipher suite, and the key exchange group are known.
+	Negotiated func(NegotiatedInfo)
+}
+
+// HandshakeMessageInfo describes a handshake message passed to
+// [Tracer.HandshakeMessage].
+type HandshakeMessageInfo struct {
+	// Time is when the message was sent or fully received.
+	Time time.Time
+
+	// Sent is true for the messages sent by this side of the connection.
+	Sent bool
+
+	// Type is the handshake message type, for example 1 for ClientHello.
+	// See RFC 8446, Section 4.
+	Type uint8
+
+	// Raw is the message, including its four bytes header.
+	Raw []byte
+}
+
+// RecordInfo describes a TLS record passed to [Tracer.Record].
+type RecordInfo struct {
+	// Time is when the record was written, or buffered to be written
+	// together with the following ones, or fully received.
+	Time time.Time
+
+	// Sent is true for the records sent by this side of the connection.
+	Sent bool
+
+	// Type is the content type in the record header. In TLS 1.3 encrypted
+	// records always use the application_data type.
+	Type uint8
+
+	// Version is the legacy version in the record header.
+	Version uint16
+
+	// Length is the length of the record payload, as in the record header.
+	Length int
+}
+
+// AlertInfo describes an alert passed to [Tracer.Alert].
+type AlertInfo struct {
+	// Time is when the alert was sent or received.
+	Time time.Time
+
+	// Sent is true for the alerts sent by this side of the connection.
+	Sent bool
+
+	// Level is 1 for warning alerts and 2 for fatal alerts.
+	Level uint8
+
+	// Description is the alert description, for example 40 for
+	// handshake_failure. See RFC 8446, Section 6.
+	Description uint8
+}
+
+// KeyChangeInfo describes a key change passed to [Tracer.KeyChange].
+type KeyChangeInfo struct {
+	// Time is when the new keys were installed.
+	Time time.Time
+
+	// Sent is true when the keys protecting the data sent by this side of
+	// the connection change, and false for the data received.
+	Sent bool
+
+	// Level is the encryption level of the new keys. In TLS 1.2 the only
+	// key change, triggered by ChangeCipherSpec, uses
+	// QUICEncryptionLevelApplication. In TLS 1.3 the key updates after the
+	// handshake also use QUICEncryptionLevelApplication.
+	Level QUICEncryptionLevel
+}
+
+// NegotiatedInfo describes the parameters passed to [Tracer.Negotiated].
+type NegotiatedInfo struct {
+	// Time is when the parameters were known.
+	Time time.Time
+
+	// Version is the TLS version.
+	Version uint16
+
+	// CipherSuite is the cipher suite.
+	CipherSuite uint16
+
+	// CurveID is the key exchange group, or zero if the handshake does not
+	// use one, as in TLS 1.2 resumptions and RSA key exchanges.
+	CurveID CurveID
+}
+
+// tracer returns the Config's Tracer, or nil.
+func (c *Conn) tracer() *Tracer {
+	if c.config == nil {
+		return nil
+	}
+	return c.config.Tracer
+}
+
+func (c *Conn) traceHandshakeMessage(info HandshakeMessageInfo) {
+	if t := c.tracer(); t != nil && t.HandshakeMessage != nil {
+		t.HandshakeMessage(info)
+	}
+}
+
+func (c *Conn) traceRecord(sent bool, hdr []byte) {
+	if t := c.tracer(); t != nil && t.Record != nil {
+		t.Record(RecordInfo{
+			Time:    c.config.time(),
+			Sent:    sent,
+			Type:    hdr[0],
+			Version: uint16(hdr[1])<<8 | uint16(hdr[2]),
+			Length:  int(hdr[3])<<8 | int(hdr[4]),
+		})
+	}
+}
+
+func (c *Conn) traceAlert(sent bool, level uint8, description alert) {
+	if t := c.tracer(); t != nil && t.Alert != nil {
+		t.Alert(AlertInfo{
+			Time:        c.config.time(),
+			Sent:        sent,
+			Level:       level,
+			Description: uint8(description),
+		})
+	}
+}
+
+func (c *Conn) traceKeyChange(sent bool, level QUICEncryptionLevel) {
+	if t := c.tracer(); t != nil && t.KeyChange != nil {
+		t.KeyChange(KeyChangeInfo{
+			Time:  c.config.time(),
+			Sent:  sent,
+			Level: level,
+		})
+	}
+}
+
+// initKeyChangeTracing makes the two halves of the connection report their
+// key changes to [Tracer.KeyChange].
+func (c *Conn) initKeyChangeTracing() {
+	c.in.onKeyChange = func(level QUICEncryptionLevel) { c.traceKeyChange(false, level) }
+	c.out.onKeyChange = func(level QUICEncryptionLevel) { c.traceKeyChange(true, level) }
+}
+
+// traceNegotiated reports the parameters of the connection to
+// [Tracer.Negotiated] once they are negotiated.
+func (c *Conn) traceNegotiated() {
+	if t := c.tracer(); t != nil && t.Negotiated != nil {
+		t.Negotiated(NegotiatedInfo{
+			Time:        c.config.time(),
+			Version:     c.vers,
+			CipherSuite: c.cipherSuite,
+			CurveID:     c.curveID,
+		})
+	}
+}
+
+// keyAgreementCurveID returns the group used by a TLS 1.2 key agreement,
+// or zero if it does not use one.
+func keyAgreementCurveID(ka keyAgreement) CurveID {
+	if ka, ok := ka.(*ecdheKeyAgreement); ok {
+		return ka.curveID
+	}
+	return 0
+}
@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+)
+
+// testTrace collects the events reported by a Tracer. The client side of
+// testHandshake keeps running after the handshake to close the connection,
+// so the events are protected by a mutex and read through events.
+type testTrace struct {
+	mu sync.Mutex
+	ev traceEvents
+}
+
+type traceEvents struct {
+	messages   []HandshakeMessageInfo
+	records    []RecordInfo
+	alerts     []AlertInfo
+	keyChanges []KeyChangeInfo
+	negotiated []NegotiatedInfo
+}
+
+func (tt *testTrace) tracer() *Tracer {
+	return &Tracer{
+		HandshakeMessage: func(info HandshakeMessageInfo) {
+			info.Raw = append([]byte(nil), info.Raw...)
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.ev.messages = append(tt.ev.messages, info)
+		},
+		Record: func(info RecordInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.ev.records = append(tt.ev.records, info)
+		},
+		Alert: func(info AlertInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.ev.alerts = append(tt.ev.alerts, info)
+		},
+		KeyChange: func(info KeyChangeInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.ev.keyChanges = append(tt.ev.keyChanges, info)
+		},
+		Negotiated: func(info NegotiatedInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.ev.negotiated = append(tt.ev.negotiated, info)
+		},
+	}
+}
+
+// events returns a copy of the events collected so far.
+func (tt *testTrace) events() *traceEvents {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	ev := tt.ev
+	return &ev
+}
+
+// messageTypes returns the types of the handshake messages sent or received.
+func (ev *traceEvents) messageTypes(sent bool) []uint8 {
+	var types []uint8
+	for _, m := range ev.messages {
+		if m.Sent == sent {
+			types = append(types, m.Type)
+		}
+	}
+	return types
+}
+
+// hasKeyChange returns whether the events contain the given key change.
+func (ev *traceEvents) hasKeyChange(sent bool, level QUICEncryptionLevel) bool {
+	for _, kc := range ev.keyChanges {
+		if kc.Sent == sent && kc.Level == level {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTracerTLS13(t *testing.T) {
+	var clientTracer, serverTracer testTrace
+	clientConfig := testConfig.Clone()
+	clientConfig.Tracer = clientTracer.tracer()
+	serverConfig := testConfig.Clone()
+	serverConfig.Tracer = serverTracer.tracer()
+
+	_, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTrace, serverTrace := clientTracer.events(), serverTracer.events()
+
+	wantSent := []uint8{typeClientHello, typeFinished}
+	if got := clientTrace.messageTypes(true); !bytes.Equal(got, wantSent) {
+		t.Errorf("client sent %v, want %v", got, wantSent)
+	}
+	wantReceived := []uint8{typeServerHello, typeEncryptedExtensions, typeCertificate,
+		typeCertificateVerify, typeFinished}
+	if got := clientTrace.messageTypes(false); !bytes.HasPrefix(got, wantReceived) {
+		t.Errorf("client received %v, want %v", got, wantReceived)
+	}
+	if !bytes.Equal(clientTrace.messages[0].Raw, serverTrace.messages[0].Raw) {
+		t.Error("the ClientHello sent and received differ")
+	}
+	for _, m := range clientTrace.messages {
+		if m.Time != testConfig.Time() {
+			t.Errorf("got time %v", m.Time)
+		}
+	}
+
+	first := clientTrace.records[0]
+	if !first.Sent || first.Type != byte(recordTypeHandshake) || first.Version != VersionTLS10 ||
+		first.Length != len(clientTrace.messages[0].Raw) {
+		t.Errorf("unexpected first record %+v", first)
+	}
+	var serverSent []RecordInfo
+	for _, r := range serverTrace.records {
+		if r.Sent {
+			serverSent = append(serverSent, r)
+		}
+	}
+	if serverSent[0].Type != byte(recordTypeHandshake) {
+		t.Errorf("unexpected first server record %+v", serverSent[0])
+	}
+	for _, r := range serverSent[1:] {
+		if r.Type == byte(recordTypeHandshake) {
+			t.Errorf("server sent an unencrypted handshake record after the ServerHello: %+v", r)
+		}
+	}
+
+	for _, tt := range []*traceEvents{clientTrace, serverTrace} {
+		for _, sent := range []bool{true, false} {
+			for _, level := range []QUICEncryptionLevel{QUICEncryptionLevelHandshake, QUICEncryptionLevelApplication} {
+				if !tt.hasKeyChange(sent, level) {
+					t.Errorf("missing key change (sent %v, %v)", sent, level)
+				}
+			}
+		}
+		if len(tt.negotiated) != 1 {
+			t.Fatalf("got %d negotiated events", len(tt.negotiated))
+		}
+		want := NegotiatedInfo{Time: testConfig.Time(), Version: VersionTLS13,
+			CipherSuite: cs.CipherSuite, CurveID: X25519}
+		if tt.negotiated[0] != want {
+			t.Errorf("got %+v, want %+v", tt.negotiated[0], want)
+		}
+	}
+
+	// The server closes the connection, and the client receives the
+	// close_notify alert before testHandshake returns.
+	wantAlert := AlertInfo{Time: testConfig.Time(), Level: alertLevelWarning, Description: uint8(alertCloseNotify)}
+	if len(clientTrace.alerts) == 0 || clientTrace.alerts[0] != wantAlert {
+		t.Errorf("client alerts: got %+v, want %+v", clientTrace.alerts, wantAlert)
+	}
+	wantAlert.Sent = true
+	if len(serverTrace.alerts) != 1 || serverTrace.alerts[0] != wantAlert {
+		t.Errorf("server alerts: got %+v, want %+v", serverTrace.alerts, wantAlert)
+	}
+}
+
+func TestTracerTLS12(t *testing.T) {
+	var clientTracer, serverTracer testTrace
+	clientConfig := testConfig.Clone()
+	clientConfig.MaxVersion = VersionTLS12
+	clientConfig.Tracer = clientTracer.tracer()
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+	serverConfig.Tracer = serverTracer.tracer()
+
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	clientTrace, serverTrace := clientTracer.events(), serverTracer.events()
+
+	wantSent := []uint8{typeClientHello, typeClientKeyExchange, typeFinished}
+	if got := clientTrace.messageTypes(true); !bytes.Equal(got, wantSent) {
+		t.Errorf("client sent %v, want %v", got, wantSent)
+	}
+	for _, tt := range []*traceEvents{clientTrace, serverTrace} {
+		if len(tt.keyChanges) != 2 || !tt.hasKeyChange(true, QUICEncryptionLevelApplication) ||
+			!tt.hasKeyChange(false, QUICEncryptionLevelApplication) {
+			t.Errorf("unexpected key changes: %+v", tt.keyChanges)
+		}
+		if len(tt.negotiated) != 1 || tt.negotiated[0].Version != VersionTLS12 ||
+			tt.negotiated[0].CurveID != CurveP256 {
+			t.Errorf("unexpected negotiated events: %+v", tt.negotiated)
+		}
+	}
+	for _, r := range clientTrace.records {
+		if r.Version != VersionTLS10 && r.Version != VersionTLS12 {
+			t.Errorf("unexpected record version %x", r.Version)
+		}
+	}
+}
+
+func TestTracerAlert(t *testing.T) {
+	var clientTracer, serverTracer testTrace
+	clientConfig := testConfig.Clone()
+	clientConfig.Tracer = clientTracer.tracer()
+	clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	clientConfig.MaxVersion = VersionTLS12
+	serverConfig := testConfig.Clone()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	serverConfig.Tracer = serverTracer.tracer()
+
+	if _, _, err := testHandshake(t, clientConfig, serverConfig); err == nil {
+		t.Fatal("expected a handshake failure")
+	}
+	clientTrace, serverTrace := clientTracer.events(), serverTracer.events()
+	want := AlertInfo{Time: testConfig.Time(), Sent: true, Level: alertLevelError,
+		Description: uint8(alertHandshakeFailure)}
+	if len(serverTrace.alerts) != 1 || serverTrace.alerts[0] != want {
+		t.Errorf("server alerts: got %+v, want %+v", serverTrace.alerts, want)
+	}
+	want.Sent = false
+	if len(clientTrace.alerts) != 1 || clientTrace.alerts[0] != want {
+		t.Errorf("client alerts: got %+v, want %+v", clientTrace.alerts, want)
+	}
+	if len(clientTrace.negotiated) != 0 {
+		t.Errorf("unexpected negotiated events: %+v", clientTrace.negotiated)
+	}
+}
+
+func TestTracerQUIC(t *testing.T) {
+	var clientTracer, serverTracer testTrace
+	clientConfig := testConfig.Clone()
+	clientConfig.MinVersion = VersionTLS13
+	clientConfig.Tracer = clientTracer.tracer()
+	serverConfig := testConfig.Clone()
+	serverConfig.MinVersion = VersionTLS13
+	serverConfig.Tracer = serverTracer.tracer()
+
+	cli := newTestQUICClient(t, clientConfig)
+	cli.conn.SetTransportParameters(nil)
+	srv := newTestQUICServer(t, serverConfig)
+	srv.conn.SetTransportParameters(nil)
+	if err := runTestQUICConnection(context.Background(), cli, srv, nil); err != nil {
+		t.Fatalf("error during connection handshake: %v", err)
+	}
+	clientTrace, serverTrace := clientTracer.events(), serverTracer.events()
+
+	for _, tt := range []*traceEvents{clientTrace, serverTrace} {
+		if len(tt.records) != 0 {
+			t.Errorf("unexpected records: %+v", tt.records)
+		}
+		if len(tt.messages) == 0 || len(tt.negotiated) != 1 {
+			t.Errorf("got %d messages and %d negotiated events", len(tt.messages), len(tt.negotiated))
+		}
+		if !tt.hasKeyChange(true, QUICEncryptionLevelApplication) {
+			t.Error("missing application key change")
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+
+	"github.com/ooni/oocrypto/tls/fingerprint"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// helloSummary contains the fields of ConnectionState derived from the hello
+// messages exchanged during the first handshake.
+type helloSummary struct {
+	serverRandom         []byte
+	didHelloRetryRequest bool
+	serverExtensions     []uint16
+	ja3, ja4, ja3s, ja4s string
+
+	// clientHello and serverHello are the first ClientHello and the last
+	// ServerHello, which are kept until summarizeHellos computes their
+	// fingerprints.
+	clientHello, serverHello []byte
+}
+
+// addHandshakeMessage is called for each handshake message sent or received,
+// which must not be modified afterwards, and reports it to the Tracer. During
+// the first handshake, it also keeps what HandshakeError and the fields of
+// ConnectionState derived from the hello messages need, and records the
+// message if Config.RecordHandshakeTranscript is true.
+func (c *Conn) addHandshakeMessage(sent bool, raw []byte) {
+	if len(raw) == 0 || c.config == nil {
+		return
+	}
+	info := HandshakeMessageInfo{
+		Time: c.config.time(),
+		Sent: sent,
+		Type: raw[0],
+		Raw:  raw,
+	}
+	if c.handshakes == 0 && !c.isHandshakeComplete.Load() {
+		last := info
+		if sent {
+			c.lastMessageSent = &last
+		} else {
+			c.lastMessageReceived = &last
+		}
+		c.hellos.add(raw)
+		if c.config.RecordHandshakeTranscript {
+			c.handshakeTranscript = append(c.handshakeTranscript, info)
+		}
+	}
+	c.traceHandshakeMessage(info)
+}
+
+// add updates the summary with a handshake message.
+func (h *helloSummary) add(raw []byte) {
+	switch raw[0] {
+	case typeClientHello:
+		if h.clientHello == nil {
+			h.clientHello = raw
+		}
+	case typeServerHello:
+		if len(raw) >= 38 && bytes.Equal(raw[6:38], helloRetryRequestRandom) {
+			h.didHelloRetryRequest = true
+			return
+		}
+		h.serverHello = raw
+		if len(raw) >= 38 {
+			h.serverRandom = bytes.Clone(raw[6:38])
+		}
+		h.serverExtensions = serverHelloExtensionTypes(raw)
+	case typeEncryptedExtensions:
+		h.serverExtensions = append(h.serverExtensions, encryptedExtensionsTypes(raw)...)
+	}
+}
+
+// summarizeHellos computes the fingerprints of the hello messages, once the
+// first handshake completed or failed.
+func (c *Conn) summarizeHellos() {
+	if c.handshakes != 0 {
+		return
+	}
+	h := &c.hellos
+	var ch clientHelloMsg
+	if ch.unmarshal(h.clientHello) {
+		if hello, ok := newClientHelloMessage(&ch); ok {
+			fp := hello.Fingerprint()
+			h.ja3 = fp.JA3()
+			h.ja4 = clientHelloJA4(fp, c.quic != nil)
+		}
+	}
+	var sh serverHelloMsg
+	if sh.unmarshal(h.serverHello) {
+		if hello, ok := newServerHelloMessage(&sh); ok {
+			fp := hello.Fingerprint()
+			h.ja3s = fp.JA3S()
+			h.ja4s = serverHelloJA4S(fp, c.quic != nil)
+		}
+	}
+	h.clientHello, h.serverHello = nil, nil
+}
+
+// setTranscriptState fills the fields of state derived from the handshake
+// messages.
+func (c *Conn) setTranscriptState(state *ConnectionState) {
+	// The transcript is only appended to, so its current elements can be
+	// shared with the caller.
+	state.HandshakeTranscript = c.handshakeTranscript[:len(c.handshakeTranscript):len(c.handshakeTranscript)]
+	if len(state.HandshakeTranscript) == 0 {
+		state.HandshakeTranscript = nil
+	}
+	h := &c.hellos
+	state.ServerRandom = h.serverRandom
+	state.DidHelloRetryRequest = h.didHelloRetryRequest
+	state.ServerExtensions = h.serverExtensions
+	state.JA3, state.JA4 = h.ja3, h.ja4
+	state.JA3S, state.JA4S = h.ja3s, h.ja4s
+}
+
+// serverHelloExtensionTypes returns the types of the extensions in a
+// marshaled ServerHello, in order, or nil if it cannot be parsed.
+func serverHelloExtensionTypes(raw []byte) []uint16 {
+	s := cryptobyte.String(raw)
+	var sessionID cryptobyte.String
+	if !s.Skip(4) || !s.Skip(2) || !s.Skip(32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.Skip(2) || !s.Skip(1) {
+		return nil
+	}
+	if s.Empty() {
+		return nil
+	}
+	return extensionTypes(s)
+}
+
+// encryptedExtensionsTypes returns the types of the extensions in a
+// marshaled EncryptedExtensions, in order, or nil if it cannot be parsed.
+func encryptedExtensionsTypes(raw []byte) []uint16 {
+	s := cryptobyte.String(raw)
+	if !s.Skip(4) {
+		return nil
+	}
+	return extensionTypes(s)
+}
+
+// extensionTypes returns the types in a uint16 length-prefixed list of
+// extensions, or nil if it cannot be parsed.
+func extensionTypes(s cryptobyte.String) []uint16 {
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) || !s.Empty() {
+		return nil
+	}
+	var types []uint16
+	for !exts.Empty() {
+		var extType uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil
+		}
+		types = append(types, extType)
+	}
+	return types
+}
+
+func clientHelloJA4(ch *fingerprint.ClientHello, quic bool) string {
+	if quic {
+		return ch.JA4QUIC()
+	}
+	return ch.JA4()
+}
+
+func serverHelloJA4S(sh *fingerprint.ServerHello, quic bool) string {
+	if quic {
+		return sh.JA4SQUIC()
+	}
+	return sh.JA4S()
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tls
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// recordingConfig returns a copy of testConfig that records the handshake
+// transcript.
+func recordingConfig() *Config {
+	config := testConfig.Clone()
+	config.RecordHandshakeTranscript = true
+	return config
+}
+
+// transcriptTypes returns the types of the messages in a transcript.
+func transcriptTypes(transcript []HandshakeMessageInfo) []uint8 {
+	var types []uint8
+	for _, m := range transcript {
+		types = append(types, m.Type)
+	}
+	return types
+}
+
+// checkSameTranscript checks that the client and the server recorded the
+// same messages, in opposite directions.
+func checkSameTranscript(t *testing.T, cs, ss ConnectionState) {
+	t.Helper()
+	if len(cs.HandshakeTranscript) != len(ss.HandshakeTranscript) {
+		t.Fatalf("client has %d messages, server has %d", len(cs.HandshakeTranscript), len(ss.HandshakeTranscript))
+	}
+	for idx, m := range cs.HandshakeTranscript {
+		other := ss.HandshakeTranscript[idx]
+		if m.Sent == other.Sent || !bytes.Equal(m.Raw, other.Raw) || m.Type != other.Type {
+			t.Errorf("message %d differs between client and server", idx)
+		}
+	}
+	if !bytes.Equal(cs.ServerRandom, ss.ServerRandom) || len(cs.ServerRandom) != 32 {
+		t.Errorf("got server randoms %x and %x", cs.ServerRandom, ss.ServerRandom)
+	}
+	if !reflect.DeepEqual(cs.ServerExtensions, ss.ServerExtensions) {
+		t.Errorf("got server extensions %v and %v", cs.ServerExtensions, ss.ServerExtensions)
+	}
+}
+
+func TestHandshakeTranscriptTLS13(t *testing.T) {
+	clientConfig := recordingConfig()
+	clientConfig.NextProtos = []string{"h2"}
+	serverConfig := recordingConfig()
+	serverConfig.NextProtos = []string{"h2"}
+
+	ss, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameTranscript(t, cs, ss)
+	want := []uint8{typeClientHello, typeServerHello, typeEncryptedExtensions, typeCertificate,
+		typeCertificateVerify, typeFinished, typeFinished}
+	if got := transcriptTypes(cs.HandshakeTranscript); !bytes.Equal(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+	if cs.DidHelloRetryRequest {
+		t.Error("unexpected HelloRetryRequest")
+	}
+	want16 := []uint16{extensionSupportedVersions, extensionKeyShare, extensionALPN}
+	if !reflect.DeepEqual(cs.ServerExtensions, want16) {
+		t.Errorf("got server extensions %v, want %v", cs.ServerExtensions, want16)
+	}
+	if !bytes.Equal(cs.ServerRandom, cs.HandshakeTranscript[1].Raw[6:38]) {
+		t.Error("ServerRandom does not match the ServerHello")
+	}
+}
+
+func TestHandshakeTranscriptHelloRetryRequest(t *testing.T) {
+	serverConfig := recordingConfig()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	ss, cs, err := testHandshake(t, recordingConfig(), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameTranscript(t, cs, ss)
+	if !cs.DidHelloRetryRequest || !ss.DidHelloRetryRequest {
+		t.Error("expected a HelloRetryRequest")
+	}
+	want := []uint8{typeClientHello, typeServerHello, typeClientHello, typeServerHello}
+	if got := transcriptTypes(cs.HandshakeTranscript); !bytes.HasPrefix(got, want) {
+		t.Errorf("got messages %v, want prefix %v", got, want)
+	}
+	if bytes.Equal(cs.ServerRandom, helloRetryRequestRandom) {
+		t.Error("ServerRandom is the HelloRetryRequest one")
+	}
+}
+
+func TestHandshakeTranscriptTLS12(t *testing.T) {
+	clientConfig := recordingConfig()
+	clientConfig.MaxVersion = VersionTLS12
+
+	ss, cs, err := testHandshake(t, clientConfig, recordingConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameTranscript(t, cs, ss)
+	want := []uint8{typeClientHello, typeServerHello, typeCertificate, typeServerKeyExchange,
+		typeServerHelloDone, typeClientKeyExchange, typeFinished, typeFinished}
+	if got := transcriptTypes(cs.HandshakeTranscript); !bytes.Equal(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+	if len(cs.ServerExtensions) == 0 {
+		t.Error("expected some server extensions")
+	}
+}
+
+func TestHandshakeTranscriptFailure(t *testing.T) {
+	clientConfig := recordingConfig()
+	clientConfig.MaxVersion = VersionTLS12
+	clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	serverConfig := recordingConfig()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+
+	c, s := localPipe(t)
+	done := make(chan ConnectionState)
+	go func() {
+		server := Server(s, serverConfig)
+		server.Handshake()
+		s.Close()
+		done <- server.ConnectionState()
+	}()
+	client := Client(c, clientConfig)
+	if err := client.Handshake(); err == nil {
+		t.Fatal("expected a handshake failure")
+	}
+	cs, ss := client.ConnectionState(), <-done
+	for _, state := range []ConnectionState{cs, ss} {
+		if got := transcriptTypes(state.HandshakeTranscript); !bytes.Equal(got, []uint8{typeClientHello}) {
+			t.Errorf("got messages %v", got)
+		}
+		if state.ServerRandom != nil || state.ServerExtensions != nil {
+			t.Error("unexpected ServerHello fields")
+		}
+	}
+	if !cs.HandshakeTranscript[0].Sent || ss.HandshakeTranscript[0].Sent {
+		t.Error("wrong message directions")
+	}
+}
+
+func TestHandshakeFingerprints(t *testing.T) {
+	clientConfig := recordingConfig()
+	clientConfig.NextProtos = []string{"h2"}
+	serverConfig := recordingConfig()
+	serverConfig.NextProtos = []string{"h2"}
+	var ja3, ja4 string
+	serverConfig.GetConfigForClient = func(chi *ClientHelloInfo) (*Config, error) {
+		ja3, ja4 = chi.JA3(), chi.JA4()
+		return nil, nil
+	}
+
+	ss, cs, err := testHandshake(t, clientConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := ParseClientHello(cs.HandshakeTranscript[0].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := hello.Fingerprint()
+	serverHello, err := ParseServerHello(cs.HandshakeTranscript[1].Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := serverHello.Fingerprint()
+	want := [4]string{ch.JA3(), ch.JA4(), sh.JA3S(), sh.JA4S()}
+	for _, state := range []ConnectionState{cs, ss} {
+		if got := [4]string{state.JA3, state.JA4, state.JA3S, state.JA4S}; got != want {
+			t.Errorf("got fingerprints %q, want %q", got, want)
+		}
+	}
+	if ja3 != want[0] || ja4 != want[1] {
+		t.Errorf("got ClientHelloInfo fingerprints %q and %q, want %q and %q", ja3, ja4, want[0], want[1])
+	}
+	// In TLS 1.3 the ALPN extension is in the EncryptedExtensions.
+	if len(cs.JA4S) < 8 || cs.JA4S[:8] != "t130200_" {
+		t.Errorf("unexpected JA4S %q", cs.JA4S)
+	}
+}
+
+func TestHandshakeTranscriptNotRecorded(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CurvePreferences = []CurveID{CurveP256}
+
+	ss, cs, err := testHandshake(t, testConfig, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []ConnectionState{cs, ss} {
+		if state.HandshakeTranscript != nil {
+			t.Error("the transcript was recorded without RecordHandshakeTranscript")
+		}
+		if len(state.ServerRandom) != 32 || !state.DidHelloRetryRequest || len(state.ServerExtensions) == 0 {
+			t.Errorf("missing ServerHello fields: %x %v %v", state.ServerRandom,
+				state.DidHelloRetryRequest, state.ServerExtensions)
+		}
+		if state.JA3 == "" || state.JA4 == "" || state.JA3S == "" || state.JA4S == "" {
+			t.Error("missing fingerprints")
+		}
+	}
+	if cs.JA4 != ss.JA4 || cs.JA4S != ss.JA4S {
+		t.Errorf("client and server fingerprints differ: %q %q, %q %q", cs.JA4, ss.JA4, cs.JA4S, ss.JA4S)
+	}
+}